@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/tsileo/blobfs/pkg/fstree"
+	"golang.org/x/net/context"
+)
+
+func WriteJSON(w http.ResponseWriter, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+// Error codes returned in the JSON body of failed API requests, the CLI relies on them
+const (
+	ErrCodeBadRequest        = "bad_request"
+	ErrCodeMethodNotAllowed  = "method_not_allowed"
+	ErrCodeNotFound          = "not_found"
+	ErrCodeConflict          = "conflict"
+	ErrCodeOutOfSync         = "out_of_sync"
+	ErrCodeRemoteUnreachable = "remote_unreachable"
+	ErrCodeImmutable         = "immutable"
+	ErrCodeBusy              = "busy"
+	ErrCodeInternal          = "internal"
+)
+
+// APIError is the JSON body of a failed API request
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiErr returns the HTTP status and the `APIError` for the given error
+func apiErr(err error) (int, *APIError) {
+	switch err {
+	case fstree.ErrNotFound, fstree.ErrUnknownRef, ErrJobNotFound:
+		return http.StatusNotFound, &APIError{ErrCodeNotFound, err.Error()}
+	case fstree.ErrConflict:
+		return http.StatusConflict, &APIError{ErrCodeConflict, err.Error()}
+	case fstree.ErrOutOfSync:
+		return http.StatusConflict, &APIError{ErrCodeOutOfSync, err.Error()}
+	case fstree.ErrImmutable:
+		return http.StatusForbidden, &APIError{ErrCodeImmutable, err.Error()}
+	case ErrJobRunning:
+		return http.StatusConflict, &APIError{ErrCodeBusy, err.Error()}
+	case ErrNotCancelable, ErrJobDone, fstree.ErrAmbiguousRef:
+		return http.StatusBadRequest, &APIError{ErrCodeBadRequest, err.Error()}
+	}
+	switch err.(type) {
+	case *url.Error, net.Error:
+		// The HTTP clients of the BlobStash remote failed before getting a response
+		return http.StatusBadGateway, &APIError{ErrCodeRemoteUnreachable, err.Error()}
+	}
+	return http.StatusInternalServerError, &APIError{ErrCodeInternal, err.Error()}
+}
+
+// WriteError writes the JSON error for `err` (with the status matching its error code)
+func (api *API) WriteError(w http.ResponseWriter, err error) {
+	status, apiError := apiErr(err)
+	if status == http.StatusInternalServerError {
+		api.fs.log.Error("API request failed", "err", err)
+	}
+	writeAPIError(w, status, apiError)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, apiError *APIError) {
+	js, err := json.Marshal(apiError)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(js)
+}
+
+func badRequest(w http.ResponseWriter, err error) {
+	writeAPIError(w, http.StatusBadRequest, &APIError{ErrCodeBadRequest, err.Error()})
+}
+
+func methodNotAllowed(w http.ResponseWriter, expected string) {
+	writeAPIError(w, http.StatusMethodNotAllowed, &APIError{ErrCodeMethodNotAllowed, expected + " request expected"})
+}
+
+// API is the HTTP API of a mounted FS, served over a unix socket
+type API struct {
+	fs *FS
+
+	l          net.Listener
+	socketPath string
+	closed     chan struct{}
+}
+
+// Listen creates the unix socket of the API, it's served by `Serve`
+func (api *API) Listen(socketPath string) error {
+	l, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	api.l = l
+	api.socketPath = socketPath
+	api.closed = make(chan struct{})
+	return nil
+}
+
+// Close stops serving the API and removes its socket
+func (api *API) Close() error {
+	close(api.closed)
+	err := api.l.Close()
+	os.Remove(api.socketPath)
+	return err
+}
+
+// Serve serves the API on the socket created by `Listen` until `Close` is called (nil is returned then)
+func (api *API) Serve() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ref", api.refHandler)
+	mux.HandleFunc("/sync", api.syncHandler)
+	mux.HandleFunc("/pull", api.pullHandler)
+	mux.HandleFunc("/status", api.statusHandler)
+	mux.HandleFunc("/diff", api.diffHandler)
+	mux.HandleFunc("/history", api.historyHandler)
+	mux.HandleFunc("/undo", api.undoHandler)
+	mux.HandleFunc("/debug", api.debugHandler)
+	// mux.HandleFunc("/log", apiLogHandler)
+	mux.HandleFunc("/public", api.publicHandler)
+	mux.HandleFunc("/jobs/", api.jobHandler)
+	if err := http.Serve(api.l, mux); err != nil {
+		select {
+		case <-api.closed:
+			return nil
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+type NodeStatus struct {
+	Type string
+	Path string
+	Ref  string
+}
+
+func (api *API) refHandler(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, map[string]string{"ref": api.fs.tree.Ref()})
+}
+
+type CheckoutReq struct {
+	Ref string `json:"ref"`
+}
+
+// func apiCheckoutHandler(w http.ResponseWriter, r *http.Request) {
+// 	if r.Method != "POST" {
+// 		http.Error(w, "POST request expected", http.StatusMethodNotAllowed)
+// 		return
+// 	}
+// 	cr := &CheckoutReq{}
+// 	if err := json.NewDecoder(r.Body).Decode(cr); err != nil {
+// 		if err != nil {
+// 			panic(err)
+// 		}
+// 	}
+// 	var immutable bool
+// 	// if cr.Ref == bfs.latest.ref {
+// 	// 	immutable = true
+// 	// }
+// 	if err := bfs.setRoot(cr.Ref, immutable); err != nil {
+// 		panic(err)
+// 	}
+// 	WriteJSON(w, cr)
+// }
+
+func (api *API) debugHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	versions, err := api.fs.tree.Versions()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	WriteJSON(w, versions)
+}
+
+func (api *API) syncHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	comment, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	// The push runs in the background, the progress is available at `/jobs/<id>`
+	api.startJob(w, "push", true, func(ctx context.Context, stats *fstree.SyncStats) error {
+		return api.fs.tree.PushContext(ctx, comment, stats)
+	})
+}
+
+func (api *API) pullHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	// A pull can't be canceled since it updates the tree in place
+	api.startJob(w, "pull", false, func(ctx context.Context, stats *fstree.SyncStats) error {
+		return api.fs.Pull()
+	})
+}
+
+func (api *API) publicHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	out, err := api.fs.tree.PublicNodes()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	WriteJSON(w, out)
+}
+
+type CommitLog struct {
+	T       string `json:"t"`
+	Ref     string `json:"ref"`
+	Comment string `json:"comment"`
+	Current bool   `json:"current"`
+}
+
+// FIXME(tsileo): use the local or remote vkv store for this???
+// func apiLogHandler(w http.ResponseWriter, r *http.Request) {
+// 	if r.Method != "GET" {
+// 		w.WriteHeader(http.StatusMethodNotAllowed)
+// 		return
+// 	}
+// 	out := []*CommitLog{}
+
+// 	versions, err := bfs.kvs.Versions(fmt.Sprintf(rootKeyFmt, bfs.name), 0, -1, 0)
+// 	switch err {
+// 	case kvstore.ErrKeyNotFound:
+// 	case nil:
+// 		for _, v := range versions.Versions {
+// 			croot := &root.Root{}
+// 			if err := json.Unmarshal(v.Data, croot); err != nil {
+// 				panic(err)
+// 			}
+// 			cl := &CommitLog{
+// 				T:       time.Unix(0, int64(v.Version)).Format(time.RFC3339),
+// 				Ref:     croot.Ref,
+// 				Comment: croot.Comment,
+// 			}
+// 			out = append(out, cl)
+// 		}
+// 	default:
+// 		panic(err)
+// 	}
+// 	WriteJSON(w, out)
+// }
+
+func (api *API) statusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	changes, err := api.fs.tree.Status()
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	if len(changes) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	WriteJSON(w, fstree.NewStatusResp(changes))
+}
+
+func (api *API) diffHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	q := r.URL.Query()
+	var path string
+	if hostPath := q.Get("path"); hostPath != "" {
+		var err error
+		path, err = api.fs.fsPath(hostPath)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	resp, err := api.fs.tree.Diff(q.Get("a"), q.Get("b"), path, q.Get("text") == "1")
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	WriteJSON(w, resp)
+}
+
+func (api *API) historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	// Without a path, the history of the root is returned
+	path := "/"
+	if hostPath := r.URL.Query().Get("path"); hostPath != "" {
+		var err error
+		path, err = api.fs.fsPath(hostPath)
+		if err != nil {
+			badRequest(w, err)
+			return
+		}
+	}
+	entries, err := api.fs.tree.History(path)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	WriteJSON(w, entries)
+}
+
+type UndoReq struct {
+	Path string `json:"path"`
+	To   string `json:"to"`
+}
+
+func (api *API) undoHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	ur := &UndoReq{}
+	if err := json.NewDecoder(r.Body).Decode(ur); err != nil {
+		badRequest(w, err)
+		return
+	}
+	path, err := api.fs.fsPath(ur.Path)
+	if err != nil {
+		badRequest(w, err)
+		return
+	}
+	if err := api.fs.Undo(path, ur.To); err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
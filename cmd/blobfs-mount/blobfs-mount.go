@@ -1,13 +1,9 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"io/ioutil"
-	"net"
 	"net/http"
 	"os"
 	"os/exec"
@@ -15,27 +11,30 @@ import (
 	"os/user"
 	"path/filepath"
 	"runtime"
-	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	bstore "github.com/tsileo/blobfs/pkg/blobstore"
 	"github.com/tsileo/blobfs/pkg/cache"
+	"github.com/tsileo/blobfs/pkg/chunker"
+	"github.com/tsileo/blobfs/pkg/config"
+	"github.com/tsileo/blobfs/pkg/encryption"
+	"github.com/tsileo/blobfs/pkg/fstree"
 	"github.com/tsileo/blobfs/pkg/pathutil"
+	"github.com/tsileo/blobfs/pkg/registry"
 	"github.com/tsileo/blobfs/pkg/root"
 	"gopkg.in/yaml.v2"
 
 	"bazil.org/fuse"
 	"bazil.org/fuse/fs"
-	"bazil.org/fuse/fuseutil"
 	"github.com/tsileo/blobstash/pkg/apps/app"
 	"github.com/tsileo/blobstash/pkg/client/blobstore"
 	"github.com/tsileo/blobstash/pkg/client/kvstore"
 	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
 	"github.com/tsileo/blobstash/pkg/filetree/reader/filereader"
-	"github.com/tsileo/blobstash/pkg/filetree/writer"
 	"github.com/tsileo/blobstash/pkg/vkv"
 	"golang.org/x/net/context"
 	"gopkg.in/inconshreveable/log15.v2"
@@ -55,7 +54,6 @@ import (
 
 const (
 	debugSuffix = ".blobfs_debug"
-	maxInt      = int(^uint(0) >> 1)
 )
 
 var virtualXAttrs = map[string]func(*meta.Meta) []byte{
@@ -71,219 +69,15 @@ var virtualXAttrs = map[string]func(*meta.Meta) []byte{
 	// },
 }
 
-var (
-	wg  sync.WaitGroup
-	bfs *FS
-)
-
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	fmt.Fprintf(os.Stderr, "  %s NAME MOUNTPOINT\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s NAME (the mountpoint is read from the config)\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s (mount every filesystem of the config)\n", os.Args[0])
 	flag.PrintDefaults()
 }
 
 var Log = log15.New("logger", "blobfs")
-var stats *Stats
-
-func WriteJSON(w http.ResponseWriter, data interface{}) {
-	js, err := json.Marshal(data)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(js)
-}
-
-type API struct {
-}
-
-func (api *API) Serve(socketPath string) error {
-	http.HandleFunc("/ref", apiRefHandler)
-	http.HandleFunc("/sync", apiSyncHandler)
-	http.HandleFunc("/pull", apiPullHandler)
-	http.HandleFunc("/debug", apiDebugHandler)
-	// http.HandleFunc("/log", apiLogHandler)
-	http.HandleFunc("/public", apiPublicHandler)
-	l, err := net.Listen("unix", socketPath)
-	if err != nil {
-		panic(err)
-	}
-	defer func() {
-		l.Close()
-		os.Remove(socketPath)
-	}()
-	if err := http.Serve(l, nil); err != nil {
-		panic(err)
-	}
-	return nil
-}
-
-type NodeStatus struct {
-	Type string
-	Path string
-	Ref  string
-}
-
-func apiRefHandler(w http.ResponseWriter, r *http.Request) {
-	WriteJSON(w, map[string]string{"ref": bfs.Mount().node.Meta().Hash})
-}
-
-type CheckoutReq struct {
-	Ref string `json:"ref"`
-}
-
-// func apiCheckoutHandler(w http.ResponseWriter, r *http.Request) {
-// 	if r.Method != "POST" {
-// 		http.Error(w, "POST request expected", http.StatusMethodNotAllowed)
-// 		return
-// 	}
-// 	cr := &CheckoutReq{}
-// 	if err := json.NewDecoder(r.Body).Decode(cr); err != nil {
-// 		if err != nil {
-// 			panic(err)
-// 		}
-// 	}
-// 	var immutable bool
-// 	// if cr.Ref == bfs.latest.ref {
-// 	// 	immutable = true
-// 	// }
-// 	if err := bfs.setRoot(cr.Ref, immutable); err != nil {
-// 		panic(err)
-// 	}
-// 	WriteJSON(w, cr)
-// }
-
-func apiDebugHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "GET request expected", http.StatusMethodNotAllowed)
-		return
-	}
-	fsName := fmt.Sprintf(rootKeyFmt, bfs.Name())
-	// Fetch and save all the known remote mutations
-	remoteVersions, err := bfs.rkv.Versions(fsName, 0, -1, 0)
-	if err != nil {
-		panic(err)
-	}
-	localRemoteVersions, err := bfs.lkv.Versions(fsName, 0, -1, 0)
-	if err != nil {
-		panic(err)
-	}
-	localVersions, err := bfs.lkv.Versions(fmt.Sprintf(localRootKeyFmt, bfs.Name()), 0, -1, 0)
-	if err != nil {
-		panic(err)
-	}
-	WriteJSON(w, map[string]interface{}{
-		"remote":       remoteVersions,
-		"local-remote": localRemoteVersions,
-		"local":        localVersions,
-	})
-
-}
-
-func apiSyncHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "POST request expected", http.StatusMethodNotAllowed)
-		return
-	}
-	comment, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		panic(err)
-	}
-	if err := bfs.Push(comment); err != nil {
-		panic(err)
-	}
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func apiPullHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		http.Error(w, "POST request expected", http.StatusMethodNotAllowed)
-		return
-	}
-	if err := bfs.Pull(); err != nil {
-		panic(err)
-	}
-	w.WriteHeader(http.StatusNoContent)
-}
-
-func apiPublicHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	// FIXME(tsileo): lock the FS?
-	out := map[string]*meta.Meta{}
-	rootDir := bfs.Mount().node.(*Dir)
-	if err := iterDir(rootDir, func(node Node) error {
-		if node.Meta().IsPublic() {
-			out[node.Meta().Hash] = node.Meta()
-		}
-		return nil
-	}); err != nil {
-		panic(err)
-	}
-	WriteJSON(w, out)
-}
-
-type CommitLog struct {
-	T       string `json:"t"`
-	Ref     string `json:"ref"`
-	Comment string `json:"comment"`
-	Current bool   `json:"current"`
-}
-
-// FIXME(tsileo): use the local or remote vkv store for this???
-// func apiLogHandler(w http.ResponseWriter, r *http.Request) {
-// 	if r.Method != "GET" {
-// 		w.WriteHeader(http.StatusMethodNotAllowed)
-// 		return
-// 	}
-// 	out := []*CommitLog{}
-
-// 	versions, err := bfs.kvs.Versions(fmt.Sprintf(rootKeyFmt, bfs.name), 0, -1, 0)
-// 	switch err {
-// 	case kvstore.ErrKeyNotFound:
-// 	case nil:
-// 		for _, v := range versions.Versions {
-// 			croot := &root.Root{}
-// 			if err := json.Unmarshal(v.Data, croot); err != nil {
-// 				panic(err)
-// 			}
-// 			cl := &CommitLog{
-// 				T:       time.Unix(0, int64(v.Version)).Format(time.RFC3339),
-// 				Ref:     croot.Ref,
-// 				Comment: croot.Comment,
-// 			}
-// 			out = append(out, cl)
-// 		}
-// 	default:
-// 		panic(err)
-// 	}
-// 	WriteJSON(w, out)
-// }
-
-// iterDir executes the given callback `cb` on each nodes (file or dir) recursively.
-func iterDir(dir *Dir, cb func(n Node) error) error {
-	if dir.Children == nil {
-		if err := dir.reload(); err != nil {
-			return err
-		}
-	}
-
-	for _, node := range dir.Children {
-		if node.IsDir() {
-			if err := iterDir(node.(*Dir), cb); err != nil {
-				return err
-			}
-		} else {
-			if err := cb(node); err != nil {
-				return err
-			}
-		}
-	}
-	return cb(dir)
-}
 
 // Borrowed from https://github.com/ipfs/go-ipfs/blob/master/fuse/mount/mount.go
 func unmount(mountpoint string) error {
@@ -330,7 +124,7 @@ type AppNode struct {
 }
 
 func (an *AppNode) Reader() app.ReadSeekCloser {
-	ff := filereader.NewFile(bfs.bs, an.meta)
+	ff := filereader.NewFile(an.fs.bs, an.meta)
 	fmt.Printf("FF=%+v\n", ff)
 	return ff
 }
@@ -349,154 +143,374 @@ func (an *AppNode) ModTime() time.Time {
 }
 
 func main() {
-	hostPtr := flag.String("host", "", "remote host, default to http://localhost:8050")
-	loglevelPtr := flag.String("loglevel", "info", "logging level (debug|info|warn|crit)")
-	immutablePtr := flag.Bool("immutable", false, "make the filesystem immutable")
-	hostnamePtr := flag.String("hostname", "", "default to system hostname")
+	configPtr := flag.String("config", "", "config file, default to $BLOBFS_CONFIG or ~/.config/blobfs/config.yaml")
+	flag.String("host", config.DefaultHost, "remote host")
+	flag.String("loglevel", config.DefaultLogLevel, "logging level (debug|info|warn|crit)")
+	flag.Bool("immutable", false, "make the filesystem immutable")
+	flag.String("hostname", "", "default to system hostname")
+	flag.String("var-dir", "", "directory for the local data, default to ~/var/blobfs")
+	flag.Int("app-port", config.DefaultAppPort, "port of the app server (only used if the FS contains an app.yaml)")
+	flag.Bool("encrypt", false, "encrypt the blobs and the root before sending them to BlobStash")
+	flag.String("encryption-key", "", "keyfile for the encryption, default to a key derived from $BLOBFS_PASSPHRASE")
+	flag.Int("chunk-min", 0, "minimum size of the file chunks in bytes (default 32KB)")
+	flag.Int("chunk-avg", 0, "average size of the file chunks in bytes, must be a power of 2 (default 128KB)")
+	flag.Int("chunk-max", 0, "maximum size of the file chunks in bytes (default 512KB)")
+	flag.Int64("cache-size", 0, "max size of the local cache in bytes, used to report the free space (default to the free disk space)")
+	flag.Int64("remote-quota", 0, "quota of the remote BlobStash in bytes, used to report the free space")
+	flag.Bool("lock-lease", false, "warn when another host holds a lock on the same file (using leases stored in BlobStash)")
+	pushOnExitPtr := flag.Bool("push-on-exit", false, "push the local changes before exiting")
+	shutdownTimeoutPtr := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for the open files to be closed when exiting")
+	daemonPtr := flag.Bool("daemon", false, "run in the background (stays in the foreground under systemd, and notifies its readiness)")
+	pidfilePtr := flag.String("pidfile", "", "write the pid to this file")
+	logfilePtr := flag.String("logfile", "", "log to this file instead of stdout (rotated every 10MB), default to $BLOBFS_VAR_DIR/blobfs-mount.log in daemon mode")
 
 	flag.Usage = Usage
 	flag.Parse()
 
-	if flag.NArg() != 2 {
+	if flag.NArg() > 2 {
 		Usage()
 		os.Exit(2)
 	}
-	name := flag.Arg(0)
-	mountpoint := flag.Arg(1)
 
-	var err error
-	root.Hostname = *hostnamePtr
-	if root.Hostname == "" {
-		root.Hostname, err = os.Hostname()
+	conf, err := config.Open(*configPtr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load config: %v\n", err)
+		os.Exit(2)
+	}
+	global, err := conf.Settings("", flag.CommandLine)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid config: %v\n", err)
+		os.Exit(2)
+	}
+
+	// Build the list of FS to mount before detaching, so config errors are displayed
+	names := conf.Names()
+	if flag.NArg() > 0 {
+		names = []string{flag.Arg(0)}
+	}
+	if len(names) == 0 {
+		Usage()
+		os.Exit(2)
+	}
+	mounts := []*config.Settings{}
+	for _, name := range names {
+		m, err := conf.Settings(name, flag.CommandLine)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid config for %s: %v\n", name, err)
+			os.Exit(2)
+		}
+		if flag.NArg() == 2 {
+			m.Set("mountpoint", flag.Arg(1), config.SourceFlag)
+		}
+		if m.Mountpoint == "" {
+			fmt.Fprintf(os.Stderr, "missing mountpoint for %s\n", name)
+			os.Exit(2)
+		}
+		mountpoint, err := filepath.Abs(m.Mountpoint)
+		if err != nil {
+			panic(err)
+		}
+		m.Mountpoint = mountpoint
+		mounts = append(mounts, m)
+	}
+
+	if *daemonPtr {
+		detached, err := daemonize()
 		if err != nil {
-			fmt.Printf("failed to retrieve hostname, set one manually: %v", err)
+			fmt.Fprintf(os.Stderr, "failed to start the daemon: %v\n", err)
+			os.Exit(1)
+		}
+		if detached {
+			os.Exit(0)
 		}
 	}
 
-	lvl, err := log15.LvlFromString(*loglevelPtr)
+	root.Hostname = global.Hostname
+	if root.Hostname == "" {
+		fmt.Printf("failed to retrieve hostname, set one manually")
+	}
+
+	pathutil.SetVarDir(global.VarDir)
+	if err := pathutil.InitVarDir(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to setup var directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	lvl, err := log15.LvlFromString(global.LogLevel)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "invalid log level %q\n", global.LogLevel)
+		os.Exit(2)
+	}
+	logfile := *logfilePtr
+	if logfile == "" && *daemonPtr {
+		logfile = filepath.Join(pathutil.VarDir(), "blobfs-mount.log")
+	}
+	Log.SetHandler(logHandler(lvl, logfile))
+	if conf.Path != "" {
+		Log.Info("Config loaded", "path", conf.Path)
 	}
-	Log.SetHandler(log15.LvlFilterHandler(lvl, log15.StreamHandler(os.Stdout, log15.TerminalFormat())))
-	fslog := Log.New("name", name)
 
-	// Display stats ever 10 seconds if there was some changes in the FS
-	stats = &Stats{LastReset: time.Now()}
-	go func() {
-		t := time.NewTicker(10 * time.Second)
-		for _ = range t.C {
-			// fslog.Info(fmt.Sprintf("latest=%+v,staging=%+v,mount=%+v", bfs.latest, bfs.staging, bfs.mount))
-			if stats.updated {
-				fslog.Info(stats.String())
-				fslog.Debug("Flushing stats")
-				stats.Reset()
-			}
+	if *pidfilePtr != "" {
+		if err := writePidfile(*pidfilePtr); err != nil {
+			Log.Crit("failed to write pidfile", "err", err)
+			os.Exit(1)
+		}
+		defer os.Remove(*pidfilePtr)
+	}
+
+	// Be ready to cleanup if we receive a kill signal
+	cs := make(chan os.Signal, 1)
+	signal.Notify(cs, os.Interrupt,
+		syscall.SIGHUP,
+		syscall.SIGINT,
+		syscall.SIGTERM,
+		syscall.SIGQUIT)
+
+	// The FS using the same BlobStash instance share the same client
+	remotes := map[string]*bstore.Remote{}
+	fses := []*FS{}
+	exitCode := 0
+	for _, m := range mounts {
+		opts := blobstore.DefaultOpts().SetHost(m.Host, m.APIKey)
+		opts.SnappyCompression = true
+		remote, ok := remotes[opts.Host+":"+opts.APIKey]
+		if !ok {
+			remote = bstore.NewRemote(opts)
+			remotes[opts.Host+":"+opts.APIKey] = remote
+		}
+		f, err := mountFS(m, remote)
+		if err != nil {
+			// Only this FS fails, the other ones are still mounted
+			Log.Crit("failed to mount", "name", m.Name, "err", err)
+			exitCode = 1
+			continue
+		}
+		fses = append(fses, f)
+	}
+
+	if len(fses) > 0 {
+		// Every root that could be loaded is mounted
+		if err := sdNotify("READY=1"); err != nil {
+			Log.Error("failed to notify systemd", "err", err)
 		}
+		<-cs
+	}
+
+	sdNotify("STOPPING=1")
+	// Another signal stops waiting for the open files (of every FS)
+	stop := make(chan struct{})
+	go func() {
+		<-cs
+		close(stop)
 	}()
+	// The FSes are shut down concurrently so the open files timeout doesn't add up
+	errs := make(chan error, len(fses))
+	for _, f := range fses {
+		go func(f *FS) {
+			errs <- f.shutdown(*shutdownTimeoutPtr, *pushOnExitPtr, stop)
+		}(f)
+	}
+	for range fses {
+		if err := <-errs; err != nil {
+			exitCode = 1
+		}
+	}
+	if *pidfilePtr != "" {
+		os.Remove(*pidfilePtr)
+	}
+	os.Exit(exitCode)
+}
+
+// encryptionKey loads the key from the keyfile, or derives it from $BLOBFS_PASSPHRASE (salted with the FS name)
+func encryptionKey(opts *config.Settings) (*encryption.Key, error) {
+	if opts.EncryptionKey != "" {
+		return encryption.KeyFromFile(opts.EncryptionKey)
+	}
+	passphrase := os.Getenv(config.EnvPassphrase)
+	if passphrase == "" {
+		return nil, fmt.Errorf("no encryption_key keyfile and $%s is not set", config.EnvPassphrase)
+	}
+	return encryption.KeyFromPassphrase(passphrase, opts.Name)
+}
+
+// mountFS loads the root of the FS, mounts it and starts its API
+func mountFS(opts *config.Settings, remote *bstore.Remote) (*FS, error) {
+	name := opts.Name
+	mountpoint := opts.Mountpoint
+	fslog := Log.New("name", name)
 
 	// FIXME(tsileo): re-enable, and do the update only if it's been 10 minutes without any activity
 	// go func() {
 	// 	t := time.NewTicker(10 * time.Minute)
 	// 	for _ = range t.C {
 	// 		fslog.Debug("trigger sync")
-	// 		bfs.sync <- struct{}{}
+	// 		bfs.triggerSync()
 	// 	}
 	// }()
 
-	sockPath := fmt.Sprintf("/tmp/blobfs_%s_%d.sock", name, time.Now().UnixNano())
-
-	go func() {
-		api := &API{}
-		// TODO(tsileo): make the API port configurable
-		fslog.Info("Starting API at localhost:8049")
-		if err := api.Serve(sockPath); err != nil {
-			fslog.Crit("failed to start API")
+	// Register the mount so the CLI can find it by name (or from any path inside the mountpoint)
+	reg, err := registry.Default()
+	if err != nil {
+		return nil, err
+	}
+	sockPath := reg.SocketPath(name)
+	if err := reg.Register(&registry.Mount{
+		Name:       name,
+		Mountpoint: mountpoint,
+		Socket:     sockPath,
+		Pid:        os.Getpid(),
+		Started:    time.Now(),
+	}); err != nil {
+		if err == registry.ErrAlreadyMounted {
+			return nil, fmt.Errorf("%s is already mounted", name)
+		}
+		return nil, err
+	}
+	// The cleanups are deferred right after acquiring each resource, they only run if the FS fails to mount
+	mounted := false
+	defer func() {
+		if !mounted {
+			reg.Unregister(name)
 		}
 	}()
 
-	fslog.Info("Mouting fs...", "mountpoint", mountpoint, "immutable", *immutablePtr)
-	bsOpts := blobstore.DefaultOpts().SetHost(*hostPtr, os.Getenv("BLOBSTASH_API_KEY"))
-	bsOpts.SnappyCompression = false
-	bs, err := cache.New(fslog.New("module", "blobstore"), bsOpts, fmt.Sprintf("blobfs_cache_%s", name))
+	fslog.Info("Mouting fs...", "mountpoint", mountpoint, "immutable", opts.Immutable, "encrypted", opts.Encrypt)
+	chunks, err := chunker.New(opts.ChunkMin, opts.ChunkAvg, opts.ChunkMax)
 	if err != nil {
-		fslog.Crit("failed to init cache", "err", err)
-		os.Exit(1)
+		return nil, err
 	}
+	kvsOpts := kvstore.DefaultOpts().SetHost(opts.Host, opts.APIKey)
+	kvsOpts.SnappyCompression = true
+	var rkv fstree.KvStore = kvstore.New(kvsOpts)
 
-	kvsOpts := kvstore.DefaultOpts().SetHost(*hostPtr, os.Getenv("BLOBSTASH_API_KEY"))
-	// FIXME(tsileo): re-enable Snappy compression
-	kvsOpts.SnappyCompression = false
-	rkv := kvstore.New(kvsOpts)
-
-	c, err := fuse.Mount(
-		mountpoint,
-		fuse.FSName(name),
-		fuse.Subtype("blobfs"),
-		// fuse.LocalVolume(),
-		fuse.VolumeName(name),
-	)
-	defer c.Close()
-	if err != nil {
-		fslog.Crit("failed to mount", "err", err)
-		os.Exit(1)
+	// Blobs and roots are encrypted before leaving the machine
+	var rbs bstore.BlobStore = remote
+	if opts.Encrypt {
+		key, err := encryptionKey(opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the encryption key: %v", err)
+		}
+		rbs = encryption.NewBlobStore(remote, rkv, key)
+		rkv = encryption.NewKvStore(rkv, key)
 	}
 
-	if err := pathutil.InitVarDir(); err != nil {
-		fslog.Crit("failed to setup var directory", "err", err)
-		os.Exit(1)
+	bs, err := cache.NewWithRemote(fslog.New("module", "blobstore"), rbs, fmt.Sprintf("blobfs_cache_%s", name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to init cache: %v", err)
 	}
+	defer func() {
+		if !mounted {
+			bs.Close()
+		}
+	}()
 
 	// Initialize the local Vkv store that will store all the local mutations
 	lkv, err := vkv.New(filepath.Join(pathutil.VarDir(), fmt.Sprintf("lkv_%s", name)))
-	defer lkv.Close()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer func() {
+		if !mounted {
+			lkv.Close()
+		}
+	}()
 
 	// Retrieve the current user Uid/Gid for using it for hte FS
 	cuser, err := user.Current()
 	if err != nil {
-		fslog.Crit("failed to get current user", "err", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("failed to get current user: %v", err)
 	}
 	iuid, err := strconv.Atoi(cuser.Uid)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid uid %q: %v", cuser.Uid, err)
 	}
 	igid, err := strconv.Atoi(cuser.Gid)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("invalid gid %q: %v", cuser.Gid, err)
+	}
+
+	bfs := &FS{
+		tree:        fstree.New(fslog, name, bs, lkv, rkv, opts.Immutable),
+		log:         fslog,
+		name:        name,
+		reg:         reg,
+		lkv:         lkv,
+		socketPath:  sockPath,
+		mountpoint:  mountpoint,
+		bs:          bs,
+		uid:         uint32(iuid),
+		gid:         uint32(igid),
+		host:        kvsOpts.Host,
+		cache:       map[fuse.NodeID]struct{}{},
+		nodes:       map[fstree.Node]fs.Node{},
+		cacheCap:    opts.CacheSize,
+		remoteQuota: opts.RemoteQuota,
+	}
+	bfs.tree.SetChunker(chunks)
+	if opts.LockLease {
+		bfs.tree.EnableLockLeases(lockLeaseTTL)
+	}
+	bfs.jobs = NewJobs(bfs.log, &bfs.wg)
+	bfs.snapshotsDir = newSnapshotsDir(bfs)
+
+	// Load the Root of the FS before we mount it
+	if err := bfs.tree.Load(); err != nil {
+		return nil, fmt.Errorf("failed to load the root: %v", err)
 	}
 
-	bfs = &FS{
-		log:        fslog,
-		socketPath: sockPath,
-		name:       name,
-		bs:         bs,
-		c:          c,
-		uid:        uint32(iuid),
-		gid:        uint32(igid),
-		lkv:        lkv,
-		rkv:        rkv,
-		uploader:   writer.NewUploader(bs),
-		immutable:  *immutablePtr,
-		host:       bsOpts.Host,
-		cache:      map[fuse.NodeID]struct{}{},
-		sync:       make(chan struct{}),
+	// The socket is created before mounting so a failure only fails this FS
+	api := &API{fs: bfs}
+	if err := api.Listen(sockPath); err != nil {
+		return nil, fmt.Errorf("failed to start the API: %v", err)
 	}
+	defer func() {
+		if !mounted {
+			api.Close()
+		}
+	}()
+	go func() {
+		fslog.Info("Starting API", "socket", sockPath)
+		if err := api.Serve(); err != nil {
+			fslog.Error("API failed", "err", err)
+		}
+	}()
 
-	// Load the Root of the FS before we mount it
-	if err := bfs.loadRoot(); err != nil {
-		panic(err)
+	c, err := fuse.Mount(
+		mountpoint,
+		fuse.FSName(name),
+		fuse.Subtype("blobfs"),
+		// fuse.LocalVolume(),
+		fuse.VolumeName(name),
+		fuse.LockingFlock(),
+		fuse.LockingPOSIX(),
+	)
+	if err != nil {
+		return nil, err
 	}
-	bfs.root = bfs.Mount().node.(*Dir)
+	mounted = true
+	bfs.c = c
+
+	// Display stats ever 10 seconds if there was some changes in the FS
+	go func() {
+		stats := bfs.tree.Stats
+		t := time.NewTicker(10 * time.Second)
+		for _ = range t.C {
+			if stats.Updated() {
+				fslog.Info(stats.String())
+				fslog.Debug("Flushing stats")
+				stats.Reset()
+			}
+		}
+	}()
 
-	appConfigYAML, err := bfs.Path("/app.yaml")
+	appConfigYAML, err := bfs.tree.Path("/app.yaml")
 	if err != nil {
 		panic(err)
 	}
 	if appConfigYAML != nil {
+		bfs.tree.RLock()
 		fakeFile := filereader.NewFile(bfs.bs, appConfigYAML.Meta())
+		bfs.tree.RUnlock()
 		data, err := ioutil.ReadAll(fakeFile)
 		if err != nil {
 			panic(err)
@@ -510,12 +524,14 @@ func main() {
 
 		// func New(name string, entrypoint *EntryPoint, config map[string]interface{}, pathFunc func(string) (AppNode, error), authFunc func(*http.Request) bool) *App {
 		pathFunc := func(path string) (app.AppNode, error) {
-			node, err := bfs.Path(path)
+			node, err := bfs.tree.Path(path)
 			if err != nil {
 				panic(err)
 
 			}
 			if node != nil {
+				bfs.tree.RLock()
+				defer bfs.tree.RUnlock()
 				return &AppNode{
 					fs:   bfs,
 					meta: node.Meta(),
@@ -532,31 +548,17 @@ func main() {
 		go func() {
 			mux := http.NewServeMux()
 			mux.HandleFunc("/", h)
-			http.ListenAndServe(":8030", mux)
+			fslog.Info("Starting app server", "port", opts.AppPort)
+			if err := http.ListenAndServe(fmt.Sprintf(":%d", opts.AppPort), mux); err != nil {
+				fslog.Error("app server failed", "err", err)
+			}
 		}()
 	}
-	// Listen for sync request
-	// FIXME(tsileo): we may want this to be async when it's triggered when making a file public,
-	// when the link will be given, it still won't be there remotely and cause issue if done pragmatically
-	go func() {
-		for {
-			select {
-			case <-bfs.sync:
-				fslog.Info("Sync triggered")
-				if err := bfs.Pull(); err != nil {
-					fslog.Error("failed to push", "err", err)
-				}
-				if err := bfs.Push(nil); err != nil {
-					fslog.Error("failed to push", "err", err)
-				}
-			}
-		}
-	}()
-
 	// Actually mount the FS
+	bfs.wg.Add(1)
 	go func() {
-		wg.Add(1)
-		err = fs.Serve(c, bfs)
+		defer bfs.wg.Done()
+		err := fs.Serve(c, bfs)
 		if err != nil {
 			fslog.Crit("failed to serve", "err", err)
 			os.Exit(1)
@@ -572,68 +574,9 @@ func main() {
 			fslog.Crit("failed to close connection", "err", err)
 		}
 		bfs.bs.Close()
-		wg.Done()
 	}()
 
-	// Be ready to cleanup if we receive a kill signal
-	cs := make(chan os.Signal, 1)
-	signal.Notify(cs, os.Interrupt,
-		syscall.SIGHUP,
-		syscall.SIGINT,
-		syscall.SIGTERM,
-		syscall.SIGQUIT)
-	<-cs
-	fslog.Info("Unmounting...")
-	if err := unmount(mountpoint); err != nil {
-		fslog.Crit("failed to unmount", "err", err)
-		os.Exit(1)
-	}
-	wg.Wait()
-	os.Exit(0)
-}
-
-// initRoot intializes a new root dir
-func (f *FS) initRoot() (*Dir, error) {
-	newRoot := &Dir{
-		fs:       f,
-		Children: map[string]Node{},
-		meta:     &meta.Meta{Name: ""}, // We want an empty name for the root
-	}
-	newRoot.log = f.log.New("ref", "undefined", "name", "_root", "type", "dir")
-	if err := newRoot.Save(); err != nil {
-		return nil, err
-	}
-	f.log.Debug("Created new root", "ref", newRoot.Meta().Hash)
-	return newRoot, nil
-}
-
-type SyncStats struct {
-	BlobsUploaded int
-	BlobsSkipped  int
-}
-
-type Stats struct {
-	LastReset    time.Time
-	FilesCreated int
-	DirsCreated  int
-	FilesUpdated int
-	DirsUpdated  int
-	updated      bool
-	sync.Mutex
-}
-
-func (s *Stats) Reset() {
-	s.LastReset = time.Now()
-	s.FilesCreated = 0
-	s.DirsCreated = 0
-	s.FilesUpdated = 0
-	s.DirsUpdated = 0
-	s.updated = false
-}
-
-func (s *Stats) String() string {
-	return fmt.Sprintf("%d files created, %d dirs created, %d files updated, %d dirs updated",
-		s.FilesCreated, s.DirsCreated, s.FilesUpdated, s.DirsUpdated)
+	return bfs, nil
 }
 
 // debugFile is a dummy file that hold a string
@@ -658,28 +601,34 @@ func (f *debugFile) ReadAll(ctx context.Context) ([]byte, error) {
 	return f.data, nil
 }
 
+// FS is the FUSE adapter on top of the `fstree.FS`
 type FS struct {
-	log log15.Logger
+	tree *fstree.FS
 
-	root *Dir
+	log log15.Logger
 
-	rkv *kvstore.KvStore // remote vkv store
-	lkv *vkv.DB          // local vkv store
+	name string
+	reg  *registry.Registry
+	lkv  *vkv.DB // Local mutations, closed on shutdown
 
-	bs       *cache.Cache     // blobstore.BlobStore wrapper
-	uploader *writer.Uploader // BlobStash FileTree client
+	bs *cache.Cache // blobstore.BlobStore wrapper
 
 	socketPath string // Socket used for HTTP FS communications
 
-	name      string
-	host      string
-	immutable bool
+	host       string
+	mountpoint string
 
-	sync   chan struct{}
 	lastOP time.Time
 
-	local  *Mount
-	remote *Mount
+	snapshotsDir *snapshotsDir // Virtual `.snapshots` directory
+
+	jobs *Jobs // Background push/pull jobs
+
+	cacheCap    int64 // Max size of the local cache (0 if unlimited)
+	remoteQuota int64 // Quota of the remote BlobStash (0 if unlimited)
+	usage       *DiskUsage
+	usageAt     time.Time
+	usageMu     sync.Mutex // Protects the cached usage
 
 	c *fuse.Conn
 
@@ -689,12 +638,16 @@ type FS struct {
 	gid uint32 // Current user gid
 
 	cache map[fuse.NodeID]struct{}
+	nodes map[fstree.Node]fs.Node // FUSE node of each tree node, the kernel identifies a node by its FUSE node
+	mu    sync.Mutex              // Protects the node caches
 
-	openFds int // Open file descriptors count
-	mu      sync.Mutex
+	wg sync.WaitGroup // Tracks the FUSE server and the background jobs
 }
 
 func (f *FS) InvalidateCache() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	for nodeID, _ := range f.cache {
 		f.log.Debug("Invalidate node", "nodeID", nodeID)
 		err := f.c.InvalidateNode(nodeID, 0, -1)
@@ -703,938 +656,160 @@ func (f *FS) InvalidateCache() error {
 		case fuse.ErrNotCached:
 			f.log.Debug("node not cached")
 		default:
-			f.log.Error("failed to invalidate", "nodeID", nodeID, "err", err)
+			f.log.Error("failed to invalidate", "err", err)
 		}
 		delete(f.cache, nodeID)
 	}
-	// f.root.Children = nil
 	return nil
 }
 
-// Mount determine if the current root should the local one or the remote one and returns it
-func (f *FS) Mount() *Mount {
-	if f.local != nil {
-		if f.remote == nil || (f.remote != nil && f.local.root.Version > f.remote.root.Version) {
-			return f.local
-		}
-		return f.remote
+// Pull fetches the remote mutations and invalidates the kernel cache
+func (f *FS) Pull() error {
+	if err := f.tree.Pull(); err != nil {
+		return err
 	}
-	return f.remote
+	return f.InvalidateCache()
 }
 
-func (f *FS) Path(lp string) (Node, error) {
-	return f.path(f.root, lp, "/")
+// Undo restores the node at `path` (see `fstree.FS.Undo`) and invalidates the kernel cache
+func (f *FS) Undo(path, to string) error {
+	if err := f.tree.Undo(path, to); err != nil {
+		return err
+	}
+	return f.InvalidateCache()
 }
 
-func (f *FS) path(n Node, lp, p string) (Node, error) {
-	if n.IsDir() {
-		d := n.(*Dir)
-		if d.Children == nil {
-			if err := d.reload(); err != nil {
-				return nil, err
-			}
+// triggerSync pulls then pushes in a background job (queued if a push or a pull is running), e.g. so a node made public
+// (or private) is (un)available on BlobStash right away
+func (f *FS) triggerSync() {
+	f.log.Info("Sync triggered")
+	f.jobs.Queue("sync", true, func(ctx context.Context, stats *fstree.SyncStats) error {
+		// Nobody waits for this job, so the errors are logged
+		if err := f.Pull(); err != nil {
+			f.log.Error("failed to pull", "err", err)
+			return err
 		}
-		for _, child := range d.Children {
-
-			childPath := filepath.Join(p, n.Meta().Name, child.Meta().Name)
-			if child.IsDir() {
-				rnode, err := f.path(child, lp, filepath.Join(p, n.Meta().Name))
-				if err != nil {
-					return nil, err
-				}
-				if rnode != nil && childPath == lp {
-					return rnode, nil
-				}
-
-			} else {
-				if childPath == lp {
-					return child, nil
-				}
-			}
-		}
-	}
-	return nil, nil
-}
-
-// Build the local index (a map[path]hash)
-func (f *FS) localIndex() (map[string]string, error) {
-	return f.buildLocalIndex(f.root, "/")
-}
-
-func (f *FS) buildLocalIndex(n Node, p string) (map[string]string, error) {
-	index := map[string]string{}
-	index[filepath.Join(p, n.Meta().Name)] = n.Meta().Hash
-	if n.IsDir() {
-		d := n.(*Dir)
-		if d.Children == nil {
-			if err := d.reload(); err != nil {
-				return nil, err
-			}
-		}
-		for _, child := range d.Children {
-			if child.IsDir() {
-				childIndex, err := f.buildLocalIndex(child, filepath.Join(p, n.Meta().Name))
-				if err != nil {
-					return nil, err
-				}
-				for cp, cref := range childIndex {
-					index[cp] = cref
-				}
-			} else {
-				index[filepath.Join(p, n.Meta().Name, child.Meta().Name)] = child.Meta().Hash
-			}
-		}
-	}
-	return index, nil
-}
-
-type DiffNode struct {
-	Path, Hash string
-}
-
-type Diff struct {
-	Added             []*DiffNode
-	Conflicted        []*DiffNode
-	DeletedCandidates []*DiffNode
-}
-
-func (f *FS) compareIndex(localIndex, remoteIndex map[string]string) (*Diff, error) {
-	if _, ok := remoteIndex["/"]; ok {
-		delete(remoteIndex, "/")
-	}
-	if _, ok := localIndex["/"]; ok {
-		delete(localIndex, "/")
-	}
-	diff := &Diff{
-		Added:             []*DiffNode{},
-		Conflicted:        []*DiffNode{},
-		DeletedCandidates: []*DiffNode{},
-	}
-	for p, ref := range remoteIndex {
-		if lref, ok := localIndex[p]; ok {
-			// The file is also present in the local index
-			if ref != lref {
-				// The ref are different, there is a conflict
-				diff.Conflicted = append(diff.Conflicted, &DiffNode{p, ref})
-			}
-		} else {
-			// The file is not present in the local index, it has been "added"
-			diff.Added = append(diff.Added, &DiffNode{p, ref})
-		}
-	}
-	for p, ref := range localIndex {
-		if _, ok := remoteIndex[p]; !ok {
-			diff.DeletedCandidates = append(diff.DeletedCandidates, &DiffNode{p, ref})
+		if err := f.tree.PushContext(ctx, nil, stats); err != nil {
+			f.log.Error("failed to push", "err", err)
+			return err
 		}
-	}
-	// Make sure we handle the deepest children first so we don't delete a directory with a file not deleted yet
-	sort.Sort(ByLength(diff.DeletedCandidates))
-
-	return diff, nil
+		return nil
+	})
 }
 
 func (f *FS) updateLastOP() {
 	f.lastOP = time.Now()
 }
 
-type Mount struct {
-	immutable bool
-	node      Node
-	root      *root.Root
-}
-
-func (m *Mount) Empty() bool {
-	return m.node == nil
-}
-
-func (m *Mount) Copy(m2 *Mount) {
-	m2.immutable = m.immutable
-	m2.node = m.node
-	m2.root = m.root
-}
-
-// Same struct BlobStash's filetree.Node
-// XXX(tsileo): check if we can use a Meta for this? a meta never output hash/ref :s
-type RemoteNode struct {
-	Name     string  `json:"name"`
-	Type     string  `json:"type"`
-	Size     int     `json:"size"`
-	Mode     uint32  `json:"mode"`
-	ModTime  string  `json:"mtime"`
-	Hash     string  `json:"ref"`
-	Children []*Node `json:"children,omitempty"`
-}
-
-// remoteNode fetch the remote node at `path` in the given `mutationRef`
-func (f *FS) remoteNode(mutationRef, path string) (*RemoteNode, error) {
-	resp, err := f.bs.Client().DoReq("GET", fmt.Sprintf("/api/filetree/fs/ref/%s/%s", mutationRef, path), nil, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+// fsPath converts an absolute path on the host (inside the mountpoint) to a path relative to the root of the FS
+func (f *FS) fsPath(hostPath string) (string, error) {
+	rel, err := filepath.Rel(f.mountpoint, hostPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("path \"%s\" is not inside the mountpoint", hostPath)
 	}
-	switch {
-	case resp.StatusCode == 200:
-		node := &RemoteNode{}
-		if err := json.Unmarshal(body, &node); err != nil {
-			return nil, err
-		}
-		return node, nil
-	default:
-		return nil, fmt.Errorf("failed to fetch node at path \"%s\" for ref=%v: %s", path, mutationRef, body)
+	if rel == "." {
+		return "/", nil
 	}
+	return "/" + rel, nil
 }
 
-// remoteIndex fetch the remote index (map[path]hash) for the given mutation ref
-func (f *FS) remoteIndex(ref string) (map[string]string, error) {
-	resp, err := f.bs.Client().DoReq("GET", "/api/filetree/index/"+ref, nil, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	switch {
-	case resp.StatusCode == 200:
-		out := map[string]string{}
-		if err := json.Unmarshal(body, &out); err != nil {
-			return nil, err
-		}
-		return out, nil
-	default:
-		return nil, fmt.Errorf("failed to fetch index for ref=%v: %s", ref, body)
-	}
+func (f *FS) Root() (fs.Node, error) {
+	f.log.Info("OP Root")
+	return f.fuseNode(f.tree.Root()), nil
 }
 
-// Refs returns a "snapshot" of the FS
-// - a slice of refs containing all the blobfs of the Tree
-func (f *FS) Refs(rootDir *Dir) ([]string, error) {
-	f.log.Info("Fetching refs", "root", rootDir, "meta", rootDir.Meta())
-	defer f.log.Info("Fetching refs done")
-
-	wg.Add(1)
-	defer wg.Done()
-
+// fuseNode returns the FUSE node for the given tree node, the same FUSE node is returned until the kernel forgets it
+// (bazil assigns the node IDs by FUSE node)
+func (f *FS) fuseNode(n fstree.Node) fs.Node {
 	f.mu.Lock()
-	defer f.mu.Unlock()
-
-	refs := []string{}
-
-	// 	rootNode, err := bfs.getRoot()
-	// 	if err != nil {
-	// 		f.log.Error("Failed to fetch root", "err", err)
-	// 		return nil, nil, err
-	// 	}
-
-	// 	rootDir := rootNode.(*Dir)
-	// rootDir := root.node
-
-	if err := iterDir(rootDir, func(node Node) error {
-		f.log.Debug("[fetch dir]", "node", node.Meta())
-		refs = append(refs, node.Meta().Hash)
-		if !node.IsDir() {
-			for _, iref := range node.Meta().Refs {
-				data := iref.([]interface{})
-				ref := data[1].(string)
-				refs = append(refs, ref)
-			}
-		}
-		return nil
-	}); err != nil {
-		f.log.Error("iterDir failed", "err", err)
-		return nil, err
+	fn, ok := f.nodes[n]
+	f.mu.Unlock()
+	if ok {
+		return fn
 	}
 
-	return refs, nil
-}
-
-type ByLength []*DiffNode
-
-func (s ByLength) Len() int {
-	return len(s)
-}
-func (s ByLength) Swap(i, j int) {
-	s[i], s[j] = s[j], s[i]
-}
-func (s ByLength) Less(i, j int) bool {
-	return len(strings.Split(s[i].Path, "/")) > len(strings.Split(s[j].Path, "/"))
-}
-
-//
-func (f *FS) Pull() error {
-	// First, try to fetch the local root
-	var err error
-	var remoteRoot *root.Root
-	var remoteNode Node
-
-	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
-	// localFsName := fmt.Sprintf(localRootKeyFmt, f.Name())
-
-	f.log.Debug("load latest remote mutation", "name", fsName)
-	remoteKv, err := f.rkv.Get(fsName, -1)
-	switch err {
-	case nil:
-		f.log.Debug("loaded remote", "kv", string(remoteKv.Data))
-		// There are mutations for this FS in BlobStash
-		remoteRoot, remoteNode, err = f.kvDataToDir(remoteKv.Data, remoteKv.Version)
-	case kvstore.ErrKeyNotFound:
-		f.log.Debug("remote not found")
-		// The FS is new, no remote mutation nor local, we'll create the inital root later
-	default:
-		f.log.Error("failed to fetch lastest mutation from BlobStash", "err", err)
-		return err
-	}
-
-	// Then, try to fetch the remote root
-	f.log.Debug("load latest local mutation")
-	localKv, err := f.lkv.Get(fsName, -1)
-	switch err {
-	case nil:
-		f.log.Debug("loaded local", "kv", string(localKv.Data))
-	case vkv.ErrNotFound:
-		f.log.Debug("local not found")
-	default:
-		return err
-	}
-
-	switch {
-	case localKv == nil:
-		// FIXME(tsileo): is this case even possible?
-		f.log.Debug("No local mutations yet")
-		if remoteKv == nil {
-			newRoot, err := f.initRoot()
-			if err != nil {
-				return err
-			}
-			rootNode := newRoot
-			// The root was just created
-			localRoot := &root.Root{Ref: rootNode.Meta().Hash}
-			jsroot, err := localRoot.JSON()
-			if err != nil {
-				return err
-			}
-			localFsName := fmt.Sprintf(localRootKeyFmt, f.Name())
-			kv, err := f.lkv.Put(localFsName, "", jsroot, -1)
-			localRoot.Version = kv.Version
-			if err != nil {
-				return err
-			}
-			f.local = &Mount{
-				immutable: false,
-				root:      localRoot,
-				node:      newRoot,
-			}
-			f.root = f.Mount().node.(*Dir)
-			return nil
-		}
-		// Fetch and save all the known remote mutations
-		versions, err := f.rkv.Versions(fsName, 0, -1, 0)
-		if err != nil {
-			return err
-		}
-		for _, version := range versions.Versions {
-			f.log.Debug("Saving mutation locally", "root", string(version.Data))
-			if f.lkv.Put(fsName, version.Hash, version.Data, version.Version); err != nil {
-				return err
-			}
-		}
-		f.remote = &Mount{
-			immutable: f.Immutable(),
-			root:      remoteRoot,
-			node:      remoteNode,
-		}
-		f.log.Debug("DEBUG", "f.root", f.root, "remoteDir", remoteNode)
-		if f.root != nil {
-			*f.root = *remoteNode.(*Dir)
-		} else {
-			f.root = remoteNode.(*Dir)
-		}
-		// if err := bfs.c.InvalidateEntry(fuse.RootID, ""); err != nil {
-		// 	f.log.Error("failed to invalidate entry", "err", err)
-		// 	return err
-		// }
-		return f.InvalidateCache()
-
-	case remoteKv == nil:
-		f.log.Info("FS does not exist remotely")
-
-	case remoteKv.Version > localKv.Version:
-		f.log.Info("there are un-synced remote mutations")
-		// No un-synced mutation, just copy the new mutations
-		// versions, err := f.rkv.Versions(fsName, localKv.Version-1, -1, 0)
-		versions, err := f.rkv.Versions(fsName, 0, -1, 0)
-		if err != nil {
-			return err
-		}
-
-		// FIXME(tsileo): assert that the latest remote (the one stored locally) ref is
-		// actually present in the old versions
-		// var lastRefData []byte
-		saved := 0
-		shouldBreak := false
-		for _, version := range versions.Versions {
-			if shouldBreak {
-				break
-			}
-			if f.remote != nil && version.Version == f.remote.root.Version {
-				shouldBreak = true
-				// This mean we should catch the version as the previous ref
-				continue
-			}
-			if f.lkv.Put(fsName, version.Hash, version.Data, version.Version); err != nil {
-				return err
-			}
-			saved++
-		}
-
-		f.log.Info("Remote mutations saved", "count", saved)
-
-		// FIXME(tsileo): check here too
-		// Check we have mutation not synced yet
-		if f.local != nil && f.local.root.Version > localKv.Version {
-			// Conflict handling
-
-			// FIXME(tsileo): do a merge, create a new mount and set it as local
-			f.log.Info("There is a conflict")
-
-			remoteIndex, err := f.remoteIndex(remoteRoot.Ref)
-			if err != nil {
-				return err
-			}
-			f.log.Info("Fetched remote index", "index", remoteIndex)
-
-			localIndex, err := f.localIndex()
-			if err != nil {
-				return err
-			}
-			f.log.Info("Built local index", "index", localIndex)
-
-			// Compute the diff between the two mutations
-			diff, err := f.compareIndex(localIndex, remoteIndex)
-			if err != nil {
-				return err
-			}
-			f.log.Info("Computed diff", "diff", diff)
-
-			for _, added := range diff.Added {
-				m, err := f.metaFromHash(added.Hash)
-				if err != nil {
-					return err
-				}
-				f.log.Info("[add]", "node", added)
-				if err := f.createNode(added.Path, m); err != nil {
-					return err
-				}
-			}
-
-			for _, conflicted := range diff.Conflicted {
-				m, err := f.metaFromHash(conflicted.Hash)
-				if err != nil {
-					return err
-				}
-				f.log.Info("[conflicted]", "node", conflicted)
-				m.Name = m.Name + ".conflicted"
-				if err := f.createNode(conflicted.Path+".conflicted", m); err != nil {
-					return err
-				}
-			}
-			// If there is only one remote mutation, then all the deletedCandidates are new local files
-			// if prevMutationRef != "" {
-			// FIXME(tsileo): rename Diff.Deleted to Diff.DeletedCandidates and make the handling outside of this func
-			// then, check at /api/filetree/fs/ref/{ref}+p
-			// if the node exists, compare the ref, if it's the same, we can delete the file
-			// safely (since it will be super easy to restore), it it's not the same,
-			// rename it as .conflicted+deleted
-			// }
-			// FIXME(tsileo): check if there is a previous version
-
-			for _, deletedCandidate := range diff.DeletedCandidates {
-				// rnode, err := f.remoteNode()
-				f.log.Debug("[deleted *candidate*]", "node", deletedCandidate)
-				// 	f.log.Info("[deleted]", "node", deleted)
-				// 	// FIXME(tsileo): detect new file/unsynced file/if the deleted file has been modified"
-				// 	// XXX(tsileo): should check the latest remote (from local rkv) and see if the file is the same
-				// 	// in this case delete it, if not ???
-				// 	if err := f.deleteNode(deleted.Path); err != nil {
-				// 		return err
-				// 	}
-			}
-
-			// FIXME(tsileo): bad root here?
-			// f.remote = &Mount{
-			// 	immutable: f.Immutable(),
-			// 	node:
-			// }
-
-			*f.root = *f.local.node.(*Dir)
-			f.log.Info("Diff done")
-
-			return f.InvalidateCache()
-		}
-
-		f.remote = &Mount{
-			immutable: f.Immutable(),
-			root:      remoteRoot,
-			node:      remoteNode,
-		}
-		*f.root = *remoteNode.(*Dir)
-
-	case remoteKv.Version < localKv.Version:
-		return fmt.Errorf("BlobStash seems out of sync")
-	case localKv.Version == remoteKv.Version:
-		f.log.Info("Already in sync")
-		return nil
-	}
-
-	return f.InvalidateCache()
-}
-
-func (f *FS) metaFromHash(hash string) (*meta.Meta, error) {
-	blob, err := f.bs.Get(context.TODO(), hash)
-	if err != nil {
-		return nil, err
-	}
-	// Decode it as a Meta
-	return meta.NewMetaFromBlob(hash, blob)
-}
-
-func (f *FS) deleteNode(path string) error {
-	split := strings.Split(path[1:], "/")
-	pathCount := len(split)
-	node := f.root
-	for i, p := range split {
-		if node.Children == nil {
-			if err := node.reload(); err != nil {
-				return err
-			}
-		}
-		child, ok := node.Children[p]
-		if ok {
-			if i == pathCount-1 {
-				delete(node.Children, p)
-				return node.Save()
-			}
-
-			// Keep searching
-			node = child.(*Dir)
-			continue
-		}
-
-		return fmt.Errorf("shouldn't happen")
-	}
-	return nil
-}
-
-func (f *FS) createNode(path string, cmeta *meta.Meta) error {
-	var prev *Dir
-	split := strings.Split(path[1:], "/")
-	pathCount := len(split)
-	node := f.root
-	for i, p := range split {
-		if node.Children == nil {
-			if err := node.reload(); err != nil {
-				return err
-			}
-		}
-		prev = node
-		child, ok := node.Children[p]
-		if ok {
-			node = child.(*Dir)
-			continue
-		}
-
-		if i == pathCount-1 {
-			nfile, err := NewFile(f, cmeta, node)
-			if err != nil {
-				return err
-			}
-			node.Children[p] = nfile
-			if err := node.Save(); err != nil {
-				return err
-			}
-
-		} else {
-			newMeta := &meta.Meta{
-				Type: "dir",
-				Name: p,
-			}
-			newd, err := NewDir(f, newMeta, prev)
-			if err != nil {
-				return err
-			}
-			node.Children[p] = newd
-			// FIXME(tsileo): needed?
-			if err := node.Save(); err != nil {
-				return err
-			}
-			node = newd
-		}
-	}
-	return nil
-}
-
-// Push saves all the blobs of the tree, and add the VK entry to the remote BlobStash instance
-func (f *FS) Push(comment []byte) error {
-	f.log.Info("Pushing data", "comment", comment)
-
-	wg.Add(1)
-	defer wg.Done()
-
-	// Ensure the current root is a local one
-	if f.Mount().root.Ref != f.local.root.Ref {
-		f.log.Info("No local changes")
-		return nil
-	}
-
-	// Try to fetch the latest remote mutation
-	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
-	remoteKv, err := f.rkv.Get(fsName, -1)
-	// versions, err2 := f.rkv.Versions(fsName, 0, -1, 0)
-	// if err2 != nil && err2 != kvstore.ErrKeyNotFound {
-	// 	panic(err)
-	// }
-	// if versions != nil {
-	// 	fmt.Printf("DEBUG:%+v/\n%+v/\n%+v/\n%+v\n\n", remoteKv, versions.Versions[0], f.remote.root, f.remote.node)
-	// }
-	switch err {
-	case nil:
-		// There are mutations for this FS in BlobStash
-		_, remoteNode, err := f.kvDataToDir(remoteKv.Data, remoteKv.Version)
-		f.log.Debug("remote node", "node", remoteNode)
-		if err != nil {
-			return err
-		}
-		// FIXME(tsileo): compare with lkv instead f.remote
-		// if f.remote.root != nil && f.remote.root.Ref != remoteRoot.Ref {
-		// 	f.log.Error("conflicted", "local_remote_root", f.remote.root, "remote_root", remoteRoot)
-		// 	// FIXME(tsileo): return conflicted error asking to pull
-		// 	return nil
-		// }
-	case kvstore.ErrKeyNotFound:
-		// The FS is new, no remote mutation nor local, we'll create the inital root later
-	default:
-		f.log.Error("failed to fetch lastest mutation from BlobStash", "err", err)
-		return err
-	}
-
-	// Keep some basic stats about the on-going sync
-	stats := &SyncStats{}
-	defer f.log.Info("Push done", "blobs_uploaded", stats.BlobsUploaded, "blobs_skipped", stats.BlobsSkipped)
-
-	// rootNode := f.root
-
-	// rootDir := f.local.node.(*Dir) //rootNode.(*Dir)
-	croot := f.local.root
-	if comment != nil {
-		croot.Comment = string(comment)
-	}
-
-	refs, err := bfs.Refs(f.root)
-	if err != nil {
-		return err
-	}
-	f.log.Debug("snapshot fetched", "root", croot, "len", len(refs))
-
-	// First save all the blobs of the tree
-	for _, ref := range refs {
-		exists, err := f.bs.StatRemote(ref)
-		if err != nil {
-			f.log.Error("stat failed", "err", err)
-			return err
-		}
-		if exists {
-			stats.BlobsSkipped++
-		} else {
-			blob, err := f.bs.Get(context.TODO(), ref)
-			if err != nil {
-				f.log.Error("Failed to fetch blob from cached", "err", err)
-			}
-			if err := f.bs.PutRemote(ref, blob); err != nil {
-				f.log.Error("PutRemote failed", "err", err)
-				return err
-			}
-			stats.BlobsUploaded++
-		}
-	}
-
-	jsRoot, err := croot.JSON()
-	if err != nil {
-		return err
-	}
-	// Set a KV entry for this mutation
-	// FIXME(tsileo): conditional request to ensure the previous version is the same
-	f.log.Debug("saving the mutation remotely", "name", fsName, "version", croot.Version, "ref", croot.Ref)
-	if _, err := bfs.rkv.Put(fsName, "", jsRoot, croot.Version); err != nil {
-		f.log.Error("Sync failed (failed to update the remote vkv entry)", "err", err)
-		return err
-	}
-	// Save the mutation as remote locally  too
-	if _, err := bfs.lkv.Put(fsName, "", jsRoot, croot.Version); err != nil {
-		f.log.Error("Sync failed (failed to update the remote vkv entry)", "err", err)
-		return err
+	// The node is built without holding the lock as it reads the meta (which acquires the tree lock)
+	if n.IsDir() {
+		fn = newDir(f, n.(*fstree.Dir))
+	} else {
+		fn = newFile(f, n.(*fstree.File))
 	}
 
-	return nil
-}
-
-func (f *FS) Immutable() bool {
-	// TODO(tsileo): check the mount
-	return f.immutable
-}
-
-func (f *FS) Name() string {
-	return f.name
-}
-
-var (
-	rootKeyFmt      = "blobfs:root:%v"
-	localRootKeyFmt = "local:root:%v"
-)
-
-func (f *FS) Root() (fs.Node, error) {
-	f.log.Info("OP Root")
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	return f.Mount().node, nil
-}
-
-func (f *FS) kvDataToDir(data []byte, version int) (*root.Root, *Dir, error) {
-	lroot, err := root.NewFromJSON([]byte(data), version)
-	if err != nil {
-		return nil, nil, err
-	}
-	f.log.Debug("decoding root", "root", lroot)
-	// Fetch the root ref
-	blob, err := f.bs.Get(context.TODO(), lroot.Ref)
-	if err != nil {
-		return nil, nil, err
-	}
-	// Decode it as a Meta
-	m, err := meta.NewMetaFromBlob(lroot.Ref, blob)
-	if err != nil {
-		return nil, nil, err
-	}
-	f.log.Debug("loaded meta root", "ref", m.Hash)
-	dir, err := NewDir(f, m, nil)
-	if err != nil {
-		return nil, nil, err
-	}
-	return lroot, dir, nil
-}
-
-func (f *FS) loadRoot() error {
-	// First, try to fetch the local root
-	// return f.Pull()
-	var err error
-	var wipRoot, localRoot, remoteRoot *root.Root
-	var wipNode, localNode, remoteNode, rootNode Node
-
-	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
-	localFsName := fmt.Sprintf(localRootKeyFmt, f.Name())
-
-	f.log.Debug("load latest local mutation")
-	localKv, err := f.lkv.Get(fsName, -1)
-	switch err {
-	case nil:
-		localRoot, localNode, err = f.kvDataToDir(localKv.Data, localKv.Version)
-	case vkv.ErrNotFound:
-	default:
-		return err
-	}
-
-	f.log.Debug("load latest wip mutation")
-	wipKv, err := f.lkv.Get(localFsName, -1)
-	switch err {
-	case nil:
-		wipRoot, wipNode, err = f.kvDataToDir(wipKv.Data, wipKv.Version)
-	case vkv.ErrNotFound:
-	default:
-		return err
-	}
-
-	// Then, try to fetch the remote root
-	f.log.Debug("load latest remote mutation")
-	remoteKv, err := f.rkv.Get(fsName, -1)
-	switch err {
-	case nil:
-		// There are mutations for this FS in BlobStash
-		remoteRoot, remoteNode, err = f.kvDataToDir(remoteKv.Data, remoteKv.Version)
-		f.log.Debug("remote node", "node", remoteNode)
-	case kvstore.ErrKeyNotFound:
-		// The FS is new, no remote mutation nor local, we'll create the inital root later
-	default:
-		f.log.Error("failed to fetch lastest mutation from BlobStash", "err", err)
-		return err
-	}
-	if wipKv != nil && ((localKv == nil && remoteKv == nil) || (remoteKv != nil && localKv == nil && wipKv.Version > remoteKv.Version) || (localKv != nil && remoteKv != nil && wipKv.Version > localKv.Version && wipKv.Version > remoteKv.Version)) {
-		f.local = &Mount{
-			immutable: f.Immutable(),
-			node:      wipNode,
-			root:      wipRoot,
-		}
-		f.root = f.Mount().node.(*Dir)
-		return nil
-	}
-	switch {
-	case localKv == nil && remoteKv == nil:
-		newRoot, err := f.initRoot()
-		if err != nil {
-			return err
-		}
-		rootNode = newRoot
-		// The root was just created
-		localRoot = &root.Root{Ref: rootNode.Meta().Hash}
-		jsroot, err := localRoot.JSON()
-		if err != nil {
-			return err
-		}
-		kv, err := f.lkv.Put(localFsName, "", jsroot, -1)
-		localRoot.Version = kv.Version
-		if err != nil {
-			return err
-		}
-		f.local = &Mount{
-			immutable: false,
-			root:      localRoot,
-			node:      newRoot,
-		}
-		f.root = f.Mount().node.(*Dir)
-		return nil
-	case localKv != nil && remoteKv != nil:
-		if localRoot.Version == remoteRoot.Version {
-			f.remote = &Mount{
-				immutable: f.Immutable(),
-				node:      localNode,
-				root:      localRoot,
-			}
-			return nil
-		}
-		if localKv.Version > remoteKv.Version {
-			f.log.Error("Version mismatch", "localkv", localKv, "remotekv", remoteKv)
-			// XXX(tsileo): recover from this should be possible if the cache hasn't been pruned
-			return fmt.Errorf("BlobStash instance seems out of sync, version mismatch")
-		} else {
-			// FIXME(tsileo): not only save the last, but all the missing one
-
-			localKv, err = f.lkv.Put(fsName, remoteKv.Hash, remoteKv.Data, remoteKv.Version)
-			if err != nil {
-				return err
-			}
-			f.remote = &Mount{
-				immutable: f.Immutable(),
-				node:      remoteNode,
-				root:      remoteRoot,
-			}
-			f.root = f.Mount().node.(*Dir)
-			return nil
-		}
-	case remoteKv != nil && localKv == nil:
-		f.log.Debug("Saving the remote mutations locally")
-		versions, err := f.rkv.Versions(fsName, 0, -1, 0)
-		if err != nil {
-			return err
-		}
-		for _, version := range versions.Versions {
-			if f.lkv.Put(fsName, version.Hash, version.Data, version.Version); err != nil {
-				return err
-			}
-		}
-
-		f.remote = &Mount{
-			immutable: f.Immutable(),
-			node:      remoteNode,
-			root:      remoteRoot,
-		}
-		f.root = f.Mount().node.(*Dir)
-		return nil
-	}
-	return fmt.Errorf("shouldn't happen")
-}
-
-// the Node interface wraps `fs.Node`
-type Node interface {
-	fs.Node
-	Meta() *meta.Meta
-	SetMeta(*meta.Meta)
-	Save() error
-	IsDir() bool
-}
-
-// Dir implements both Node and Handle for the root directory.
-type Dir struct {
-	fs       *FS
-	meta     *meta.Meta
-	parent   *Dir
-	Children map[string]Node
-	log      log15.Logger
-}
-
-func NewDir(rfs *FS, m *meta.Meta, parent *Dir) (*Dir, error) {
-	d := &Dir{
-		fs:     rfs,
-		meta:   m,
-		parent: parent,
-		log:    rfs.log.New("ref", m.Hash, "name", m.Name, "type", "dir"),
-	}
-	return d, nil
-}
-
-func (d *Dir) reload() error {
-	// XXX(tsileo): should we assume the Mutex is locked?
-	d.log.Info("Reload dir children")
-	d.Children = map[string]Node{}
-	for _, ref := range d.meta.Refs {
-		d.log.Debug("Trying to fetch ref", "hash", ref.(string))
-		blob, err := d.fs.bs.Get(context.TODO(), ref.(string))
-		if err != nil {
-			return err
-		}
-		m, err := meta.NewMetaFromBlob(ref.(string), blob)
-		if err != nil {
-			return err
-		}
-		d.log.Debug("fetched meta", "meta", m)
-		if m.IsDir() {
-			ndir, err := NewDir(d.fs, m, d)
-			if err != nil {
-				d.log.Error("failed to build dir", "err", err)
-				return err
-			}
-			d.Children[m.Name] = ndir
-		} else {
-			nfile, err := NewFile(d.fs, m, d)
-			if err != nil {
-				d.log.Error("failed to build file", "err", err)
-				return err
-			}
-			d.Children[m.Name] = nfile
-		}
+	// Another lookup may have built it in the meantime
+	if cached, ok := f.nodes[n]; ok {
+		return cached
 	}
-	return nil
+	f.nodes[n] = fn
+	return fn
+}
+
+// forgetNode drops the FUSE node of the tree node once the kernel forgot it, false is returned if the FUSE node was
+// already replaced
+func (f *FS) forgetNode(n fstree.Node, fn fs.Node) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.nodes[n] != fn {
+		return false
+	}
+	delete(f.nodes, n)
+	return true
 }
 
-func (d *Dir) IsDir() bool { return true }
+// fuseErr converts the `fstree` errors to their FUSE equivalent
+func fuseErr(err error) error {
+	switch err {
+	case fstree.ErrImmutable:
+		return fuse.EPERM
+	case fstree.ErrNotFound:
+		return fuse.ENOENT
+	case fstree.ErrExists:
+		return fuse.EEXIST
+	case fstree.ErrNoXattr:
+		return fuse.ErrNoXattr
+	case fstree.ErrLocked:
+		return fuse.Errno(syscall.EAGAIN)
+	case fstree.ErrNotEmpty:
+		return fuse.Errno(syscall.ENOTEMPTY)
+	case fstree.ErrNotDir:
+		return fuse.Errno(syscall.ENOTDIR)
+	case fstree.ErrIsDir:
+		return fuse.Errno(syscall.EISDIR)
+	case fstree.ErrInvalid:
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		return fuse.Errno(errno)
+	}
+	return err
+}
 
-func (d *Dir) Meta() *meta.Meta { return d.meta }
+// Dir implements both Node and Handle for the directories
+type Dir struct {
+	fs   *FS
+	node *fstree.Dir
+	log  log15.Logger
+}
 
-func (d *Dir) SetMeta(m *meta.Meta) {
-	d.meta = m
+func newDir(f *FS, node *fstree.Dir) *Dir {
+	f.tree.RLock()
+	m := node.Meta()
+	f.tree.RUnlock()
+	return &Dir{
+		fs:   f,
+		node: node,
+		log:  f.log.New("ref", m.Hash, "name", m.Name, "type", "dir"),
+	}
 }
 
 func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	d.log.Debug("OP Attr")
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
-	if d.parent == nil {
-		// Root should have Inode 2
+	if d.node.IsRoot() {
+		// Root should have Inode 2 (snapshot roots don't)
 		a.Inode = 2
 	} else {
 		a.Inode = 0
@@ -1646,36 +821,12 @@ func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
 	return nil
 }
 
-func makePublic(node Node, value string) error {
-	if value == "1" {
-		node.Meta().XAttrs["public"] = value
-	} else {
-		delete(node.Meta().XAttrs, "public")
-	}
-	// TODO(tsileo): too much mutations??
-	if node.IsDir() {
-		for _, child := range node.(*Dir).Children {
-			if err := makePublic(child, value); err != nil {
-				return err
-			}
-		}
-	}
-	if err := node.Save(); err != nil {
-		return err
-	}
-	return nil
-}
-
 func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
 	d.log.Debug("OP Setxattr", "name", req.Name, "xattr", string(req.Xattr))
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
-	// If the request is to make the dir public, make it recursively
-	if req.Name == "public" {
-		return makePublic(d, string(req.Xattr))
+	if d.node.Immutable() {
+		return fuse.EPERM
 	}
 
 	// Prevent writing attributes name that are virtual attributes
@@ -1683,19 +834,13 @@ func (d *Dir) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
 		return nil
 	}
 
-	if d.meta.XAttrs == nil {
-		d.meta.XAttrs = map[string]string{}
-	}
-
-	d.meta.XAttrs[req.Name] = string(req.Xattr)
-
-	if err := d.Save(); err != nil {
-		return err
+	if err := d.node.SetXattr(req.Name, req.Xattr); err != nil {
+		return fuseErr(err)
 	}
 
 	// // Trigger a sync so the file will be (un)available for BlobStash right now
 	if req.Name == "public" {
-		bfs.sync <- struct{}{}
+		d.fs.triggerSync()
 	}
 
 	return nil
@@ -1705,103 +850,62 @@ func (d *Dir) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) err
 	d.log.Debug("OP Removexattr", "name", req.Name)
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
+	if d.node.Immutable() {
+		return fuse.EPERM
+	}
 
 	// Can't delete virtual attributes
 	if _, exists := virtualXAttrs[req.Name]; exists {
 		return fuse.ErrNoXattr
 	}
 
-	if d.meta.XAttrs == nil {
-		return fuse.ErrNoXattr
+	if err := d.node.RemoveXattr(req.Name); err != nil {
+		return fuseErr(err)
 	}
 
-	if _, ok := d.meta.XAttrs[req.Name]; ok {
-		// Delete the attribute
-		delete(d.meta.XAttrs, req.Name)
-		if err := d.Save(); err != nil {
-			return err
-		}
-
-		// // Trigger a sync so the file won't be available via BlobStash
-		if req.Name == "public" {
-			bfs.sync <- struct{}{}
-		}
-
-		return nil
+	// // Trigger a sync so the file won't be available via BlobStash
+	if req.Name == "public" {
+		d.fs.triggerSync()
 	}
-	return fuse.ErrNoXattr
+
+	return nil
 }
 
 func (d *Dir) Forget() {
 	d.log.Debug("OP Forget")
-	// For now, this is a noop
+	d.fs.forgetNode(d.node, d)
 }
 
 func (d *Dir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
 	d.log.Debug("OP Listxattr")
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
+	d.fs.tree.RLock()
+	defer d.fs.tree.RUnlock()
 
-	return handleListxattr(d.meta, resp)
+	return handleListxattr(d.node.Meta(), resp)
 }
 
 func (d *Dir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
 	d.log.Debug("OP Getxattr", "name", req.Name)
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
+	d.fs.tree.RLock()
+	defer d.fs.tree.RUnlock()
 
-	return handleGetxattr(d.fs, d.meta, req, resp)
+	return handleGetxattr(d.fs, d.node.Meta(), req, resp)
 }
 
 func (d *Dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
 	d.log.Debug("OP Rename", "name", req.OldName, "new_name", req.NewName)
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
-	if d.Children == nil {
-		if err := d.reload(); err != nil {
-			return err
-		}
-	}
-
-	if node, ok := d.Children[req.OldName]; ok {
-		meta := node.Meta()
-		// FIXME(tsileo): Is the RenameMeta even needed? (it may be bad that it's saving the meta?)
-		if err := d.fs.uploader.RenameMeta(meta, req.NewName); err != nil {
-			return err
-		}
-		// Delete the source
-		delete(d.Children, req.OldName)
-
-		ndir := newDir.(*Dir)
-		if d != ndir {
-			ndir.Children[req.NewName] = node
-		} else {
-			d.Children[req.NewName] = node
-		}
-
-		if err := d.Save(); err != nil {
-			return err
-		}
-
-		// Also save the dest dir if it was different from the src dir
-		if d != ndir {
-			if err := ndir.Save(); err != nil {
-				return err
-			}
-		}
-		return nil
+	// The destination may be a virtual (read-only) directory
+	nd, ok := newDir.(*Dir)
+	if !ok {
+		return fuse.EPERM
 	}
-
-	return fuse.EIO
+	return fuseErr(d.node.Rename(req.OldName, nd.node, req.NewName))
 }
 
 func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
@@ -1810,19 +914,14 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 	resp.EntryValid = 5 * time.Second
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
 	// Magic file for returnign the socket path, available in every directory
 	if name == ".blobfs_socket" {
 		return newDebugFile([]byte(d.fs.socketPath)), nil
 	}
 
-	// normal lookup operation
-	if d.Children == nil {
-		if err := d.reload(); err != nil {
-			return nil, err
-		}
+	// Virtual directory for browsing the history, only available at the root
+	if name == snapshotsDirName && d.node.IsRoot() {
+		return d.fs.snapshotsDir, nil
 	}
 
 	var debug bool
@@ -1831,35 +930,38 @@ func (d *Dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.Lo
 		name = name[0 : len(name)-len(debugSuffix)]
 	}
 
-	if c, ok := d.Children[name]; ok {
-		// If we are in debug, output the Meta as JSON (hash + meta JSON encoded)
-		if debug {
-			hash, js := c.Meta().Json()
-			payload := []byte(hash)
-			payload = append(payload, js...)
-			return newDebugFile(payload), nil
-		}
-		return c, nil
+	// normal lookup operation
+	c, err := d.node.Lookup(name)
+	if err != nil {
+		return nil, fuseErr(err)
 	}
 
-	return nil, fuse.ENOENT
+	// If we are in debug, output the Meta as JSON (hash + meta JSON encoded)
+	if debug {
+		d.fs.tree.RLock()
+		hash, js := c.Meta().Json()
+		d.fs.tree.RUnlock()
+		payload := []byte(hash)
+		payload = append(payload, js...)
+		return newDebugFile(payload), nil
+	}
+	return d.fs.fuseNode(c), nil
 }
 
 func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	d.log.Debug("OP ReadDirAll")
 	d.fs.updateLastOP()
 
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
-	if d.Children == nil {
-		if err := d.reload(); err != nil {
-			return nil, err
-		}
+	children, err := d.node.ReadDir()
+	if err != nil {
+		return nil, err
 	}
 
+	d.fs.tree.RLock()
+	defer d.fs.tree.RUnlock()
+
 	dirs := []fuse.Dirent{}
-	for _, c := range d.Children {
+	for _, c := range children {
 		nodeType := fuse.DT_File
 		if c.IsDir() {
 			nodeType = fuse.DT_Dir
@@ -1878,299 +980,63 @@ func (d *Dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error
 	d.log.Debug("OP Mkdir", "name", req.Name)
 	d.fs.updateLastOP()
 
-	if d.fs.Immutable() {
-		return nil, fuse.EPERM
-	}
-
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
-	if d.Children == nil {
-		if err := d.reload(); err != nil {
-			return nil, err
-		}
-	}
-
-	// Ensure the directory does not already exist
-	if _, ok := d.Children[req.Name]; ok {
-		return nil, fuse.EEXIST
-	}
-
-	// XXX(tsileo): can permissions be set when creating a dir? if so handle it
-
-	// Actually create the dir
-	newdir := &Dir{
-		fs:       d.fs,
-		parent:   d,
-		Children: map[string]Node{},
-		// Put only the name in the Meta since when saving it will set oll the needed attrs
-		meta: &meta.Meta{
-			Name: req.Name,
-		},
-	}
-	newdir.log = d.fs.log.New("ref", "unknown", "name", req.Name, "type", "dir")
-
-	// Save it
-	if err := newdir.Save(); err != nil {
-		return nil, err
-	}
-
-	// Make this new the dir the children of its parent
-	d.Children[newdir.meta.Name] = newdir
-	if err := d.Save(); err != nil {
-		return nil, err
+	newdir, err := d.node.Mkdir(req.Name)
+	if err != nil {
+		return nil, fuseErr(err)
 	}
-	newdir.log = newdir.log.New("ref", newdir.meta.Hash)
-
-	stats.Lock()
-	stats.updated = true
-	stats.DirsCreated++
-	stats.Unlock()
-
-	return newdir, nil
+	return d.fs.fuseNode(newdir), nil
 }
 
 func (d *Dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
-	d.log.Debug("OP Remove", "name", req.Name)
+	d.log.Debug("OP Remove", "name", req.Name, "dir", req.Dir)
 	d.fs.updateLastOP()
 
-	if d.fs.Immutable() {
-		return fuse.EPERM
-	}
-
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
-	if d.Children == nil {
-		if err := d.reload(); err != nil {
-			return err
-		}
-	}
-
-	// FIXME(tsileo): what happens when trying to remove a file that does not exist?
-	delete(d.Children, req.Name)
-	if err := d.Save(); err != nil {
-		d.log.Error("Failed to saved", "err", err)
-		return err
-	}
-
-	return nil
-}
-
-// Save save all the node recursively bottom to top until the root node is reached
-// Assumes the caller has acquired the lock
-func (d *Dir) Save() error {
-	d.log.Debug("saving")
-
-	// Create a new Meta and populate it using the previous Meta data
-	m := meta.NewMeta()
-	m.Name = d.meta.Name
-	m.Type = "dir"
-	m.Mode = uint32(os.ModeDir | 0555)
-	if d.meta.ModTime != "" {
-		m.ModTime = d.meta.ModTime
-	} else {
-		m.ModTime = time.Now().Format(time.RFC3339)
-	}
-
-	for _, c := range d.Children {
-		switch node := c.(type) {
-		case *Dir:
-			m.AddRef(node.meta.Hash)
-		case *File:
-			m.AddRef(node.meta.Hash)
-		}
-	}
-
-	// Recompute the hash and update the node's meta ref
-	mhash, mjs := m.Json()
-	m.Hash = mhash
-	d.meta = m
-
-	mexists, err := d.fs.bs.Stat(mhash)
-	if err != nil {
-		d.log.Error("stat failed", "err", err)
-		return err
-	}
-
-	if !mexists {
-		if err := d.fs.bs.Put(mhash, mjs); err != nil {
-			d.log.Error("put failed", "err", err)
-			return err
-		}
-	}
-
-	if d.parent == nil {
-		// If no parent, this is the root so save the ref
-		root := root.New(mhash, 0)
-		js, err := json.Marshal(root)
-		if err != nil {
-			return err
-		}
-
-		// Save the mutation locally
-		kv, err := d.fs.lkv.Put(fmt.Sprintf(localRootKeyFmt, d.fs.Name()), "", js, -1)
-		if err != nil {
-			return err
-		}
-
-		root.Version = kv.Version
-		d.log.Debug("Creating a new VKV entry", "entry", kv)
-
-		// Update the local mount
-		d.fs.local = &Mount{
-			immutable: false,
-			root:      root,
-			node:      d,
-		}
-
-		d.log.Debug("Current root", "root", d.fs.root, "new", d)
-
-		// FIXME(tsileo): should the root be updated??
-		if d.fs.root != nil {
-			*d.fs.root = *d
-		}
-	} else {
-		// d.parent.mu.Lock()
-		// defer d.parent.mu.Unlock()
-		if err := d.parent.Save(); err != nil {
-			return err
-		}
+	// `req.Dir` is set for rmdir, unset for unlink
+	if req.Dir {
+		return fuseErr(d.node.Rmdir(req.Name))
 	}
-	return nil
+	return fuseErr(d.node.Remove(req.Name))
 }
 
 func (d *Dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
 	d.log.Debug("OP Create", "name", req.Name)
 	d.fs.updateLastOP()
 
-	if d.fs.Immutable() {
-		return nil, nil, fuse.EPERM
-	}
-
-	d.fs.mu.Lock()
-	defer d.fs.mu.Unlock()
-
-	if d.Children == nil {
-		if err := d.reload(); err != nil {
-			return nil, nil, err
-		}
-	}
-
-	m := meta.NewMeta()
-	m.Type = "file"
-	m.Name = req.Name
-	m.Mode = uint32(req.Mode)
-	m.ModTime = time.Now().Format(time.RFC3339)
-
-	// If the parent directory is public, the new file should to
-	if d.meta.IsPublic() {
-		m.XAttrs = map[string]string{"public": "1"}
-	}
-
-	// Save the meta
-	mhash, mjs := m.Json()
-	m.Hash = mhash
-	mexists, err := d.fs.bs.Stat(mhash)
-	if err != nil {
-		return nil, nil, err
-	}
-	if !mexists {
-		if err := d.fs.bs.Put(mhash, mjs); err != nil {
-			return nil, nil, err
-		}
-	}
-
-	// Create the file node and set it as the children of the parent
-	f, err := NewFile(d.fs, m, d)
+	node, err := d.node.Create(req.Name, req.Mode)
 	if err != nil {
-		return nil, nil, err
-	}
-	d.Children[m.Name] = f
-	if err := d.Save(); err != nil {
-		return nil, nil, err
+		return nil, nil, fuseErr(err)
 	}
-
-	// XXX(tsileo): track opened file descriptor globally in the FS?
-	f.state.openCount++
-	f.fs.openFds++
-	f.log.Debug("new openCount", "count", f.state.openCount, "global", f.fs.openFds)
-
-	stats.Lock()
-	stats.updated = true
-	stats.FilesCreated++
-	stats.Unlock()
-
+	f := d.fs.fuseNode(node).(*File)
 	return f, f, nil
 }
 
-type fileState struct {
-	updated   bool
-	openCount int
-}
-
+// File implements both Node and Handle for the files
 type File struct {
-	fs       *FS
-	data     []byte // FIXME(tsileo): if data grows too much, use a temp file
-	meta     *meta.Meta
-	FakeFile *filereader.File
-	log      log15.Logger
-	parent   *Dir
-	state    *fileState
+	fs   *FS
+	node *fstree.File
+	log  log15.Logger
 }
 
-func NewFile(fs *FS, m *meta.Meta, parent *Dir) (*File, error) {
+func newFile(f *FS, node *fstree.File) *File {
+	f.tree.RLock()
+	m := node.Meta()
+	f.tree.RUnlock()
 	return &File{
-		parent: parent,
-		fs:     fs,
-		meta:   m,
-		log:    fs.log.New("ref", m.Hash, "name", m.Name, "type", "file"),
-		state:  &fileState{},
-	}, nil
-}
-
-func (f *File) IsDir() bool { return false }
-
-func (f *File) Meta() *meta.Meta { return f.meta }
-
-func (f *File) SetMeta(m *meta.Meta) {
-	f.meta = m
+		fs:   f,
+		node: node,
+		log:  f.log.New("ref", m.Hash, "name", m.Name, "type", "file"),
+	}
 }
 
 func (f *File) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
 	f.log.Debug("OP Write", "offset", req.Offset, "size", len(req.Data))
 	f.fs.updateLastOP()
 
-	if f.fs.Immutable() {
-		return fuse.EPERM
-	}
-
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
-
-	// Set the updated flag
-	f.state.updated = true
-
-	newLen := req.Offset + int64(len(req.Data))
-	if newLen > int64(maxInt) {
-		return fuse.Errno(syscall.EFBIG)
-	}
-
-	n := copy(f.data[req.Offset:], req.Data)
-	if n < len(req.Data) {
-		f.data = append(f.data, req.Data[n:]...)
+	n, err := f.node.Write(req.Data, req.Offset)
+	if err != nil {
+		return fuseErr(err)
 	}
-
-	resp.Size = len(req.Data)
-	return nil
-}
-
-// XXX(tsileo): try to get rid of this
-type ClosingBuffer struct {
-	*bytes.Buffer
-}
-
-func (*ClosingBuffer) Close() error {
+	resp.Size = n
 	return nil
 }
 
@@ -2178,60 +1044,36 @@ func (f *File) Flush(ctx context.Context, req *fuse.FlushRequest) error {
 	f.log.Debug("OP Flush")
 	f.fs.updateLastOP()
 
-	// Flush is a noop for now
+	// Closing any file descriptor releases the POSIX locks of the process
+	f.node.ReleaseLocks(uint64(req.LockOwner), false)
 
-	return nil
+	return fuseErr(f.node.Flush())
 }
 
 func (f *File) Setxattr(ctx context.Context, req *fuse.SetxattrRequest) error {
 	f.log.Debug("OP Setxattr", "name", req.Name, "xattr", string(req.Xattr))
 	f.fs.updateLastOP()
 
-	if f.fs.Immutable() {
+	if f.node.Immutable() {
 		return nil
 	}
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
-
 	// Prevent writing attributes name that are virtual attributes
 	if _, exists := virtualXAttrs[req.Name]; exists {
 		return nil
 	}
 
-	if f.meta.XAttrs == nil {
-		f.meta.XAttrs = map[string]string{}
-	}
-	f.meta.XAttrs[req.Name] = string(req.Xattr)
-
-	// XXX(tsileo): check thath the parent get the updated hash?
-	if err := f.Save(); err != nil {
-		return err
+	if err := f.node.SetXattr(req.Name, req.Xattr); err != nil {
+		return fuseErr(err)
 	}
 
 	// Trigger a sync so the file will be (un)available for BlobStash right now
 	if req.Name == "public" {
-		bfs.sync <- struct{}{}
+		f.fs.triggerSync()
 	}
 	return nil
 }
 
-// Save will save every node recursively bottom to top until the root is reached.
-// Assumes the FS lock is acquired.
-func (f *File) Save() error {
-	if f.fs.Immutable() {
-		f.log.Warn("Trying to save an immutable node")
-		return nil
-	}
-
-	// Update the new `Meta`
-	f.log.Debug("OP Save (file)", "meta", f.meta)
-	// f.parent.fs.uploader.PutMeta(f.meta)
-
-	// And save the parent
-	return f.parent.Save()
-}
-
 func handleListxattr(m *meta.Meta, resp *fuse.ListxattrResponse) error {
 	// Add the "virtual" eXtended Attributes
 	for vattr, xattrFunc := range virtualXAttrs {
@@ -2259,15 +1101,18 @@ func (f *File) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *
 	f.log.Debug("OP Listxattr")
 	f.fs.updateLastOP()
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
+	f.fs.tree.RLock()
+	defer f.fs.tree.RUnlock()
 
-	return handleListxattr(f.meta, resp)
+	return handleListxattr(f.node.Meta(), resp)
 }
 
 func (f *File) Forget() {
 	f.log.Debug("OP Forget")
-	// Forget is a noop for now
+	// The kernel won't reference the node anymore, drop the remaining locks
+	if f.fs.forgetNode(f.node, f) {
+		f.node.ReleaseAllLocks()
+	}
 }
 
 func handleGetxattr(fs *FS, m *meta.Meta, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
@@ -2319,71 +1164,59 @@ func (f *File) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fu
 	f.log.Debug("OP Getxattr", "name", req.Name)
 	f.fs.updateLastOP()
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
+	f.fs.tree.RLock()
+	defer f.fs.tree.RUnlock()
 
-	return handleGetxattr(f.parent.fs, f.meta, req, resp)
+	return handleGetxattr(f.fs, f.node.Meta(), req, resp)
 }
 
 func (f *File) Removexattr(ctx context.Context, req *fuse.RemovexattrRequest) error {
 	f.log.Debug("OP Removexattr", "name", req.Name)
 	f.fs.updateLastOP()
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
+	if f.node.Immutable() {
+		return fuse.EPERM
+	}
 
 	// Can't delete virtual attributes
 	if _, exists := virtualXAttrs[req.Name]; exists {
 		return fuse.ErrNoXattr
 	}
 
-	if f.meta.XAttrs == nil {
-		return fuse.ErrNoXattr
+	if err := f.node.RemoveXattr(req.Name); err != nil {
+		return fuseErr(err)
 	}
 
-	if _, ok := f.meta.XAttrs[req.Name]; ok {
-		// Delete the attribute
-		delete(f.meta.XAttrs, req.Name)
-
-		// Save the meta
-		if err := f.Save(); err != nil {
-			return err
-		}
-		// Trigger a sync so the file won't be available via BlobStash
-		if req.Name == "public" {
-			bfs.sync <- struct{}{}
-		}
-
-		return nil
+	// Trigger a sync so the file won't be available via BlobStash
+	if req.Name == "public" {
+		f.fs.triggerSync()
 	}
 
-	return fuse.ErrNoXattr
-}
-
-func (f *File) Size() int {
-	if f.fs.Immutable() || f.data == nil {
-		return f.meta.Size
-	} else {
-		// If the file is open, check the buffer length
-		return len(f.data)
-	}
+	return nil
 }
 
 func (f *File) Attr(ctx context.Context, a *fuse.Attr) error {
 	f.log.Debug("OP Attr")
 	f.fs.updateLastOP()
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
+	// The size is read first, the file lock must not be acquired while holding the FS lock
+	size := f.node.Size()
+
+	f.fs.tree.RLock()
+	defer f.fs.tree.RUnlock()
 
+	m := f.node.Meta()
 	a.Inode = 0 // auto inode
-	a.Mode = os.FileMode(f.meta.Mode)
+	a.Mode = os.FileMode(m.Mode)
+	if f.node.Snapshot() {
+		a.Mode &^= 0222
+	}
 	a.Uid = f.fs.uid
 	a.Gid = f.fs.gid
-	a.Size = uint64(f.Size())
+	a.Size = uint64(size)
 
-	if f.meta.ModTime != "" {
-		t, err := time.Parse(time.RFC3339, f.meta.ModTime)
+	if m.ModTime != "" {
+		t, err := time.Parse(time.RFC3339, m.ModTime)
 		if err != nil {
 			panic(fmt.Errorf("error parsing mtime for %v: %v", f, err))
 		}
@@ -2399,13 +1232,10 @@ func (f *File) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse
 	f.log.Debug("OP Setattr")
 	f.fs.updateLastOP()
 
-	if f.fs.Immutable() {
+	if f.node.Immutable() {
 		return fuse.EPERM
 	}
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
-
 	// FIXME(tsileo): implement this
 	//if req.Valid&fuse.SetattrMode != 0 {
 	//if err := os.Chmod(n.path, req.Mode); err != nil {
@@ -2453,35 +1283,18 @@ func (f *File) Open(ctx context.Context, req *fuse.OpenRequest, res *fuse.OpenRe
 	f.log.Debug("OP Open")
 	f.fs.updateLastOP()
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
-
-	f.state.openCount++
-	f.fs.openFds++
-	f.log.Debug("open count", "count", f.state.openCount, "global", f.fs.openFds)
+	if err := f.node.Open(); err != nil {
+		return nil, fuseErr(err)
+	}
 
+	f.fs.mu.Lock()
 	f.fs.cache[req.Header.Node] = struct{}{}
 	f.log.Debug("current node cache", "cache", f.fs.cache)
+	f.fs.mu.Unlock()
 
 	// Bypass page cache
 	res.Flags |= fuse.OpenDirectIO
 
-	// If it's the first file descriptor for this file, load the file content into a buffer so it can be written
-	// FIXME(tsileo): instead of loading all the file in RAM, create a temporary file at $BLOBFS_WD/$PATH_IN_THE_FS
-	// this way, if there's a power outage/unexpected exception, the WIP won't be loose (like is it right now)
-	if f.state.openCount == 1 && len(f.meta.Refs) > 0 {
-		f.log.Debug("Loading the file in memory")
-		// if !f.fs.Immutable() && f.FakeFile == nil && f.data == nil {
-		// f.log.Debug("Creating FakeFile")
-		f.FakeFile = filereader.NewFile(f.fs.bs, f.meta)
-		var err error
-		f.data, err = ioutil.ReadAll(f.FakeFile)
-		if err != nil {
-			f.log.Error("failed to read", "err", err)
-			return nil, err
-		}
-	}
-
 	return f, nil
 }
 
@@ -2489,94 +1302,30 @@ func (f *File) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
 	f.log.Debug("OP Release")
 	f.fs.updateLastOP()
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
-
-	defer func() {
-		f.state.openCount--
-		f.fs.openFds--
-		f.log.Debug("new openCount", "count", f.state.openCount, "global", f.fs.openFds)
-		f.log.Debug("OP Release END")
-	}()
-
-	// If it's the last file descriptor for this file, then we need to save it
-	if f.state.openCount == 1 {
-		f.log.Debug("Last file descriptor for this node, cleaning up the FakeFile and data")
-		if !f.fs.Immutable() && f.data != nil && len(f.data) > 0 && f.state.updated {
-			f.meta.Size = len(f.data)
-			// XXX(tsileo): data will be saved once the tree will be synced
-			buf := bytes.NewBuffer(f.data)
-			m2, err := f.fs.uploader.PutReader(f.meta.Name, &ClosingBuffer{buf})
-			f.log.Debug("new meta", "meta", fmt.Sprintf("%+v", m2))
-			// f.log.Debug("WriteResult", "wr", wr)
-			if err != nil {
-				return err
-			}
-			// f.parent.mu.Lock()
-			// defer f.parent.mu.Unlock()
-			f.meta = m2
-			if err := f.parent.Save(); err != nil {
-				return err
-			}
-			// f.log.Debug("new meta2", "meta", f.parent.Children[m2.Name].Meta(), "meta2", f.fs.root.Children[m2.Name].Meta())
-
-			// f.log = f.log.New("ref", m2.Hash[:10])
-			f.log.Debug("Flushed", "data_len", len(f.data))
-			f.state.updated = false
-		}
-		// This is the last file descriptor, we can clean everything
-		if f.FakeFile != nil {
-			f.FakeFile.Close()
-			f.FakeFile = nil
-		}
-		f.data = nil
+	if req.ReleaseFlags&fuse.ReleaseFlockUnlock != 0 {
+		f.node.ReleaseLocks(uint64(req.LockOwner), true)
 	}
-	return nil
+
+	return fuseErr(f.node.Release())
 }
 
 func (f *File) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
 	f.log.Debug("OP Fsync")
 	f.fs.updateLastOP()
-	// XXX(tsileo): flush the file?
 
-	// This is a noop for now
-
-	return nil
+	return fuseErr(f.node.Fsync())
 }
 
 func (f *File) Read(ctx context.Context, req *fuse.ReadRequest, res *fuse.ReadResponse) error {
 	f.log.Debug("OP Read", "offset", req.Offset, "size", req.Size)
 	f.fs.updateLastOP()
 
-	f.fs.mu.Lock()
-	defer f.fs.mu.Unlock()
-
-	if f.data == nil && f.FakeFile == nil {
-		f.log.Debug("Aborting, neither data or FakeFile is init")
-		return nil
-	}
-
-	if req.Offset >= int64(f.Size()) {
-		f.log.Debug("Aborting, out of boundaries offset")
-		return nil
-	}
-
-	if f.fs.Immutable() {
-		f.log.Debug("Reading from FakeFile")
-		buf := make([]byte, req.Size)
-		n, err := f.FakeFile.ReadAt(buf, req.Offset)
-		if err == io.EOF {
-			err = nil
-		}
-		if err != nil {
-			return fuse.EIO
-		}
-		res.Data = buf[:n]
-		return nil
+	data, err := f.node.Read(req.Offset, req.Size)
+	if err != nil {
+		f.log.Error("failed to read", "err", err)
+		return fuse.EIO
 	}
-
-	f.log.Debug("Reading from memory")
-	fuseutil.HandleRead(req, res, f.data)
+	res.Data = data
 	f.log.Debug("Resp len", "len", len(res.Data))
 	return nil
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"gopkg.in/inconshreveable/log15.v2"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// Set in the environment of the detached process
+const daemonEnv = "BLOBFS_DAEMON"
+
+// daemonize re-executes the current process detached from the terminal, and returns true in the parent process
+// (which should exit). Nothing is done when running under systemd (`NOTIFY_SOCKET` is set), since systemd expects the
+// process to stay in the foreground and to notify its readiness.
+func daemonize() (bool, error) {
+	if os.Getenv(daemonEnv) == "1" || os.Getenv("NOTIFY_SOCKET") != "" {
+		return false, nil
+	}
+	devNull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0)
+	if err != nil {
+		return false, err
+	}
+	defer devNull.Close()
+
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdin = devNull
+	cmd.Stdout = devNull
+	cmd.Stderr = devNull
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return false, err
+	}
+	fmt.Printf("blobfs-mount started in the background (pid=%d)\n", cmd.Process.Pid)
+	return true, nil
+}
+
+// sdNotify sends the state to systemd (e.g. "READY=1"), it's a no-op when not running under systemd
+func sdNotify(state string) error {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return nil
+	}
+	// Abstract namespace socket
+	if strings.HasPrefix(addr, "@") {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// writePidfile writes the current pid to `path`, it fails if the pidfile belongs to another running process
+func writePidfile(path string) error {
+	if data, err := ioutil.ReadFile(path); err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err == nil && pid != os.Getpid() {
+			if err := syscall.Kill(pid, 0); err == nil || err == syscall.EPERM {
+				return fmt.Errorf("pidfile %s belongs to a running process (pid=%d)", path, pid)
+			}
+		}
+	}
+	return ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// logHandler returns a handler writing to stdout, or to the given file (rotated once it reaches 10MB)
+func logHandler(lvl log15.Lvl, logfile string) log15.Handler {
+	if logfile == "" {
+		return log15.LvlFilterHandler(lvl, log15.StreamHandler(os.Stdout, log15.TerminalFormat()))
+	}
+	var w io.Writer = &lumberjack.Logger{
+		Filename:   logfile,
+		MaxSize:    10, // MB
+		MaxBackups: 5,
+		Compress:   true,
+	}
+	return log15.LvlFilterHandler(lvl, log15.StreamHandler(w, log15.LogfmtFormat()))
+}
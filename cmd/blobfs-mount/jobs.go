@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsileo/blobfs/pkg/fstree"
+	"golang.org/x/net/context"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+// Maximum number of finished jobs kept around for `GET /jobs/<id>`
+const maxFinishedJobs = 20
+
+var (
+	ErrJobRunning    = errors.New("a push or a pull is already running")
+	ErrJobNotFound   = errors.New("job not found")
+	ErrNotCancelable = errors.New("job can't be canceled")
+	ErrJobDone       = errors.New("job is already done")
+	ErrJobPanicked   = errors.New("internal error (the job panicked, see the logs)")
+)
+
+const (
+	JobRunning  = "running"
+	JobDone     = "done"
+	JobFailed   = "failed"
+	JobCanceled = "canceled"
+)
+
+// Job is a push or a pull running in the background
+type Job struct {
+	ID      string
+	Type    string
+	Status  string
+	Err     error
+	Started time.Time
+	Ended   time.Time
+	Stats   *fstree.SyncStats
+
+	cancel func()
+}
+
+// JobResp is the JSON representation of a `Job`
+type JobResp struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Status        string    `json:"status"`
+	Error         *APIError `json:"error,omitempty"`
+	Started       string    `json:"started"`
+	Ended         string    `json:"ended,omitempty"`
+	BlobsTotal    int       `json:"blobs_total"`
+	BlobsStated   int       `json:"blobs_stated"`
+	BlobsUploaded int       `json:"blobs_uploaded"`
+	BlobsSkipped  int       `json:"blobs_skipped"`
+	BytesUploaded int       `json:"bytes_uploaded"`
+	BytesSkipped  int       `json:"bytes_skipped"`
+	DedupRatio    float64   `json:"dedup_ratio"` // Ratio of the bytes that did not need to be uploaded
+	ETA           float64   `json:"eta"`         // Estimated remaining time in seconds, -1 if unknown
+}
+
+// Jobs keeps track of the running and the recently finished jobs, only one job can run at a time
+type Jobs struct {
+	jobs    map[string]*Job
+	order   []string
+	running *Job
+	queued  *queuedJob      // Started once the running job is done
+	wg      *sync.WaitGroup // Tracks the running job
+	log     log15.Logger
+	mu      sync.Mutex
+}
+
+type queuedJob struct {
+	typ        string
+	cancelable bool
+	run        func(ctx context.Context, stats *fstree.SyncStats) error
+}
+
+func NewJobs(logger log15.Logger, wg *sync.WaitGroup) *Jobs {
+	return &Jobs{jobs: map[string]*Job{}, wg: wg, log: logger}
+}
+
+func newJobID() string {
+	b := make([]byte, 6)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Start runs `run` in a new goroutine, `ErrJobRunning` is returned if a job is already running
+func (j *Jobs) Start(typ string, cancelable bool, run func(ctx context.Context, stats *fstree.SyncStats) error) (*Job, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.running != nil {
+		return nil, ErrJobRunning
+	}
+	return j.start(typ, cancelable, run), nil
+}
+
+// Queue is like `Start` but if a job is already running, the job is started once it's done (only the last queued job
+// is kept)
+func (j *Jobs) Queue(typ string, cancelable bool, run func(ctx context.Context, stats *fstree.SyncStats) error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.running != nil {
+		j.queued = &queuedJob{typ, cancelable, run}
+		return
+	}
+	j.start(typ, cancelable, run)
+}
+
+// start runs the job, the lock must be held and no job must be running
+func (j *Jobs) start(typ string, cancelable bool, run func(ctx context.Context, stats *fstree.SyncStats) error) *Job {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{
+		ID:      newJobID(),
+		Type:    typ,
+		Status:  JobRunning,
+		Started: time.Now(),
+		Stats:   &fstree.SyncStats{},
+	}
+	if cancelable {
+		job.cancel = cancel
+	}
+	j.jobs[job.ID] = job
+	j.order = append(j.order, job.ID)
+	j.running = job
+
+	j.wg.Add(1)
+	go func() {
+		defer j.wg.Done()
+		defer cancel()
+		var err error
+		defer func() {
+			// A panic would kill the whole process (and every FS it serves)
+			if r := recover(); r != nil {
+				j.log.Error("job panicked", "type", job.Type, "id", job.ID, "panic", r, "stack", string(debug.Stack()))
+				err = ErrJobPanicked
+			}
+			j.finish(job, err)
+		}()
+		err = run(ctx, job.Stats)
+	}()
+	return job
+}
+
+func (j *Jobs) finish(job *Job, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job.Ended = time.Now()
+	switch err {
+	case nil:
+		job.Status = JobDone
+	case context.Canceled:
+		job.Status = JobCanceled
+	default:
+		job.Status = JobFailed
+		job.Err = err
+	}
+	j.running = nil
+	if q := j.queued; q != nil {
+		j.queued = nil
+		j.start(q.typ, q.cancelable, q.run)
+	}
+
+	// Forget about the oldest finished jobs
+	for len(j.order) > maxFinishedJobs {
+		delete(j.jobs, j.order[0])
+		j.order = j.order[1:]
+	}
+}
+
+// Get returns the job with the given ID, `ErrJobNotFound` is returned if it does not exist (or was forgotten)
+func (j *Jobs) Get(id string) (*JobResp, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return nil, ErrJobNotFound
+	}
+	return job.resp(), nil
+}
+
+// Cancel cancels the running job with the given ID
+func (j *Jobs) Cancel(id string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return ErrJobNotFound
+	}
+	if job.cancel == nil {
+		return ErrNotCancelable
+	}
+	if job.Status != JobRunning {
+		return ErrJobDone
+	}
+	job.cancel()
+	return nil
+}
+
+// resp returns the JSON representation of the job, must be called with the lock held
+func (job *Job) resp() *JobResp {
+	job.Stats.Lock()
+	defer job.Stats.Unlock()
+
+	resp := &JobResp{
+		ID:            job.ID,
+		Type:          job.Type,
+		Status:        job.Status,
+		Started:       job.Started.Format(time.RFC3339),
+		BlobsTotal:    job.Stats.BlobsTotal,
+		BlobsStated:   job.Stats.BlobsStated,
+		BlobsUploaded: job.Stats.BlobsUploaded,
+		BlobsSkipped:  job.Stats.BlobsSkipped,
+		BytesUploaded: job.Stats.BytesUploaded,
+		BytesSkipped:  job.Stats.BytesSkipped,
+		DedupRatio:    job.Stats.DedupRatio(),
+		ETA:           -1,
+	}
+	if job.Err != nil {
+		_, resp.Error = apiErr(job.Err)
+	}
+	if !job.Ended.IsZero() {
+		resp.Ended = job.Ended.Format(time.RFC3339)
+		resp.ETA = 0
+	} else if job.Stats.BlobsStated > 0 {
+		// Estimate the remaining time using the average time spent per blob so far
+		elapsed := time.Since(job.Started).Seconds()
+		remaining := job.Stats.BlobsTotal - job.Stats.BlobsStated
+		resp.ETA = elapsed / float64(job.Stats.BlobsStated) * float64(remaining)
+	}
+	return resp
+}
+
+// startJob starts the job and replies with a 202 and the job ID
+func (api *API) startJob(w http.ResponseWriter, typ string, cancelable bool, run func(ctx context.Context, stats *fstree.SyncStats) error) {
+	job, err := api.fs.jobs.Start(typ, cancelable, run)
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	js, err := json.Marshal(map[string]string{"id": job.ID})
+	if err != nil {
+		api.WriteError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/jobs/"+job.ID)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(js)
+}
+
+// jobHandler returns the job progress on GET, and cancels the job on DELETE
+func (api *API) jobHandler(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/jobs/")
+	switch r.Method {
+	case "GET":
+		job, err := api.fs.jobs.Get(id)
+		if err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		WriteJSON(w, job)
+	case "DELETE":
+		if err := api.fs.jobs.Cancel(id); err != nil {
+			api.WriteError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "GET or DELETE")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"github.com/tsileo/blobfs/pkg/fstree"
+)
+
+// TTL of the advisory cross-host lock leases (renewed every half TTL while the file is locked)
+const lockLeaseTTL = 10 * time.Minute
+
+// The locks are tracked by the fstree node, the kernel sends the lock requests because the FS is mounted with
+// `fuse.LockingFlock()` and `fuse.LockingPOSIX()`
+var _ fs.HandleFlockLocker = (*File)(nil)
+var _ fs.HandlePOSIXLocker = (*File)(nil)
+
+func newLock(owner fuse.LockOwner, lk fuse.FileLock, flags fuse.LockFlags) *fstree.Lock {
+	l := &fstree.Lock{
+		Owner: uint64(owner),
+		PID:   lk.PID,
+		Type:  fstree.ReadLock,
+		Start: lk.Start,
+		End:   lk.End,
+		Flock: flags&fuse.LockFlock != 0,
+	}
+	if lk.Type == fuse.LockWrite {
+		l.Type = fstree.WriteLock
+	}
+	if l.Flock {
+		// flock locks the whole file
+		l.Start, l.End = 0, fstree.LockEOF
+	}
+	return l
+}
+
+func (f *File) Lock(ctx context.Context, req *fuse.LockRequest) error {
+	f.log.Debug("OP Lock", "owner", req.LockOwner, "lock", req.Lock, "flags", req.LockFlags)
+	f.fs.updateLastOP()
+
+	l := newLock(req.LockOwner, req.Lock, req.LockFlags)
+	if req.Lock.Type == fuse.LockUnlock {
+		f.node.Unlock(l)
+		return nil
+	}
+	return fuseErr(f.node.Lock(l))
+}
+
+func (f *File) LockWait(ctx context.Context, req *fuse.LockWaitRequest) error {
+	f.log.Debug("OP LockWait", "owner", req.LockOwner, "lock", req.Lock, "flags", req.LockFlags)
+	f.fs.updateLastOP()
+
+	l := newLock(req.LockOwner, req.Lock, req.LockFlags)
+	if req.Lock.Type == fuse.LockUnlock {
+		f.node.Unlock(l)
+		return nil
+	}
+	switch err := f.node.LockWait(ctx, l); err {
+	case nil:
+		return nil
+	case context.Canceled, context.DeadlineExceeded:
+		// The process got interrupted while waiting
+		return fuse.Errno(syscall.EINTR)
+	default:
+		return fuseErr(err)
+	}
+}
+
+func (f *File) Unlock(ctx context.Context, req *fuse.UnlockRequest) error {
+	f.log.Debug("OP Unlock", "owner", req.LockOwner, "lock", req.Lock, "flags", req.LockFlags)
+	f.fs.updateLastOP()
+
+	f.node.Unlock(newLock(req.LockOwner, req.Lock, req.LockFlags))
+	return nil
+}
+
+func (f *File) QueryLock(ctx context.Context, req *fuse.QueryLockRequest, resp *fuse.QueryLockResponse) error {
+	f.log.Debug("OP QueryLock", "owner", req.LockOwner, "lock", req.Lock, "flags", req.LockFlags)
+	f.fs.updateLastOP()
+
+	conflict := f.node.QueryLock(newLock(req.LockOwner, req.Lock, req.LockFlags))
+	if conflict == nil {
+		resp.Lock = fuse.FileLock{Type: fuse.LockUnlock}
+		return nil
+	}
+	resp.Lock = fuse.FileLock{
+		Start: conflict.Start,
+		End:   conflict.End,
+		Type:  fuse.LockRead,
+		PID:   conflict.PID,
+	}
+	if conflict.Type == fstree.WriteLock {
+		resp.Lock.Type = fuse.LockWrite
+	}
+	return nil
+}
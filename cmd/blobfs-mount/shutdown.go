@@ -0,0 +1,100 @@
+package main
+
+import (
+	"time"
+)
+
+// shutdown cleanly stops the FS: it waits for the open files to be closed (up to `timeout`, or until `stop` is
+// closed), saves the in-memory content of the files still open, optionally pushes, and finally unmounts the FS. What
+// is still local-only is logged before unmounting. A failed flush doesn't prevent the unmount, its error is returned
+// at the end.
+func (f *FS) shutdown(timeout time.Duration, push bool, stop <-chan struct{}) error {
+	log := f.log
+	log.Info("Shutting down...")
+
+	// Wait for the open files to be closed
+	deadline := time.After(timeout)
+	t := time.NewTicker(200 * time.Millisecond)
+	defer t.Stop()
+	var logged bool
+L:
+	for {
+		open := f.tree.OpenFiles()
+		if open == 0 {
+			break
+		}
+		if !logged {
+			log.Warn("Waiting for the open files to be closed (send the signal again to stop waiting)", "count", open, "timeout", timeout)
+			logged = true
+		}
+		select {
+		case <-t.C:
+		case <-stop:
+			log.Warn("Not waiting for the open files anymore", "count", open)
+			break L
+		case <-deadline:
+			log.Warn("Timeout while waiting for the open files to be closed", "count", open)
+			break L
+		}
+	}
+
+	// Save the buffered writes of the files still open
+	flushed, ferr := f.tree.FlushAll()
+	if ferr != nil {
+		log.Error("Failed to flush the open files", "err", ferr)
+	}
+	if flushed > 0 {
+		log.Info("Flushed open files", "count", flushed)
+	}
+
+	// Let the running push/pull finish
+	f.tree.Wait()
+
+	if push {
+		log.Info("Pushing before exiting")
+		if err := f.tree.Push(nil); err != nil {
+			log.Error("Final push failed", "err", err)
+		}
+	}
+
+	f.logLocalSummary()
+
+	log.Info("Unmounting...")
+	if err := unmount(f.mountpoint); err != nil {
+		log.Crit("failed to unmount", "err", err)
+		return err
+	}
+	f.wg.Wait()
+	if err := f.lkv.Close(); err != nil {
+		log.Error("failed to close the local kvstore", "err", err)
+	}
+	if err := f.reg.Unregister(f.name); err != nil {
+		log.Error("failed to unregister the mount", "err", err)
+	}
+	return ferr
+}
+
+// logLocalSummary logs the changes that haven't been pushed, and the ignored nodes
+func (f *FS) logLocalSummary() {
+	log := f.log
+	summary, err := f.tree.LocalSummary()
+	if err != nil {
+		log.Error("Failed to build the local-only summary", "err", err)
+		return
+	}
+	if len(summary.Changes) == 0 {
+		log.Info("Everything has been pushed")
+	} else {
+		log.Warn("Local changes not pushed yet", "count", len(summary.Changes))
+		for _, c := range summary.Changes {
+			if c.OldPath != "" {
+				log.Warn("Not pushed", "op", c.Op, "path", c.Path, "old_path", c.OldPath)
+			} else {
+				log.Warn("Not pushed", "op", c.Op, "path", c.Path)
+			}
+		}
+	}
+	if len(summary.Ignored) > 0 {
+		log.Info("Ignored nodes (local only)", "paths", summary.Ignored)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"sync"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"github.com/tsileo/blobfs/pkg/fstree"
+	"golang.org/x/net/context"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const snapshotsDirName = ".snapshots"
+
+// snapshotsDir is the virtual read-only `.snapshots` directory available at the root of the FS,
+// every retained version of the FS is exposed as an immutable sub-directory.
+type snapshotsDir struct {
+	fs   *FS
+	dirs map[string]*Dir // Snapshots already loaded
+	log  log15.Logger
+	mu   sync.Mutex
+}
+
+func newSnapshotsDir(f *FS) *snapshotsDir {
+	return &snapshotsDir{
+		fs:   f,
+		dirs: map[string]*Dir{},
+		log:  f.log.New("name", snapshotsDirName, "type", "snapshots"),
+	}
+}
+
+func (sd *snapshotsDir) Attr(ctx context.Context, a *fuse.Attr) error {
+	sd.log.Debug("OP Attr")
+	a.Inode = 0
+	a.Mode = os.ModeDir | 0555
+	a.Uid = sd.fs.uid
+	a.Gid = sd.fs.gid
+	return nil
+}
+
+func (sd *snapshotsDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	sd.log.Debug("OP ReadDirAll")
+	sd.fs.updateLastOP()
+
+	snapshots, err := sd.fs.tree.Snapshots()
+	if err != nil {
+		sd.log.Error("failed to list snapshots", "err", err)
+		return nil, err
+	}
+	dirs := []fuse.Dirent{}
+	for _, s := range snapshots {
+		dirs = append(dirs, fuse.Dirent{
+			Inode: 0,
+			Name:  s.Name,
+			Type:  fuse.DT_Dir,
+		})
+	}
+	return dirs, nil
+}
+
+func (sd *snapshotsDir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	sd.log.Debug("OP Lookup", "name", req.Name)
+	sd.fs.updateLastOP()
+
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	if dir, ok := sd.dirs[req.Name]; ok {
+		return dir, nil
+	}
+
+	node, err := sd.fs.tree.SnapshotDir(req.Name)
+	if err != nil {
+		if err != fstree.ErrNotFound {
+			sd.log.Error("failed to load snapshot", "err", err)
+		}
+		return nil, fuseErr(err)
+	}
+	dir := sd.fs.fuseNode(node).(*Dir)
+	sd.dirs[req.Name] = dir
+	return dir, nil
+}
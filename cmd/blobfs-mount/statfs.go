@@ -0,0 +1,101 @@
+package main
+
+import (
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+
+	"github.com/tsileo/blobfs/pkg/pathutil"
+)
+
+var _ fs.FSStatfser = (*FS)(nil)
+
+// Block size reported to statfs
+const statfsBlockSize = 4096
+
+// How long the usage is cached (the tree and the local blobstore track their usage incrementally, it only saves the
+// statfs syscall on the var dir)
+const usageTTL = 10 * time.Second
+
+// DiskUsage is the space used and available on the FS
+type DiskUsage struct {
+	TreeSize    int64 `json:"tree_size"`    // Total size of the files in the current tree
+	Nodes       int   `json:"nodes"`        // Number of files and directories in the current tree
+	CacheSize   int64 `json:"cache_size"`   // Disk usage of the local cache
+	CacheCap    int64 `json:"cache_cap"`    // Configured max size of the local cache (0 if unlimited)
+	RemoteQuota int64 `json:"remote_quota"` // Configured quota of the remote BlobStash (0 if unlimited)
+	Free        int64 `json:"free"`         // Space available for new data
+}
+
+// Usage returns the current usage of the FS, cached for `usageTTL`
+func (f *FS) Usage() (*DiskUsage, error) {
+	f.usageMu.Lock()
+	defer f.usageMu.Unlock()
+	if f.usage != nil && time.Since(f.usageAt) < usageTTL {
+		return f.usage, nil
+	}
+
+	treeSize, nodes, err := f.tree.Usage()
+	if err != nil {
+		return nil, err
+	}
+	cacheSize, err := f.bs.LocalSize()
+	if err != nil {
+		return nil, err
+	}
+	u := &DiskUsage{
+		TreeSize:    treeSize,
+		Nodes:       nodes,
+		CacheSize:   cacheSize,
+		CacheCap:    f.cacheCap,
+		RemoteQuota: f.remoteQuota,
+	}
+
+	// The new data is written to the local cache first, so it's bounded by the disk hosting the var dir
+	st := &syscall.Statfs_t{}
+	if err := syscall.Statfs(pathutil.VarDir(), st); err != nil {
+		return nil, err
+	}
+	u.Free = int64(st.Bavail) * int64(st.Bsize)
+	if u.CacheCap > 0 && u.CacheCap-u.CacheSize < u.Free {
+		u.Free = u.CacheCap - u.CacheSize
+	}
+	// And then uploaded to BlobStash (the tree size is an estimate of the remote usage, the blobs are deduplicated but
+	// the older versions are kept too)
+	if u.RemoteQuota > 0 && u.RemoteQuota-u.TreeSize < u.Free {
+		u.Free = u.RemoteQuota - u.TreeSize
+	}
+	if u.Free < 0 {
+		u.Free = 0
+	}
+
+	f.usage = u
+	f.usageAt = time.Now()
+	return u, nil
+}
+
+// Statfs reports the size of the current tree as the used space, and the space left in the local cache (and the
+// remote quota) as the free space
+func (f *FS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	u, err := f.Usage()
+	if err != nil {
+		f.log.Error("failed to compute the usage", "err", err)
+		return fuseErr(err)
+	}
+	f.log.Debug("OP Statfs", "tree_size", u.TreeSize, "cache_size", u.CacheSize, "free", u.Free)
+
+	free := uint64(u.Free) / statfsBlockSize
+	resp.Bsize = statfsBlockSize
+	resp.Frsize = statfsBlockSize
+	resp.Blocks = (uint64(u.TreeSize)+statfsBlockSize-1)/statfsBlockSize + free
+	resp.Bfree = free
+	resp.Bavail = free
+	// There's no inode limit, a new file needs at least a block
+	resp.Ffree = free
+	resp.Files = uint64(u.Nodes) + free
+	resp.Namelen = 255
+	return nil
+}
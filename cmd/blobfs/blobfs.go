@@ -8,12 +8,20 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
 	"text/tabwriter"
 	"time"
 
 	"github.com/AlekSi/xattr"
 	"github.com/fatih/color"
+	"github.com/tsileo/blobfs/pkg/config"
+	"github.com/tsileo/blobfs/pkg/registry"
 	"github.com/tv42/httpunix"
 )
 
@@ -26,6 +34,7 @@ var (
 	yellow     = color.New(color.FgYellow).SprintFunc()
 	yellowBold = color.New(color.FgYellow, color.Bold).SprintFunc()
 	bold       = color.New(color.Bold).SprintFunc()
+	red        = color.New(color.FgRed, color.Bold).SprintFunc()
 )
 
 type CommitLog struct {
@@ -41,6 +50,17 @@ var Usage = func() {
 	flag.PrintDefaults()
 }
 
+// unixClient returns a client for the API of the mount listening on `socket`, `timeout` applies to the whole request
+func unixClient(socket string, timeout time.Duration) http.Client {
+	transport := &httpunix.Transport{
+		DialTimeout:           100 * time.Millisecond,
+		RequestTimeout:        timeout,
+		ResponseHeaderTimeout: timeout,
+	}
+	transport.RegisterLocation("blobfs", socket)
+	return http.Client{Transport: transport}
+}
+
 func isPublic(path string) (bool, error) {
 	res, err := xattr.Get(path, "public")
 	if err != nil {
@@ -58,6 +78,12 @@ func isPublic(path string) (bool, error) {
 func main() {
 	commentPtr := flag.String("comment", "", "optional commit comment")
 	publicPtr := flag.Bool("public", false, "share the node publicly (default to semi-private)")
+	unifiedPtr := flag.Bool("u", false, "display a unified diff for text files (diff command)")
+	toPtr := flag.String("to", "", "ref to restore (undo command), default to the previous version")
+	fsPtr := flag.String("fs", "", "name of the FS to use, default to the mount containing the current directory")
+	configPtr := flag.String("config", "", "config file, default to $BLOBFS_CONFIG or ~/.config/blobfs/config.yaml")
+	waitPtr := flag.Bool("wait", false, "wait for the push/pull to finish and display its progress, Ctrl+C cancels the push")
+	timeoutPtr := flag.Duration("timeout", 10*time.Minute, "timeout of the commands walking the tree or fetching remote data (status, diff, history, undo...)")
 	// shareTTLPtr := flag.String("share-ttl", "1h", "TTL for the semi-private sharing linl (default to 1h)")
 
 	flag.Usage = Usage
@@ -68,22 +94,35 @@ func main() {
 		os.Exit(2)
 	}
 	cmd := flag.Arg(0)
-	rsocket, err := ioutil.ReadFile(".blobfs_socket")
-	// TODO(tsileo): do the same for bash
-
-	transport := &httpunix.Transport{
-		DialTimeout:           100 * time.Millisecond,
-		RequestTimeout:        1 * time.Second,
-		ResponseHeaderTimeout: 1 * time.Second,
+	if cmd == "mounts" {
+		if err := Mounts(); err != nil {
+			fatal(err)
+		}
+		return
 	}
-	transport.RegisterLocation("blobfs", string(rsocket))
-
-	var client = http.Client{
-		Transport: transport,
+	if cmd == "config" {
+		if flag.NArg() < 2 || flag.NArg() > 3 || flag.Arg(1) != "show" {
+			fmt.Fprintf(os.Stderr, "usage: %s [-config PATH] config show [NAME]\n", os.Args[0])
+			os.Exit(2)
+		}
+		name := *fsPtr
+		if flag.NArg() == 3 {
+			name = flag.Arg(2)
+		}
+		if err := ConfigShow(*configPtr, name); err != nil {
+			fatal(err)
+		}
+		return
 	}
+	rsocket, err := socketPath(*fsPtr)
+
+	// The short timeout is used for the control calls, the calls walking the tree or fetching remote data (which are
+	// handled synchronously by the mount) use the longer one
+	client := unixClient(rsocket, 1*time.Second)
+	slowClient := unixClient(rsocket, *timeoutPtr)
 	u := "http+unix://blobfs"
 	if cmd == "__ps1_bash" {
-		if os.IsNotExist(err) {
+		if err != nil {
 			fmt.Printf("")
 			return
 		}
@@ -106,7 +145,7 @@ func main() {
 		return
 	}
 	if cmd == "__ps1_zsh" {
-		if os.IsNotExist(err) {
+		if err != nil {
 			fmt.Printf("")
 			return
 		}
@@ -130,29 +169,135 @@ func main() {
 		return
 	}
 	if err != nil {
-		// panic(err)
+		fatal(err)
 	}
 	url := string(u)
 	switch cmd {
 	case "checkout":
-		if err := Checkout(client, url, flag.Arg(1)); err != nil {
-			panic(err)
+		if err := Checkout(slowClient, url, flag.Arg(1)); err != nil {
+			fatal(err)
 		}
-	case "history", "log":
-		if err := Log(client, url); err != nil {
-			panic(err)
+	case "status":
+		dirty, err := Status(slowClient, url)
+		if err != nil {
+			fatal(err)
+		}
+		// Exit with 1 if there is something to push, so scripts can rely on it
+		if dirty {
+			os.Exit(1)
+		}
+	case "diff":
+		// Usage: blobfs diff [REF_A] [REF_B] [PATH], or blobfs diff [REF_A] [REF_B] -- PATH to only diff a path
+		args := flag.Args()[1:]
+		var paths []string
+		for i, arg := range args {
+			if arg == "--" {
+				args, paths = args[:i], args[i+1:]
+				break
+			}
+		}
+		if paths == nil && len(args) == 3 {
+			args, paths = args[:2], args[2:]
+		}
+		if len(args) > 2 || len(paths) > 1 {
+			fmt.Printf("usage: %s [-u] diff [REF_A] [REF_B] [[--] PATH]\n", os.Args[0])
+			os.Exit(2)
+		}
+		var path string
+		if len(paths) == 1 {
+			path = absPath(paths[0])
+		}
+		var refA, refB string
+		if len(args) > 0 {
+			refA = args[0]
+		}
+		if len(args) > 1 {
+			refB = args[1]
+		}
+		// The unified diffs fetch the content of both versions
+		if err := Diff(slowClient, url, refA, refB, path, *unifiedPtr); err != nil {
+			fatal(err)
+		}
+	case "history":
+		switch flag.NArg() {
+		case 1:
+			// Without a path, the history of the root is listed
+			if err := History(slowClient, url, ""); err != nil {
+				fatal(err)
+			}
+		case 2:
+			if err := History(slowClient, url, absPath(flag.Arg(1))); err != nil {
+				fatal(err)
+			}
+		default:
+			fmt.Printf("usage: %s history [PATH]\n", os.Args[0])
+			os.Exit(2)
+		}
+	case "undo":
+		if flag.NArg() < 2 {
+			fmt.Printf("usage: %s undo PATH [-to REF]\n", os.Args[0])
+			os.Exit(2)
+		}
+		path := flag.Arg(1)
+		// Also accept the flags after the path (e.g. `blobfs undo file.txt -to REF`)
+		flag.CommandLine.Parse(flag.Args()[2:])
+		if flag.NArg() != 0 {
+			fmt.Printf("usage: %s undo PATH [-to REF]\n", os.Args[0])
+			os.Exit(2)
+		}
+		if err := Undo(slowClient, url, absPath(path), *toPtr); err != nil {
+			fatal(err)
+		}
+	case "log":
+		if err := Log(slowClient, url); err != nil {
+			fatal(err)
 		}
 	case "sync", "push":
-		if err := Sync(client, url, *commentPtr); err != nil {
-			panic(err)
+		// Also accept the flags after the command (e.g. `blobfs push -wait`)
+		flag.CommandLine.Parse(flag.Args()[1:])
+		id, err := Sync(client, url, *commentPtr)
+		if err != nil {
+			fatal(err)
+		}
+		if !*waitPtr {
+			fmt.Printf("push started (job %s), run `blobfs job %s` to follow it\n", id, id)
+			return
+		}
+		if err := WaitJob(slowClient, url, id); err != nil {
+			fatal(err)
 		}
 	case "fetch", "pull":
-		if err := Pull(client, url); err != nil {
-			panic(err)
+		flag.CommandLine.Parse(flag.Args()[1:])
+		id, err := Pull(client, url)
+		if err != nil {
+			fatal(err)
+		}
+		if !*waitPtr {
+			fmt.Printf("pull started (job %s), run `blobfs job %s` to follow it\n", id, id)
+			return
+		}
+		if err := WaitJob(slowClient, url, id); err != nil {
+			fatal(err)
+		}
+	case "job":
+		if flag.NArg() != 2 {
+			fmt.Printf("usage: %s job ID\n", os.Args[0])
+			os.Exit(2)
+		}
+		jr, err := Job(slowClient, url, flag.Arg(1))
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("%s %s: %s\n", jr.Type, jr.ID, yellow(jr.Status))
+		if jr.Type == "push" {
+			fmt.Printf("%s\n", progressBar(jr))
+		}
+		if jr.Error != nil {
+			fatal(jr.Error)
 		}
 	case "debug":
 		if err := Debug(client, url); err != nil {
-			panic(err)
+			fatal(err)
 		}
 	case "share":
 		path := "."
@@ -161,7 +306,7 @@ func main() {
 		}
 		public, err := isPublic(path)
 		if err != nil {
-			panic(err)
+			fatal(err)
 		}
 		fmt.Printf("public:%s\n", public)
 
@@ -171,16 +316,16 @@ func main() {
 			if public {
 				burl, err := xattr.Get(path, "url")
 				if err != nil {
-					panic(err)
+					fatal(err)
 				}
 				fmt.Printf("%s\n", burl)
 			} else {
 				if err := xattr.Set(path, "public", []byte("1")); err != nil {
-					panic(err)
+					fatal(err)
 				}
 				burl, err := xattr.Get(path, "url")
 				if err != nil {
-					panic(err)
+					fatal(err)
 				}
 				fmt.Printf("%s\n", burl)
 			}
@@ -195,7 +340,7 @@ func main() {
 		// Share in semi-private mode (e.g. anyone with the link can access it)
 		burl, err := xattr.Get(path, "url.semiprivate")
 		if err != nil {
-			panic(err)
+			fatal(err)
 		}
 		fmt.Printf("%s\n", burl)
 		fmt.Printf("\nYou still need to make a sync for the file to become available.")
@@ -207,7 +352,7 @@ func main() {
 		}
 		public, err := isPublic(path)
 		if err != nil {
-			panic(err)
+			fatal(err)
 		}
 		fmt.Printf("public:%s\n", public)
 		if !public {
@@ -218,20 +363,189 @@ func main() {
 		}
 
 		if err := xattr.Set(path, "public", []byte("0")); err != nil {
-			panic(err)
+			fatal(err)
 		}
 		fmt.Printf("\nYou still need to commit for the file to become unavailable.")
 	case "prune", "public": // XXX(tsileo): find a better name than `public` for listing public nodes
 		fmt.Printf("Not implemented yet")
 	default:
-		fmt.Printf("unknown cmd %v", cmd)
+		fmt.Fprintf(os.Stderr, "unknown cmd %v\n", cmd)
+		os.Exit(2)
+	}
+}
+
+// socketPath returns the API socket of the mount named `name`, or of the mount containing the current directory
+func socketPath(name string) (string, error) {
+	reg, err := registry.Default()
+	if err != nil {
+		return "", err
+	}
+	if name != "" {
+		m, err := reg.Get(name)
+		if err != nil {
+			if err == registry.ErrNotMounted {
+				return "", &MountErr{fmt.Errorf("%s is not mounted", name)}
+			}
+			return "", err
+		}
+		return m.Socket, nil
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	m, err := reg.Find(wd)
+	switch err {
+	case nil:
+		return m.Socket, nil
+	case registry.ErrNotMounted:
+		// Fallback to the magic file served in every directory of the mount
+		rsocket, err := ioutil.ReadFile(".blobfs_socket")
+		if err != nil {
+			return "", &MountErr{fmt.Errorf("the current directory is not inside a mount, use -fs NAME")}
+		}
+		return string(rsocket), nil
+	default:
+		return "", err
+	}
+}
+
+// Mounts lists the live mounts
+func Mounts() error {
+	reg, err := registry.Default()
+	if err != nil {
+		return err
+	}
+	mounts, err := reg.List()
+	if err != nil {
+		return err
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	for _, m := range mounts {
+		fmt.Fprintf(w, "%s\t%s\tpid=%d\t%s\n", yellow(m.Name), m.Mountpoint, m.Pid, m.Started.Format(time.RFC3339))
+	}
+	w.Flush()
+	return nil
+}
+
+// ConfigShow displays the effective settings for the FS `name` (default to the mount containing the current
+// directory), along with where each value comes from
+func ConfigShow(path, name string) error {
+	conf, err := config.Open(path)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		if reg, err := registry.Default(); err == nil {
+			if wd, err := os.Getwd(); err == nil {
+				if m, err := reg.Find(wd); err == nil {
+					name = m.Name
+				}
+			}
+		}
+	}
+	s, err := conf.Settings(name, nil)
+	if err != nil {
+		return err
+	}
+	if conf.Path != "" {
+		fmt.Printf("# config: %s\n", conf.Path)
+	} else {
+		fmt.Printf("# config: none (%s does not exist)\n", config.DefaultPath())
+	}
+	if name != "" {
+		fmt.Printf("# filesystem: %s\n", yellow(name))
 	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	for _, key := range config.Keys {
+		fmt.Fprintf(w, "%s\t%s\t(%s)\n", key, s.Get(key), s.Sources[key])
+	}
+	w.Flush()
+	return nil
+}
+
+// Exit codes, 1 is used by `status` when there are changes to push and 2 for usage errors
+const (
+	exitError             = 3
+	exitNotMounted        = 4
+	exitConflict          = 5
+	exitOutOfSync         = 6
+	exitRemoteUnreachable = 7
+	exitNotFound          = 8
+)
+
+// APIError is the JSON error returned by the blobfs-mount API
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	switch e.Code {
+	case "conflict":
+		return "the remote has changes that haven't been pulled yet, run `blobfs pull` first"
+	case "out_of_sync":
+		return fmt.Sprintf("the local state is out of sync with BlobStash (%s)", e.Message)
+	case "remote_unreachable":
+		return fmt.Sprintf("BlobStash is unreachable (%s)", e.Message)
+	case "not_found":
+		return e.Message
+	}
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+// MountErr is returned when the blobfs-mount API can't be reached
+type MountErr struct {
+	Err error
+}
+
+func (e *MountErr) Error() string {
+	return fmt.Sprintf("failed to reach blobfs-mount: %v", e.Err)
+}
+
+// respErr decodes the JSON error of a failed API request
+func respErr(resp *http.Response) error {
+	apiErr := &APIError{}
+	if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Code == "" {
+		return &APIError{Code: "internal", Message: fmt.Sprintf("unexpected status %d", resp.StatusCode)}
+	}
+	return apiErr
+}
+
+// fatal displays the error and exits with the exit code matching the error
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "%s %v\n", red("error:"), err)
+	code := exitError
+	switch e := err.(type) {
+	case *MountErr:
+		code = exitNotMounted
+	case *APIError:
+		switch e.Code {
+		case "conflict":
+			code = exitConflict
+		case "out_of_sync":
+			code = exitOutOfSync
+		case "remote_unreachable":
+			code = exitRemoteUnreachable
+		case "not_found":
+			code = exitNotFound
+		}
+	}
+	os.Exit(code)
+}
+
+type Renamed struct {
+	From string `json:"from"`
+	To   string `json:"to"`
 }
 
 type StatusResp struct {
-	Added    []string `json:"added"`
-	Modified []string `json:"modified"`
-	Deleted  []string `json:"deleted"`
+	Added    []string   `json:"added"`
+	Modified []string   `json:"modified"`
+	Deleted  []string   `json:"deleted"`
+	Renamed  []*Renamed `json:"renamed"`
 }
 
 type RefResp struct {
@@ -246,54 +560,220 @@ func buildStatusIndex(in []string) map[string]struct{} {
 	return out
 }
 
-// func Status(client http.Client, u string) error {
-// 	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s", u, "/status"), nil)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	resp, err := client.Do(request)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	if resp.StatusCode == 204 {
-// 		return nil
-// 	}
-// 	if resp.StatusCode != 200 {
-// 		return fmt.Errorf("http %d", resp.StatusCode)
-// 	}
-// 	sr := &StatusResp{}
-// 	if err := json.NewDecoder(resp.Body).Decode(sr); err != nil {
-// 		return err
-// 	}
-// 	deletedIndex := buildStatusIndex(sr.Deleted)
-// 	modifiedIndex := buildStatusIndex(sr.Modified)
-// 	addedIndex := buildStatusIndex(sr.Added)
-// 	paths := []string{}
-// 	for _, p := range sr.Added {
-// 		paths = append(paths, p)
-// 	}
-// 	for _, p := range sr.Deleted {
-// 		paths = append(paths, p)
-// 	}
-// 	for _, p := range sr.Modified {
-// 		paths = append(paths, p)
-// 	}
-// 	sort.Strings(paths)
-// 	for _, p := range paths {
-// 		var letter string
-// 		if _, ok := addedIndex[p]; ok {
-// 			letter = "A"
-// 		}
-// 		if _, ok := modifiedIndex[p]; ok {
-// 			letter = "M"
-// 		}
-// 		if _, ok := deletedIndex[p]; ok {
-// 			letter = "D"
-// 		}
-// 		fmt.Printf("%s  %s\n", yellow(letter), p)
-// 	}
-// 	return nil
-// }
+// Status displays the changes not pushed yet, returns true if there is anything to push
+func Status(client http.Client, u string) (bool, error) {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s", u, "/status"), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return false, &MountErr{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == 204 {
+		return false, nil
+	}
+	if resp.StatusCode != 200 {
+		return false, respErr(resp)
+	}
+	sr := &StatusResp{}
+	if err := json.NewDecoder(resp.Body).Decode(sr); err != nil {
+		return false, err
+	}
+	deletedIndex := buildStatusIndex(sr.Deleted)
+	modifiedIndex := buildStatusIndex(sr.Modified)
+	addedIndex := buildStatusIndex(sr.Added)
+	renamedIndex := map[string]string{}
+	paths := []string{}
+	for _, p := range sr.Added {
+		paths = append(paths, p)
+	}
+	for _, p := range sr.Deleted {
+		paths = append(paths, p)
+	}
+	for _, p := range sr.Modified {
+		paths = append(paths, p)
+	}
+	for _, r := range sr.Renamed {
+		renamedIndex[r.To] = r.From
+		paths = append(paths, r.To)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		var letter string
+		if _, ok := addedIndex[p]; ok {
+			letter = "A"
+		}
+		if _, ok := modifiedIndex[p]; ok {
+			letter = "M"
+		}
+		if _, ok := deletedIndex[p]; ok {
+			letter = "D"
+		}
+		if from, ok := renamedIndex[p]; ok {
+			fmt.Printf("%s  %s -> %s\n", yellow("R"), from, p)
+			continue
+		}
+		fmt.Printf("%s  %s\n", yellow(letter), p)
+	}
+	return len(paths) > 0, nil
+}
+
+type Change struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	OldPath string `json:"old_path"`
+	Size    int    `json:"size"`
+	OldSize int    `json:"old_size"`
+	IsDir   bool   `json:"is_dir"`
+	Diff    string `json:"diff"`
+}
+
+type DiffResp struct {
+	A       string    `json:"a"`
+	B       string    `json:"b"`
+	Changes []*Change `json:"changes"`
+}
+
+func Diff(client http.Client, u, refA, refB, path string, unified bool) error {
+	q := neturl.Values{}
+	q.Set("a", refA)
+	q.Set("b", refB)
+	q.Set("path", path)
+	if unified {
+		q.Set("text", "1")
+	}
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s?%s", u, "/diff", q.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return &MountErr{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return respErr(resp)
+	}
+	dr := &DiffResp{}
+	if err := json.NewDecoder(resp.Body).Decode(dr); err != nil {
+		return err
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	for _, c := range dr.Changes {
+		p := c.Path
+		if c.OldPath != "" {
+			p = c.OldPath + " -> " + c.Path
+		}
+		if c.IsDir {
+			fmt.Fprintf(w, "%s  %s/\t\n", yellow(c.Op), p)
+			continue
+		}
+		fmt.Fprintf(w, "%s  %s\t%s\n", yellow(c.Op), p, sizeDelta(c.Size-c.OldSize))
+	}
+	w.Flush()
+	for _, c := range dr.Changes {
+		if c.Diff != "" {
+			fmt.Printf("\n%s", c.Diff)
+		}
+	}
+	return nil
+}
+
+func absPath(path string) string {
+	p, err := filepath.Abs(path)
+	if err != nil {
+		fatal(err)
+	}
+	return p
+}
+
+type HistoryEntry struct {
+	T        string `json:"t"`
+	Snapshot string `json:"snapshot"`
+	RootRef  string `json:"root_ref"`
+	Ref      string `json:"ref"`
+	Size     int    `json:"size"`
+	Host     string `json:"host"`
+	Deleted  bool   `json:"deleted"`
+	Current  bool   `json:"current"`
+}
+
+// History lists the versions of the node at `path`, or of the root if it's empty
+func History(client http.Client, u, path string) error {
+	q := neturl.Values{}
+	if path != "" {
+		q.Set("path", path)
+	}
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s?%s", u, "/history", q.Encode()), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return &MountErr{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return respErr(resp)
+	}
+	entries := []*HistoryEntry{}
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return err
+	}
+	w := new(tabwriter.Writer)
+	w.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	for _, e := range entries {
+		size := fmt.Sprintf("%d B", e.Size)
+		if e.Deleted {
+			size = "deleted"
+		}
+		if e.Current {
+			fmt.Fprintf(w, "* %s\t%s\t%s\t%s\n", yellow(shortRef(e.RootRef)), e.T, size, e.Host)
+		} else {
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", shortRef(e.RootRef), e.T, size, e.Host)
+		}
+	}
+	w.Flush()
+	return nil
+}
+
+// shortRef returns the first 10 characters of the ref (the length used for the snapshot names)
+func shortRef(ref string) string {
+	if len(ref) < 10 {
+		return ref
+	}
+	return ref[:10]
+}
+
+func Undo(client http.Client, u, path, to string) error {
+	body, err := json.Marshal(map[string]interface{}{"path": path, "to": to})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s%s", u, "/undo"), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return &MountErr{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 204 {
+		return respErr(resp)
+	}
+	return nil
+}
+
+func sizeDelta(delta int) string {
+	if delta >= 0 {
+		return fmt.Sprintf("+%d B", delta)
+	}
+	return fmt.Sprintf("%d B", delta)
+}
 
 func Debug(client http.Client, u string) error {
 	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s", u, "/debug"), nil)
@@ -302,10 +782,10 @@ func Debug(client http.Client, u string) error {
 	}
 	resp, err := client.Do(request)
 	if err != nil {
-		return err
+		return &MountErr{err}
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("http %d", resp.StatusCode)
+		return respErr(resp)
 	}
 	out := map[string]interface{}{}
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
@@ -336,37 +816,171 @@ func displayVersion(out map[string]interface{}, k string) {
 	}
 }
 
-func Pull(client http.Client, u string) error {
+// Pull starts a pull job, and returns its ID
+func Pull(client http.Client, u string) (string, error) {
 	request, err := http.NewRequest("POST", fmt.Sprintf("%s%s", u, "/pull"), nil)
 	if err != nil {
-		return err
+		return "", err
 	}
+	return startJob(client, request)
+}
+
+// Sync starts a push job, and returns its ID
+func Sync(client http.Client, u, comment string) (string, error) {
+	request, err := http.NewRequest("POST", fmt.Sprintf("%s%s", u, "/sync"), bytes.NewReader([]byte(comment)))
+	if err != nil {
+		return "", err
+	}
+	return startJob(client, request)
+}
+
+func startJob(client http.Client, request *http.Request) (string, error) {
 	resp, err := client.Do(request)
 	if err != nil {
-		return err
+		return "", &MountErr{err}
 	}
-	if resp.StatusCode != 204 {
-		return fmt.Errorf("http %d", resp.StatusCode)
+	defer resp.Body.Close()
+	if resp.StatusCode != 202 {
+		return "", respErr(resp)
 	}
-	return nil
+	jr := &JobResp{}
+	if err := json.NewDecoder(resp.Body).Decode(jr); err != nil {
+		return "", err
+	}
+	return jr.ID, nil
 }
 
-func Sync(client http.Client, u, comment string) error {
-	fmt.Printf("comment=%s\n", comment)
-	request, err := http.NewRequest("POST", fmt.Sprintf("%s%s", u, "/sync"), bytes.NewReader([]byte(comment)))
+type JobResp struct {
+	ID            string    `json:"id"`
+	Type          string    `json:"type"`
+	Status        string    `json:"status"`
+	Error         *APIError `json:"error"`
+	Started       string    `json:"started"`
+	Ended         string    `json:"ended"`
+	BlobsTotal    int       `json:"blobs_total"`
+	BlobsStated   int       `json:"blobs_stated"`
+	BlobsUploaded int       `json:"blobs_uploaded"`
+	BlobsSkipped  int       `json:"blobs_skipped"`
+	BytesUploaded int       `json:"bytes_uploaded"`
+	BytesSkipped  int       `json:"bytes_skipped"`
+	DedupRatio    float64   `json:"dedup_ratio"` // Ratio of the bytes that did not need to be uploaded
+	ETA           float64   `json:"eta"`
+}
+
+// Job fetches the progress of the given job
+func Job(client http.Client, u, id string) (*JobResp, error) {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s/jobs/%s", u, id), nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	resp, err := client.Do(request)
+	if err != nil {
+		return nil, &MountErr{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, respErr(resp)
+	}
+	jr := &JobResp{}
+	if err := json.NewDecoder(resp.Body).Decode(jr); err != nil {
+		return nil, err
+	}
+	return jr, nil
+}
+
+// CancelJob cancels the given job, only push jobs can be canceled
+func CancelJob(client http.Client, u, id string) error {
+	request, err := http.NewRequest("DELETE", fmt.Sprintf("%s/jobs/%s", u, id), nil)
 	if err != nil {
 		return err
 	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return &MountErr{err}
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode != 204 {
-		return fmt.Errorf("http %d", resp.StatusCode)
+		return respErr(resp)
 	}
 	return nil
 }
 
+// WaitJob displays a progress bar until the job is done, hitting Ctrl+C cancels the job
+func WaitJob(client http.Client, u, id string) error {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	var canceling bool
+	t := time.NewTicker(200 * time.Millisecond)
+	defer t.Stop()
+	for {
+		jr, err := Job(client, u, id)
+		if err != nil {
+			return err
+		}
+		if jr.Type == "push" {
+			fmt.Fprintf(os.Stderr, "\r%s", progressBar(jr))
+		}
+		switch jr.Status {
+		case "done":
+			if jr.Type == "push" {
+				fmt.Fprintf(os.Stderr, "\n%s uploaded, %s deduplicated (dedup ratio %.0f%%)\n",
+					humanSize(jr.BytesUploaded), humanSize(jr.BytesSkipped), jr.DedupRatio*100)
+			}
+			return nil
+		case "canceled":
+			fmt.Fprintf(os.Stderr, "\n")
+			return fmt.Errorf("%s canceled", jr.Type)
+		case "failed":
+			fmt.Fprintf(os.Stderr, "\n")
+			if jr.Error == nil {
+				return fmt.Errorf("%s failed", jr.Type)
+			}
+			return jr.Error
+		}
+
+		select {
+		case <-sigs:
+			if !canceling {
+				canceling = true
+				if err := CancelJob(client, u, id); err != nil {
+					return err
+				}
+			}
+		case <-t.C:
+		}
+	}
+}
+
+const progressBarWidth = 30
+
+func progressBar(jr *JobResp) string {
+	var done int
+	if jr.BlobsTotal > 0 {
+		done = progressBarWidth * jr.BlobsStated / jr.BlobsTotal
+	}
+	bar := strings.Repeat("=", done) + strings.Repeat(" ", progressBarWidth-done)
+	eta := "?"
+	if jr.ETA >= 0 {
+		eta = (time.Duration(jr.ETA) * time.Second).String()
+	}
+	return fmt.Sprintf("[%s] %d/%d blobs (%d uploaded, %d skipped) %s ETA %s ",
+		bar, jr.BlobsStated, jr.BlobsTotal, jr.BlobsUploaded, jr.BlobsSkipped, humanSize(jr.BytesUploaded), eta)
+}
+
+func humanSize(size int) string {
+	switch {
+	case size >= 1<<30:
+		return fmt.Sprintf("%.1f GB", float64(size)/(1<<30))
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(size)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", size)
+}
+
 func Log(client http.Client, u string) error {
 	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s", u, "/log"), nil)
 	if err != nil {
@@ -374,10 +988,10 @@ func Log(client http.Client, u string) error {
 	}
 	resp, err := client.Do(request)
 	if err != nil {
-		return err
+		return &MountErr{err}
 	}
 	if resp.StatusCode != 200 {
-		return fmt.Errorf("http %d", resp.StatusCode)
+		return respErr(resp)
 	}
 	logs := []*CommitLog{}
 	if err := json.NewDecoder(resp.Body).Decode(&logs); err != nil {
@@ -407,10 +1021,10 @@ func Checkout(client http.Client, u, ref string) error {
 	}
 	resp, err := client.Do(request)
 	if err != nil {
-		return err
+		return &MountErr{err}
 	}
 	if resp.StatusCode == 200 {
 		return nil
 	}
-	return fmt.Errorf("http %d", resp.StatusCode)
+	return respErr(resp)
 }
@@ -0,0 +1,463 @@
+/*
+
+Package blobstashtest implements an in-process fake BlobStash server for hermetic tests.
+
+Only the endpoints used by blobfs are implemented, everything is kept in memory:
+
+ - /api/blobstore/blob/{hash} (GET/HEAD) and /api/blobstore/upload (POST, multipart)
+ - /api/vkv/key/{key} (GET/POST) and /api/vkv/key/{key}/versions (GET)
+ - /api/filetree/index/{ref} (GET)
+ - /api/filetree/fs/ref/{ref}/{path} (GET)
+ - /api/filetree/node/{ref} (HEAD with `bewit=1`)
+
+Like BlobStash, request bodies with `Content-Encoding: snappy` are decoded, and responses are Snappy-encoded when
+the client sends `Accept-Encoding: snappy`.
+
+*/
+package blobstashtest
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"github.com/golang/snappy"
+	"golang.org/x/net/context"
+
+	"github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+)
+
+// KeyValue mirrors BlobStash's vkv.KeyValue
+type KeyValue struct {
+	Key     string `json:"key"`
+	Hash    string `json:"hash,omitempty"`
+	Data    []byte `json:"data"`
+	Version int    `json:"version"`
+}
+
+// KeyValueVersions mirrors BlobStash's vkv.KeyValueVersions
+type KeyValueVersions struct {
+	Key      string      `json:"key"`
+	Versions []*KeyValue `json:"versions"`
+}
+
+// Node mirrors BlobStash's filetree.Node (without the children)
+type Node struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int    `json:"size"`
+	Mode    uint32 `json:"mode"`
+	ModTime string `json:"mtime"`
+	Hash    string `json:"ref"`
+}
+
+// Server is a fake BlobStash server
+type Server struct {
+	*httptest.Server
+
+	Blobs *blobstore.Memory // Blobs stored on the server
+
+	kvs map[string][]*KeyValue // Versions sorted from the oldest to the newest
+
+	snappyReqs int // Requests with a Snappy-encoded body or response
+	mu         sync.Mutex
+}
+
+// New starts a new fake BlobStash server, the caller must call `Close` when done
+func New() *Server {
+	s := &Server{
+		Blobs: blobstore.NewMemory(),
+		kvs:   map[string][]*KeyValue{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/blobstore/blob/", s.blobHandler)
+	mux.HandleFunc("/api/blobstore/upload", s.uploadHandler)
+	mux.HandleFunc("/api/vkv/key/", s.kvHandler)
+	mux.HandleFunc("/api/filetree/index/", s.indexHandler)
+	mux.HandleFunc("/api/filetree/fs/ref/", s.fsRefHandler)
+	mux.HandleFunc("/api/filetree/node/", s.nodeHandler)
+	s.Server = httptest.NewServer(s.snappyMiddleware(mux))
+	return s
+}
+
+// SnappyRequests returns the number of requests that used Snappy (for the body or the response)
+func (s *Server) SnappyRequests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snappyReqs
+}
+
+// snappyWriter buffers the response so it can be encoded once the handler is done
+type snappyWriter struct {
+	http.ResponseWriter
+	buf    []byte
+	status int
+}
+
+func (w *snappyWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	return len(data), nil
+}
+
+func (w *snappyWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (s *Server) snappyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		decodeReq := r.Header.Get("Content-Encoding") == "snappy"
+		encodeResp := strings.Contains(r.Header.Get("Accept-Encoding"), "snappy")
+		if !decodeReq && !encodeResp {
+			next.ServeHTTP(w, r)
+			return
+		}
+		s.mu.Lock()
+		s.snappyReqs++
+		s.mu.Unlock()
+
+		if decodeReq {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			decoded, err := snappy.Decode(nil, body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(decoded))
+			r.ContentLength = int64(len(decoded))
+			r.Header.Del("Content-Encoding")
+		}
+		if !encodeResp {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &snappyWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		if len(sw.buf) > 0 {
+			w.Header().Set("Content-Encoding", "snappy")
+			w.Header().Del("Content-Length")
+			w.WriteHeader(sw.status)
+			w.Write(snappy.Encode(nil, sw.buf))
+			return
+		}
+		w.WriteHeader(sw.status)
+	})
+}
+
+// Host returns the base URL of the server, suitable for `clientutil.Opts.SetHost`
+func (s *Server) Host() string {
+	return s.URL
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	js, err := json.Marshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(js)
+}
+
+func (s *Server) blobHandler(w http.ResponseWriter, r *http.Request) {
+	hash := strings.TrimPrefix(r.URL.Path, "/api/blobstore/blob/")
+	switch r.Method {
+	case "HEAD":
+		exists, err := s.Blobs.Stat(hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case "GET":
+		blob, err := s.Blobs.Get(context.Background(), hash)
+		switch err {
+		case nil:
+			w.Write(blob)
+		case blobstore.ErrBlobNotFound:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		data, err := ioutil.ReadAll(part)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Like BlobStash, the blobs are content-addressed
+		if hash := fmt.Sprintf("%x", blake2b.Sum256(data)); hash != part.FormName() {
+			http.Error(w, fmt.Sprintf("bad hash for blob %v", part.FormName()), http.StatusBadRequest)
+			return
+		}
+		if err := s.Blobs.Put(part.FormName(), data); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// Put sets a new version for the key, a negative version uses the current time
+func (s *Server) Put(key, ref string, data []byte, version int) *KeyValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if version < 0 {
+		version = int(time.Now().UTC().UnixNano())
+	}
+	kv := &KeyValue{Key: key, Hash: ref, Data: data, Version: version}
+	versions := append(s.kvs[key], kv)
+	sort.Sort(byVersion(versions))
+	s.kvs[key] = versions
+	return kv
+}
+
+// Get returns the given version of the key (or the latest if version is negative), nil if it does not exist
+func (s *Server) Get(key string, version int) *KeyValue {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	versions := s.kvs[key]
+	if len(versions) == 0 {
+		return nil
+	}
+	if version < 0 {
+		return versions[len(versions)-1]
+	}
+	for _, kv := range versions {
+		if kv.Version == version {
+			return kv
+		}
+	}
+	return nil
+}
+
+// Versions returns the versions of the key between start and end, from the newest to the oldest
+func (s *Server) Versions(key string, start, end, limit int) *KeyValueVersions {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := &KeyValueVersions{Key: key, Versions: []*KeyValue{}}
+	versions := s.kvs[key]
+	for i := len(versions) - 1; i >= 0; i-- {
+		kv := versions[i]
+		if kv.Version < start || (end > 0 && kv.Version > end) {
+			continue
+		}
+		out.Versions = append(out.Versions, kv)
+		if limit > 0 && len(out.Versions) == limit {
+			break
+		}
+	}
+	return out
+}
+
+type byVersion []*KeyValue
+
+func (s byVersion) Len() int           { return len(s) }
+func (s byVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
+
+func intParam(r *http.Request, name string, defaultValue int) (int, error) {
+	v := r.FormValue(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	return strconv.Atoi(v)
+}
+
+func (s *Server) kvHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/api/vkv/key/")
+	if strings.HasSuffix(key, "/versions") {
+		key = strings.TrimSuffix(key, "/versions")
+		start, err := intParam(r, "start", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		end, err := intParam(r, "end", -1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit, err := intParam(r, "limit", 0)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		versions := s.Versions(key, start, end, limit)
+		if len(versions.Versions) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, versions)
+		return
+	}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		version, err := intParam(r, "version", -1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		kv := s.Get(key, version)
+		if kv == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeJSON(w, kv)
+	case "POST", "PUT":
+		version, err := intParam(r, "version", -1)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, s.Put(key, r.FormValue("ref"), []byte(r.FormValue("data")), version))
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) meta(ref string) (*meta.Meta, error) {
+	blob, err := s.Blobs.Get(context.Background(), ref)
+	if err != nil {
+		return nil, err
+	}
+	return meta.NewMetaFromBlob(ref, blob)
+}
+
+// buildIndex returns the index (map[path]hash) of the tree, like BlobStash's filetree index
+func (s *Server) buildIndex(m *meta.Meta, p string, index map[string]string) error {
+	p = filepath.Join(p, m.Name)
+	index[p] = m.Hash
+	if !m.IsDir() {
+		return nil
+	}
+	for _, ref := range m.Refs {
+		child, err := s.meta(ref.(string))
+		if err != nil {
+			return err
+		}
+		if err := s.buildIndex(child, p, index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) indexHandler(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/api/filetree/index/")
+	m, err := s.meta(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	index := map[string]string{}
+	if err := s.buildIndex(m, "/", index); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, index)
+}
+
+func (s *Server) fsRefHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/api/filetree/fs/ref/"), "/", 2)
+	m, err := s.meta(parts[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if len(parts) == 2 {
+		for _, name := range strings.Split(parts[1], "/") {
+			if name == "" {
+				continue
+			}
+			var found *meta.Meta
+			for _, ref := range m.Refs {
+				if !m.IsDir() {
+					break
+				}
+				child, err := s.meta(ref.(string))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if child.Name == name {
+					found = child
+					break
+				}
+			}
+			if found == nil {
+				http.Error(w, fmt.Sprintf("%s not found", parts[1]), http.StatusNotFound)
+				return
+			}
+			m = found
+		}
+	}
+	writeJSON(w, &Node{
+		Name:    m.Name,
+		Type:    m.Type,
+		Size:    m.Size,
+		Mode:    m.Mode,
+		ModTime: m.ModTime,
+		Hash:    m.Hash,
+	})
+}
+
+func (s *Server) nodeHandler(w http.ResponseWriter, r *http.Request) {
+	ref := strings.TrimPrefix(r.URL.Path, "/api/filetree/node/")
+	if r.Method != "HEAD" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	exists, err := s.Blobs.Stat(ref)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.URL.Query().Get("bewit") == "1" {
+		w.Header().Set("BlobStash-FileTree-Bewit", "fakebewit-"+ref)
+	}
+	w.WriteHeader(http.StatusOK)
+}
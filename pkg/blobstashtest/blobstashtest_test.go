@@ -0,0 +1,215 @@
+package blobstashtest_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/tsileo/blobfs/pkg/blobstashtest"
+	"github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobfs/pkg/blobstore/blobstoretest"
+	"github.com/tsileo/blobstash/pkg/client/clientutil"
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+	"golang.org/x/net/context"
+)
+
+func TestRemoteBlobStore(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	opts := &clientutil.Opts{}
+	bs := blobstore.NewRemote(opts.SetHost(s.Host(), ""))
+	blobstoretest.TestBlobStore(t, bs)
+
+	// The blobs are content-addressed
+	blob := blobstoretest.RandomBlob(512)
+	other := blobstoretest.RandomBlob(512)
+	if err := bs.Put(other.Hash, blob.Data); err == nil {
+		t.Errorf("a blob stored under the wrong hash should be rejected")
+	}
+}
+
+func TestKvStore(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	kvs := kvstore.New(kvstore.DefaultOpts().SetHost(s.Host(), ""))
+	if _, err := kvs.Get("k", -1); err != kvstore.ErrKeyNotFound {
+		t.Fatalf("Get of an unknown key should return ErrKeyNotFound, got %v", err)
+	}
+	if _, err := kvs.Versions("k", 0, -1, 0); err != kvstore.ErrKeyNotFound {
+		t.Fatalf("Versions of an unknown key should return ErrKeyNotFound, got %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if _, err := kvs.Put("k", "", []byte{byte('a' + i - 1)}, i); err != nil {
+			t.Fatalf("failed to put key: %v", err)
+		}
+	}
+
+	kv, err := kvs.Get("k", -1)
+	if err != nil {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	if kv.Version != 3 || string(kv.Data) != "c" {
+		t.Errorf("bad latest version %+v", kv)
+	}
+	kv, err = kvs.Get("k", 2)
+	if err != nil {
+		t.Fatalf("failed to get key: %v", err)
+	}
+	if kv.Version != 2 || string(kv.Data) != "b" {
+		t.Errorf("bad version %+v", kv)
+	}
+
+	versions, err := kvs.Versions("k", 0, -1, 0)
+	if err != nil {
+		t.Fatalf("failed to fetch versions: %v", err)
+	}
+	if len(versions.Versions) != 3 {
+		t.Fatalf("3 versions expected, got %d", len(versions.Versions))
+	}
+	for i, kv := range versions.Versions {
+		if kv.Version != 3-i {
+			t.Errorf("versions should be sorted from the newest to the oldest, got %d at index %d", kv.Version, i)
+		}
+	}
+}
+
+func putMeta(t *testing.T, s *blobstashtest.Server, m *meta.Meta) {
+	hash, js := m.Json()
+	m.Hash = hash
+	if err := s.Blobs.Put(hash, js); err != nil {
+		t.Fatalf("failed to put meta: %v", err)
+	}
+}
+
+func TestFileTree(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	file := meta.NewMeta()
+	file.Name = "hello.txt"
+	file.Type = "file"
+	file.Size = 5
+	putMeta(t, s, file)
+
+	dir := meta.NewMeta()
+	dir.Name = "docs"
+	dir.Type = "dir"
+	dir.AddRef(file.Hash)
+	putMeta(t, s, dir)
+
+	root := meta.NewMeta()
+	root.Type = "dir"
+	root.AddRef(dir.Hash)
+	putMeta(t, s, root)
+
+	resp, err := http.Get(s.Host() + "/api/filetree/index/" + root.Hash)
+	if err != nil {
+		t.Fatalf("failed to fetch index: %v", err)
+	}
+	defer resp.Body.Close()
+	index := map[string]string{}
+	if err := json.NewDecoder(resp.Body).Decode(&index); err != nil {
+		t.Fatalf("failed to decode index: %v", err)
+	}
+	expected := map[string]string{
+		"/":               root.Hash,
+		"/docs":           dir.Hash,
+		"/docs/hello.txt": file.Hash,
+	}
+	if len(index) != len(expected) {
+		t.Errorf("bad index %+v", index)
+	}
+	for p, ref := range expected {
+		if index[p] != ref {
+			t.Errorf("bad ref for %s, expected %s, got %s", p, ref, index[p])
+		}
+	}
+
+	resp2, err := http.Get(s.Host() + "/api/filetree/fs/ref/" + root.Hash + "/docs/hello.txt")
+	if err != nil {
+		t.Fatalf("failed to fetch node: %v", err)
+	}
+	defer resp2.Body.Close()
+	node := &blobstashtest.Node{}
+	if err := json.NewDecoder(resp2.Body).Decode(node); err != nil {
+		t.Fatalf("failed to decode node: %v", err)
+	}
+	if node.Hash != file.Hash || node.Size != 5 {
+		t.Errorf("bad node %+v", node)
+	}
+
+	resp3, err := http.Get(s.Host() + "/api/filetree/fs/ref/" + root.Hash + "/docs/nope")
+	if err != nil {
+		t.Fatalf("failed to fetch node: %v", err)
+	}
+	resp3.Body.Close()
+	if resp3.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown path should return a 404, got %d", resp3.StatusCode)
+	}
+
+	req, err := http.NewRequest("HEAD", s.Host()+"/api/filetree/node/"+file.Hash+"?bewit=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp4, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to HEAD node: %v", err)
+	}
+	resp4.Body.Close()
+	if resp4.StatusCode != http.StatusOK || resp4.Header.Get("BlobStash-FileTree-Bewit") == "" {
+		t.Errorf("bad bewit response %d %+v", resp4.StatusCode, resp4.Header)
+	}
+}
+
+// TestSnappyCompatibility checks that the clients work with Snappy enabled, and that blobs/keys written with Snappy
+// can be read without it (and the other way around)
+func TestSnappyCompatibility(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	snappyOpts := &clientutil.Opts{SnappyCompression: true}
+	snappyOpts.SetHost(s.Host(), "")
+	plainOpts := &clientutil.Opts{}
+	plainOpts.SetHost(s.Host(), "")
+
+	blobstoretest.TestBlobStore(t, blobstore.NewRemote(snappyOpts))
+	if s.SnappyRequests() == 0 {
+		t.Errorf("the client should use Snappy")
+	}
+
+	for _, tdata := range []struct {
+		name       string
+		put, get   *clientutil.Opts
+		key, value string
+	}{
+		{"snappy to plain", snappyOpts, plainOpts, "k1", "snappy"},
+		{"plain to snappy", plainOpts, snappyOpts, "k2", "plain"},
+	} {
+		blob := blobstoretest.RandomBlob(4096)
+		if err := blobstore.NewRemote(tdata.put).Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("%s: failed to put blob: %v", tdata.name, err)
+		}
+		data, err := blobstore.NewRemote(tdata.get).Get(context.Background(), blob.Hash)
+		if err != nil {
+			t.Fatalf("%s: failed to get blob: %v", tdata.name, err)
+		}
+		if !bytes.Equal(data, blob.Data) {
+			t.Errorf("%s: bad blob content", tdata.name)
+		}
+
+		if _, err := kvstore.New(tdata.put).Put(tdata.key, "", []byte(tdata.value), 1); err != nil {
+			t.Fatalf("%s: failed to put key: %v", tdata.name, err)
+		}
+		kv, err := kvstore.New(tdata.get).Get(tdata.key, -1)
+		if err != nil {
+			t.Fatalf("%s: failed to get key: %v", tdata.name, err)
+		}
+		if string(kv.Data) != tdata.value || kv.Version != 1 {
+			t.Errorf("%s: bad kv %+v", tdata.name, kv)
+		}
+	}
+}
@@ -5,62 +5,207 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/tsileo/blobstash/pkg/config/pathutil"
+	"golang.org/x/net/context"
 )
 
+// ErrBlobNotFound is returned by every BlobStore implementation when the requested blob does not exist
 var ErrBlobNotFound = errors.New("Blob not found")
 
-type BlobStore struct {
-	path string
-	fs   string
+// ErrNotSupported is returned when a BlobStore implementation does not support an operation (e.g. Remove/Iter on
+// a remote BlobStash instance)
+var ErrNotSupported = errors.New("Operation not supported")
+
+// BlobStore is the interface implemented by all the blob stores (local, remote, in-memory and tiered)
+type BlobStore interface {
+	// Get returns the blob or `ErrBlobNotFound`
+	Get(ctx context.Context, hash string) ([]byte, error)
+	Put(hash string, data []byte) error
+	Stat(hash string) (bool, error)
+	Remove(hash string) error
+	// Iter calls `fn` for each stored blob hash
+	Iter(fn func(hash string) error) error
+	Close() error
+}
+
+// Local is a BlobStore that stores blobs on disk, blobs are compressed using Snappy when it's worth it.
+// Small blobs (mostly metas) are appended to pack files, the bigger ones are stored as files (one file per blob).
+type Local struct {
+	path  string
+	fs    string
+	packs *packStore
+
+	unsynced map[string]struct{} // Blob files written since the last sync
+	files    int64               // Size of the blob files (the packs are tracked by the pack store)
+	mu       sync.Mutex
 }
 
-func New(path, fsName string) (*BlobStore, error) {
+// New returns a new Local blobstore for the given FS name, the path default to `$VAR_DIR/blobfs/blobstore`
+func New(path, fsName string) (*Local, error) {
 	if path == "" {
 		path = filepath.Join(pathutil.VarDir(), "blobfs", "blobstore")
 	}
-	bs := &BlobStore{path: path, fs: fsName}
+	bs := &Local{path: path, fs: fsName, unsynced: map[string]struct{}{}}
 	if err := os.MkdirAll(filepath.Join(path, fsName), 0700); err != nil {
 		return nil, err
 	}
+	packs, err := openPackStore(filepath.Join(path, fsName, "packs"))
+	if err != nil {
+		return nil, err
+	}
+	bs.packs = packs
+
+	// The size of the blob files is computed once, and then updated on every put/remove
+	packsPath := filepath.Join(path, fsName, "packs")
+	if err := filepath.Walk(filepath.Join(path, fsName), func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && p == packsPath {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() {
+			bs.files += fi.Size()
+		}
+		return nil
+	}); err != nil {
+		packs.close()
+		return nil, err
+	}
 
 	return bs, nil
 }
 
-func (bs *BlobStore) Destroy() error {
+func (bs *Local) Destroy() error {
+	bs.packs.close()
 	return os.RemoveAll(bs.path)
 }
 
-func (bs *BlobStore) Close() error {
-	return nil
+func (bs *Local) Close() error {
+	return bs.packs.close()
 }
 
-func (bs *BlobStore) iter(wfunc func(string, string, error) error) func(path string, fi os.FileInfo, err error) error {
-	return func(path string, fi os.FileInfo, err error) error {
-		if len(fi.Name()) == 64 { // The name looks like a hash it must be blob
-			return wfunc(path, fi.Name(), err)
+// Sync returns once every blob written before the call is durably stored on disk
+func (bs *Local) Sync() error {
+	if err := bs.packs.sync(); err != nil {
+		return err
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	dirs := map[string]struct{}{}
+	for path := range bs.unsynced {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+		dirs[filepath.Dir(path)] = struct{}{}
+		delete(bs.unsynced, path)
+	}
+	// The directory entries too (and the shard directories entries)
+	if len(dirs) > 0 {
+		dirs[filepath.Join(bs.path, bs.fs)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := syncDir(dir); err != nil {
+			return err
 		}
-		return nil
 	}
+	return nil
+}
+
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Compact rewrites the pack files mostly filled with removed blobs, returns the number of reclaimed bytes. Removing a
+// blob only marks it as removed in the packs, so it should be called after removing blobs (see `gc.NewWithCompaction`).
+func (bs *Local) Compact() (int64, error) {
+	return bs.packs.compact()
 }
 
-func (bs *BlobStore) Iter(walkFunc func(string, string, error) error) error {
-	return filepath.Walk(filepath.Join(pathutil.VarDir(), "blobfs", "blobstore", bs.fs), bs.iter(walkFunc))
+// Size returns the disk usage of the blobstore in bytes (the blob files, the packs and their index), it's tracked
+// incrementally so it's cheap to call
+func (bs *Local) Size() (int64, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	return bs.files + bs.packs.diskSize(), nil
 }
 
-func (bs *BlobStore) Put(hash string, data []byte) error {
-	if err := os.MkdirAll(filepath.Join(pathutil.VarDir(), "blobfs", "blobstore", bs.fs, hash[0:2]), 0700); err != nil {
+// blobPath returns the path of the blob on disk, blobs are sharded in directories using the first two hex chars
+func (bs *Local) blobPath(hash string) string {
+	return filepath.Join(bs.path, bs.fs, hash[0:2], hash)
+}
+
+func (bs *Local) Iter(fn func(hash string) error) error {
+	for _, hash := range bs.packs.hashes() {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	packsPath := filepath.Join(bs.path, bs.fs, "packs")
+	return filepath.Walk(filepath.Join(bs.path, bs.fs), func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && path == packsPath {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() && len(fi.Name()) == 64 { // The name looks like a hash it must be blob
+			return fn(fi.Name())
+		}
+		return nil
+	})
+}
+
+func (bs *Local) Put(hash string, data []byte) error {
+	blob := compress(data)
+	if len(blob) < packMaxBlobSize {
+		return bs.packs.put(hash, blob)
+	}
+	if err := os.MkdirAll(filepath.Join(bs.path, bs.fs, hash[0:2]), 0700); err != nil {
+		return err
+	}
+	// The lock is held while writing so the size stays accurate if the blob is overwritten
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	var old int64
+	if fi, err := os.Stat(bs.blobPath(hash)); err == nil {
+		old = fi.Size()
+	}
+	if err := ioutil.WriteFile(bs.blobPath(hash), blob, 0644); err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filepath.Join(pathutil.VarDir(), "blobfs", "blobstore", bs.fs, hash[0:2], hash), data, 0644)
+	bs.files += int64(len(blob)) - old
+	bs.unsynced[bs.blobPath(hash)] = struct{}{}
+	return nil
 }
 
-func (bs *BlobStore) Get(hash string) ([]byte, error) {
-	blob, err := ioutil.ReadFile(filepath.Join(pathutil.VarDir(), "blobfs", "blobstore", bs.fs, hash[0:2], hash))
+func (bs *Local) Get(ctx context.Context, hash string) ([]byte, error) {
+	blob, err := bs.packs.get(hash)
+	switch err {
+	case nil:
+		return decompress(hash, blob)
+	case ErrBlobNotFound:
+	default:
+		return nil, err
+	}
+	blob, err = ioutil.ReadFile(bs.blobPath(hash))
 	switch {
 	case err == nil:
-		return blob, nil
+		return decompress(hash, blob)
 	case os.IsNotExist(err):
 		return nil, ErrBlobNotFound
 	default:
@@ -69,13 +214,32 @@ func (bs *BlobStore) Get(hash string) ([]byte, error) {
 
 }
 
-func (bs *BlobStore) Remove(hash string) error {
-	return os.Remove(filepath.Join(pathutil.VarDir(), "blobfs", "blobstore", bs.fs, hash[0:2], hash))
+func (bs *Local) Remove(hash string) error {
+	if err := bs.packs.remove(hash); err != ErrBlobNotFound {
+		return err
+	}
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	delete(bs.unsynced, bs.blobPath(hash))
+	fi, err := os.Stat(bs.blobPath(hash))
+	if os.IsNotExist(err) {
+		return ErrBlobNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(bs.blobPath(hash)); err != nil {
+		return err
+	}
+	bs.files -= fi.Size()
+	return nil
 }
 
-func (bs *BlobStore) Stat(hash string) (bool, error) {
-	f, err := os.Open(filepath.Join(pathutil.VarDir(), "blobfs", "blobstore", bs.fs, hash[0:2], hash))
-	defer f.Close()
+func (bs *Local) Stat(hash string) (bool, error) {
+	if bs.packs.stat(hash) {
+		return true, nil
+	}
+	_, err := os.Stat(bs.blobPath(hash))
 	switch {
 	case err == nil:
 		return true, nil
@@ -1,21 +1,20 @@
-package blobstore
+package blobstore_test
 
 import (
 	"bytes"
-	"crypto/rand"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/dchest/blake2b"
+	"github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobfs/pkg/blobstore/blobstoretest"
+	"golang.org/x/net/context"
 )
 
-type Blob struct {
-	Hash string
-	Data []byte
-}
-
 func TestBlobStore(t *testing.T) {
 	dir, err := ioutil.TempDir("", "blobfs")
 	t.Logf("tmp dir=%+v\n", dir)
@@ -25,7 +24,7 @@ func TestBlobStore(t *testing.T) {
 
 	defer os.RemoveAll(dir) // clean up
 
-	bs, err := New(dir, "testblobfs")
+	bs, err := blobstore.New(dir, "testblobfs")
 	if err != nil {
 		panic(err)
 	}
@@ -33,79 +32,403 @@ func TestBlobStore(t *testing.T) {
 		bs.Close()
 		bs.Destroy()
 	}()
-	blobs := []*Blob{}
-	blobsIndex := map[string]struct{}{}
 
-	// Create fixtures
-	for i := 0; i < 10; i++ {
-		blob := make([]byte, 1024*8)
-		if _, err := rand.Read(blob); err != nil {
-			panic(err)
-		}
-		hash := fmt.Sprintf("%x", blake2b.Sum256(blob))
+	blobstoretest.TestBlobStore(t, bs)
+}
+
+func TestMemory(t *testing.T) {
+	blobstoretest.TestBlobStore(t, blobstore.NewMemory())
+}
+
+func TestLocalCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobfs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
 
-		blobs = append(blobs, &Blob{hash, blob})
-		blobsIndex[hash] = struct{}{}
+	bs, err := blobstore.New(dir, "testblobfs")
+	if err != nil {
+		t.Fatalf("failed to init blobstore: %v", err)
+	}
 
-		// Put the just created blob
-		if err := bs.Put(hash, blob); err != nil {
-			panic(err)
+	// Space used in the packs by the last put blob
+	var packed int
+	diskSize := func(hash string) int {
+		fi, err := os.Stat(filepath.Join(dir, "testblobfs", hash[0:2], hash))
+		switch {
+		case err == nil:
+			return int(fi.Size())
+		case os.IsNotExist(err):
+			return packed - packRecordHeaderSize
+		default:
+			t.Fatalf("failed to stat blob %s: %v", hash, err)
 		}
+		return 0
 	}
-	for _, blob := range blobs {
-		ok, err := bs.Stat(blob.Hash)
-		if !ok {
-			t.Errorf("failed to stat blob %s", blob.Hash)
+	put := func(data []byte) string {
+		hash := fmt.Sprintf("%x", blake2b.Sum256(data))
+		before := packsSize(t, dir)
+		if err := bs.Put(hash, data); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
 		}
+		packed = packsSize(t, dir) - before
+		out, err := bs.Get(context.Background(), hash)
 		if err != nil {
-			panic(err)
+			t.Fatalf("failed to get blob: %v", err)
 		}
-		blob2, err := bs.Get(blob.Hash)
-		if err != nil {
-			panic(err)
+		if !bytes.Equal(out, data) {
+			t.Errorf("bad blob content for %s", hash)
 		}
+		return hash
+	}
 
-		if !bytes.Equal(blob.Data, blob2) {
-			t.Errorf("failed to fetch blob %s", blob.Hash)
+	// Compressible data
+	text := bytes.Repeat([]byte("blobfs is a FUSE file system built on top of BlobStash\n"), 200)
+	if size := diskSize(put(text)); size > len(text)/3 {
+		t.Errorf("text blob should be compressed, %d bytes on disk for %d bytes", size, len(text))
+	}
+
+	// Incompressible data is stored raw (plus the header byte)
+	random := blobstoretest.RandomBlob(8 * 1024)
+	if size := diskSize(put(random.Data)); size != len(random.Data)+1 {
+		t.Errorf("random blob should be stored raw, %d bytes on disk for %d bytes", size, len(random.Data))
+	}
+
+	// Small blobs too
+	small := []byte(`{"name":"a"}`)
+	if size := diskSize(put(small)); size != len(small)+1 {
+		t.Errorf("small blob should be stored raw, %d bytes on disk for %d bytes", size, len(small))
+	}
+
+	// Blobs stored before the compression was added (no header byte) can still be read
+	for _, legacy := range [][]byte{text, {1, 2, 3}, {0, 'a'}, {}} {
+		hash := fmt.Sprintf("%x", blake2b.Sum256(legacy))
+		os.MkdirAll(filepath.Join(dir, "testblobfs", hash[0:2]), 0700)
+		if err := ioutil.WriteFile(filepath.Join(dir, "testblobfs", hash[0:2], hash), legacy, 0644); err != nil {
+			t.Fatalf("failed to write legacy blob: %v", err)
+		}
+		out, err := bs.Get(context.Background(), hash)
+		if err != nil {
+			t.Fatalf("failed to get legacy blob: %v", err)
+		}
+		if !bytes.Equal(out, legacy) {
+			t.Errorf("bad legacy blob content %q", out)
 		}
+	}
 
+	// Corrupted blobs are detected
+	hash := put(blobstoretest.RandomBlob(64 * 1024).Data)
+	ioutil.WriteFile(filepath.Join(dir, "testblobfs", hash[0:2], hash), []byte("corrupted"), 0644)
+	if _, err := bs.Get(context.Background(), hash); err != blobstore.ErrCorrupted {
+		t.Errorf("corrupted blob should return ErrCorrupted, got %v", err)
 	}
+}
 
-	// Delete a blobs
-	blob1 := blobs[0]
-	blobs = blobs[1:len(blobs)]
+// Size of the record header in the packs
+const packRecordHeaderSize = 40
 
-	if err := bs.Remove(blob1.Hash); err != nil {
-		panic(err)
+func packsSize(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "testblobfs", "packs", "pack-*.pack"))
+	if err != nil {
+		t.Fatalf("failed to list packs: %v", err)
+	}
+	size := 0
+	for _, path := range files {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("failed to stat pack: %v", err)
+		}
+		size += int(fi.Size())
 	}
+	return size
+}
 
-	// Ensure the stat return false
-	ok, err := bs.Stat(blob1.Hash)
+func TestLocalPacks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobfs")
 	if err != nil {
-		panic(err)
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bs, err := blobstore.New(dir, "testblobfs")
+	if err != nil {
+		t.Fatalf("failed to init blobstore: %v", err)
+	}
+	check := func(blobs []*blobstoretest.Blob, exists bool) {
+		for _, blob := range blobs {
+			data, err := bs.Get(context.Background(), blob.Hash)
+			switch {
+			case exists && err != nil:
+				t.Fatalf("failed to get blob %s: %v", blob.Hash, err)
+			case exists && !bytes.Equal(data, blob.Data):
+				t.Errorf("bad blob content for %s", blob.Hash)
+			case !exists && err != blobstore.ErrBlobNotFound:
+				t.Errorf("blob %s should not exist, got err=%v", blob.Hash, err)
+			}
+		}
 	}
-	if ok {
-		t.Errorf("blob %s should be removed", blob1.Hash)
+	reopen := func() {
+		if err := bs.Close(); err != nil {
+			t.Fatalf("failed to close blobstore: %v", err)
+		}
+		bs, err = blobstore.New(dir, "testblobfs")
+		if err != nil {
+			t.Fatalf("failed to reopen blobstore: %v", err)
+		}
 	}
 
-	if _, err := bs.Get(blob1.Hash); err != ErrBlobNotFound {
-		t.Errorf("Blob %s should not be present", blob1.Hash)
+	blobs := []*blobstoretest.Blob{}
+	for i := 0; i < 100; i++ {
+		blob := blobstoretest.RandomBlob(512)
+		if err := bs.Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+		blobs = append(blobs, blob)
+	}
+	big := blobstoretest.RandomBlob(64 * 1024)
+	if err := bs.Put(big.Hash, big.Data); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
 	}
 
+	// Only the big blob has its own file
+	if _, err := os.Stat(filepath.Join(dir, "testblobfs", big.Hash[0:2], big.Hash)); err != nil {
+		t.Errorf("big blob should be stored in its own file: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "testblobfs", blobs[0].Hash[0:2], blobs[0].Hash)); !os.IsNotExist(err) {
+		t.Errorf("small blob should be stored in a pack")
+	}
 	cnt := 0
-	walkFunc := func(path, hash string, err error) error {
+	if err := bs.Iter(func(hash string) error {
 		cnt++
-		if _, ok := blobsIndex[hash]; !ok {
-			t.Errorf("blob %s not in index", hash)
-		}
 		return nil
+	}); err != nil {
+		t.Fatalf("failed to iter: %v", err)
+	}
+	if cnt != 101 {
+		t.Errorf("Iter should return 101 blobs, got %d", cnt)
 	}
 
-	if err := bs.Iter(walkFunc); err != nil {
-		panic(err)
+	// Removed blobs are still removed after a restart
+	for _, blob := range blobs[:80] {
+		if err := bs.Remove(blob.Hash); err != nil {
+			t.Fatalf("failed to remove blob: %v", err)
+		}
+	}
+	reopen()
+	check(blobs[:80], false)
+	check(blobs[80:], true)
+
+	// Compaction reclaims the space used by the removed blobs
+	before := packsSize(t, dir)
+	reclaimed, err := bs.Compact()
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
 	}
+	if reclaimed == 0 || packsSize(t, dir) >= before/2 {
+		t.Errorf("compaction should reclaim space (reclaimed=%d, size %d -> %d)", reclaimed, before, packsSize(t, dir))
+	}
+	check(blobs[:80], false)
+	check(blobs[80:], true)
+	reopen()
+	check(blobs[:80], false)
+	check(blobs[80:], true)
+	check([]*blobstoretest.Blob{big}, true)
 
-	if cnt != 9 {
-		t.Errorf("9 blobs expected, got %d", cnt)
+	// Simulate a crash: the last records never made it to the index, and a record was partially written
+	extra := []*blobstoretest.Blob{}
+	for i := 0; i < 5; i++ {
+		blob := blobstoretest.RandomBlob(512)
+		if err := bs.Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+		extra = append(extra, blob)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatalf("failed to close blobstore: %v", err)
+	}
+	indexPath := filepath.Join(dir, "testblobfs", "packs", "index")
+	fi, err := os.Stat(indexPath)
+	if err != nil {
+		t.Fatalf("failed to stat index: %v", err)
+	}
+	// Drop the last 3 index records (49 bytes each) and leave a partial one
+	if err := os.Truncate(indexPath, fi.Size()-3*49+10); err != nil {
+		t.Fatalf("failed to truncate index: %v", err)
+	}
+	packs, _ := filepath.Glob(filepath.Join(dir, "testblobfs", "packs", "pack-*.pack"))
+	sort.Strings(packs)
+	f, err := os.OpenFile(packs[len(packs)-1], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("failed to open pack: %v", err)
+	}
+	f.Write(bytes.Repeat([]byte{0xff}, 100))
+	f.Close()
+
+	bs, err = blobstore.New(dir, "testblobfs")
+	if err != nil {
+		t.Fatalf("failed to recover blobstore: %v", err)
+	}
+	check(extra, true)
+	check(blobs[:80], false)
+	check(blobs[80:], true)
+	more := blobstoretest.RandomBlob(512)
+	if err := bs.Put(more.Hash, more.Data); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	reopen()
+	check(append(extra, more), true)
+
+	// Simulate a crash where the index made it to the disk but not the end of the pack
+	tail := []*blobstoretest.Blob{}
+	for i := 0; i < 3; i++ {
+		blob := blobstoretest.RandomBlob(512)
+		if err := bs.Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+		tail = append(tail, blob)
+	}
+	if err := bs.Close(); err != nil {
+		t.Fatalf("failed to close blobstore: %v", err)
+	}
+	packs, _ = filepath.Glob(filepath.Join(dir, "testblobfs", "packs", "pack-*.pack"))
+	sort.Strings(packs)
+	fi, err = os.Stat(packs[len(packs)-1])
+	if err != nil {
+		t.Fatalf("failed to stat pack: %v", err)
+	}
+	// Drop the last record and the end of the one before
+	if err := os.Truncate(packs[len(packs)-1], fi.Size()-600); err != nil {
+		t.Fatalf("failed to truncate pack: %v", err)
+	}
+	bs, err = blobstore.New(dir, "testblobfs")
+	if err != nil {
+		t.Fatalf("failed to recover blobstore: %v", err)
+	}
+	check(tail[:1], true)
+	check(tail[1:], false)
+	check(append(extra, more), true)
+	if err := bs.Put(tail[2].Hash, tail[2].Data); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	reopen()
+	check([]*blobstoretest.Blob{tail[0], tail[2]}, true)
+	check(tail[1:2], false)
+	bs.Close()
+}
+
+func TestLocalSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobfs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bs, err := blobstore.New(dir, "testblobfs")
+	if err != nil {
+		t.Fatalf("failed to init blobstore: %v", err)
+	}
+	defer bs.Close()
+
+	small := blobstoretest.RandomBlob(512)
+	big := blobstoretest.RandomBlob(64 * 1024)
+	removed := blobstoretest.RandomBlob(64 * 1024)
+	for _, blob := range []*blobstoretest.Blob{small, big, removed} {
+		if err := bs.Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+	}
+	if err := bs.Remove(removed.Hash); err != nil {
+		t.Fatalf("failed to remove blob: %v", err)
+	}
+	if err := bs.Sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	// Nothing left to sync
+	if err := bs.Sync(); err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+}
+
+func TestLocalSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobfs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bs, err := blobstore.New(dir, "testblobfs")
+	if err != nil {
+		t.Fatalf("failed to init blobstore: %v", err)
+	}
+	defer func() {
+		bs.Close()
+	}()
+
+	empty, err := bs.Size()
+	if err != nil {
+		t.Fatalf("size failed: %v", err)
+	}
+	// Random data is stored uncompressed
+	big := blobstoretest.RandomBlob(64 * 1024)
+	if err := bs.Put(big.Hash, big.Data); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	size, err := bs.Size()
+	if err != nil {
+		t.Fatalf("size failed: %v", err)
+	}
+	if size-empty < int64(len(big.Data)) {
+		t.Errorf("the size should grow by at least %d bytes, got %d -> %d", len(big.Data), empty, size)
+	}
+
+	// The size is tracked incrementally, it matches the disk usage
+	diskUsage := func() int64 {
+		var total int64
+		if err := filepath.Walk(filepath.Join(dir, "testblobfs"), func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				total += fi.Size()
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("walk failed: %v", err)
+		}
+		return total
+	}
+	small := []*blobstoretest.Blob{}
+	for i := 0; i < 10; i++ {
+		blob := blobstoretest.RandomBlob(512)
+		if err := bs.Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+		small = append(small, blob)
+	}
+	for _, blob := range append(small, big) {
+		if err := bs.Remove(blob.Hash); err != nil {
+			t.Fatalf("failed to remove blob: %v", err)
+		}
+	}
+	if _, err := bs.Compact(); err != nil {
+		t.Fatalf("compact failed: %v", err)
+	}
+	size, err = bs.Size()
+	if err != nil {
+		t.Fatalf("size failed: %v", err)
+	}
+	if disk := diskUsage(); size != disk {
+		t.Errorf("size should be %d, got %d", disk, size)
+	}
+
+	// And it's computed again when the blobstore is opened
+	bs.Close()
+	bs, err = blobstore.New(dir, "testblobfs")
+	if err != nil {
+		t.Fatalf("failed to init blobstore: %v", err)
+	}
+	if reopened, err := bs.Size(); err != nil || reopened != size {
+		t.Errorf("size should be %d after reopening, got %d (%v)", size, reopened, err)
 	}
 }
@@ -0,0 +1,127 @@
+/*
+
+Package blobstoretest implements a test suite shared by all the BlobStore implementations.
+
+*/
+package blobstoretest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/dchest/blake2b"
+	"golang.org/x/net/context"
+
+	"github.com/tsileo/blobfs/pkg/blobstore"
+)
+
+type Blob struct {
+	Hash string
+	Data []byte
+}
+
+// RandomBlob returns a new blob filled with `size` random bytes
+func RandomBlob(size int) *Blob {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		panic(err)
+	}
+	return &Blob{fmt.Sprintf("%x", blake2b.Sum256(data)), data}
+}
+
+// TestBlobStore runs the test suite against the given (empty) BlobStore.
+// Remove and Iter are allowed to return `blobstore.ErrNotSupported`.
+func TestBlobStore(t *testing.T, bs blobstore.BlobStore) {
+	blobs := []*Blob{}
+	blobsIndex := map[string]struct{}{}
+
+	// Create fixtures
+	for i := 0; i < 10; i++ {
+		blob := RandomBlob(1024 * 8)
+		blobs = append(blobs, blob)
+		blobsIndex[blob.Hash] = struct{}{}
+
+		// Put the just created blob
+		if err := bs.Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("failed to put blob %s: %v", blob.Hash, err)
+		}
+	}
+	for _, blob := range blobs {
+		ok, err := bs.Stat(blob.Hash)
+		if err != nil {
+			t.Fatalf("failed to stat blob %s: %v", blob.Hash, err)
+		}
+		if !ok {
+			t.Errorf("failed to stat blob %s", blob.Hash)
+		}
+		blob2, err := bs.Get(context.Background(), blob.Hash)
+		if err != nil {
+			t.Fatalf("failed to get blob %s: %v", blob.Hash, err)
+		}
+
+		if !bytes.Equal(blob.Data, blob2) {
+			t.Errorf("failed to fetch blob %s", blob.Hash)
+		}
+	}
+
+	// Unknown blobs must return the typed error
+	unknown := RandomBlob(8)
+	if _, err := bs.Get(context.Background(), unknown.Hash); err != blobstore.ErrBlobNotFound {
+		t.Errorf("Get of an unknown blob should return ErrBlobNotFound, got %v", err)
+	}
+	ok, err := bs.Stat(unknown.Hash)
+	if err != nil {
+		t.Fatalf("failed to stat blob %s: %v", unknown.Hash, err)
+	}
+	if ok {
+		t.Errorf("blob %s should not exist", unknown.Hash)
+	}
+
+	// Delete a blobs
+	blob1 := blobs[0]
+	expected := len(blobs) - 1
+
+	switch err := bs.Remove(blob1.Hash); err {
+	case nil:
+		// Ensure the stat return false
+		ok, err := bs.Stat(blob1.Hash)
+		if err != nil {
+			t.Fatalf("failed to stat blob %s: %v", blob1.Hash, err)
+		}
+		if ok {
+			t.Errorf("blob %s should be removed", blob1.Hash)
+		}
+
+		if _, err := bs.Get(context.Background(), blob1.Hash); err != blobstore.ErrBlobNotFound {
+			t.Errorf("Blob %s should not be present", blob1.Hash)
+		}
+		delete(blobsIndex, blob1.Hash)
+	case blobstore.ErrNotSupported:
+		t.Logf("Remove not supported")
+		expected = len(blobs)
+	default:
+		t.Fatalf("failed to remove blob %s: %v", blob1.Hash, err)
+	}
+
+	cnt := 0
+	walkFunc := func(hash string) error {
+		cnt++
+		if _, ok := blobsIndex[hash]; !ok {
+			t.Errorf("blob %s not in index", hash)
+		}
+		return nil
+	}
+
+	switch err := bs.Iter(walkFunc); err {
+	case nil:
+		if cnt != expected {
+			t.Errorf("%d blobs expected, got %d", expected, cnt)
+		}
+	case blobstore.ErrNotSupported:
+		t.Logf("Iter not supported")
+	default:
+		t.Fatalf("Iter failed: %v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package blobstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dchest/blake2b"
+	"github.com/golang/snappy"
+)
+
+// ErrCorrupted is returned when a stored blob does not match its hash
+var ErrCorrupted = errors.New("Blob corrupted")
+
+// Header byte of the blobs stored by Local
+const (
+	headerRaw    byte = 0
+	headerSnappy byte = 1
+)
+
+// Blobs smaller than this are stored raw, and a compressed blob must save at least 1/8 of its size to be kept
+// (incompressible data like images and archives are stored raw)
+const minCompressSize = 256
+
+// compress returns the blob prefixed with its header byte, compressed if it's worth it
+func compress(data []byte) []byte {
+	if len(data) >= minCompressSize {
+		encoded := snappy.Encode(nil, data)
+		if len(encoded) < len(data)-len(data)/8 {
+			return append([]byte{headerSnappy}, encoded...)
+		}
+	}
+	return append([]byte{headerRaw}, data...)
+}
+
+// decompress returns the original blob, blobs stored before the compression was added (without header) are
+// detected by checking their hash
+func decompress(hash string, data []byte) ([]byte, error) {
+	if len(data) > 0 {
+		switch data[0] {
+		case headerRaw:
+			if blob := data[1:]; checkHash(hash, blob) {
+				return blob, nil
+			}
+		case headerSnappy:
+			if blob, err := snappy.Decode(nil, data[1:]); err == nil && checkHash(hash, blob) {
+				return blob, nil
+			}
+		}
+	}
+	if checkHash(hash, data) {
+		return data, nil
+	}
+	return nil, ErrCorrupted
+}
+
+func checkHash(hash string, data []byte) bool {
+	return fmt.Sprintf("%x", blake2b.Sum256(data)) == hash
+}
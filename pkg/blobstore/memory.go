@@ -0,0 +1,74 @@
+package blobstore
+
+import (
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Memory is an in-memory BlobStore, mostly useful for testing
+type Memory struct {
+	blobs map[string][]byte
+	mu    sync.Mutex
+}
+
+func NewMemory() *Memory {
+	return &Memory{blobs: map[string][]byte{}}
+}
+
+func (bs *Memory) Close() error {
+	return nil
+}
+
+func (bs *Memory) Put(hash string, data []byte) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	blob := make([]byte, len(data))
+	copy(blob, data)
+	bs.blobs[hash] = blob
+	return nil
+}
+
+func (bs *Memory) Get(ctx context.Context, hash string) ([]byte, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	blob, ok := bs.blobs[hash]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	out := make([]byte, len(blob))
+	copy(out, blob)
+	return out, nil
+}
+
+func (bs *Memory) Stat(hash string) (bool, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	_, ok := bs.blobs[hash]
+	return ok, nil
+}
+
+func (bs *Memory) Remove(hash string) error {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if _, ok := bs.blobs[hash]; !ok {
+		return ErrBlobNotFound
+	}
+	delete(bs.blobs, hash)
+	return nil
+}
+
+func (bs *Memory) Iter(fn func(hash string) error) error {
+	bs.mu.Lock()
+	hashes := make([]string, 0, len(bs.blobs))
+	for hash := range bs.blobs {
+		hashes = append(hashes, hash)
+	}
+	bs.mu.Unlock()
+	for _, hash := range hashes {
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,646 @@
+package blobstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Blobs (once compressed) smaller than this are stored in pack files instead of one file per blob
+const packMaxBlobSize = 32 * 1024
+
+// A new pack is started once the current one reaches this size
+const packMaxSize = 64 * 1024 * 1024
+
+// Packs where at least this ratio of the bytes belongs to removed blobs are rewritten by `Compact`
+const packCompactRatio = 0.5
+
+// Pack record: hash (32 bytes) | data length (uint32) | data CRC32 (uint32) | data
+const packRecordHeaderSize = 32 + 4 + 4
+
+// Index record: op (1 byte) | hash (32 bytes) | pack ID (uint32) | offset (uint64) | data length (uint32)
+const indexRecordSize = 1 + 32 + 4 + 8 + 4
+
+const (
+	opPut byte = iota + 1
+	opDelete
+	opMark // Everything before offset in the pack is indexed (written when the index is rewritten)
+)
+
+var errBadRecord = errors.New("bad pack record")
+
+// packEntry locates a blob inside a pack
+type packEntry struct {
+	pack   uint32
+	offset int64 // Offset of the data (after the record header)
+	size   uint32
+}
+
+// packStore stores small blobs in append-only pack files, an append-only index (replayed on startup) maps the
+// hashes to their location in the packs.
+type packStore struct {
+	path string
+
+	index   map[string]*packEntry
+	dead    map[uint32]int64 // Bytes used by removed blobs, per pack
+	packs   map[uint32]*os.File
+	current uint32 // ID of the pack being written
+	size    int64  // Size of the current pack
+	disk    int64  // Size of the packs and the index on disk
+
+	unsynced map[uint32]struct{} // Packs written since the last sync
+	created  bool                // A pack has been created since the last sync
+
+	indexFile *os.File
+	mu        sync.Mutex
+}
+
+func packName(id uint32) string {
+	return fmt.Sprintf("pack-%06d.pack", id)
+}
+
+// openPackStore loads the index and replays the tails of the packs that were not indexed (e.g. after a crash)
+func openPackStore(path string) (*packStore, error) {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return nil, err
+	}
+	ps := &packStore{
+		path:  path,
+		index: map[string]*packEntry{},
+		dead:  map[uint32]int64{},
+		packs: map[uint32]*os.File{},
+
+		unsynced: map[uint32]struct{}{},
+	}
+
+	// Open the existing packs
+	files, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint32{}
+	for _, fi := range files {
+		if !strings.HasPrefix(fi.Name(), "pack-") || !strings.HasSuffix(fi.Name(), ".pack") {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(fi.Name(), "pack-"), ".pack"), 10, 32)
+		if err != nil {
+			continue
+		}
+		f, err := os.OpenFile(filepath.Join(path, fi.Name()), os.O_RDWR, 0644)
+		if err != nil {
+			ps.close()
+			return nil, err
+		}
+		ps.packs[uint32(id)] = f
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// Replay the index
+	indexed, err := ps.loadIndex()
+	if err != nil {
+		ps.close()
+		return nil, err
+	}
+
+	// Replay the tail of every pack, the records written after the last indexed one are re-indexed, and a
+	// partially written record is truncated
+	for _, id := range ids {
+		if err := ps.recover(id, indexed[id]); err != nil {
+			ps.close()
+			return nil, err
+		}
+	}
+
+	if len(ids) == 0 {
+		if err := ps.newPack(1); err != nil {
+			ps.close()
+			return nil, err
+		}
+	} else {
+		ps.current = ids[len(ids)-1]
+		fi, err := ps.packs[ps.current].Stat()
+		if err != nil {
+			ps.close()
+			return nil, err
+		}
+		ps.size = fi.Size()
+	}
+
+	// Remove the packs without any live blob left (a compaction crashed before removing them)
+	live := map[uint32]bool{ps.current: true}
+	for _, e := range ps.index {
+		live[e.pack] = true
+	}
+	for _, id := range ids {
+		if live[id] {
+			continue
+		}
+		ps.packs[id].Close()
+		delete(ps.packs, id)
+		delete(ps.dead, id)
+		if err := os.Remove(filepath.Join(path, packName(id))); err != nil {
+			ps.close()
+			return nil, err
+		}
+	}
+
+	// The disk usage is computed once (the recovery may have updated it), and then updated on every write
+	ps.disk = 0
+	for _, f := range ps.packs {
+		fi, err := f.Stat()
+		if err != nil {
+			ps.close()
+			return nil, err
+		}
+		ps.disk += fi.Size()
+	}
+	fi, err := ps.indexFile.Stat()
+	if err != nil {
+		ps.close()
+		return nil, err
+	}
+	ps.disk += fi.Size()
+	return ps, nil
+}
+
+// loadIndex replays the index log, and returns the end of the last indexed record for each pack. The entries
+// pointing past the end of their pack, or to a corrupted record (the index may have been synced before the pack when
+// crashing) are dropped, and their records are re-indexed (or truncated) by `recover`.
+func (ps *packStore) loadIndex() (map[uint32]int64, error) {
+	indexed := map[uint32]int64{}
+	sizes := map[uint32]int64{}
+	for id, pf := range ps.packs {
+		fi, err := pf.Stat()
+		if err != nil {
+			return nil, err
+		}
+		sizes[id] = fi.Size()
+	}
+	f, err := os.OpenFile(filepath.Join(ps.path, "index"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	ps.indexFile = f
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	n := len(data) / indexRecordSize
+	for i := 0; i < n; i++ {
+		rec := data[i*indexRecordSize : (i+1)*indexRecordSize]
+		hash := hex.EncodeToString(rec[1:33])
+		e := &packEntry{
+			pack:   binary.BigEndian.Uint32(rec[33:37]),
+			offset: int64(binary.BigEndian.Uint64(rec[37:45])),
+			size:   binary.BigEndian.Uint32(rec[45:49]),
+		}
+		if _, ok := ps.packs[e.pack]; !ok {
+			// The pack has been removed by a compaction
+			continue
+		}
+		switch rec[0] {
+		case opMark:
+			if e.offset > sizes[e.pack] {
+				e.offset = sizes[e.pack]
+			}
+			if e.offset > indexed[e.pack] {
+				indexed[e.pack] = e.offset
+			}
+		case opPut:
+			if !ps.checkEntry(hash, e, sizes[e.pack]) {
+				continue
+			}
+			if old, ok := ps.index[hash]; ok {
+				ps.dead[old.pack] += packRecordHeaderSize + int64(old.size)
+			}
+			ps.index[hash] = e
+			if end := e.offset + int64(e.size); end > indexed[e.pack] {
+				indexed[e.pack] = end
+			}
+		case opDelete:
+			if old, ok := ps.index[hash]; ok {
+				ps.dead[old.pack] += packRecordHeaderSize + int64(old.size)
+				delete(ps.index, hash)
+			}
+		default:
+			return nil, fmt.Errorf("bad index record %d", i)
+		}
+	}
+	// Drop a partially written record
+	if rest := len(data) % indexRecordSize; rest != 0 {
+		if err := f.Truncate(int64(n * indexRecordSize)); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(int64(n*indexRecordSize), io.SeekStart); err != nil {
+		return nil, err
+	}
+	return indexed, nil
+}
+
+// checkEntry returns true if the entry points to a valid record of the blob (a stale entry may point to a record
+// written over a truncated one)
+func (ps *packStore) checkEntry(hash string, e *packEntry, packSize int64) bool {
+	if e.offset < packRecordHeaderSize {
+		return false
+	}
+	rhash, size, err := readRecordHeader(ps.packs[e.pack], e.offset-packRecordHeaderSize, packSize)
+	if err != nil || rhash != hash || size != e.size {
+		return false
+	}
+	data := make([]byte, e.size)
+	if _, err := ps.packs[e.pack].ReadAt(data, e.offset); err != nil {
+		return false
+	}
+	return checkRecord(ps.packs[e.pack], e.offset-packRecordHeaderSize, data) == nil
+}
+
+// recover indexes the records of the pack written after `from` (the end of the last indexed record)
+func (ps *packStore) recover(id uint32, from int64) error {
+	f := ps.packs[id]
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	offset := from
+	for offset < fi.Size() {
+		hash, size, err := readRecordHeader(f, offset, fi.Size())
+		if err != nil {
+			break
+		}
+		data := make([]byte, size)
+		if _, err := f.ReadAt(data, offset+packRecordHeaderSize); err != nil {
+			break
+		}
+		if err := checkRecord(f, offset, data); err != nil {
+			break
+		}
+		e := &packEntry{pack: id, offset: offset + packRecordHeaderSize, size: size}
+		if err := ps.appendIndex(opPut, hash, e); err != nil {
+			return err
+		}
+		ps.index[hash] = e
+		offset += packRecordHeaderSize + int64(size)
+	}
+	if offset < fi.Size() {
+		return f.Truncate(offset)
+	}
+	return nil
+}
+
+func readRecordHeader(f *os.File, offset, end int64) (string, uint32, error) {
+	if offset+packRecordHeaderSize > end {
+		return "", 0, errBadRecord
+	}
+	header := make([]byte, packRecordHeaderSize)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return "", 0, err
+	}
+	size := binary.BigEndian.Uint32(header[32:36])
+	if offset+packRecordHeaderSize+int64(size) > end {
+		return "", 0, errBadRecord
+	}
+	return hex.EncodeToString(header[0:32]), size, nil
+}
+
+func checkRecord(f *os.File, offset int64, data []byte) error {
+	crc := make([]byte, 4)
+	if _, err := f.ReadAt(crc, offset+36); err != nil {
+		return err
+	}
+	if binary.BigEndian.Uint32(crc) != crc32.ChecksumIEEE(data) {
+		return errBadRecord
+	}
+	return nil
+}
+
+func (ps *packStore) newPack(id uint32) error {
+	f, err := os.OpenFile(filepath.Join(ps.path, packName(id)), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	ps.packs[id] = f
+	ps.current = id
+	ps.size = 0
+	ps.created = true
+	return nil
+}
+
+func indexRecord(op byte, hash string, e *packEntry) ([]byte, error) {
+	rec := make([]byte, indexRecordSize)
+	rec[0] = op
+	if hash != "" {
+		rawHash, err := hex.DecodeString(hash)
+		if err != nil || len(rawHash) != 32 {
+			return nil, fmt.Errorf("invalid hash %q", hash)
+		}
+		copy(rec[1:33], rawHash)
+	}
+	binary.BigEndian.PutUint32(rec[33:37], e.pack)
+	binary.BigEndian.PutUint64(rec[37:45], uint64(e.offset))
+	binary.BigEndian.PutUint32(rec[45:49], e.size)
+	return rec, nil
+}
+
+func (ps *packStore) appendIndex(op byte, hash string, e *packEntry) error {
+	rec, err := indexRecord(op, hash, e)
+	if err != nil {
+		return err
+	}
+	if _, err := ps.indexFile.Write(rec); err != nil {
+		return err
+	}
+	ps.disk += int64(len(rec))
+	return nil
+}
+
+// write appends the record to the current pack (the lock must be held)
+func (ps *packStore) write(hash string, data []byte) (*packEntry, error) {
+	rawHash, err := hex.DecodeString(hash)
+	if err != nil || len(rawHash) != 32 {
+		return nil, fmt.Errorf("invalid hash %q", hash)
+	}
+	if ps.size >= packMaxSize {
+		if err := ps.newPack(ps.current + 1); err != nil {
+			return nil, err
+		}
+	}
+	rec := make([]byte, packRecordHeaderSize+len(data))
+	copy(rec[0:32], rawHash)
+	binary.BigEndian.PutUint32(rec[32:36], uint32(len(data)))
+	binary.BigEndian.PutUint32(rec[36:40], crc32.ChecksumIEEE(data))
+	copy(rec[packRecordHeaderSize:], data)
+	if _, err := ps.packs[ps.current].WriteAt(rec, ps.size); err != nil {
+		return nil, err
+	}
+	ps.disk += int64(len(rec))
+	e := &packEntry{pack: ps.current, offset: ps.size + packRecordHeaderSize, size: uint32(len(data))}
+	ps.size += int64(len(rec))
+	ps.unsynced[ps.current] = struct{}{}
+	if err := ps.appendIndex(opPut, hash, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (ps *packStore) put(hash string, data []byte) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if _, ok := ps.index[hash]; ok {
+		return nil
+	}
+	e, err := ps.write(hash, data)
+	if err != nil {
+		return err
+	}
+	ps.index[hash] = e
+	return nil
+}
+
+// get returns the stored data, or `ErrBlobNotFound`
+func (ps *packStore) get(hash string) ([]byte, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	e, ok := ps.index[hash]
+	if !ok {
+		return nil, ErrBlobNotFound
+	}
+	data := make([]byte, e.size)
+	if _, err := ps.packs[e.pack].ReadAt(data, e.offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (ps *packStore) stat(hash string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	_, ok := ps.index[hash]
+	return ok
+}
+
+// remove marks the blob as removed, the space is reclaimed by `compact`
+func (ps *packStore) remove(hash string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	e, ok := ps.index[hash]
+	if !ok {
+		return ErrBlobNotFound
+	}
+	if err := ps.appendIndex(opDelete, hash, e); err != nil {
+		return err
+	}
+	delete(ps.index, hash)
+	ps.dead[e.pack] += packRecordHeaderSize + int64(e.size)
+	return nil
+}
+
+func (ps *packStore) hashes() []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	hashes := make([]string, 0, len(ps.index))
+	for hash := range ps.index {
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// compact rewrites the packs mostly filled with removed blobs: the live blobs are copied to the current pack, the
+// index is rewritten, and the old packs are removed. Returns the number of reclaimed bytes.
+func (ps *packStore) compact() (int64, error) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	sparse := map[uint32]bool{}
+	for id, f := range ps.packs {
+		if ps.dead[id] == 0 {
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if float64(ps.dead[id]) >= packCompactRatio*float64(fi.Size()) {
+			sparse[id] = true
+		}
+	}
+	if len(sparse) == 0 {
+		return 0, nil
+	}
+	if sparse[ps.current] {
+		// The live blobs can't be copied to the pack being rewritten
+		if err := ps.newPack(ps.current + 1); err != nil {
+			return 0, err
+		}
+	}
+
+	// Copy the live blobs (sorted to keep the pack order)
+	hashes := []string{}
+	for hash, e := range ps.index {
+		if sparse[e.pack] {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		a, b := ps.index[hashes[i]], ps.index[hashes[j]]
+		if a.pack != b.pack {
+			return a.pack < b.pack
+		}
+		return a.offset < b.offset
+	})
+	for _, hash := range hashes {
+		e := ps.index[hash]
+		data := make([]byte, e.size)
+		if _, err := ps.packs[e.pack].ReadAt(data, e.offset); err != nil {
+			return 0, err
+		}
+		ne, err := ps.write(hash, data)
+		if err != nil {
+			return 0, err
+		}
+		ps.index[hash] = ne
+	}
+	if err := ps.packs[ps.current].Sync(); err != nil {
+		return 0, err
+	}
+	if err := ps.indexFile.Sync(); err != nil {
+		return 0, err
+	}
+
+	// Rewrite the index without the removed blobs first, so a crash can't leave the index pointing to removed packs
+	if err := ps.rewriteIndex(); err != nil {
+		return 0, err
+	}
+
+	// Then remove the old packs (they're removed when opening the store if we crash before)
+	var reclaimed int64
+	for id := range sparse {
+		f := ps.packs[id]
+		fi, err := f.Stat()
+		if err != nil {
+			return reclaimed, err
+		}
+		f.Close()
+		delete(ps.packs, id)
+		delete(ps.dead, id)
+		if err := os.Remove(filepath.Join(ps.path, packName(id))); err != nil {
+			return reclaimed, err
+		}
+		reclaimed += fi.Size()
+		ps.disk -= fi.Size()
+	}
+	return reclaimed, nil
+}
+
+// rewriteIndex atomically replaces the index log with a snapshot of the current index, and marks the packs as
+// fully indexed (so the removed blobs aren't replayed when recovering the pack tails)
+func (ps *packStore) rewriteIndex() error {
+	var buf bytes.Buffer
+	for hash, e := range ps.index {
+		rec, err := indexRecord(opPut, hash, e)
+		if err != nil {
+			return err
+		}
+		buf.Write(rec)
+	}
+	for id, f := range ps.packs {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		rec, _ := indexRecord(opMark, "", &packEntry{pack: id, offset: fi.Size()})
+		buf.Write(rec)
+	}
+
+	tmpPath := filepath.Join(ps.path, "index.tmp")
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	old, err := ps.indexFile.Stat()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := os.Rename(tmpPath, filepath.Join(ps.path, "index")); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := syncDir(ps.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	ps.disk += int64(buf.Len()) - old.Size()
+	ps.indexFile.Close()
+	ps.indexFile = tmp
+	return nil
+}
+
+// diskSize returns the size of the packs and the index on disk
+func (ps *packStore) diskSize() int64 {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.disk
+}
+
+// sync flushes the packs written since the last sync and the index to disk
+func (ps *packStore) sync() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for id := range ps.unsynced {
+		if f, ok := ps.packs[id]; ok {
+			if err := f.Sync(); err != nil {
+				return err
+			}
+		}
+		delete(ps.unsynced, id)
+	}
+	if err := ps.indexFile.Sync(); err != nil {
+		return err
+	}
+	if ps.created {
+		if err := syncDir(ps.path); err != nil {
+			return err
+		}
+		ps.created = false
+	}
+	return nil
+}
+
+func (ps *packStore) close() error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	var err error
+	for _, f := range ps.packs {
+		if cerr := f.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	if ps.indexFile != nil {
+		if cerr := ps.indexFile.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
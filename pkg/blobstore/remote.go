@@ -0,0 +1,55 @@
+package blobstore
+
+import (
+	"github.com/tsileo/blobstash/pkg/client/blobstore"
+	"github.com/tsileo/blobstash/pkg/client/clientutil"
+	"golang.org/x/net/context"
+)
+
+// Remote is a BlobStore backed by a remote BlobStash instance
+type Remote struct {
+	bs *blobstore.BlobStore
+}
+
+func NewRemote(opts *clientutil.Opts) *Remote {
+	return &Remote{bs: blobstore.New(opts)}
+}
+
+// Client returns the underlying BlobStash client
+func (r *Remote) Client() *clientutil.Client {
+	return r.bs.Client()
+}
+
+func (r *Remote) Close() error {
+	return nil
+}
+
+func (r *Remote) Put(hash string, data []byte) error {
+	return r.bs.Put(hash, data)
+}
+
+func (r *Remote) Get(ctx context.Context, hash string) ([]byte, error) {
+	blob, err := r.bs.Get(ctx, hash)
+	switch err {
+	case nil:
+		return blob, nil
+	case clientutil.ErrBlobNotFound:
+		return nil, ErrBlobNotFound
+	default:
+		return nil, err
+	}
+}
+
+func (r *Remote) Stat(hash string) (bool, error) {
+	return r.bs.Stat(hash)
+}
+
+// Remove is not supported by BlobStash
+func (r *Remote) Remove(hash string) error {
+	return ErrNotSupported
+}
+
+// Iter is not supported by BlobStash
+func (r *Remote) Iter(fn func(hash string) error) error {
+	return ErrNotSupported
+}
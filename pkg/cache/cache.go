@@ -7,41 +7,82 @@ import (
 	"golang.org/x/net/context"
 	log "gopkg.in/inconshreveable/log15.v2"
 
-	localblobstore "github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobfs/pkg/blobstore"
 	"github.com/tsileo/blobfs/pkg/pathutil"
-	"github.com/tsileo/blobstash/pkg/client/blobstore"
 	"github.com/tsileo/blobstash/pkg/client/clientutil"
 )
 
+// Cache is a tiered BlobStore, blobs are written to the local tier and fetched from the remote tier (and then saved
+// locally) when they are not available locally.
 type Cache struct {
-	lbs *localblobstore.BlobStore
-	rbs *blobstore.BlobStore // Remote BlobStore client for BlobStash
+	lbs blobstore.BlobStore // Local tier
+	rbs blobstore.BlobStore // Remote tier (BlobStash)
 	log log.Logger
 }
 
-// TODO(tsileo): return (*Cache, error)
+// New returns a Cache using the default tiers: a local blobstore in the var directory and a remote BlobStash
 func New(logger log.Logger, opts *clientutil.Opts, name string) (*Cache, error) {
+	return NewWithRemote(logger, blobstore.NewRemote(opts), name)
+}
+
+// NewWithRemote returns a Cache using a local blobstore in the var directory and the given remote tier, so several
+// caches can share the same BlobStash client (and its connections)
+func NewWithRemote(logger log.Logger, remote blobstore.BlobStore, name string) (*Cache, error) {
 	path := filepath.Join(pathutil.VarDir(), name)
 	if err := os.MkdirAll(path, 0700); err != nil {
 		return nil, err
 	}
-	lbs, err := localblobstore.New("", name)
+	lbs, err := blobstore.New("", name)
 	if err != nil {
 		return nil, err
 	}
+	return NewTiered(logger, lbs, remote), nil
+}
+
+// NewTiered returns a Cache on top of the given local and remote BlobStores
+func NewTiered(logger log.Logger, local, remote blobstore.BlobStore) *Cache {
 	return &Cache{
-		rbs: blobstore.New(opts),
-		lbs: lbs,
+		lbs: local,
+		rbs: remote,
 		log: logger,
-	}, nil
+	}
 }
 
 func (c *Cache) Close() error {
-	return c.lbs.Close()
+	if err := c.lbs.Close(); err != nil {
+		return err
+	}
+	return c.rbs.Close()
+}
+
+// Sync flushes the local tier to disk (if it supports it)
+func (c *Cache) Sync() error {
+	if s, ok := c.lbs.(interface {
+		Sync() error
+	}); ok {
+		return s.Sync()
+	}
+	return nil
 }
 
+// LocalSize returns the disk usage of the local tier in bytes (0 if it can't report it)
+func (c *Cache) LocalSize() (int64, error) {
+	if s, ok := c.lbs.(interface {
+		Size() (int64, error)
+	}); ok {
+		return s.Size()
+	}
+	return 0, nil
+}
+
+// Client returns the BlobStash client if the remote tier is a BlobStash instance, nil otherwise
 func (c *Cache) Client() *clientutil.Client {
-	return c.rbs.Client()
+	if r, ok := c.rbs.(interface {
+		Client() *clientutil.Client
+	}); ok {
+		return r.Client()
+	}
+	return nil
 }
 
 func (c *Cache) PutRemote(hash string, blob []byte) error {
@@ -49,6 +90,34 @@ func (c *Cache) PutRemote(hash string, blob []byte) error {
 	return c.rbs.Put(hash, blob)
 }
 
+// publicRemote returns the plaintext remote tier when the remote tier encrypts the blobs
+func (c *Cache) publicRemote() (blobstore.BlobStore, bool) {
+	if r, ok := c.rbs.(interface {
+		Public() blobstore.BlobStore
+	}); ok {
+		return r.Public(), true
+	}
+	return nil, false
+}
+
+// PutRemotePublic uploads the blob in plaintext even if the remote tier encrypts the blobs
+func (c *Cache) PutRemotePublic(hash string, blob []byte) error {
+	c.log.Debug("OP Put remote public", "hash", hash)
+	if public, ok := c.publicRemote(); ok {
+		return public.Put(hash, blob)
+	}
+	return c.rbs.Put(hash, blob)
+}
+
+// StatRemotePublic returns true if the blob is available in plaintext on the remote tier (always true if the remote
+// tier does not encrypt the blobs, since they've already been uploaded)
+func (c *Cache) StatRemotePublic(hash string) (bool, error) {
+	if public, ok := c.publicRemote(); ok {
+		return public.Stat(hash)
+	}
+	return true, nil
+}
+
 func (c *Cache) Put(hash string, blob []byte) error {
 	c.log.Debug("OP Put", "hash", hash)
 	return c.lbs.Put(hash, blob)
@@ -71,10 +140,10 @@ func (c *Cache) Stat(hash string) (bool, error) {
 
 func (c *Cache) Get(ctx context.Context, hash string) ([]byte, error) {
 	c.log.Debug("OP Get", "hash", hash)
-	blob, err := c.lbs.Get(hash)
+	blob, err := c.lbs.Get(ctx, hash)
 	switch err {
 	// If the blob is not found locally, try to fetch it from the remote blobstore
-	case clientutil.ErrBlobNotFound:
+	case blobstore.ErrBlobNotFound:
 		blob, err = c.rbs.Get(ctx, hash)
 		if err != nil {
 			return nil, err
@@ -89,3 +158,14 @@ func (c *Cache) Get(ctx context.Context, hash string) ([]byte, error) {
 	}
 	return blob, nil
 }
+
+// Remove removes the blob from the local tier only
+func (c *Cache) Remove(hash string) error {
+	c.log.Debug("OP Remove", "hash", hash)
+	return c.lbs.Remove(hash)
+}
+
+// Iter iterates over the blobs of the local tier only
+func (c *Cache) Iter(fn func(hash string) error) error {
+	return c.lbs.Iter(fn)
+}
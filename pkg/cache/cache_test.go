@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+	log "gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobfs/pkg/blobstore/blobstoretest"
+)
+
+func newTestCache() (*Cache, *blobstore.Memory, *blobstore.Memory) {
+	logger := log.New()
+	logger.SetHandler(log.DiscardHandler())
+	local := blobstore.NewMemory()
+	remote := blobstore.NewMemory()
+	return NewTiered(logger, local, remote), local, remote
+}
+
+func TestCacheBlobStore(t *testing.T) {
+	c, _, _ := newTestCache()
+	blobstoretest.TestBlobStore(t, c)
+}
+
+func TestCacheRemoteFallback(t *testing.T) {
+	c, local, remote := newTestCache()
+
+	blob := blobstoretest.RandomBlob(512)
+	if err := remote.Put(blob.Hash, blob.Data); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+
+	ok, err := c.Stat(blob.Hash)
+	if err != nil {
+		t.Fatalf("failed to stat blob: %v", err)
+	}
+	if !ok {
+		t.Errorf("blob %s should be available from the remote tier", blob.Hash)
+	}
+
+	// The blob is only available remotely, the Get should fallback to the remote tier
+	data, err := c.Get(context.Background(), blob.Hash)
+	if err != nil {
+		t.Fatalf("failed to get blob %s: %v", blob.Hash, err)
+	}
+	if string(data) != string(blob.Data) {
+		t.Errorf("bad blob data for %s", blob.Hash)
+	}
+
+	// And now it should be cached locally
+	ok, err = local.Stat(blob.Hash)
+	if err != nil {
+		t.Fatalf("failed to stat blob: %v", err)
+	}
+	if !ok {
+		t.Errorf("blob %s should have been saved in the local tier", blob.Hash)
+	}
+
+	// Unknown blobs return the typed error from both tiers
+	unknown := blobstoretest.RandomBlob(8)
+	if _, err := c.Get(context.Background(), unknown.Hash); err != blobstore.ErrBlobNotFound {
+		t.Errorf("Get of an unknown blob should return ErrBlobNotFound, got %v", err)
+	}
+}
+
+func TestCachePutRemote(t *testing.T) {
+	c, local, remote := newTestCache()
+
+	blob := blobstoretest.RandomBlob(512)
+	if err := c.Put(blob.Hash, blob.Data); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+	if ok, _ := remote.Stat(blob.Hash); ok {
+		t.Errorf("Put should only write to the local tier")
+	}
+	if err := c.PutRemote(blob.Hash, blob.Data); err != nil {
+		t.Fatalf("failed to put blob remotely: %v", err)
+	}
+	if ok, _ := c.StatRemote(blob.Hash); !ok {
+		t.Errorf("blob %s should be available remotely", blob.Hash)
+	}
+	if ok, _ := local.Stat(blob.Hash); !ok {
+		t.Errorf("blob %s should still be available locally", blob.Hash)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+
+Package chunker implements content-defined chunking.
+
+The chunk boundaries are found using a rolling hash (a gear hash) over the content, so they only depend on the
+surrounding bytes: inserting or removing a few bytes in a large file only changes the chunks around the edit, and
+the other chunks (and so the blobs) are deduplicated.
+
+*/
+package chunker
+
+import (
+	"fmt"
+)
+
+// Default chunk sizes
+const (
+	DefaultMin = 32 * 1024
+	DefaultAvg = 128 * 1024
+	DefaultMax = 512 * 1024
+)
+
+// gear maps every byte to a random 64 bits value, it must never change as the boundaries (and the dedup of the
+// already stored blobs) depend on it
+var gear [256]uint64
+
+func init() {
+	// splitmix64 with a fixed seed
+	seed := uint64(0x626c6f626673)
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Chunker splits data into chunks of `Min` to `Max` bytes, a boundary is found every `Avg` bytes on average once
+// `Min` bytes have been read (`Avg` must be a power of 2)
+type Chunker struct {
+	Min  int
+	Avg  int
+	Max  int
+	mask uint64
+}
+
+// New returns a Chunker, a zero size means the default one
+func New(min, avg, max int) (*Chunker, error) {
+	if min == 0 {
+		min = DefaultMin
+	}
+	if avg == 0 {
+		avg = DefaultAvg
+	}
+	if max == 0 {
+		max = DefaultMax
+	}
+	if avg&(avg-1) != 0 {
+		return nil, fmt.Errorf("average chunk size must be a power of 2, got %d", avg)
+	}
+	if min <= 0 || min > avg || avg > max {
+		return nil, fmt.Errorf("chunk sizes must satisfy 0 < min <= avg <= max, got %d/%d/%d", min, avg, max)
+	}
+	return &Chunker{
+		Min: min,
+		Avg: avg,
+		Max: max,
+		// The mask bits are taken from the top of the hash, the low bits only depend on the last few bytes
+		mask: uint64(avg-1) << uint(64-bits(avg)),
+	}, nil
+}
+
+// Default returns a Chunker using the default sizes
+func Default() *Chunker {
+	c, _ := New(DefaultMin, DefaultAvg, DefaultMax)
+	return c
+}
+
+func bits(n int) int {
+	b := 0
+	for n > 1 {
+		n >>= 1
+		b++
+	}
+	return b
+}
+
+// Cut returns the size of the first chunk of `data`
+func (c *Chunker) Cut(data []byte) int {
+	if len(data) <= c.Min {
+		return len(data)
+	}
+	end := len(data)
+	if end > c.Max {
+		end = c.Max
+	}
+	// The bytes before `Min` are skipped, only the last 64 bytes matter for the hash anyway
+	var hash uint64
+	start := c.Min - 64
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < end; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if i >= c.Min && hash&c.mask == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// Split returns the chunks of `data` (the chunks are sub-slices of `data`)
+func (c *Chunker) Split(data []byte) [][]byte {
+	chunks := [][]byte{}
+	for len(data) > 0 {
+		n := c.Cut(data)
+		chunks = append(chunks, data[:n])
+		data = data[n:]
+	}
+	return chunks
+}
@@ -0,0 +1,85 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("failed to generate data: %v", err)
+	}
+	return data
+}
+
+func TestNew(t *testing.T) {
+	c, err := New(0, 0, 0)
+	if err != nil {
+		t.Fatalf("default sizes should be valid: %v", err)
+	}
+	if c.Min != DefaultMin || c.Avg != DefaultAvg || c.Max != DefaultMax {
+		t.Errorf("bad default sizes %d/%d/%d", c.Min, c.Avg, c.Max)
+	}
+	for _, sizes := range [][3]int{{1024, 3000, 8192}, {8192, 4096, 16384}, {1024, 4096, 2048}, {-1, 4096, 8192}} {
+		if _, err := New(sizes[0], sizes[1], sizes[2]); err == nil {
+			t.Errorf("sizes %v should be invalid", sizes)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	c, err := New(2*1024, 8*1024, 32*1024)
+	if err != nil {
+		t.Fatalf("failed to init chunker: %v", err)
+	}
+	data := randomData(t, 1024*1024)
+	chunks := c.Split(data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatalf("chunks don't match the data")
+	}
+	for i, chunk := range chunks {
+		if len(chunk) > c.Max || (len(chunk) < c.Min && i != len(chunks)-1) {
+			t.Errorf("chunk %d has a bad size %d", i, len(chunk))
+		}
+	}
+	if avg := len(data) / len(chunks); avg < c.Min || avg > c.Max {
+		t.Errorf("bad average chunk size %d", avg)
+	}
+
+	// The boundaries don't depend on the previous data
+	if len(chunks) < 3 {
+		t.Fatalf("not enough chunks")
+	}
+	offset := len(chunks[0])
+	rest := c.Split(data[offset:])
+	if len(rest) != len(chunks)-1 || !bytes.Equal(rest[0], chunks[1]) {
+		t.Errorf("the boundaries should not depend on the previous chunks")
+	}
+}
+
+func TestSplitEdit(t *testing.T) {
+	c, err := New(2*1024, 8*1024, 32*1024)
+	if err != nil {
+		t.Fatalf("failed to init chunker: %v", err)
+	}
+	data := randomData(t, 1024*1024)
+	known := map[string]bool{}
+	for _, chunk := range c.Split(data) {
+		known[string(chunk)] = true
+	}
+
+	// Insert a byte in the middle of the data, only the chunks around it should change
+	edited := append(append(append([]byte{}, data[:len(data)/2]...), 'x'), data[len(data)/2:]...)
+	chunks := c.Split(edited)
+	var changed int
+	for _, chunk := range chunks {
+		if !known[string(chunk)] {
+			changed++
+		}
+	}
+	if changed == 0 || changed > 2 {
+		t.Errorf("inserting a byte should only change 1 or 2 chunks, %d/%d changed", changed, len(chunks))
+	}
+}
@@ -0,0 +1,465 @@
+/*
+
+Package config implements the YAML configuration shared by `blobfs-mount` and `blobfs`.
+
+The global settings apply to every filesystem, each filesystem has its own section (keyed by its name) which can
+override some of them:
+
+	host: http://localhost:8050
+	api_key: secret
+	loglevel: info
+	filesystems:
+	  documents:
+	    mountpoint: ~/docs
+	    app_port: 8030
+	  archives:
+	    mountpoint: ~/archives
+	    host: http://backup:8050
+	    immutable: true
+
+The effective settings are resolved with the following precedence: flags > env > config > defaults.
+
+*/
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tsileo/blobfs/pkg/pathutil"
+	"gopkg.in/yaml.v2"
+)
+
+// Default values
+const (
+	DefaultHost     = "http://localhost:8050"
+	DefaultLogLevel = "info"
+	DefaultAppPort  = 8030
+)
+
+// Environment variables
+const (
+	EnvConfig   = "BLOBFS_CONFIG"
+	EnvHost     = "BLOBFS_HOST"
+	EnvAPIKey   = "BLOBSTASH_API_KEY"
+	EnvHostname = "BLOBFS_HOSTNAME"
+	EnvLogLevel = "BLOBFS_LOGLEVEL"
+	EnvVarDir   = pathutil.VarDirEnv
+
+	EnvEncryptionKey = "BLOBFS_ENCRYPTION_KEY"
+	// EnvPassphrase is the passphrase used to derive the encryption key (when no keyfile is set)
+	EnvPassphrase = "BLOBFS_PASSPHRASE"
+)
+
+// Keys lists the settings keys (as used in the config file) in display order
+var Keys = []string{"mountpoint", "host", "api_key", "hostname", "loglevel", "var_dir", "immutable", "app_port", "encrypt", "encryption_key",
+	"chunk_min", "chunk_avg", "chunk_max", "lock_lease", "cache_size", "remote_quota"}
+
+var envKeys = map[string]string{
+	"host":           EnvHost,
+	"api_key":        EnvAPIKey,
+	"hostname":       EnvHostname,
+	"loglevel":       EnvLogLevel,
+	"var_dir":        EnvVarDir,
+	"encryption_key": EnvEncryptionKey,
+}
+
+// Source tells where an effective value comes from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceConfig  Source = "config"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// FS is the configuration of a single filesystem
+type FS struct {
+	Name          string `yaml:"-"`
+	Mountpoint    string `yaml:"mountpoint"`
+	Host          string `yaml:"host"`
+	APIKey        string `yaml:"api_key"`
+	Immutable     bool   `yaml:"immutable"`
+	AppPort       int    `yaml:"app_port"`
+	Encrypt       bool   `yaml:"encrypt"`
+	EncryptionKey string `yaml:"encryption_key"`
+	ChunkMin      int    `yaml:"chunk_min"`
+	ChunkAvg      int    `yaml:"chunk_avg"`
+	ChunkMax      int    `yaml:"chunk_max"`
+	LockLease     bool   `yaml:"lock_lease"`
+	CacheSize     int64  `yaml:"cache_size"`
+	RemoteQuota   int64  `yaml:"remote_quota"`
+}
+
+// Config is the content of a config file
+type Config struct {
+	Host      string `yaml:"host"`
+	APIKey    string `yaml:"api_key"`
+	Hostname  string `yaml:"hostname"`
+	LogLevel  string `yaml:"loglevel"`
+	VarDir    string `yaml:"var_dir"`
+	Immutable bool   `yaml:"immutable"`
+	Encrypt   bool   `yaml:"encrypt"`
+
+	// Path of the keyfile, the key is derived from $BLOBFS_PASSPHRASE if empty
+	EncryptionKey string `yaml:"encryption_key"`
+
+	// Content-defined chunking sizes in bytes (0 for the default)
+	ChunkMin int `yaml:"chunk_min"`
+	ChunkAvg int `yaml:"chunk_avg"`
+	ChunkMax int `yaml:"chunk_max"`
+
+	// Store an advisory lease in BlobStash while a file is locked, to warn when another host locks the same path
+	LockLease bool `yaml:"lock_lease"`
+
+	// Max size of the local cache and quota of the remote BlobStash in bytes (0 if unlimited), only used to report
+	// the available space
+	CacheSize   int64 `yaml:"cache_size"`
+	RemoteQuota int64 `yaml:"remote_quota"`
+
+	Filesystems map[string]*FS `yaml:"filesystems"`
+
+	// Path of the loaded file (empty if there's no config file)
+	Path string `yaml:"-"`
+}
+
+// DefaultPath returns the path of the default config file: $BLOBFS_CONFIG, or $XDG_CONFIG_HOME/blobfs/config.yaml
+// (default to ~/.config/blobfs/config.yaml)
+func DefaultPath() string {
+	if path := os.Getenv(EnvConfig); path != "" {
+		return path
+	}
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		dir = filepath.Join(os.Getenv("HOME"), ".config")
+	}
+	return filepath.Join(dir, "blobfs", "config.yaml")
+}
+
+// Open loads the config file at `path`, or the default config file if `path` is empty (an empty config is returned
+// if the default one does not exist)
+func Open(path string) (*Config, error) {
+	if path != "" {
+		return Load(path)
+	}
+	conf, err := Load(DefaultPath())
+	if os.IsNotExist(err) {
+		return &Config{Filesystems: map[string]*FS{}}, nil
+	}
+	return conf, err
+}
+
+// Load parses the config file at `path`
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	conf := &Config{}
+	if err := yaml.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	conf.Path = path
+	conf.VarDir = expandHome(conf.VarDir)
+	conf.EncryptionKey = expandHome(conf.EncryptionKey)
+	if conf.Filesystems == nil {
+		conf.Filesystems = map[string]*FS{}
+	}
+	for name, fs := range conf.Filesystems {
+		if fs == nil {
+			fs = &FS{}
+			conf.Filesystems[name] = fs
+		}
+		fs.Name = name
+		fs.Mountpoint = expandHome(fs.Mountpoint)
+		fs.EncryptionKey = expandHome(fs.EncryptionKey)
+	}
+	return conf, nil
+}
+
+// Names returns the sorted filesystem names
+func (c *Config) Names() []string {
+	names := []string{}
+	for name := range c.Filesystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Settings holds the effective settings for a filesystem
+type Settings struct {
+	Name       string
+	Mountpoint string
+	Host       string
+	APIKey     string
+	Hostname   string
+	LogLevel   string
+	VarDir     string
+	Immutable  bool
+	AppPort    int
+
+	// Encrypt the blobs and the root before sending them to BlobStash, using the key from the EncryptionKey keyfile
+	// (or derived from $BLOBFS_PASSPHRASE)
+	Encrypt       bool
+	EncryptionKey string
+
+	// Min/average/max size of the chunks when splitting the files (0 for the default)
+	ChunkMin int
+	ChunkAvg int
+	ChunkMax int
+
+	// Warn when another host holds a lock on the same path (using leases stored in BlobStash)
+	LockLease bool
+
+	// Max size of the local cache and quota of the remote BlobStash in bytes (0 if unlimited), used to report the
+	// available space
+	CacheSize   int64
+	RemoteQuota int64
+
+	// Source of each value, keyed by setting key
+	Sources map[string]Source
+}
+
+// Settings returns the effective settings for the filesystem `name` (can be empty for the global settings only).
+// The filesystem section overrides the global settings, then come the environment variables, and finally the flags
+// explicitly set on the command line (named after the key, with dashes instead of underscores, e.g. `-app-port`).
+func (c *Config) Settings(name string, flags *flag.FlagSet) (*Settings, error) {
+	hostname, _ := os.Hostname()
+	s := &Settings{
+		Name:     name,
+		Host:     DefaultHost,
+		Hostname: hostname,
+		LogLevel: DefaultLogLevel,
+		VarDir:   pathutil.DefaultVarDir(),
+		AppPort:  DefaultAppPort,
+		Sources:  map[string]Source{},
+	}
+	for _, key := range Keys {
+		s.Sources[key] = SourceDefault
+	}
+
+	// Config file
+	values := map[string]string{
+		"host":           c.Host,
+		"api_key":        c.APIKey,
+		"hostname":       c.Hostname,
+		"loglevel":       c.LogLevel,
+		"var_dir":        c.VarDir,
+		"encryption_key": c.EncryptionKey,
+	}
+	if c.Immutable {
+		values["immutable"] = "true"
+	}
+	if c.Encrypt {
+		values["encrypt"] = "true"
+	}
+	if c.LockLease {
+		values["lock_lease"] = "true"
+	}
+	for key, size := range map[string]int{"chunk_min": c.ChunkMin, "chunk_avg": c.ChunkAvg, "chunk_max": c.ChunkMax} {
+		if size != 0 {
+			values[key] = strconv.Itoa(size)
+		}
+	}
+	for key, size := range map[string]int64{"cache_size": c.CacheSize, "remote_quota": c.RemoteQuota} {
+		if size != 0 {
+			values[key] = strconv.FormatInt(size, 10)
+		}
+	}
+	if fs, ok := c.Filesystems[name]; ok {
+		values["mountpoint"] = fs.Mountpoint
+		if fs.Host != "" {
+			values["host"] = fs.Host
+		}
+		if fs.APIKey != "" {
+			values["api_key"] = fs.APIKey
+		}
+		if fs.Immutable {
+			values["immutable"] = "true"
+		}
+		if fs.AppPort != 0 {
+			values["app_port"] = strconv.Itoa(fs.AppPort)
+		}
+		if fs.Encrypt {
+			values["encrypt"] = "true"
+		}
+		if fs.LockLease {
+			values["lock_lease"] = "true"
+		}
+		if fs.EncryptionKey != "" {
+			values["encryption_key"] = fs.EncryptionKey
+		}
+		for key, size := range map[string]int{"chunk_min": fs.ChunkMin, "chunk_avg": fs.ChunkAvg, "chunk_max": fs.ChunkMax} {
+			if size != 0 {
+				values[key] = strconv.Itoa(size)
+			}
+		}
+		for key, size := range map[string]int64{"cache_size": fs.CacheSize, "remote_quota": fs.RemoteQuota} {
+			if size != 0 {
+				values[key] = strconv.FormatInt(size, 10)
+			}
+		}
+	}
+	for _, key := range Keys {
+		if v := values[key]; v != "" {
+			if err := s.Set(key, v, SourceConfig); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Environment
+	for _, key := range Keys {
+		if env, ok := envKeys[key]; ok {
+			if v := os.Getenv(env); v != "" {
+				if err := s.Set(key, v, SourceEnv); err != nil {
+					return nil, fmt.Errorf("invalid $%s: %v", env, err)
+				}
+			}
+		}
+	}
+
+	// Flags
+	if flags != nil {
+		var err error
+		flags.Visit(func(f *flag.Flag) {
+			key := strings.Replace(f.Name, "-", "_", -1)
+			if _, ok := s.Sources[key]; ok && err == nil {
+				err = s.Set(key, f.Value.String(), SourceFlag)
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Set updates the setting `key`
+func (s *Settings) Set(key, value string, src Source) error {
+	switch key {
+	case "mountpoint":
+		s.Mountpoint = value
+	case "host":
+		s.Host = value
+	case "api_key":
+		s.APIKey = value
+	case "hostname":
+		s.Hostname = value
+	case "loglevel":
+		s.LogLevel = value
+	case "var_dir":
+		s.VarDir = value
+	case "immutable":
+		immutable, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid immutable value %q", value)
+		}
+		s.Immutable = immutable
+	case "app_port":
+		port, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("invalid app_port value %q", value)
+		}
+		s.AppPort = port
+	case "encrypt":
+		encrypt, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid encrypt value %q", value)
+		}
+		s.Encrypt = encrypt
+	case "encryption_key":
+		s.EncryptionKey = value
+	case "lock_lease":
+		lease, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid lock_lease value %q", value)
+		}
+		s.LockLease = lease
+	case "chunk_min", "chunk_avg", "chunk_max":
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid %s value %q", key, value)
+		}
+		switch key {
+		case "chunk_min":
+			s.ChunkMin = size
+		case "chunk_avg":
+			s.ChunkAvg = size
+		case "chunk_max":
+			s.ChunkMax = size
+		}
+	case "cache_size", "remote_quota":
+		size, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || size < 0 {
+			return fmt.Errorf("invalid %s value %q", key, value)
+		}
+		if key == "cache_size" {
+			s.CacheSize = size
+		} else {
+			s.RemoteQuota = size
+		}
+	default:
+		return fmt.Errorf("unknown setting %q", key)
+	}
+	s.Sources[key] = src
+	return nil
+}
+
+// Get returns the value of the setting `key` as a string (the API key is masked)
+func (s *Settings) Get(key string) string {
+	switch key {
+	case "mountpoint":
+		return s.Mountpoint
+	case "host":
+		return s.Host
+	case "api_key":
+		if s.APIKey == "" {
+			return ""
+		}
+		return "********"
+	case "hostname":
+		return s.Hostname
+	case "loglevel":
+		return s.LogLevel
+	case "var_dir":
+		return s.VarDir
+	case "immutable":
+		return strconv.FormatBool(s.Immutable)
+	case "app_port":
+		return strconv.Itoa(s.AppPort)
+	case "encrypt":
+		return strconv.FormatBool(s.Encrypt)
+	case "encryption_key":
+		return s.EncryptionKey
+	case "chunk_min":
+		return strconv.Itoa(s.ChunkMin)
+	case "chunk_avg":
+		return strconv.Itoa(s.ChunkAvg)
+	case "chunk_max":
+		return strconv.Itoa(s.ChunkMax)
+	case "lock_lease":
+		return strconv.FormatBool(s.LockLease)
+	case "cache_size":
+		return strconv.FormatInt(s.CacheSize, 10)
+	case "remote_quota":
+		return strconv.FormatInt(s.RemoteQuota, 10)
+	}
+	return ""
+}
+
+// expandHome replaces a leading `~` with the home directory
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[1:])
+	}
+	return path
+}
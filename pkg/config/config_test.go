@@ -0,0 +1,125 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	f, err := ioutil.TempFile("", "blobfs_config")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+filesystems:
+  documents:
+    mountpoint: ~/docs
+    host: http://localhost:8050
+  archives:
+    mountpoint: /mnt/archives
+    immutable: true
+`)
+	f.Close()
+
+	conf, err := Load(f.Name())
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	names := conf.Names()
+	if len(names) != 2 || names[0] != "archives" || names[1] != "documents" {
+		t.Fatalf("bad names %v", names)
+	}
+	docs := conf.Filesystems["documents"]
+	if docs.Name != "documents" || docs.Host != "http://localhost:8050" || docs.Immutable {
+		t.Errorf("bad documents config %+v", docs)
+	}
+	if expected := filepath.Join(os.Getenv("HOME"), "docs"); docs.Mountpoint != expected {
+		t.Errorf("~ should be expanded, expected %s, got %s", expected, docs.Mountpoint)
+	}
+	if archives := conf.Filesystems["archives"]; !archives.Immutable || archives.Mountpoint != "/mnt/archives" {
+		t.Errorf("bad archives config %+v", archives)
+	}
+}
+
+func TestSettings(t *testing.T) {
+	f, err := ioutil.TempFile("", "blobfs_config")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`
+host: http://global:8050
+api_key: global
+loglevel: debug
+filesystems:
+  documents:
+    mountpoint: /mnt/docs
+    host: http://docs:8050
+    app_port: 8031
+`)
+	f.Close()
+
+	conf, err := Load(f.Name())
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	os.Setenv(EnvAPIKey, "env")
+	defer os.Unsetenv(EnvAPIKey)
+	os.Unsetenv(EnvHost)
+	os.Unsetenv(EnvLogLevel)
+
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.String("loglevel", "info", "")
+	flags.Bool("immutable", false, "")
+	flags.Int("app-port", DefaultAppPort, "")
+	if err := flags.Parse([]string{"-loglevel", "crit"}); err != nil {
+		t.Fatalf("failed to parse flags: %v", err)
+	}
+
+	s, err := conf.Settings("documents", flags)
+	if err != nil {
+		t.Fatalf("failed to resolve settings: %v", err)
+	}
+	for _, tdata := range []struct {
+		key, value string
+		src        Source
+	}{
+		{"mountpoint", "/mnt/docs", SourceConfig},
+		{"host", "http://docs:8050", SourceConfig},
+		{"api_key", "********", SourceEnv},
+		{"loglevel", "crit", SourceFlag},
+		{"immutable", "false", SourceDefault},
+		{"app_port", "8031", SourceConfig},
+	} {
+		if v := s.Get(tdata.key); v != tdata.value {
+			t.Errorf("bad %s value, expected %q, got %q", tdata.key, tdata.value, v)
+		}
+		if src := s.Sources[tdata.key]; src != tdata.src {
+			t.Errorf("bad %s source, expected %s, got %s", tdata.key, tdata.src, src)
+		}
+	}
+	if s.APIKey != "env" {
+		t.Errorf("env should override the config, got %q", s.APIKey)
+	}
+
+	// Unknown FS only get the global settings
+	s, err = conf.Settings("other", nil)
+	if err != nil {
+		t.Fatalf("failed to resolve settings: %v", err)
+	}
+	if s.Host != "http://global:8050" || s.LogLevel != "debug" || s.AppPort != DefaultAppPort || s.Mountpoint != "" {
+		t.Errorf("bad global settings %+v", s)
+	}
+
+	flags = flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.Bool("immutable", false, "")
+	flags.Parse([]string{"-immutable"})
+	if s, err := conf.Settings("documents", flags); err != nil || !s.Immutable || s.Sources["immutable"] != SourceFlag {
+		t.Errorf("the -immutable flag should be used, got %+v (err=%v)", s, err)
+	}
+}
@@ -0,0 +1,138 @@
+package encryption
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dchest/blake2b"
+	"github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+	"golang.org/x/net/context"
+)
+
+// Key of the lookup entries (keyed hash of the plaintext hash), the ref of the entry is the hash of the encrypted blob
+var blobLookupKeyFmt = "blobfs:blob:%v"
+
+// BlobStore encrypts the blobs before storing them in the wrapped (remote) BlobStore. The encrypted blobs are
+// content-addressed like any other blob (BlobStash checks it), a lookup entry stored in the remote kvstore maps the
+// keyed hash of the plaintext hash to the hash of the encrypted blob.
+type BlobStore struct {
+	bs  blobstore.BlobStore
+	kvs KvStore
+	key *Key
+
+	refs map[string]string // Cached lookup entries (keyed hash -> encrypted blob hash)
+	mu   sync.Mutex
+}
+
+func NewBlobStore(bs blobstore.BlobStore, kvs KvStore, key *Key) *BlobStore {
+	return &BlobStore{bs: bs, kvs: kvs, key: key, refs: map[string]string{}}
+}
+
+// Public returns the wrapped BlobStore, used to upload the blobs of the public nodes in plaintext (so BlobStash can
+// serve them)
+func (bs *BlobStore) Public() blobstore.BlobStore {
+	return bs.bs
+}
+
+func (bs *BlobStore) Close() error {
+	return bs.bs.Close()
+}
+
+// ref returns the hash of the encrypted blob for the plaintext hash `hash`, or `blobstore.ErrBlobNotFound`
+func (bs *BlobStore) ref(hash string) (string, error) {
+	keyed := bs.key.Hash(hash)
+	bs.mu.Lock()
+	ref, ok := bs.refs[keyed]
+	bs.mu.Unlock()
+	if ok {
+		return ref, nil
+	}
+
+	kv, err := bs.kvs.Get(fmt.Sprintf(blobLookupKeyFmt, keyed), -1)
+	switch err {
+	case nil:
+	case kvstore.ErrKeyNotFound:
+		return "", blobstore.ErrBlobNotFound
+	default:
+		return "", err
+	}
+	if kv.Hash == "" {
+		// The blob has been removed
+		return "", blobstore.ErrBlobNotFound
+	}
+	bs.setRef(keyed, kv.Hash)
+	return kv.Hash, nil
+}
+
+func (bs *BlobStore) setRef(keyed, ref string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if ref == "" {
+		delete(bs.refs, keyed)
+		return
+	}
+	bs.refs[keyed] = ref
+}
+
+func (bs *BlobStore) Put(hash string, data []byte) error {
+	encrypted := bs.key.EncryptBlob(hash, data)
+	ref := fmt.Sprintf("%x", blake2b.Sum256(encrypted))
+	if err := bs.bs.Put(ref, encrypted); err != nil {
+		return err
+	}
+	// The lookup entry is only stored once the blob is, so a blob found via `Stat` can always be fetched
+	keyed := bs.key.Hash(hash)
+	if _, err := bs.kvs.Put(fmt.Sprintf(blobLookupKeyFmt, keyed), ref, nil, -1); err != nil {
+		return err
+	}
+	bs.setRef(keyed, ref)
+	return nil
+}
+
+func (bs *BlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	ref, err := bs.ref(hash)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := bs.bs.Get(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	// The nonce is derived from the plaintext hash, so a lookup entry pointing to another blob is detected
+	return bs.key.DecryptBlob(hash, blob)
+}
+
+func (bs *BlobStore) Stat(hash string) (bool, error) {
+	_, err := bs.ref(hash)
+	switch err {
+	case nil:
+		return true, nil
+	case blobstore.ErrBlobNotFound:
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+func (bs *BlobStore) Remove(hash string) error {
+	ref, err := bs.ref(hash)
+	if err != nil {
+		return err
+	}
+	if err := bs.bs.Remove(ref); err != nil {
+		return err
+	}
+	// The kvstore can't delete keys, an empty ref marks the blob as removed
+	keyed := bs.key.Hash(hash)
+	if _, err := bs.kvs.Put(fmt.Sprintf(blobLookupKeyFmt, keyed), "", nil, -1); err != nil {
+		return err
+	}
+	bs.setRef(keyed, "")
+	return nil
+}
+
+// Iter is not supported since the keyed hashes can't be reversed
+func (bs *BlobStore) Iter(fn func(hash string) error) error {
+	return blobstore.ErrNotSupported
+}
@@ -0,0 +1,168 @@
+/*
+
+Package encryption implements the client-side encryption of the data sent to BlobStash.
+
+The remote blobstore and the remote kvstore are wrapped, so the blobs and the root JSON are encrypted before leaving
+the machine (using NaCl secretbox). Every key is derived from a master key, itself derived from a passphrase or read
+from a keyfile.
+
+Blobs are encrypted with a nonce derived from their plaintext hash, so the same blob is always encrypted the same way
+and the dedup still works. The encrypted blobs are stored under their own hash, and a lookup entry keyed by a keyed
+hash of the plaintext hash is stored in the remote kvstore, so BlobStash never learns the content hashes.
+
+*/
+package encryption
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+// ErrDecrypt is returned when a blob/value can't be decrypted (wrong key or corrupted data)
+var ErrDecrypt = errors.New("failed to decrypt (wrong key?)")
+
+// ErrNotEncrypted is returned when a value is expected to be encrypted but is stored in plaintext (e.g. the FS was
+// pushed before enabling the encryption)
+var ErrNotEncrypted = errors.New("data is not encrypted")
+
+// Header of every encrypted payload (the last byte is the format version)
+var header = []byte("#blobfs/enc\x01")
+
+const (
+	keySize   = 32
+	nonceSize = 24
+)
+
+// Key is the master key, use `NewKey` to derive the sub-keys
+type Key struct {
+	hash [keySize]byte // Keyed hashes of the blob hashes
+	blob [keySize]byte // Blobs encryption
+	kv   [keySize]byte // Kv values encryption
+}
+
+// newKey derives the sub-keys from the master key
+func newKey(master []byte) (*Key, error) {
+	k := &Key{}
+	for _, sub := range []struct {
+		info string
+		key  *[keySize]byte
+	}{
+		{"blobfs hash", &k.hash},
+		{"blobfs blob", &k.blob},
+		{"blobfs kv", &k.kv},
+	} {
+		if _, err := io.ReadFull(hkdf.New(sha256.New, master, nil, []byte(sub.info)), sub.key[:]); err != nil {
+			return nil, err
+		}
+	}
+	return k, nil
+}
+
+// KeyFromPassphrase derives the key from a passphrase, the salt must be the same on every machine using the FS (the
+// FS name is used)
+func KeyFromPassphrase(passphrase, salt string) (*Key, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	master, err := scrypt.Key([]byte(passphrase), []byte("blobfs:"+salt), 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+	return newKey(master)
+}
+
+// KeyFromFile reads the key from a keyfile (at least 32 bytes, e.g. `head -c 32 /dev/urandom > keyfile`)
+func KeyFromFile(path string) (*Key, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < keySize {
+		return nil, fmt.Errorf("keyfile %s is too short (%d bytes, at least %d needed)", path, len(data), keySize)
+	}
+	return newKey(data)
+}
+
+// Hash returns the keyed hash of the blob hash, it is used as the remote hash
+func (k *Key) Hash(hash string) string {
+	mac := hmac.New(sha256.New, k.hash[:])
+	mac.Write([]byte(hash))
+	return fmt.Sprintf("%x", mac.Sum(nil))
+}
+
+// blobNonce returns the nonce used to encrypt the blob `hash`, derived from the hash so the encryption is
+// deterministic (a nonce is only reused for the same plaintext)
+func (k *Key) blobNonce(hash string) *[nonceSize]byte {
+	mac := hmac.New(sha256.New, k.blob[:])
+	mac.Write([]byte(hash))
+	nonce := &[nonceSize]byte{}
+	copy(nonce[:], mac.Sum(nil))
+	return nonce
+}
+
+// EncryptBlob encrypts the blob `hash`
+func (k *Key) EncryptBlob(hash string, data []byte) []byte {
+	return seal(&k.blob, k.blobNonce(hash), data)
+}
+
+// DecryptBlob decrypts the blob `hash`, it also checks that the blob is actually the requested one
+func (k *Key) DecryptBlob(hash string, data []byte) ([]byte, error) {
+	nonce, plain, err := open(&k.blob, data)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(nonce[:], k.blobNonce(hash)[:]) {
+		return nil, ErrDecrypt
+	}
+	return plain, nil
+}
+
+// Encrypt encrypts a value using a random nonce
+func (k *Key) Encrypt(data []byte) ([]byte, error) {
+	nonce := &[nonceSize]byte{}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return seal(&k.kv, nonce, data), nil
+}
+
+// Decrypt decrypts a value encrypted with `Encrypt`
+func (k *Key) Decrypt(data []byte) ([]byte, error) {
+	_, plain, err := open(&k.kv, data)
+	return plain, err
+}
+
+// seal returns the header, the nonce and the encrypted data
+func seal(key *[keySize]byte, nonce *[nonceSize]byte, data []byte) []byte {
+	out := make([]byte, 0, len(header)+nonceSize+len(data)+secretbox.Overhead)
+	out = append(out, header...)
+	out = append(out, nonce[:]...)
+	return secretbox.Seal(out, data, nonce, key)
+}
+
+func open(key *[keySize]byte, data []byte) (*[nonceSize]byte, []byte, error) {
+	if !bytes.HasPrefix(data, header) {
+		return nil, nil, ErrNotEncrypted
+	}
+	data = data[len(header):]
+	if len(data) < nonceSize+secretbox.Overhead {
+		return nil, nil, ErrDecrypt
+	}
+	nonce := &[nonceSize]byte{}
+	copy(nonce[:], data[:nonceSize])
+	plain, ok := secretbox.Open(nil, data[nonceSize:], nonce, key)
+	if !ok {
+		return nil, nil, ErrDecrypt
+	}
+	return nonce, plain, nil
+}
@@ -0,0 +1,180 @@
+package encryption
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dchest/blake2b"
+	"github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobfs/pkg/blobstore/blobstoretest"
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+	"golang.org/x/net/context"
+)
+
+func testKey(t *testing.T, passphrase string) *Key {
+	key, err := KeyFromPassphrase(passphrase, "test")
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	return key
+}
+
+func TestBlobStore(t *testing.T) {
+	kvs := &memoryKv{kvs: map[string][]*kvstore.KeyValue{}}
+	blobstoretest.TestBlobStore(t, NewBlobStore(blobstore.NewMemory(), kvs, testKey(t, "secret")))
+}
+
+func TestBlobs(t *testing.T) {
+	remote := blobstore.NewMemory()
+	kvs := &memoryKv{kvs: map[string][]*kvstore.KeyValue{}}
+	key := testKey(t, "secret")
+	bs := NewBlobStore(remote, kvs, key)
+
+	blob := blobstoretest.RandomBlob(512)
+	if err := bs.Put(blob.Hash, blob.Data); err != nil {
+		t.Fatalf("failed to put blob: %v", err)
+	}
+
+	// The remote only knows the encrypted data (stored under its own hash), and the keyed hash in the lookup entry
+	if ok, _ := remote.Stat(blob.Hash); ok {
+		t.Errorf("the plaintext hash should not be stored remotely")
+	}
+	lookup, err := kvs.Get(fmt.Sprintf(blobLookupKeyFmt, key.Hash(blob.Hash)), -1)
+	if err != nil {
+		t.Fatalf("failed to get the lookup entry: %v", err)
+	}
+	encrypted, err := remote.Get(context.Background(), lookup.Hash)
+	if err != nil {
+		t.Fatalf("failed to get the remote blob: %v", err)
+	}
+	if hash := fmt.Sprintf("%x", blake2b.Sum256(encrypted)); hash != lookup.Hash {
+		t.Errorf("the encrypted blob should be stored under its hash %v, got %v", hash, lookup.Hash)
+	}
+	if bytes.Contains(encrypted, blob.Data[:64]) {
+		t.Errorf("the remote blob should be encrypted")
+	}
+
+	// The encryption is deterministic so the dedup still works
+	if again := key.EncryptBlob(blob.Hash, blob.Data); !bytes.Equal(again, encrypted) {
+		t.Errorf("encrypting the same blob twice should give the same result")
+	}
+
+	// A blob can't be served in place of another one
+	other := blobstoretest.RandomBlob(512)
+	kvs.Put(fmt.Sprintf(blobLookupKeyFmt, key.Hash(other.Hash)), lookup.Hash, nil, -1)
+	if _, err := bs.Get(context.Background(), other.Hash); err != ErrDecrypt {
+		t.Errorf("swapped blob should return ErrDecrypt, got %v", err)
+	}
+
+	// Using the wrong key
+	if _, err := NewBlobStore(remote, kvs, testKey(t, "wrong")).Get(context.Background(), blob.Hash); err != blobstore.ErrBlobNotFound {
+		t.Errorf("the keyed hash depends on the key, expected ErrBlobNotFound, got %v", err)
+	}
+	wrong := testKey(t, "wrong")
+	if _, err := wrong.DecryptBlob(blob.Hash, encrypted); err != ErrDecrypt {
+		t.Errorf("decrypting with the wrong key should return ErrDecrypt, got %v", err)
+	}
+
+	// The removed blob is not found by another instance either (e.g. another host)
+	if err := bs.Remove(blob.Hash); err != nil {
+		t.Fatalf("failed to remove blob: %v", err)
+	}
+	if ok, err := NewBlobStore(remote, kvs, key).Stat(blob.Hash); ok || err != nil {
+		t.Errorf("the removed blob should not be found, got %v (%v)", ok, err)
+	}
+}
+
+type memoryKv struct {
+	kvs map[string][]*kvstore.KeyValue
+}
+
+func (m *memoryKv) Get(key string, version int) (*kvstore.KeyValue, error) {
+	versions := m.kvs[key]
+	if len(versions) == 0 {
+		return nil, kvstore.ErrKeyNotFound
+	}
+	kv := *versions[len(versions)-1]
+	return &kv, nil
+}
+
+func (m *memoryKv) Put(key, ref string, data []byte, version int) (*kvstore.KeyValue, error) {
+	kv := &kvstore.KeyValue{Key: key, Hash: ref, Data: data, Version: version}
+	m.kvs[key] = append(m.kvs[key], kv)
+	res := *kv
+	return &res, nil
+}
+
+func (m *memoryKv) Versions(key string, start, end, limit int) (*kvstore.KeyValueVersions, error) {
+	res := &kvstore.KeyValueVersions{Key: key}
+	for _, kv := range m.kvs[key] {
+		v := *kv
+		res.Versions = append(res.Versions, &v)
+	}
+	return res, nil
+}
+
+func TestKvStore(t *testing.T) {
+	remote := &memoryKv{kvs: map[string][]*kvstore.KeyValue{}}
+	kvs := NewKvStore(remote, testKey(t, "secret"))
+
+	root := []byte(`{"ref":"abcd"}`)
+	for version := 1; version <= 2; version++ {
+		if _, err := kvs.Put("blobfs:root:test", "", root, version); err != nil {
+			t.Fatalf("failed to put: %v", err)
+		}
+	}
+	if bytes.Contains(remote.kvs["blobfs:root:test"][0].Data, root) {
+		t.Errorf("the remote value should be encrypted")
+	}
+
+	kv, err := kvs.Get("blobfs:root:test", -1)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if !bytes.Equal(kv.Data, root) || kv.Version != 2 {
+		t.Errorf("bad kv %+v", kv)
+	}
+	versions, err := kvs.Versions("blobfs:root:test", 0, -1, 0)
+	if err != nil {
+		t.Fatalf("failed to get versions: %v", err)
+	}
+	if len(versions.Versions) != 2 || !bytes.Equal(versions.Versions[0].Data, root) {
+		t.Errorf("bad versions %+v", versions)
+	}
+
+	// A plaintext value (pushed before enabling the encryption) is rejected
+	remote.Put("blobfs:root:old", "", root, 1)
+	if _, err := kvs.Get("blobfs:root:old", -1); err != ErrNotEncrypted {
+		t.Errorf("plaintext value should return ErrNotEncrypted, got %v", err)
+	}
+}
+
+func TestKeyFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobfs_encryption")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyfile")
+	ioutil.WriteFile(path, []byte("short"), 0600)
+	if _, err := KeyFromFile(path); err == nil {
+		t.Errorf("a short keyfile should be rejected")
+	}
+	ioutil.WriteFile(path, bytes.Repeat([]byte("k"), 32), 0600)
+	key1, err := KeyFromFile(path)
+	if err != nil {
+		t.Fatalf("failed to load keyfile: %v", err)
+	}
+	key2, _ := KeyFromFile(path)
+	if key1.Hash("abcd") != key2.Hash("abcd") {
+		t.Errorf("the same keyfile should give the same key")
+	}
+	if key1.Hash("abcd") == testKey(t, "secret").Hash("abcd") {
+		t.Errorf("different keys should give different hashes")
+	}
+}
@@ -0,0 +1,68 @@
+package encryption
+
+import (
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+)
+
+// KvStore is the remote kvstore API (`kvstore.KvStore` implements it)
+type KvStore interface {
+	Get(key string, version int) (*kvstore.KeyValue, error)
+	Put(key, ref string, data []byte, version int) (*kvstore.KeyValue, error)
+	Versions(key string, start, end, limit int) (*kvstore.KeyValueVersions, error)
+}
+
+// Kv encrypts the values (e.g. the root JSON) before storing them in the wrapped KvStore, keys are kept in plaintext
+type Kv struct {
+	kvs KvStore
+	key *Key
+}
+
+func NewKvStore(kvs KvStore, key *Key) *Kv {
+	return &Kv{kvs: kvs, key: key}
+}
+
+func (kv *Kv) decrypt(res *kvstore.KeyValue) error {
+	data, err := kv.key.Decrypt(res.Data)
+	if err != nil {
+		return err
+	}
+	res.Data = data
+	return nil
+}
+
+func (kv *Kv) Get(key string, version int) (*kvstore.KeyValue, error) {
+	res, err := kv.kvs.Get(key, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := kv.decrypt(res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (kv *Kv) Put(key, ref string, data []byte, version int) (*kvstore.KeyValue, error) {
+	encrypted, err := kv.key.Encrypt(data)
+	if err != nil {
+		return nil, err
+	}
+	res, err := kv.kvs.Put(key, ref, encrypted, version)
+	if err != nil {
+		return nil, err
+	}
+	res.Data = data
+	return res, nil
+}
+
+func (kv *Kv) Versions(key string, start, end, limit int) (*kvstore.KeyValueVersions, error) {
+	res, err := kv.kvs.Versions(key, start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range res.Versions {
+		if err := kv.decrypt(v); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
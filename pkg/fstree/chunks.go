@@ -0,0 +1,67 @@
+package fstree
+
+import (
+	"sort"
+
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+)
+
+// dirtyRanges keeps track of the modified byte ranges of an open file, as sorted and non-overlapping [start, end)
+// ranges
+type dirtyRanges [][2]int
+
+// add marks [start, end) as modified, merging the overlapping/adjacent ranges
+func (r dirtyRanges) add(start, end int) dirtyRanges {
+	if start >= end {
+		return r
+	}
+	// First range ending at or after `start`
+	i := sort.Search(len(r), func(i int) bool { return r[i][1] >= start })
+	j := i
+	for j < len(r) && r[j][0] <= end {
+		if r[j][0] < start {
+			start = r[j][0]
+		}
+		if r[j][1] > end {
+			end = r[j][1]
+		}
+		j++
+	}
+	out := make(dirtyRanges, 0, len(r)-(j-i)+1)
+	out = append(out, r[:i]...)
+	out = append(out, [2]int{start, end})
+	return append(out, r[j:]...)
+}
+
+// overlaps returns true if [start, end) overlaps a modified range
+func (r dirtyRanges) overlaps(start, end int) bool {
+	i := sort.Search(len(r), func(i int) bool { return r[i][1] > start })
+	return i < len(r) && r[i][0] < end
+}
+
+// fileChunk is a blob of a file, stored at [start, end)
+type fileChunk struct {
+	start int
+	end   int
+	hash  string
+}
+
+// fileChunks returns the chunks of the file meta (the refs index is the end offset of the blob)
+func fileChunks(m *meta.Meta) []*fileChunk {
+	chunks := []*fileChunk{}
+	var start int
+	for _, iref := range m.Refs {
+		data, ok := iref.([]interface{})
+		if !ok || len(data) != 2 {
+			return nil
+		}
+		hash, ok := data[1].(string)
+		if !ok {
+			return nil
+		}
+		end := refIndex(data[0])
+		chunks = append(chunks, &fileChunk{start, end, hash})
+		start = end
+	}
+	return chunks
+}
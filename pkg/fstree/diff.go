@@ -0,0 +1,225 @@
+package fstree
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+	"github.com/tsileo/blobstash/pkg/filetree/reader/filereader"
+)
+
+const (
+	// wipRef can be used in place of a ref to target the current WIP root
+	wipRef = "WIP"
+
+	// Files bigger than this won't be diffed
+	maxTextDiffSize = 1 << 20
+)
+
+type DiffResp struct {
+	A       string    `json:"a"`
+	B       string    `json:"b"`
+	Changes []*Change `json:"changes"`
+}
+
+// resolveRef returns the root dir for the given ref, a ref can be a root hash (or a prefix of it), the name of a
+// snapshot (as displayed in the `.snapshots` directory) or `WIP` for the current root (the FS lock must be held to
+// use it). `ErrAmbiguousRef` is returned if a prefix matches snapshots of different roots.
+func (f *FS) resolveRef(ref string) (*Dir, error) {
+	if ref == wipRef {
+		return f.root, nil
+	}
+	snapshots, err := f.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	// Look for the newest matching snapshot first (the same root may have been snapshotted several times)
+	var match *Snapshot
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		if s.Name == ref {
+			match = s
+			break
+		}
+		if !strings.HasPrefix(s.Root.Ref, ref) {
+			continue
+		}
+		if match == nil {
+			match = s
+			continue
+		}
+		if match.Root.Ref != s.Root.Ref {
+			return nil, ErrAmbiguousRef
+		}
+	}
+	if match != nil {
+		_, dir, err := f.kvDataToDir(match.Data, match.Version)
+		if err != nil {
+			return nil, err
+		}
+		dir.immutable = true
+		return dir, nil
+	}
+	// The ref may be a (not retained) full hash
+	if len(ref) == 64 {
+		m, err := f.metaFromHash(ref)
+		if err != nil {
+			return nil, err
+		}
+		dir, err := NewDir(f, m, nil)
+		if err != nil {
+			return nil, err
+		}
+		dir.immutable = true
+		return dir, nil
+	}
+	return nil, ErrUnknownRef
+}
+
+// looksLikeText returns true if the given content seems to be text (valid UTF-8 without NUL bytes)
+func looksLikeText(data []byte) bool {
+	return !bytes.Contains(data, []byte{0}) && utf8.Valid(data)
+}
+
+// fileContent returns the content of the file with the given meta ref, an empty ref returns no content
+func (f *FS) fileContent(ref string) ([]byte, error) {
+	if ref == "" {
+		return []byte{}, nil
+	}
+	m, err := f.metaFromHash(ref)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Refs) == 0 {
+		return []byte{}, nil
+	}
+	ff := filereader.NewFile(f.bs, m)
+	defer ff.Close()
+	return ioutil.ReadAll(ff)
+}
+
+// textDiff returns the unified diff of the change, or an empty string if one of the file doesn't look like text
+func (f *FS) textDiff(c *Change) (string, error) {
+	if c.IsDir || c.Size > maxTextDiffSize || c.OldSize > maxTextDiffSize {
+		return "", nil
+	}
+	a, err := f.fileContent(c.OldRef)
+	if err != nil {
+		return "", err
+	}
+	b, err := f.fileContent(c.Ref)
+	if err != nil {
+		return "", err
+	}
+	if !looksLikeText(a) || !looksLikeText(b) {
+		return "", nil
+	}
+	fromFile := "a" + c.Path
+	if c.OldPath != "" {
+		fromFile = "a" + c.OldPath
+	}
+	if c.Op == changeAdded {
+		fromFile = "/dev/null"
+	}
+	toFile := "b" + c.Path
+	if c.Op == changeDeleted {
+		toFile = "/dev/null"
+	}
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(a)),
+		B:        difflib.SplitLines(string(b)),
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  3,
+	})
+}
+
+// Diff computes the changes between two refs (default to the last pushed root and the WIP root), only the changes
+// under `path` are returned if it's not empty. If `text` is true, unified diffs are computed for text files.
+// The snapshots are indexed and the contents are fetched without holding the FS lock, it's only held while indexing
+// the current tree.
+func (f *FS) Diff(refA, refB, path string, text bool) (*DiffResp, error) {
+	if refB == "" {
+		refB = wipRef
+	}
+	resp := &DiffResp{Changes: []*Change{}}
+	var indexA, indexB map[string]*meta.Meta
+	var err error
+	if refA != wipRef {
+		var dirA *Dir
+		if refA == "" {
+			dirA, err = f.pushedDir()
+		} else {
+			dirA, err = f.resolveRef(refA)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if dirA != nil {
+			resp.A = dirA.meta.Hash
+		}
+		if indexA, err = f.dirIndex(dirA); err != nil {
+			return nil, err
+		}
+	}
+	if refB != wipRef {
+		dirB, err := f.resolveRef(refB)
+		if err != nil {
+			return nil, err
+		}
+		resp.B = dirB.meta.Hash
+		if indexB, err = f.dirIndex(dirB); err != nil {
+			return nil, err
+		}
+	}
+
+	// The current tree is needed for the ignore patterns (ignored nodes only exist in the WIP roots, they're skipped)
+	var renames map[string]string
+	if err := f.lockTree(false); err != nil {
+		return nil, err
+	}
+	matcher, err := f.ignoreMatcher(f.root)
+	if err == nil && refA == wipRef {
+		resp.A = f.root.meta.Hash
+		indexA, err = f.dirIndex(f.root)
+	}
+	if err == nil && refB == wipRef {
+		resp.B = f.root.meta.Hash
+		indexB, err = f.dirIndex(f.root)
+	}
+	// The tracked renames are relative to the last pushed root
+	if refA == "" && refB == wipRef {
+		renames = map[string]string{}
+		for p, from := range f.renames {
+			renames[p] = from
+		}
+	}
+	f.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	filterIndex(indexA, matcher)
+	filterIndex(indexB, matcher)
+
+	for _, c := range diffIndex(indexA, indexB, renames) {
+		if path != "" && path != "/" && !inPath(c.Path, path) && !inPath(c.OldPath, path) {
+			continue
+		}
+		if text {
+			c.Diff, err = f.textDiff(c)
+			if err != nil {
+				return nil, err
+			}
+		}
+		resp.Changes = append(resp.Changes, c)
+	}
+	return resp, nil
+}
+
+// inPath returns true if `p` is `root` or one of its children
+func inPath(p, root string) bool {
+	return p == root || strings.HasPrefix(p, root+"/")
+}
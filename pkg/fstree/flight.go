@@ -0,0 +1,84 @@
+package fstree
+
+import (
+	"sync"
+
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+	"golang.org/x/net/context"
+)
+
+// flightGroup deduplicates the concurrent calls sharing the same key, the callers arriving while a call is on-going
+// wait for it and get its result (used for the network fetches, so a cold dir is only fetched once)
+type flightGroup struct {
+	calls map[string]*flightCall
+	mu    sync.Mutex
+}
+
+type flightCall struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+func (g *flightGroup) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flightCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-c.done
+		return c.val, c.err
+	}
+	c := &flightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	c.val, c.err = fn()
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(c.done)
+	return c.val, c.err
+}
+
+// getBlob fetches a blob, the concurrent fetches of the same blob are shared (the blob must not be modified)
+func (f *FS) getBlob(hash string) ([]byte, error) {
+	v, err := f.flights.do("blob:"+hash, func() (interface{}, error) {
+		return f.bs.Get(context.TODO(), hash)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// fetchChildren fetches the metas blobs of the children of the dir meta `m`, the concurrent fetches of the same dir
+// are shared (each caller decodes its own metas since they are modified in place)
+func (f *FS) fetchChildren(m *meta.Meta) ([][]byte, error) {
+	v, err := f.flights.do("dir:"+m.Hash, func() (interface{}, error) {
+		blobs := [][]byte{}
+		for _, ref := range m.Refs {
+			blob, err := f.getBlob(ref.(string))
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, blob)
+		}
+		return blobs, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([][]byte), nil
+}
+
+// sharedBlobs reads the blobs using `getBlob`, it's used to load the files content
+type sharedBlobs struct {
+	fs *FS
+}
+
+func (bs sharedBlobs) Get(ctx context.Context, hash string) ([]byte, error) {
+	return bs.fs.getBlob(hash)
+}
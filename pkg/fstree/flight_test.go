@@ -0,0 +1,281 @@
+package fstree
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tsileo/blobfs/pkg/blobstashtest"
+	"golang.org/x/net/context"
+)
+
+// blockingBlobStore blocks the blob fetches until `unblock` is closed, and counts them
+type blockingBlobStore struct {
+	BlobStore
+	blocked chan struct{} // Receives a value for each blocked fetch
+	unblock chan struct{}
+	mu      sync.Mutex
+	gets    int
+}
+
+func (bs *blockingBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	bs.mu.Lock()
+	bs.gets++
+	bs.mu.Unlock()
+	select {
+	case bs.blocked <- struct{}{}:
+	default:
+	}
+	<-bs.unblock
+	return bs.BlobStore.Get(ctx, hash)
+}
+
+func TestColdDirFetch(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+
+	root := f.Root()
+	cold, err := root.Mkdir("cold")
+	if err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		createTestFile(t, cold, fmt.Sprintf("file%d.txt", i), "data")
+	}
+	// Drop the children so the next access has to fetch them
+	f.mu.Lock()
+	cold.Children = nil
+	f.mu.Unlock()
+
+	bs := &blockingBlobStore{BlobStore: f.bs, blocked: make(chan struct{}, 1), unblock: make(chan struct{})}
+	f.bs = bs
+
+	errc := make(chan error, 2)
+	lookup := func() {
+		_, err := cold.Lookup("file0.txt")
+		errc <- err
+	}
+	go lookup()
+	<-bs.blocked
+	go lookup()
+
+	// The other operations are not blocked by the fetch
+	done := make(chan error, 1)
+	go func() {
+		_, err := root.Mkdir("other")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("mkdir is blocked by the fetch")
+	}
+
+	close(bs.unblock)
+	for i := 0; i < 2; i++ {
+		if err := <-errc; err != nil {
+			t.Errorf("lookup failed: %v", err)
+		}
+	}
+	// The concurrent lookups shared the fetch
+	if bs.gets != 3 {
+		t.Errorf("3 fetches expected (one per child), got %d", bs.gets)
+	}
+}
+
+func TestConcurrentOps(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+
+	root := f.Root()
+	dirs := []*Dir{}
+	for i := 0; i < 4; i++ {
+		d, err := root.Mkdir(fmt.Sprintf("dir%d", i))
+		if err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+		dirs = append(dirs, d)
+	}
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 64)
+	for i, d := range dirs {
+		wg.Add(1)
+		go func(i int, d *Dir) {
+			defer wg.Done()
+			file, err := d.Create("file.txt", 0644)
+			if err != nil {
+				errc <- err
+				return
+			}
+			for j := 0; j < 10; j++ {
+				if _, err := file.Write([]byte(fmt.Sprintf("%d-%d\n", i, j)), int64(j*4)); err != nil {
+					errc <- err
+					return
+				}
+				if err := file.Flush(); err != nil {
+					errc <- err
+					return
+				}
+			}
+			if err := file.Release(); err != nil {
+				errc <- err
+			}
+		}(i, d)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 10; j++ {
+			if _, err := root.ReadDir(); err != nil {
+				errc <- err
+				return
+			}
+			if _, err := f.FlushAll(); err != nil {
+				errc <- err
+				return
+			}
+			if _, _, err := f.Usage(); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := root.Rename("dir0", dirs[1], "moved"); err != nil {
+			errc <- err
+		}
+	}()
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Errorf("concurrent op failed: %v", err)
+	}
+
+	expected := func(i int) string {
+		var out string
+		for j := 0; j < 10; j++ {
+			out = out[:j*4] + fmt.Sprintf("%d-%d\n", i, j)
+		}
+		return out
+	}
+	expectFile(t, f, "/dir1/moved/file.txt", expected(0))
+	for i := 1; i < 4; i++ {
+		expectFile(t, f, fmt.Sprintf("/dir%d/file.txt", i), expected(i))
+	}
+}
+
+func TestColdUsage(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+
+	root := f.Root()
+	cold, err := root.Mkdir("cold")
+	if err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	createTestFile(t, cold, "file.txt", "data")
+	f.mu.Lock()
+	cold.Children = nil
+	f.mu.Unlock()
+
+	bs := &blockingBlobStore{BlobStore: f.bs, blocked: make(chan struct{}, 1), unblock: make(chan struct{})}
+	f.bs = bs
+
+	// A cold dir is not fetched to check if it's empty
+	if err := root.Rmdir("cold"); err != ErrNotEmpty {
+		t.Errorf("ErrNotEmpty expected, got %v", err)
+	}
+
+	type usage struct {
+		size  int64
+		nodes int
+		err   error
+	}
+	done := make(chan usage, 1)
+	go func() {
+		size, nodes, err := f.Usage()
+		done <- usage{size, nodes, err}
+	}()
+	<-bs.blocked
+	// The fetch doesn't block the other operations
+	if _, err := root.Lookup("cold"); err != nil {
+		t.Errorf("lookup failed: %v", err)
+	}
+	close(bs.unblock)
+	u := <-done
+	if u.err != nil {
+		t.Fatalf("usage failed: %v", u.err)
+	}
+	if u.size != 4 || u.nodes != 3 {
+		t.Errorf("4 bytes and 3 nodes expected, got %d bytes and %d nodes", u.size, u.nodes)
+	}
+}
+
+func TestPullFetch(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/a.txt", "a")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	writeTestFile(t, fs1, "/b.txt", "b")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	// Load the root so the mkdir below doesn't have to fetch it
+	if _, err := fs2.Root().ReadDir(); err != nil {
+		t.Fatalf("readdir failed: %v", err)
+	}
+	bs := &blockingBlobStore{BlobStore: fs2.bs, blocked: make(chan struct{}, 1), unblock: make(chan struct{})}
+	fs2.bs = bs
+	errc := make(chan error, 1)
+	go func() {
+		errc <- fs2.Pull()
+	}()
+	<-bs.blocked
+
+	// The other operations are not blocked while the remote tree is fetched
+	done := make(chan error, 1)
+	go func() {
+		_, err := fs2.Root().Mkdir("other")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("mkdir is blocked by the pull")
+	}
+
+	close(bs.unblock)
+	if err := <-errc; err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	// The local change is merged with the pulled one
+	expectFile(t, fs2, "/a.txt", "a")
+	expectFile(t, fs2, "/b.txt", "b")
+	if _, err := fs2.Root().Lookup("other"); err != nil {
+		t.Errorf("lookup failed: %v", err)
+	}
+}
@@ -0,0 +1,1589 @@
+/*
+
+Package fstree implements the BlobFS tree and its synchronization logic.
+
+The tree is made of `Dir` and `File` nodes backed by BlobStash metas. Every mutation is saved bottom-up until the root
+is reached, and the new root is stored as a WIP mutation in the local vkv store. `Push` uploads the tree to BlobStash
+and `Pull` fetches (and merge) the remote mutations.
+
+The package does not depend on FUSE, the blobstore and the kvstores are injected so the tree can be driven (and tested)
+without a kernel mount.
+
+Locking: the tree (the children of the dirs, the parent pointers, the metas, the WIP root and the mounts returned by
+`Mount`) is guarded by the FS RW lock, and the content of a file (its in-memory data and open state) by the file RW
+lock. A file meta is only replaced while holding both, so it can be read while holding either. The callers outside
+of the package read the metas with `FS.RLock` held. The locks are always acquired in this order:
+
+	(usage lock ->) file lock -> FS lock -> leaf locks (advisory locks, open files registry, stats)
+
+a file lock is never acquired while holding the FS lock. `Save` walks the tree bottom-up with the FS lock held for
+writing and never acquires a file lock, so it can't deadlock with the top-down operations. The blobs are fetched
+without holding the FS lock: the cold dirs are loaded first and the lock is acquired again (the operations walking
+the whole current tree like `Push`, `Pull` or `Status` load it entirely first, see `lockTree`), the concurrent fetches
+of the same blob or dir are shared. The snapshots, the pushed tree and the pulled one are not part of the current tree
+until they're swapped in, they're walked without holding the lock.
+
+There is a single tree lock, not one lock per dir: a save rewrites the meta of every dir up to the root and a rename
+may move a node between any two dirs, so a mutation needs the whole path anyway (the root being always part of it).
+Since no network I/O happens under the lock (the metas are saved in the local blobstore), the readers are only
+blocked for the duration of the in-memory update and the local writes.
+
+*/
+package fstree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tsileo/blobfs/pkg/chunker"
+	"github.com/tsileo/blobfs/pkg/ignore"
+	"github.com/tsileo/blobfs/pkg/root"
+
+	"github.com/tsileo/blobstash/pkg/client/clientutil"
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+	"github.com/tsileo/blobstash/pkg/filetree/writer"
+	"github.com/tsileo/blobstash/pkg/vkv"
+	"golang.org/x/net/context"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+var (
+	ErrImmutable = errors.New("node is immutable")
+	ErrNotFound  = errors.New("node not found")
+	ErrExists    = errors.New("node already exists")
+	ErrNoXattr   = errors.New("no such attribute")
+	ErrNotEmpty  = errors.New("directory not empty")
+	ErrNotDir    = errors.New("not a directory")
+	ErrIsDir     = errors.New("is a directory")
+
+	// ErrInvalid is returned for an invalid name, or when moving a directory inside itself
+	ErrInvalid = errors.New("invalid argument")
+
+	// ErrConflict is returned by `Push` when the remote has mutations that haven't been pulled yet
+	ErrConflict = errors.New("the remote has un-pulled mutations")
+
+	// ErrOutOfSync is returned when the local mutations are newer than the remote ones (e.g. the BlobStash
+	// instance was reset)
+	ErrOutOfSync = errors.New("BlobStash seems out of sync")
+
+	// ErrUnknownRef is returned when a ref can't be resolved to a snapshot
+	ErrUnknownRef = errors.New("unknown ref")
+
+	// ErrAmbiguousRef is returned when a ref prefix matches several snapshots
+	ErrAmbiguousRef = errors.New("ambiguous ref")
+)
+
+// BlobStore is where the tree blobs are stored, blobs are written locally and uploaded to BlobStash on push
+// (`cache.Cache` implements it)
+type BlobStore interface {
+	Get(ctx context.Context, hash string) ([]byte, error)
+	Put(hash string, blob []byte) error
+	Stat(hash string) (bool, error)
+	PutRemote(hash string, blob []byte) error
+	StatRemote(hash string) (bool, error)
+	Client() *clientutil.Client // Used for the filetree API (remote index/nodes)
+}
+
+// Syncer is implemented by the local stores buffering their writes (`cache.Cache` and the local blobstore implement
+// it), `Sync` returns once every previous write is durably stored
+type Syncer interface {
+	Sync() error
+}
+
+// PublicBlobStore is implemented by the BlobStores encrypting the remote blobs, the blobs of the public nodes are
+// uploaded in plaintext too so BlobStash can serve them (`cache.Cache` implements it)
+type PublicBlobStore interface {
+	PutRemotePublic(hash string, blob []byte) error
+	StatRemotePublic(hash string) (bool, error)
+}
+
+// KvStore is the remote versioned key-value store where the pushed mutations are stored (`kvstore.KvStore` implements it)
+type KvStore interface {
+	Get(key string, version int) (*kvstore.KeyValue, error)
+	Put(key, ref string, data []byte, version int) (*kvstore.KeyValue, error)
+	Versions(key string, start, end, limit int) (*kvstore.KeyValueVersions, error)
+}
+
+// LocalKvStore is the local versioned key-value store where both the WIP and the pushed mutations are stored
+// (`vkv.DB` implements it). `Put` must only return once the entry is durably stored (`vkv.DB` commits a transaction
+// for each `Put`), so there is nothing to sync.
+type LocalKvStore interface {
+	Get(key string, version int) (*vkv.KeyValue, error)
+	Put(key, ref string, data []byte, version int) (*vkv.KeyValue, error)
+	Versions(key string, start, end, limit int) (*vkv.KeyValueVersions, error)
+}
+
+type FS struct {
+	log log15.Logger
+
+	root *Dir
+
+	rkv KvStore      // remote vkv store
+	lkv LocalKvStore // local vkv store
+
+	bs       BlobStore        // blobstore.BlobStore wrapper
+	uploader *writer.Uploader // BlobStash FileTree client
+	chunker  *chunker.Chunker // Splits the files content into blobs
+
+	name      string
+	immutable bool
+
+	local  *Mount
+	remote *Mount
+
+	Stats *Stats
+
+	openFds   int                // Open file descriptors count
+	openFiles map[*File]struct{} // Files with at least one open file descriptor
+	filesMu   sync.Mutex         // Protects openFds/openFiles
+
+	flights flightGroup // Shares the concurrent blob fetches
+
+	leaseTTL time.Duration // TTL of the advisory cross-host lock leases (disabled if 0)
+	leaseMu  sync.Mutex    // Serializes the lease renewals and releases
+
+	usageMu sync.Mutex // Serializes the `Usage` calls, acquired before the file locks
+
+	renames map[string]string // Paths renamed since the last push (new path -> pushed path)
+	base    int               // Version of the last pushed (or pulled) root, the WIP roots are based on it
+
+	wg sync.WaitGroup // Track the on-going syncs
+	mu sync.RWMutex   // Tree lock, see the package doc for the lock order
+}
+
+// New returns a new FS, `Load` must be called before using it
+func New(logger log15.Logger, name string, bs BlobStore, lkv LocalKvStore, rkv KvStore, immutable bool) *FS {
+	return &FS{
+		log:       logger,
+		name:      name,
+		bs:        bs,
+		lkv:       lkv,
+		rkv:       rkv,
+		uploader:  writer.NewUploader(bs),
+		chunker:   chunker.Default(),
+		immutable: immutable,
+		Stats:     &Stats{LastReset: time.Now()},
+		openFiles: map[*File]struct{}{},
+		renames:   map[string]string{},
+	}
+}
+
+// SetChunker replaces the default chunker used to split the files content, it must be called before `Load`
+func (f *FS) SetChunker(c *chunker.Chunker) {
+	f.chunker = c
+}
+
+// Root returns the root dir of the FS
+func (f *FS) Root() *Dir {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.root
+}
+
+// Wait blocks until the on-going syncs are done
+func (f *FS) Wait() {
+	f.wg.Wait()
+}
+
+// OpenFiles returns the number of files with at least one open file descriptor
+func (f *FS) OpenFiles() int {
+	f.filesMu.Lock()
+	defer f.filesMu.Unlock()
+	return len(f.openFiles)
+}
+
+// FlushAll saves the in-memory content of the open files that were updated (the files stay open) and syncs the local
+// stores to disk, and returns the number of flushed files.
+func (f *FS) FlushAll() (int, error) {
+	f.filesMu.Lock()
+	files := make([]*File, 0, len(f.openFiles))
+	for file := range f.openFiles {
+		files = append(files, file)
+	}
+	f.filesMu.Unlock()
+
+	var flushed int
+	for _, file := range files {
+		file.mu.Lock()
+		var err error
+		if file.dirty() {
+			if err = file.flush(); err == nil {
+				flushed++
+			}
+		}
+		file.mu.Unlock()
+		if err != nil {
+			return flushed, err
+		}
+	}
+	return flushed, f.syncLocal()
+}
+
+// syncLocal flushes the local blobstore to disk, the local vkv store writes are already durable (see `LocalKvStore`)
+func (f *FS) syncLocal() error {
+	if s, ok := f.bs.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// addOpenFile registers a new file descriptor for `file`
+func (f *FS) addOpenFile(file *File) {
+	f.filesMu.Lock()
+	defer f.filesMu.Unlock()
+	f.openFds++
+	f.openFiles[file] = struct{}{}
+}
+
+// removeOpenFile unregisters a file descriptor for `file`, `last` is true for its last file descriptor
+func (f *FS) removeOpenFile(file *File, last bool) {
+	f.filesMu.Lock()
+	defer f.filesMu.Unlock()
+	f.openFds--
+	if last {
+		delete(f.openFiles, file)
+	}
+}
+
+// Lock acquires the FS lock for writing
+func (f *FS) Lock() {
+	f.mu.Lock()
+}
+
+// Unlock releases the FS lock
+func (f *FS) Unlock() {
+	f.mu.Unlock()
+}
+
+// RLock acquires the FS lock for reading, it must be held when reading nodes metas outside of the Dir/File methods
+// (which acquire it themselves), and must not be held when calling them
+func (f *FS) RLock() {
+	f.mu.RLock()
+}
+
+// RUnlock releases the FS lock acquired with `RLock`
+func (f *FS) RUnlock() {
+	f.mu.RUnlock()
+}
+
+// PublicNodes returns the metas of the public nodes (map[hash]*meta.Meta)
+func (f *FS) PublicNodes() (map[string]*meta.Meta, error) {
+	if err := f.lockTree(false); err != nil {
+		return nil, err
+	}
+	defer f.mu.RUnlock()
+
+	out := map[string]*meta.Meta{}
+	if err := iterDir(f.root, func(node Node) error {
+		if node.Meta().IsPublic() {
+			out[node.Meta().Hash] = node.Meta()
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// treeUsage is the total size of the files of a dir (recursively) and its number of nodes
+type treeUsage struct {
+	hash  string // Hash of the dir meta the usage was computed for
+	size  int64
+	nodes int
+}
+
+// Usage returns the total size of the files in the current tree (including the unsaved writes) and the number of nodes.
+// The usage of each dir is cached along with its meta hash, so only the dirs updated since the last call are walked
+// again.
+func (f *FS) Usage() (int64, int, error) {
+	f.usageMu.Lock()
+	defer f.usageMu.Unlock()
+
+	// The sizes of the open files are read first, the file locks can't be acquired while holding the FS lock
+	f.filesMu.Lock()
+	files := []*File{}
+	for file := range f.openFiles {
+		files = append(files, file)
+	}
+	f.filesMu.Unlock()
+	sizes := map[*File]int64{}
+	for _, file := range files {
+		sizes[file] = int64(file.Size())
+	}
+
+	for {
+		f.mu.RLock()
+		cold := []*Dir{}
+		u := f.dirUsage(f.root, &cold)
+		if len(cold) == 0 {
+			// Add the unsaved writes of the open files
+			for file, size := range sizes {
+				if f.attached(file) {
+					u.size += size - int64(file.meta.Size)
+				}
+			}
+		}
+		f.mu.RUnlock()
+		if len(cold) == 0 {
+			return u.size, u.nodes, nil
+		}
+
+		// The cold dirs are loaded without holding the FS lock, and the tree is walked again
+		for _, d := range cold {
+			if err := d.load(); err != nil {
+				return 0, 0, err
+			}
+		}
+	}
+}
+
+// dirUsage returns the usage of the dir, the cold dirs (not in the cache) are appended to `cold` and their usage is
+// not counted (the FS lock and the usage lock must be held)
+func (f *FS) dirUsage(d *Dir, cold *[]*Dir) treeUsage {
+	if d.meta.Hash != "" && d.usage.hash == d.meta.Hash {
+		return d.usage
+	}
+	if d.Children == nil {
+		*cold = append(*cold, d)
+		return treeUsage{}
+	}
+
+	n := len(*cold)
+	u := treeUsage{hash: d.meta.Hash, nodes: 1}
+	for _, node := range d.Children {
+		switch c := node.(type) {
+		case *Dir:
+			cu := f.dirUsage(c, cold)
+			u.size += cu.size
+			u.nodes += cu.nodes
+		case *File:
+			u.size += int64(c.meta.Size)
+			u.nodes++
+		}
+	}
+	if len(*cold) == n {
+		d.usage = u
+	}
+	return u
+}
+
+// attached returns true if the file is part of the current tree (the FS lock must be held)
+func (f *FS) attached(file *File) bool {
+	if file.parent == nil || file.parent.Children[file.meta.Name] != file {
+		return false
+	}
+	d := file.parent
+	for ; d.parent != nil; d = d.parent {
+		if d.parent.Children[d.meta.Name] != d {
+			return false
+		}
+	}
+	return d == f.root
+}
+
+// Versions returns all the known versions of the root (from the remote kvstore and the local vkv store)
+func (f *FS) Versions() (map[string]interface{}, error) {
+	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
+	remoteVersions, err := f.rkv.Versions(fsName, 0, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	localRemoteVersions, err := f.lkv.Versions(fsName, 0, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	localVersions, err := f.lkv.Versions(fmt.Sprintf(localRootKeyFmt, f.Name()), 0, -1, 0)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"remote":       remoteVersions,
+		"local-remote": localRemoteVersions,
+		"local":        localVersions,
+	}, nil
+}
+
+// iterDir executes the given callback `cb` on each nodes (file or dir) recursively.
+func iterDir(dir *Dir, cb func(n Node) error) error {
+	if dir.Children == nil {
+		if err := dir.reload(); err != nil {
+			return err
+		}
+	}
+
+	for _, node := range dir.Children {
+		if node.IsDir() {
+			if err := iterDir(node.(*Dir), cb); err != nil {
+				return err
+			}
+		} else {
+			if err := cb(node); err != nil {
+				return err
+			}
+		}
+	}
+	return cb(dir)
+}
+
+// initRoot intializes a new root dir
+func (f *FS) initRoot() (*Dir, error) {
+	newRoot := &Dir{
+		fs:       f,
+		Children: map[string]Node{},
+		meta:     &meta.Meta{Name: ""}, // We want an empty name for the root
+	}
+	newRoot.log = f.log.New("ref", "undefined", "name", "_root", "type", "dir")
+	if err := newRoot.Save(); err != nil {
+		return nil, err
+	}
+	f.log.Debug("Created new root", "ref", newRoot.Meta().Hash)
+	return newRoot, nil
+}
+
+// SyncStats keeps track of the progress of a push, it can be read while the push is running (lock it first)
+type SyncStats struct {
+	BlobsTotal    int
+	BlobsStated   int
+	BlobsUploaded int
+	BlobsSkipped  int
+	BytesUploaded int
+	BytesSkipped  int // Bytes already stored remotely (or duplicated in the tree)
+	sync.Mutex
+}
+
+// DedupRatio returns the ratio of bytes that did not need to be uploaded (must be called with the lock held)
+func (s *SyncStats) DedupRatio() float64 {
+	total := s.BytesUploaded + s.BytesSkipped
+	if total == 0 {
+		return 0
+	}
+	return float64(s.BytesSkipped) / float64(total)
+}
+
+type Stats struct {
+	LastReset    time.Time
+	FilesCreated int
+	DirsCreated  int
+	FilesUpdated int
+	DirsUpdated  int
+	updated      bool
+	sync.Mutex
+}
+
+func (s *Stats) Reset() {
+	s.LastReset = time.Now()
+	s.FilesCreated = 0
+	s.DirsCreated = 0
+	s.FilesUpdated = 0
+	s.DirsUpdated = 0
+	s.updated = false
+}
+
+// Updated returns true if the FS has been updated since the last reset
+func (s *Stats) Updated() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.updated
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("%d files created, %d dirs created, %d files updated, %d dirs updated",
+		s.FilesCreated, s.DirsCreated, s.FilesUpdated, s.DirsUpdated)
+}
+
+// Mount determine if the current root should the local one or the remote one and returns it
+func (f *FS) Mount() *Mount {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mount()
+}
+
+// Ref returns the hash of the current root meta
+func (f *FS) Ref() string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.mount().node.Meta().Hash
+}
+
+// mount is like `Mount` (the FS lock must be held, or the FS not loaded yet)
+func (f *FS) mount() *Mount {
+	if f.local != nil {
+		if f.remote == nil || (f.remote != nil && f.local.root.Version > f.remote.root.Version) {
+			return f.local
+		}
+		return f.remote
+	}
+	return f.remote
+}
+
+// Path returns the node at `lp` in the current tree, nil if it does not exist
+func (f *FS) Path(lp string) (Node, error) {
+	if err := f.lockPath(lp, false); err != nil {
+		return nil, err
+	}
+	defer f.mu.RUnlock()
+	return f.nodeAt(f.root, lp)
+}
+
+// Build the local index (a map[path]hash)
+func (f *FS) localIndex() (map[string]string, error) {
+	return f.buildLocalIndex(f.root, "/")
+}
+
+func (f *FS) buildLocalIndex(n Node, p string) (map[string]string, error) {
+	index := map[string]string{}
+	index[filepath.Join(p, n.Meta().Name)] = n.Meta().Hash
+	if n.IsDir() {
+		d := n.(*Dir)
+		if d.Children == nil {
+			if err := d.reload(); err != nil {
+				return nil, err
+			}
+		}
+		for _, child := range d.Children {
+			if child.IsDir() {
+				childIndex, err := f.buildLocalIndex(child, filepath.Join(p, n.Meta().Name))
+				if err != nil {
+					return nil, err
+				}
+				for cp, cref := range childIndex {
+					index[cp] = cref
+				}
+			} else {
+				index[filepath.Join(p, n.Meta().Name, child.Meta().Name)] = child.Meta().Hash
+			}
+		}
+	}
+	return index, nil
+}
+
+type DiffNode struct {
+	Path, Hash string
+}
+
+type Diff struct {
+	Added             []*DiffNode
+	Conflicted        []*DiffNode
+	DeletedCandidates []*DiffNode
+}
+
+func (f *FS) compareIndex(localIndex, remoteIndex map[string]string) (*Diff, error) {
+	if _, ok := remoteIndex["/"]; ok {
+		delete(remoteIndex, "/")
+	}
+	if _, ok := localIndex["/"]; ok {
+		delete(localIndex, "/")
+	}
+	diff := &Diff{
+		Added:             []*DiffNode{},
+		Conflicted:        []*DiffNode{},
+		DeletedCandidates: []*DiffNode{},
+	}
+	for p, ref := range remoteIndex {
+		if lref, ok := localIndex[p]; ok {
+			// The file is also present in the local index
+			if ref != lref {
+				// The ref are different, there is a conflict
+				diff.Conflicted = append(diff.Conflicted, &DiffNode{p, ref})
+			}
+		} else {
+			// The file is not present in the local index, it has been "added"
+			diff.Added = append(diff.Added, &DiffNode{p, ref})
+		}
+	}
+	for p, ref := range localIndex {
+		if _, ok := remoteIndex[p]; !ok {
+			diff.DeletedCandidates = append(diff.DeletedCandidates, &DiffNode{p, ref})
+		}
+	}
+	// Make sure we handle the deepest children first so we don't delete a directory with a file not deleted yet
+	sort.Sort(ByLength(diff.DeletedCandidates))
+
+	return diff, nil
+}
+
+type Mount struct {
+	immutable bool
+	node      Node
+	root      *root.Root
+}
+
+// Node returns the root node of the mount
+func (m *Mount) Node() Node {
+	return m.node
+}
+
+func (m *Mount) Empty() bool {
+	return m.node == nil
+}
+
+func (m *Mount) Copy(m2 *Mount) {
+	m2.immutable = m.immutable
+	m2.node = m.node
+	m2.root = m.root
+}
+
+// Same struct BlobStash's filetree.Node
+// XXX(tsileo): check if we can use a Meta for this? a meta never output hash/ref :s
+type RemoteNode struct {
+	Name     string  `json:"name"`
+	Type     string  `json:"type"`
+	Size     int     `json:"size"`
+	Mode     uint32  `json:"mode"`
+	ModTime  string  `json:"mtime"`
+	Hash     string  `json:"ref"`
+	Children []*Node `json:"children,omitempty"`
+}
+
+// remoteNode fetch the remote node at `path` in the given `mutationRef`
+func (f *FS) remoteNode(mutationRef, path string) (*RemoteNode, error) {
+	resp, err := f.bs.Client().DoReq("GET", fmt.Sprintf("/api/filetree/fs/ref/%s/%s", mutationRef, path), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == 200:
+		node := &RemoteNode{}
+		if err := json.Unmarshal(body, &node); err != nil {
+			return nil, err
+		}
+		return node, nil
+	default:
+		return nil, fmt.Errorf("failed to fetch node at path \"%s\" for ref=%v: %s", path, mutationRef, body)
+	}
+}
+
+// Refs returns a "snapshot" of the FS
+// - a slice of refs containing all the blobfs of the Tree (nodes ignored via `.blobfsignore` files are skipped)
+// `rootDir` must not be part of the current tree (e.g. a snapshot).
+func (f *FS) Refs(rootDir *Dir) ([]string, error) {
+	return f.refs(rootDir, false, nil)
+}
+
+// refs returns the refs of every node of the tree (or only of the public ones), the size of the blobs is stored in
+// `sizes` if it's not nil. The tree must not be part of the current tree (e.g. the one returned by `pushDir`), it's
+// walked without holding the FS lock.
+func (f *FS) refs(rootDir *Dir, publicOnly bool, sizes map[string]int) ([]string, error) {
+	f.log.Info("Fetching refs", "root", rootDir, "meta", rootDir.Meta(), "public_only", publicOnly)
+	defer f.log.Info("Fetching refs done")
+
+	f.wg.Add(1)
+	defer f.wg.Done()
+
+	refs := []string{}
+
+	// 	rootNode, err := bfs.getRoot()
+	// 	if err != nil {
+	// 		f.log.Error("Failed to fetch root", "err", err)
+	// 		return nil, nil, err
+	// 	}
+
+	// 	rootDir := rootNode.(*Dir)
+	// rootDir := root.node
+
+	if err := f.walkTree(rootDir, "/", ignore.New(), func(_ string, node Node) error {
+		f.log.Debug("[fetch dir]", "node", node.Meta())
+		if publicOnly && !node.Meta().IsPublic() {
+			return nil
+		}
+		refs = append(refs, node.Meta().Hash)
+		if sizes != nil {
+			_, js := node.Meta().Json()
+			sizes[node.Meta().Hash] = len(js)
+		}
+		if !node.IsDir() {
+			var prev int
+			for _, iref := range node.Meta().Refs {
+				data := iref.([]interface{})
+				ref := data[1].(string)
+				refs = append(refs, ref)
+				if sizes != nil {
+					// The index is the offset of the end of the blob
+					end := refIndex(data[0])
+					sizes[ref] = end - prev
+					prev = end
+				}
+			}
+		}
+		return nil
+	}); err != nil {
+		f.log.Error("walkTree failed", "err", err)
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+// refIndex returns the index of a file ref (an int when the meta was just created, a float64 once decoded from JSON)
+func refIndex(v interface{}) int {
+	switch index := v.(type) {
+	case int:
+		return index
+	case int64:
+		return int(index)
+	case float64:
+		return int(index)
+	}
+	return 0
+}
+
+type ByLength []*DiffNode
+
+func (s ByLength) Len() int {
+	return len(s)
+}
+func (s ByLength) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s ByLength) Less(i, j int) bool {
+	return len(strings.Split(s[i].Path, "/")) > len(strings.Split(s[j].Path, "/"))
+}
+
+// pulled is the remote state fetched by `Pull` before acquiring the FS lock
+type pulled struct {
+	kv       *kvstore.KeyValue
+	root     *root.Root
+	node     *Dir // Not part of the current tree until it's swapped in
+	versions *kvstore.KeyValueVersions
+	index    map[string]string // Index of the remote tree, only built if `pull` needs the whole tree
+}
+
+// errRemoteTree is returned by `pull` when the whole remote tree is needed (to merge the local changes or re-attach
+// the ignored nodes), it must be loaded without holding the FS lock
+var errRemoteTree = errors.New("the remote tree must be loaded")
+
+// Pull fetches the remote mutations, the un-synced local changes are merged (conflicted files are saved as
+// `.conflicted` files). The caller is responsible for invalidating the kernel cache.
+// The remote root and its tree are fetched before acquiring the FS lock, it's only held to swap in (or merge) them.
+func (f *FS) Pull() error {
+	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
+	p := &pulled{}
+
+	f.log.Debug("load latest remote mutation", "name", fsName)
+	remoteKv, err := f.rkv.Get(fsName, -1)
+	switch err {
+	case nil:
+		f.log.Debug("loaded remote", "kv", string(remoteKv.Data))
+		p.kv = remoteKv
+		// There are mutations for this FS in BlobStash, they're fetched unless they have already been pulled
+		localKv, err := f.lkv.Get(fsName, -1)
+		switch err {
+		case nil, vkv.ErrNotFound:
+		default:
+			return err
+		}
+		if localKv == nil || remoteKv.Version > localKv.Version {
+			p.root, p.node, err = f.kvDataToDir(remoteKv.Data, remoteKv.Version)
+			if err != nil {
+				return err
+			}
+			p.versions, err = f.rkv.Versions(fsName, 0, -1, 0)
+			if err != nil {
+				return err
+			}
+		}
+	case kvstore.ErrKeyNotFound:
+		f.log.Debug("remote not found")
+		// The FS is new, no remote mutation nor local, we'll create the inital root later
+	default:
+		f.log.Error("failed to fetch lastest mutation from BlobStash", "err", err)
+		return err
+	}
+
+	for {
+		if err := f.lockTree(true); err != nil {
+			return err
+		}
+		err := f.pull(p)
+		f.mu.Unlock()
+		if err != errRemoteTree {
+			return err
+		}
+
+		// The remote index is built from the blobs (and not using the BlobStash filetree API), since BlobStash
+		// can't read the blobs when they are encrypted
+		p.index, err = f.buildLocalIndex(p.node, "/")
+		if err != nil {
+			return err
+		}
+		f.log.Info("Built remote index", "index", p.index)
+	}
+}
+
+// pull updates the tree with the fetched remote state `p`, `errRemoteTree` is returned before updating anything if
+// the remote index is needed but not built (the FS lock must be held for writing, see `lockTree`)
+func (f *FS) pull(p *pulled) error {
+	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
+	remoteKv, remoteRoot, remoteNode := p.kv, p.root, p.node
+
+	f.log.Debug("load latest local mutation")
+	localKv, err := f.lkv.Get(fsName, -1)
+	switch err {
+	case nil:
+		f.log.Debug("loaded local", "kv", string(localKv.Data))
+	case vkv.ErrNotFound:
+		f.log.Debug("local not found")
+	default:
+		return err
+	}
+
+	switch {
+	case localKv == nil:
+		// FIXME(tsileo): is this case even possible?
+		f.log.Debug("No local mutations yet")
+		if remoteKv == nil {
+			newRoot, err := f.initRoot()
+			if err != nil {
+				return err
+			}
+			rootNode := newRoot
+			// The root was just created
+			localRoot := &root.Root{Ref: rootNode.Meta().Hash}
+			jsroot, err := localRoot.JSON()
+			if err != nil {
+				return err
+			}
+			localFsName := fmt.Sprintf(localRootKeyFmt, f.Name())
+			kv, err := f.lkv.Put(localFsName, "", jsroot, -1)
+			localRoot.Version = kv.Version
+			if err != nil {
+				return err
+			}
+			f.local = &Mount{
+				immutable: false,
+				root:      localRoot,
+				node:      newRoot,
+			}
+			f.root = f.mount().node.(*Dir)
+			return nil
+		}
+		var ignored map[string]*meta.Meta
+		if f.root != nil {
+			// Keep the local-only nodes
+			ignored, err = f.ignoredNodes(f.root)
+			if err != nil {
+				return err
+			}
+			if len(ignored) > 0 && p.index == nil {
+				return errRemoteTree
+			}
+		}
+		// Save all the known remote mutations
+		for _, version := range p.versions.Versions {
+			f.log.Debug("Saving mutation locally", "root", string(version.Data))
+			if f.lkv.Put(fsName, version.Hash, version.Data, version.Version); err != nil {
+				return err
+			}
+		}
+		f.base = remoteKv.Version
+		f.remote = &Mount{
+			immutable: f.Immutable(),
+			root:      remoteRoot,
+			node:      remoteNode,
+		}
+		f.log.Debug("DEBUG", "f.root", f.root, "remoteDir", remoteNode)
+		if f.root != nil {
+			f.swapRoot(remoteNode)
+			if err := f.attachIgnored(ignored); err != nil {
+				return err
+			}
+		} else {
+			f.root = remoteNode
+		}
+		return nil
+
+	case remoteKv == nil:
+		f.log.Info("FS does not exist remotely")
+
+	case remoteKv.Version > localKv.Version:
+		f.log.Info("there are un-synced remote mutations")
+
+		// Check we have mutation not synced yet (only the ignored nodes may have been updated since the last push)
+		unpushed, err := f.unpushedChanges(localKv)
+		if err != nil {
+			return err
+		}
+		// Keep the local-only nodes
+		ignored, err := f.ignoredNodes(f.root)
+		if err != nil {
+			return err
+		}
+		if (unpushed || len(ignored) > 0) && p.index == nil {
+			return errRemoteTree
+		}
+
+		// No un-synced mutation, just copy the new mutations
+		// FIXME(tsileo): assert that the latest remote (the one stored locally) ref is
+		// actually present in the old versions
+		// var lastRefData []byte
+		saved := 0
+		shouldBreak := false
+		for _, version := range p.versions.Versions {
+			if shouldBreak {
+				break
+			}
+			if f.remote != nil && version.Version == f.remote.root.Version {
+				shouldBreak = true
+				// This mean we should catch the version as the previous ref
+				continue
+			}
+			if f.lkv.Put(fsName, version.Hash, version.Data, version.Version); err != nil {
+				return err
+			}
+			saved++
+		}
+
+		f.log.Info("Remote mutations saved", "count", saved)
+
+		f.base = remoteKv.Version
+		if unpushed {
+			// Conflict handling
+
+			// FIXME(tsileo): do a merge, create a new mount and set it as local
+			f.log.Info("There is a conflict")
+
+			// The index is copied as it's reused if the pull is retried
+			remoteIndex := map[string]string{}
+			for rp, ref := range p.index {
+				remoteIndex[rp] = ref
+			}
+
+			localIndex, err := f.localIndex()
+			if err != nil {
+				return err
+			}
+			f.log.Info("Built local index", "index", localIndex)
+
+			// The ignored nodes are local only, they can't be conflicted
+			matcher, err := f.ignoreMatcher(f.root)
+			if err != nil {
+				return err
+			}
+			filterHashIndex(localIndex, matcher)
+			filterHashIndex(remoteIndex, matcher)
+
+			// Compute the diff between the two mutations
+			diff, err := f.compareIndex(localIndex, remoteIndex)
+			if err != nil {
+				return err
+			}
+			f.log.Info("Computed diff", "diff", diff)
+
+			// The remote metas were fetched (and cached locally) while building the remote index
+			for _, added := range diff.Added {
+				m, err := f.metaFromHash(added.Hash)
+				if err != nil {
+					return err
+				}
+				f.log.Info("[add]", "node", added)
+				if err := f.createNode(added.Path, m); err != nil {
+					return err
+				}
+			}
+
+			for _, conflicted := range diff.Conflicted {
+				m, err := f.metaFromHash(conflicted.Hash)
+				if err != nil {
+					return err
+				}
+				f.log.Info("[conflicted]", "node", conflicted)
+				m.Name = m.Name + ".conflicted"
+				if err := f.createNode(conflicted.Path+".conflicted", m); err != nil {
+					return err
+				}
+			}
+			// If there is only one remote mutation, then all the deletedCandidates are new local files
+			// if prevMutationRef != "" {
+			// FIXME(tsileo): rename Diff.Deleted to Diff.DeletedCandidates and make the handling outside of this func
+			// then, check at /api/filetree/fs/ref/{ref}+p
+			// if the node exists, compare the ref, if it's the same, we can delete the file
+			// safely (since it will be super easy to restore), it it's not the same,
+			// rename it as .conflicted+deleted
+			// }
+			// FIXME(tsileo): check if there is a previous version
+
+			for _, deletedCandidate := range diff.DeletedCandidates {
+				// rnode, err := f.remoteNode()
+				f.log.Debug("[deleted *candidate*]", "node", deletedCandidate)
+				// 	f.log.Info("[deleted]", "node", deleted)
+				// 	// FIXME(tsileo): detect new file/unsynced file/if the deleted file has been modified"
+				// 	// XXX(tsileo): should check the latest remote (from local rkv) and see if the file is the same
+				// 	// in this case delete it, if not ???
+				// 	if err := f.deleteNode(deleted.Path); err != nil {
+				// 		return err
+				// 	}
+			}
+
+			// FIXME(tsileo): bad root here?
+			// f.remote = &Mount{
+			// 	immutable: f.Immutable(),
+			// 	node:
+			// }
+
+			*f.root = *f.local.node.(*Dir)
+			f.log.Info("Diff done")
+
+			// The merged tree is now based on the pulled root
+			return f.root.Save()
+		}
+
+		f.remote = &Mount{
+			immutable: f.Immutable(),
+			root:      remoteRoot,
+			node:      remoteNode,
+		}
+		f.swapRoot(remoteNode)
+		if err := f.attachIgnored(ignored); err != nil {
+			return err
+		}
+
+	case remoteKv.Version < localKv.Version:
+		return ErrOutOfSync
+	case localKv.Version == remoteKv.Version:
+		f.log.Info("Already in sync")
+		return nil
+	}
+
+	return nil
+}
+
+// swapRoot replaces the content of the current root with the pulled root `d`, its loaded children are re-attached to
+// the current root (the FS lock must be held for writing)
+func (f *FS) swapRoot(d *Dir) {
+	*f.root = *d
+	for _, node := range f.root.Children {
+		switch c := node.(type) {
+		case *Dir:
+			c.parent = f.root
+		case *File:
+			c.parent = f.root
+		}
+	}
+}
+
+// unpushedChanges returns true if the tree has changes that were not pushed, i.e. if the tree without the ignored nodes
+// (as pushed by `PushContext`) differs from the last pushed (or pulled) root stored in `pushedKv` (the lock must be
+// held)
+func (f *FS) unpushedChanges(pushedKv *vkv.KeyValue) (bool, error) {
+	if f.local == nil || f.local.root.Version <= pushedKv.Version {
+		// The tree has not been updated since the last push
+		return false, nil
+	}
+	pushed, err := root.NewFromJSON(pushedKv.Data, pushedKv.Version)
+	if err != nil {
+		return false, err
+	}
+	m, err := f.filteredMeta(f.root, "/", ignore.New())
+	if err != nil {
+		return false, err
+	}
+	return m.Hash != pushed.Ref, nil
+}
+
+func (f *FS) metaFromHash(hash string) (*meta.Meta, error) {
+	blob, err := f.bs.Get(context.TODO(), hash)
+	if err != nil {
+		return nil, err
+	}
+	// Decode it as a Meta
+	return meta.NewMetaFromBlob(hash, blob)
+}
+
+func (f *FS) deleteNode(path string) error {
+	split := strings.Split(path[1:], "/")
+	pathCount := len(split)
+	node := f.root
+	for i, p := range split {
+		if node.Children == nil {
+			if err := node.reload(); err != nil {
+				return err
+			}
+		}
+		child, ok := node.Children[p]
+		if ok {
+			if i == pathCount-1 {
+				delete(node.Children, p)
+				return node.Save()
+			}
+
+			// Keep searching
+			node = child.(*Dir)
+			continue
+		}
+
+		return fmt.Errorf("shouldn't happen")
+	}
+	return nil
+}
+
+func (f *FS) createNode(path string, cmeta *meta.Meta) error {
+	var prev *Dir
+	split := strings.Split(path[1:], "/")
+	pathCount := len(split)
+	node := f.root
+	for i, p := range split {
+		if node.Children == nil {
+			if err := node.reload(); err != nil {
+				return err
+			}
+		}
+		prev = node
+		child, ok := node.Children[p]
+		if ok {
+			if cdir, isDir := child.(*Dir); isDir {
+				node = cdir
+				continue
+			}
+			// An existing file is replaced (e.g. a previous `.conflicted` file), but can't be a parent
+			if i != pathCount-1 {
+				return fmt.Errorf("failed to create \"%s\", \"%s\" is not a dir", path, p)
+			}
+		}
+
+		if i == pathCount-1 {
+			nnode, err := newNode(f, cmeta, node)
+			if err != nil {
+				return err
+			}
+			node.Children[p] = nnode
+			if err := node.Save(); err != nil {
+				return err
+			}
+
+		} else {
+			newMeta := &meta.Meta{
+				Type: "dir",
+				Name: p,
+			}
+			newd, err := NewDir(f, newMeta, prev)
+			if err != nil {
+				return err
+			}
+			node.Children[p] = newd
+			// FIXME(tsileo): needed?
+			if err := node.Save(); err != nil {
+				return err
+			}
+			node = newd
+		}
+	}
+	return nil
+}
+
+// newNode returns a new Dir or File depending on the meta type
+func newNode(f *FS, m *meta.Meta, parent *Dir) (Node, error) {
+	if m.IsDir() {
+		return NewDir(f, m, parent)
+	}
+	return NewFile(f, m, parent)
+}
+
+// Push saves all the blobs of the tree, and add the VK entry to the remote BlobStash instance
+func (f *FS) Push(comment []byte) error {
+	return f.PushContext(context.Background(), comment, &SyncStats{})
+}
+
+// PushContext is like `Push`, the progress is tracked in `stats`, and the upload of the blobs can be canceled
+// via `ctx` (the remote root is only updated once every blob has been uploaded).
+func (f *FS) PushContext(ctx context.Context, comment []byte, stats *SyncStats) error {
+	f.log.Info("Pushing data", "comment", comment)
+
+	f.wg.Add(1)
+	defer f.wg.Done()
+
+	// Ensure the current root is a local one
+	f.mu.RLock()
+	local := f.local
+	unchanged := local == nil || f.mount().root.Ref != local.root.Ref
+	f.mu.RUnlock()
+	if unchanged {
+		f.log.Info("No local changes")
+		return nil
+	}
+
+	// Try to fetch the latest remote mutation
+	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
+	remoteKv, err := f.rkv.Get(fsName, -1)
+	// versions, err2 := f.rkv.Versions(fsName, 0, -1, 0)
+	// if err2 != nil && err2 != kvstore.ErrKeyNotFound {
+	// 	panic(err)
+	// }
+	// if versions != nil {
+	// 	fmt.Printf("DEBUG:%+v/\n%+v/\n%+v/\n%+v\n\n", remoteKv, versions.Versions[0], f.remote.root, f.remote.node)
+	// }
+	switch err {
+	case nil:
+		// There are mutations for this FS in BlobStash, ensure they have all been pulled
+		localKv, err := f.lkv.Get(fsName, -1)
+		switch err {
+		case nil:
+		case vkv.ErrNotFound:
+			f.log.Error("conflicted, the remote mutations have never been pulled", "remote_version", remoteKv.Version)
+			return ErrConflict
+		default:
+			return err
+		}
+		if remoteKv.Version > localKv.Version {
+			f.log.Error("conflicted", "local_version", localKv.Version, "remote_version", remoteKv.Version)
+			return ErrConflict
+		}
+	case kvstore.ErrKeyNotFound:
+		// The FS is new, no remote mutation nor local, we'll create the inital root later
+	default:
+		f.log.Error("failed to fetch lastest mutation from BlobStash", "err", err)
+		return err
+	}
+
+	// Keep some basic stats about the on-going sync
+	defer func() {
+		stats.Lock()
+		defer stats.Unlock()
+		f.log.Info("Push done", "blobs_uploaded", stats.BlobsUploaded, "blobs_skipped", stats.BlobsSkipped,
+			"dedup_ratio", fmt.Sprintf("%.2f", stats.DedupRatio()))
+	}()
+
+	// rootNode := f.root
+
+	// rootDir := f.local.node.(*Dir) //rootNode.(*Dir)
+	// The pushed root doesn't contain the nodes ignored via `.blobfsignore` files
+	pushDir, croot, err := f.pushDir()
+	if err != nil {
+		return err
+	}
+	croot.Renames = nil
+	if comment != nil {
+		croot.Comment = string(comment)
+	}
+
+	// Skip the push if only ignored nodes were updated since the last push
+	lastPushedKv, err := f.lkv.Get(fsName, -1)
+	switch err {
+	case nil:
+		lastPushed, err := root.NewFromJSON(lastPushedKv.Data, lastPushedKv.Version)
+		if err != nil {
+			return err
+		}
+		if lastPushed.Ref == croot.Ref {
+			f.log.Info("No local changes (only ignored nodes were updated)")
+			return nil
+		}
+	case vkv.ErrNotFound:
+	default:
+		return err
+	}
+
+	sizes := map[string]int{}
+	refs, err := f.refs(pushDir, false, sizes)
+	if err != nil {
+		return err
+	}
+	f.log.Debug("snapshot fetched", "root", croot, "len", len(refs))
+
+	stats.Lock()
+	stats.BlobsTotal = len(refs)
+	stats.Unlock()
+
+	// First save all the blobs of the tree
+	for _, ref := range refs {
+		select {
+		case <-ctx.Done():
+			f.log.Info("Push canceled")
+			return ctx.Err()
+		default:
+		}
+		exists, err := f.bs.StatRemote(ref)
+		if err != nil {
+			f.log.Error("stat failed", "err", err)
+			return err
+		}
+		if exists {
+			stats.Lock()
+			stats.BlobsStated++
+			stats.BlobsSkipped++
+			stats.BytesSkipped += sizes[ref]
+			stats.Unlock()
+		} else {
+			blob, err := f.bs.Get(context.TODO(), ref)
+			if err != nil {
+				f.log.Error("Failed to fetch blob from cache", "err", err)
+				return err
+			}
+			if err := f.bs.PutRemote(ref, blob); err != nil {
+				f.log.Error("PutRemote failed", "err", err)
+				return err
+			}
+			stats.Lock()
+			stats.BlobsStated++
+			stats.BlobsUploaded++
+			stats.BytesUploaded += len(blob)
+			stats.Unlock()
+		}
+	}
+
+	if pbs, ok := f.bs.(PublicBlobStore); ok {
+		if err := f.pushPublic(ctx, pbs, pushDir); err != nil {
+			return err
+		}
+	}
+
+	jsRoot, err := croot.JSON()
+	if err != nil {
+		return err
+	}
+	// Set a KV entry for this mutation
+	// FIXME(tsileo): conditional request to ensure the previous version is the same
+	f.log.Debug("saving the mutation remotely", "name", fsName, "version", croot.Version, "ref", croot.Ref)
+	if _, err := f.rkv.Put(fsName, "", jsRoot, croot.Version); err != nil {
+		f.log.Error("Sync failed (failed to update the remote vkv entry)", "err", err)
+		return err
+	}
+	// Save the mutation as remote locally  too
+	if _, err := f.lkv.Put(fsName, "", jsRoot, croot.Version); err != nil {
+		f.log.Error("Sync failed (failed to update the remote vkv entry)", "err", err)
+		return err
+	}
+	f.pushed(croot.Version)
+
+	return nil
+}
+
+// pushed records that the tree was pushed as `version`, the renames are now part of the pushed tree and the next WIP
+// roots are based on it
+func (f *FS) pushed(version int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.renames = map[string]string{}
+	f.base = version
+}
+
+// pushPublic uploads the blobs of the public nodes in plaintext, so they can still be shared when the remote blobs
+// are encrypted
+func (f *FS) pushPublic(ctx context.Context, pbs PublicBlobStore, pushDir *Dir) error {
+	refs, err := f.refs(pushDir, true, nil)
+	if err != nil {
+		return err
+	}
+	for _, ref := range refs {
+		select {
+		case <-ctx.Done():
+			f.log.Info("Push canceled")
+			return ctx.Err()
+		default:
+		}
+		exists, err := pbs.StatRemotePublic(ref)
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		blob, err := f.bs.Get(ctx, ref)
+		if err != nil {
+			return err
+		}
+		if err := pbs.PutRemotePublic(ref, blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FS) Immutable() bool {
+	// TODO(tsileo): check the mount
+	return f.immutable
+}
+
+func (f *FS) Name() string {
+	return f.name
+}
+
+var (
+	rootKeyFmt      = "blobfs:root:%v"
+	localRootKeyFmt = "local:root:%v"
+)
+
+func (f *FS) kvDataToDir(data []byte, version int) (*root.Root, *Dir, error) {
+	lroot, err := root.NewFromJSON([]byte(data), version)
+	if err != nil {
+		return nil, nil, err
+	}
+	f.log.Debug("decoding root", "root", lroot)
+	// Fetch the root ref
+	blob, err := f.bs.Get(context.TODO(), lroot.Ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Decode it as a Meta
+	m, err := meta.NewMetaFromBlob(lroot.Ref, blob)
+	if err != nil {
+		return nil, nil, err
+	}
+	f.log.Debug("loaded meta root", "ref", m.Hash)
+	dir, err := NewDir(f, m, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lroot, dir, nil
+}
+
+// Load loads the current root, the latest local mutations are compared to the remote ones
+func (f *FS) Load() error {
+	if err := f.loadRoot(); err != nil {
+		return err
+	}
+	f.root = f.mount().node.(*Dir)
+	return nil
+}
+
+func (f *FS) loadRoot() error {
+	// First, try to fetch the local root
+	// return f.Pull()
+	var err error
+	var wipRoot, localRoot, remoteRoot *root.Root
+	var wipNode, localNode, remoteNode, rootNode Node
+
+	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
+	localFsName := fmt.Sprintf(localRootKeyFmt, f.Name())
+
+	f.log.Debug("load latest local mutation")
+	localKv, err := f.lkv.Get(fsName, -1)
+	switch err {
+	case nil:
+		localRoot, localNode, err = f.kvDataToDir(localKv.Data, localKv.Version)
+		f.base = localKv.Version
+	case vkv.ErrNotFound:
+	default:
+		return err
+	}
+
+	f.log.Debug("load latest wip mutation")
+	wipKv, err := f.lkv.Get(localFsName, -1)
+	switch err {
+	case nil:
+		wipRoot, wipNode, err = f.kvDataToDir(wipKv.Data, wipKv.Version)
+	case vkv.ErrNotFound:
+	default:
+		return err
+	}
+
+	// Then, try to fetch the remote root
+	f.log.Debug("load latest remote mutation")
+	remoteKv, err := f.rkv.Get(fsName, -1)
+	switch err {
+	case nil:
+		// There are mutations for this FS in BlobStash
+		remoteRoot, remoteNode, err = f.kvDataToDir(remoteKv.Data, remoteKv.Version)
+		f.log.Debug("remote node", "node", remoteNode)
+	case kvstore.ErrKeyNotFound:
+		// The FS is new, no remote mutation nor local, we'll create the inital root later
+	default:
+		f.log.Error("failed to fetch lastest mutation from BlobStash", "err", err)
+		return err
+	}
+	// The WIP tree is loaded if it's newer than the pushed one, unless a pull fast-forwarded it since it only contained
+	// ignored nodes (its ignored nodes are re-attached to the pushed tree below)
+	var wipDir *Dir
+	if wipNode != nil {
+		wipDir = wipNode.(*Dir)
+	}
+	superseded := wipRoot != nil && wipRoot.Base != 0 && localKv != nil && wipRoot.Base < localKv.Version
+	if wipKv != nil && !superseded && ((localKv == nil && remoteKv == nil) || (remoteKv != nil && localKv == nil && wipKv.Version > remoteKv.Version) || (localKv != nil && remoteKv != nil && wipKv.Version > localKv.Version && wipKv.Version > remoteKv.Version)) {
+		f.local = &Mount{
+			immutable: f.Immutable(),
+			node:      wipNode,
+			root:      wipRoot,
+		}
+		f.root = f.mount().node.(*Dir)
+		if wipRoot.Renames != nil {
+			f.renames = wipRoot.Renames
+		}
+		return nil
+	}
+	switch {
+	case localKv == nil && remoteKv == nil:
+		newRoot, err := f.initRoot()
+		if err != nil {
+			return err
+		}
+		rootNode = newRoot
+		// The root was just created
+		localRoot = &root.Root{Ref: rootNode.Meta().Hash}
+		jsroot, err := localRoot.JSON()
+		if err != nil {
+			return err
+		}
+		kv, err := f.lkv.Put(localFsName, "", jsroot, -1)
+		localRoot.Version = kv.Version
+		if err != nil {
+			return err
+		}
+		f.local = &Mount{
+			immutable: false,
+			root:      localRoot,
+			node:      newRoot,
+		}
+		f.root = f.mount().node.(*Dir)
+		return nil
+	case localKv != nil && remoteKv != nil:
+		if localRoot.Version == remoteRoot.Version {
+			f.remote = &Mount{
+				immutable: f.Immutable(),
+				node:      localNode,
+				root:      localRoot,
+			}
+			return f.keepIgnored(wipDir)
+		}
+		if localKv.Version > remoteKv.Version {
+			f.log.Error("Version mismatch", "localkv", localKv, "remotekv", remoteKv)
+			// XXX(tsileo): recover from this should be possible if the cache hasn't been pruned
+			return ErrOutOfSync
+		} else {
+			// FIXME(tsileo): not only save the last, but all the missing one
+
+			localKv, err = f.lkv.Put(fsName, remoteKv.Hash, remoteKv.Data, remoteKv.Version)
+			if err != nil {
+				return err
+			}
+			f.base = localKv.Version
+			f.remote = &Mount{
+				immutable: f.Immutable(),
+				node:      remoteNode,
+				root:      remoteRoot,
+			}
+			return f.keepIgnored(wipDir)
+		}
+	case remoteKv != nil && localKv == nil:
+		f.log.Debug("Saving the remote mutations locally")
+		versions, err := f.rkv.Versions(fsName, 0, -1, 0)
+		if err != nil {
+			return err
+		}
+		for _, version := range versions.Versions {
+			if f.lkv.Put(fsName, version.Hash, version.Data, version.Version); err != nil {
+				return err
+			}
+		}
+		f.base = remoteKv.Version
+
+		f.remote = &Mount{
+			immutable: f.Immutable(),
+			node:      remoteNode,
+			root:      remoteRoot,
+		}
+		return f.keepIgnored(wipDir)
+	}
+	return fmt.Errorf("shouldn't happen")
+}
@@ -0,0 +1,203 @@
+package fstree
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+)
+
+// HistoryEntry is a distinct version of a node
+type HistoryEntry struct {
+	T        string `json:"t"`
+	Snapshot string `json:"snapshot"`
+	RootRef  string `json:"root_ref"`
+	Ref      string `json:"ref,omitempty"`
+	Size     int    `json:"size"`
+	Host     string `json:"host"`
+	Deleted  bool   `json:"deleted"`
+	Current  bool   `json:"current"`
+}
+
+// nodeAt returns the node at `path` in the given dir, or nil if it does not exist. The cold dirs along the path are
+// loaded, if `d` is part of the current tree they must be loaded already (see `lockPath`).
+func (f *FS) nodeAt(d *Dir, path string) (Node, error) {
+	var node Node = d
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !node.IsDir() {
+			return nil, nil
+		}
+		dir := node.(*Dir)
+		if dir.Children == nil {
+			if err := dir.reload(); err != nil {
+				return nil, err
+			}
+		}
+		child, ok := dir.Children[name]
+		if !ok {
+			return nil, nil
+		}
+		node = child
+	}
+	return node, nil
+}
+
+// History returns every distinct version of the node at `path` across all the retained roots, from the oldest to
+// the newest. The snapshots are not part of the current tree, they are walked without holding the FS lock.
+func (f *FS) History(path string) ([]*HistoryEntry, error) {
+	snapshots, err := f.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	entries := []*HistoryEntry{}
+	var lastRef string
+	for _, s := range snapshots {
+		_, dir, err := f.kvDataToDir(s.Data, s.Version)
+		if err != nil {
+			return nil, err
+		}
+		dir.immutable = true
+		node, err := f.nodeAt(dir, path)
+		if err != nil {
+			return nil, err
+		}
+		entry := &HistoryEntry{
+			T:        time.Unix(0, int64(s.Version)).Format(time.RFC3339),
+			Snapshot: s.Name,
+			RootRef:  s.Root.Ref,
+			Host:     s.Root.Hostname,
+		}
+		if node == nil {
+			// Only track the deletion if the node existed before
+			if lastRef == "" {
+				continue
+			}
+			entry.Deleted = true
+		} else {
+			entry.Ref = node.Meta().Hash
+			entry.Size = node.Meta().Size
+		}
+		if entry.Ref == lastRef {
+			continue
+		}
+		lastRef = entry.Ref
+		entries = append(entries, entry)
+	}
+
+	// Flag the current version
+	if err := f.lockPath(path, false); err != nil {
+		return nil, err
+	}
+	current, err := f.nodeAt(f.root, path)
+	var currentRef string
+	if current != nil {
+		currentRef = current.Meta().Hash
+	}
+	f.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		entry.Current = (current == nil && entry.Deleted) || (current != nil && currentRef == entry.Ref)
+	}
+	return entries, nil
+}
+
+// Undo restores the node at `path` as it was in the `to` ref (default to the version preceding the current one),
+// the restore is saved as a new WIP mutation. The caller is responsible for invalidating the kernel cache.
+// The version to restore is resolved before acquiring the FS lock.
+func (f *FS) Undo(path, to string) error {
+	if path == "/" {
+		return fmt.Errorf("can't undo the root, use checkout instead")
+	}
+	if to == wipRef {
+		// The node is already at its WIP version
+		return nil
+	}
+
+	var target *meta.Meta
+	if to == "" {
+		entries, err := f.History(path)
+		if err != nil {
+			return err
+		}
+		// Find the version preceding the current one
+		var prev *HistoryEntry
+		for i := len(entries) - 1; i > 0; i-- {
+			if entries[i].Current {
+				prev = entries[i-1]
+				break
+			}
+		}
+		if prev == nil {
+			return fmt.Errorf("no previous version for \"%s\"", path)
+		}
+		if !prev.Deleted {
+			m, err := f.metaFromHash(prev.Ref)
+			if err != nil {
+				return err
+			}
+			target = m
+		}
+	} else {
+		dir, err := f.resolveRef(to)
+		if err != nil {
+			return err
+		}
+		node, err := f.nodeAt(dir, path)
+		if err != nil {
+			return err
+		}
+		if node != nil {
+			target = node.Meta()
+		}
+	}
+
+	if err := f.lockPath(path, true); err != nil {
+		return err
+	}
+	defer f.mu.Unlock()
+
+	f.log.Info("Restoring node", "path", path, "meta", target)
+	return f.restoreNode(path, target)
+}
+
+// restoreNode replaces the node at `path` with a node built from the given meta, a nil meta deletes the node.
+// Missing parent directories are created (the FS lock must be held for writing, see `lockPath`).
+func (f *FS) restoreNode(path string, m *meta.Meta) error {
+	dirPath, name := filepath.Split(path)
+	parentNode, err := f.nodeAt(f.root, dirPath)
+	if err != nil {
+		return err
+	}
+	if parentNode == nil || !parentNode.IsDir() {
+		if m == nil {
+			return nil
+		}
+		return f.createNode(path, m)
+	}
+	parent := parentNode.(*Dir)
+	if parent.Children == nil {
+		if err := parent.reload(); err != nil {
+			return err
+		}
+	}
+	if m == nil {
+		if _, ok := parent.Children[name]; !ok {
+			return nil
+		}
+		delete(parent.Children, name)
+		return parent.Save()
+	}
+	node, err := newNode(f, m, parent)
+	if err != nil {
+		return err
+	}
+	parent.Children[name] = node
+	return parent.Save()
+}
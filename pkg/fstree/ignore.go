@@ -0,0 +1,291 @@
+package fstree
+
+import (
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tsileo/blobfs/pkg/ignore"
+	"github.com/tsileo/blobfs/pkg/root"
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+)
+
+// walkTree executes the given callback `cb` on each node (file or dir) recursively, like `iterDir`, but skips the
+// nodes ignored by the `.blobfsignore` files found along the way. The patterns are added to `matcher`.
+func (f *FS) walkTree(dir *Dir, p string, matcher *ignore.Matcher, cb func(string, Node) error) error {
+	if dir.Children == nil {
+		if err := dir.reload(); err != nil {
+			return err
+		}
+	}
+
+	// Load the ignore file first as it applies to its siblings
+	if node, ok := dir.Children[ignore.FileName]; ok && !node.IsDir() {
+		data, err := f.fileContent(node.Meta().Hash)
+		if err != nil {
+			return err
+		}
+		matcher.Add(p, data)
+	}
+
+	for name, node := range dir.Children {
+		childPath := path.Join(p, name)
+		if matcher.Match(childPath, node.IsDir()) {
+			continue
+		}
+		if node.IsDir() {
+			if err := f.walkTree(node.(*Dir), childPath, matcher, cb); err != nil {
+				return err
+			}
+		} else {
+			if err := cb(childPath, node); err != nil {
+				return err
+			}
+		}
+	}
+	return cb(p, dir)
+}
+
+// ignoreMatcher returns a Matcher loaded with all the `.blobfsignore` files of the tree
+func (f *FS) ignoreMatcher(dir *Dir) (*ignore.Matcher, error) {
+	matcher := ignore.New()
+	if err := f.walkTree(dir, "/", matcher, func(string, Node) error { return nil }); err != nil {
+		return nil, err
+	}
+	return matcher, nil
+}
+
+// filterIndex removes the ignored paths from the index
+func filterIndex(index map[string]*meta.Meta, matcher *ignore.Matcher) {
+	for p, m := range index {
+		if matcher.Match(p, m.IsDir()) {
+			delete(index, p)
+		}
+	}
+}
+
+// filterHashIndex removes the ignored paths from the index (as returned by `buildLocalIndex`/`remoteIndex`), the
+// node types are not known so directory-only patterns are checked for both types
+func filterHashIndex(index map[string]string, matcher *ignore.Matcher) {
+	for p := range index {
+		if matcher.Match(p, false) || matcher.Match(p, true) {
+			delete(index, p)
+		}
+	}
+}
+
+// filteredMeta returns the meta of the dir without the ignored nodes, the dir meta is returned as is if there is
+// no ignored nodes in it. The new metas are saved in the local blobstore (the FS lock must be held, see `lockTree`).
+func (f *FS) filteredMeta(d *Dir, p string, matcher *ignore.Matcher) (*meta.Meta, error) {
+	if d.Children == nil {
+		if err := d.reload(); err != nil {
+			return nil, err
+		}
+	}
+	if node, ok := d.Children[ignore.FileName]; ok && !node.IsDir() {
+		data, err := f.fileContent(node.Meta().Hash)
+		if err != nil {
+			return nil, err
+		}
+		matcher.Add(p, data)
+	}
+
+	changed := false
+	refs := []string{}
+	for name, node := range d.Children {
+		childPath := path.Join(p, name)
+		if matcher.Match(childPath, node.IsDir()) {
+			changed = true
+			continue
+		}
+		if !node.IsDir() {
+			refs = append(refs, node.Meta().Hash)
+			continue
+		}
+		cm, err := f.filteredMeta(node.(*Dir), childPath, matcher)
+		if err != nil {
+			return nil, err
+		}
+		if cm.Hash != node.Meta().Hash {
+			changed = true
+		}
+		refs = append(refs, cm.Hash)
+	}
+	if !changed {
+		return d.meta, nil
+	}
+
+	// Same as `Dir.Save`
+	m := meta.NewMeta()
+	m.Name = d.meta.Name
+	m.Type = "dir"
+	m.Mode = uint32(os.ModeDir | 0555)
+	m.XAttrs = d.meta.XAttrs
+	if d.meta.ModTime != "" {
+		m.ModTime = d.meta.ModTime
+	} else {
+		m.ModTime = time.Now().Format(time.RFC3339)
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		m.AddRef(ref)
+	}
+	mhash, mjs := m.Json()
+	m.Hash = mhash
+	mexists, err := f.bs.Stat(mhash)
+	if err != nil {
+		return nil, err
+	}
+	if !mexists {
+		if err := f.bs.Put(mhash, mjs); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// pushDir returns a read-only copy of the current root without the ignored nodes, along with a copy of the WIP root
+// pointing to it. The copy is not part of the current tree (its root meta is decoded again), it can be walked without
+// holding the FS lock.
+func (f *FS) pushDir() (*Dir, *root.Root, error) {
+	if err := f.lockTree(false); err != nil {
+		return nil, nil, err
+	}
+	defer f.mu.RUnlock()
+
+	fm, err := f.filteredMeta(f.root, "/", ignore.New())
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := f.metaFromHash(fm.Hash)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir, err := NewDir(f, m, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	dir.immutable = true
+	croot := &root.Root{}
+	*croot = *f.local.root
+	croot.Ref = m.Hash
+	return dir, croot, nil
+}
+
+// ignoredNodes returns the top-most ignored nodes of the tree (map[path]*meta.Meta)
+func (f *FS) ignoredNodes(dir *Dir) (map[string]*meta.Meta, error) {
+	out := map[string]*meta.Meta{}
+	matcher, err := f.ignoreMatcher(dir)
+	if err != nil {
+		return nil, err
+	}
+	if matcher.Empty() {
+		return out, nil
+	}
+	var collect func(*Dir, string) error
+	collect = func(d *Dir, p string) error {
+		if d.Children == nil {
+			if err := d.reload(); err != nil {
+				return err
+			}
+		}
+		for name, node := range d.Children {
+			childPath := path.Join(p, name)
+			if matcher.Match(childPath, node.IsDir()) {
+				out[childPath] = node.Meta()
+				continue
+			}
+			if node.IsDir() {
+				if err := collect(node.(*Dir), childPath); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	if err := collect(dir, "/"); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// attachIgnored re-attaches the local-only nodes to the current root (after it has been replaced by a pushed one), the
+// metas of their parents are updated but no WIP mutation is recorded as the pushable tree is unchanged (the lock must
+// be held)
+func (f *FS) attachIgnored(nodes map[string]*meta.Meta) error {
+	for p, m := range nodes {
+		f.log.Debug("restoring ignored node", "path", p)
+		parent, err := f.attachParent(path.Dir(p))
+		if err != nil {
+			return err
+		}
+		if parent == nil {
+			f.log.Warn("failed to restore ignored node, its parent is not a dir anymore", "path", p)
+			continue
+		}
+		node, err := newNode(f, m, parent)
+		if err != nil {
+			return err
+		}
+		parent.Children[path.Base(p)] = node
+		for d := parent; d != nil; d = d.parent {
+			if err := d.saveMeta(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// attachParent returns the dir at `p`, the missing dirs are created (but not saved), nil is returned if a file is
+// found along the way
+func (f *FS) attachParent(p string) (*Dir, error) {
+	d := f.root
+	for _, name := range strings.Split(p, "/") {
+		if d.Children == nil {
+			if err := d.reload(); err != nil {
+				return nil, err
+			}
+		}
+		if name == "" {
+			continue
+		}
+		child, ok := d.Children[name]
+		if !ok {
+			ndir, err := NewDir(f, &meta.Meta{Type: "dir", Name: name}, d)
+			if err != nil {
+				return nil, err
+			}
+			ndir.Children = map[string]Node{}
+			d.Children[name] = ndir
+			child = ndir
+		}
+		cdir, ok := child.(*Dir)
+		if !ok {
+			return nil, nil
+		}
+		d = cdir
+	}
+	if d.Children == nil {
+		if err := d.reload(); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// keepIgnored re-attaches the ignored nodes of the WIP tree `wip` to the current root when the WIP tree is not the
+// one loaded (e.g. it was pushed without its ignored nodes)
+func (f *FS) keepIgnored(wip *Dir) error {
+	f.root = f.mount().node.(*Dir)
+	if wip == nil || wip.meta.Hash == f.root.meta.Hash {
+		return nil
+	}
+	ignored, err := f.ignoredNodes(wip)
+	if err != nil {
+		return err
+	}
+	return f.attachIgnored(ignored)
+}
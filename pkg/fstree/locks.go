@@ -0,0 +1,375 @@
+package fstree
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tsileo/blobfs/pkg/root"
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+	"golang.org/x/net/context"
+)
+
+// ErrLocked is returned when a lock conflicts with a lock held by another owner
+var ErrLocked = errors.New("lock held by another owner")
+
+// LockEOF is the end of a lock extending to the end of the file (the `OFFSET_MAX` sent by the kernel)
+const LockEOF = 1<<63 - 1
+
+// Key of the advisory cross-host leases (FS name, path)
+var lockLeaseKeyFmt = "blobfs:lock:%v:%v"
+
+// LockType is the type of an advisory lock
+type LockType int
+
+const (
+	ReadLock LockType = iota + 1
+	WriteLock
+)
+
+// Lock is an advisory lock on a file, either a POSIX byte-range lock (fcntl) or a whole-file lock (flock), the two
+// kinds don't interact with each other (like on Linux)
+type Lock struct {
+	Owner uint64 // Lock owner as sent by the kernel
+	PID   int32
+	Type  LockType
+	Start uint64
+	End   uint64 // Inclusive, `LockEOF` for a lock extending to the end of the file
+	Flock bool
+}
+
+func (l *Lock) overlaps(o *Lock) bool {
+	return l.Flock == o.Flock && l.Start <= o.End && o.Start <= l.End
+}
+
+func (l *Lock) conflicts(o *Lock) bool {
+	return l.Owner != o.Owner && l.overlaps(o) && (l.Type == WriteLock || o.Type == WriteLock)
+}
+
+// fileLocks holds the locks of a file, it has its own mutex so waiting for a lock never blocks the tree
+type fileLocks struct {
+	locks   []*Lock
+	changed chan struct{} // Closed (and replaced) when a lock is released
+	leasing chan struct{} // Closed to stop the renewal of the cross-host lease, nil if no lease is held
+	mu      sync.Mutex
+}
+
+// conflict returns the first lock conflicting with `l` (the lock must be held)
+func (fl *fileLocks) conflict(l *Lock) *Lock {
+	for _, o := range fl.locks {
+		if o.conflicts(l) {
+			return o
+		}
+	}
+	return nil
+}
+
+// remove removes the range of `l` from the locks of its owner, the locks partially covered are split (the lock must
+// be held)
+func (fl *fileLocks) remove(l *Lock) bool {
+	var removed bool
+	locks := []*Lock{}
+	for _, o := range fl.locks {
+		if o.Owner != l.Owner || !o.overlaps(l) {
+			locks = append(locks, o)
+			continue
+		}
+		removed = true
+		if o.Start < l.Start {
+			before := *o
+			before.End = l.Start - 1
+			locks = append(locks, &before)
+		}
+		if o.End > l.End {
+			after := *o
+			after.Start = l.End + 1
+			locks = append(locks, &after)
+		}
+	}
+	fl.locks = locks
+	return removed
+}
+
+// notify wakes up the waiters (the lock must be held)
+func (fl *fileLocks) notify() {
+	if fl.changed != nil {
+		close(fl.changed)
+		fl.changed = nil
+	}
+}
+
+// Lock acquires the lock, `ErrLocked` is returned if it conflicts with a lock held by another owner. A lock replaces
+// the locks already held by the same owner on the same range (e.g. to upgrade a read lock).
+func (f *File) Lock(l *Lock) error {
+	fl := &f.state.locks
+	fl.mu.Lock()
+	if fl.conflict(l) != nil {
+		fl.mu.Unlock()
+		return ErrLocked
+	}
+	if fl.remove(l) {
+		// A downgrade may unblock a waiter
+		fl.notify()
+	}
+	fl.locks = append(fl.locks, l)
+	// The lease is stored on the first lock, and renewed until the last one is released
+	var leasing chan struct{}
+	if f.fs.leaseTTL > 0 && fl.leasing == nil {
+		leasing = make(chan struct{})
+		fl.leasing = leasing
+		go f.keepLease(leasing)
+	}
+	fl.mu.Unlock()
+
+	f.log.Debug("locked", "lock", fmt.Sprintf("%+v", l))
+	if leasing != nil {
+		f.fs.acquireLease(f.Path(), leasing)
+	}
+	return nil
+}
+
+// keepLease renews the cross-host lease every half TTL until `stop` is closed
+func (f *File) keepLease(stop chan struct{}) {
+	t := time.NewTicker(f.fs.leaseTTL / 2)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			f.fs.renewLease(f.Path(), stop)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stopLease stops the renewal of the lease, it returns true if a lease was held (the lock must be held)
+func (fl *fileLocks) stopLease() bool {
+	if fl.leasing == nil {
+		return false
+	}
+	close(fl.leasing)
+	fl.leasing = nil
+	return true
+}
+
+// LockWait is like `Lock` but it waits until the conflicting locks are released (or `ctx` is canceled)
+func (f *File) LockWait(ctx context.Context, l *Lock) error {
+	for {
+		fl := &f.state.locks
+		fl.mu.Lock()
+		if fl.conflict(l) == nil {
+			fl.mu.Unlock()
+			if err := f.Lock(l); err != ErrLocked {
+				return err
+			}
+			continue
+		}
+		if fl.changed == nil {
+			fl.changed = make(chan struct{})
+		}
+		changed := fl.changed
+		fl.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Unlock releases the range of `l` from the locks held by its owner
+func (f *File) Unlock(l *Lock) {
+	fl := &f.state.locks
+	fl.mu.Lock()
+	if !fl.remove(l) {
+		fl.mu.Unlock()
+		return
+	}
+	fl.notify()
+	var leased bool
+	if len(fl.locks) == 0 {
+		leased = fl.stopLease()
+	}
+	fl.mu.Unlock()
+
+	f.log.Debug("unlocked", "lock", fmt.Sprintf("%+v", l))
+	if leased {
+		f.fs.releaseLease(f.Path())
+	}
+}
+
+// QueryLock returns the first lock conflicting with `l`, or nil if `l` could be acquired
+func (f *File) QueryLock(l *Lock) *Lock {
+	fl := &f.state.locks
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	if o := fl.conflict(l); o != nil {
+		out := *o
+		return &out
+	}
+	return nil
+}
+
+// ReleaseLocks releases every lock held by `owner` (the POSIX locks, or the flock locks if `flock` is true), it must
+// be called when the owner closes the file
+func (f *File) ReleaseLocks(owner uint64, flock bool) {
+	f.Unlock(&Lock{Owner: owner, Start: 0, End: LockEOF, Flock: flock})
+}
+
+// ReleaseAllLocks releases the locks of every owner (e.g. when the kernel forgets the node), the locks are kept while
+// the file is still open (through another node of the same file)
+func (f *File) ReleaseAllLocks() {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.state.openCount > 0 {
+		return
+	}
+
+	fl := &f.state.locks
+	fl.mu.Lock()
+	if len(fl.locks) == 0 {
+		fl.mu.Unlock()
+		return
+	}
+	fl.locks = nil
+	fl.notify()
+	leased := fl.stopLease()
+	fl.mu.Unlock()
+
+	if leased {
+		f.fs.releaseLease(f.Path())
+	}
+}
+
+// Locks returns a copy of the locks currently held on the file
+func (f *File) Locks() []*Lock {
+	fl := &f.state.locks
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	locks := []*Lock{}
+	for _, l := range fl.locks {
+		out := *l
+		locks = append(locks, &out)
+	}
+	return locks
+}
+
+// Path returns the path of the file from the root of the FS
+func (f *File) Path() string {
+	f.fs.mu.RLock()
+	defer f.fs.mu.RUnlock()
+
+	return nodePath(f.parent, f.meta.Name)
+}
+
+// LockLease is an advisory lease stored in the remote kvstore while a host holds a lock on a file
+type LockLease struct {
+	Host    string `json:"host"`
+	Expires int64  `json:"expires"` // Unix timestamp, a released lease expires immediately
+}
+
+// EnableLockLeases enables the advisory cross-host leases: when a file gets locked, a lease valid for `ttl` is stored
+// in the remote kvstore, and a warning is logged if another host already holds one on the same path. The leases
+// never block the local locks.
+func (f *FS) EnableLockLeases(ttl time.Duration) {
+	f.leaseTTL = ttl
+}
+
+// LockLease returns the current lease on `path`, or nil if no host holds one
+func (f *FS) LockLease(path string) (*LockLease, error) {
+	kv, err := f.rkv.Get(fmt.Sprintf(lockLeaseKeyFmt, f.Name(), path), -1)
+	switch err {
+	case nil:
+	case kvstore.ErrKeyNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	lease := &LockLease{}
+	if err := json.Unmarshal(kv.Data, lease); err != nil {
+		return nil, err
+	}
+	if lease.Expires <= time.Now().Unix() {
+		return nil, nil
+	}
+	return lease, nil
+}
+
+// acquireLease stores a lease for `path` in the background (if the leases are enabled), unless `stop` has been closed
+// (the lock released) before it gets stored
+func (f *FS) acquireLease(path string, stop chan struct{}) {
+	if f.leaseTTL == 0 {
+		return
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.renewLease(path, stop)
+	}()
+}
+
+// renewLease renews our lease for `path` unless `stop` has been closed in the meantime (so a renewal never overwrites
+// a released lease)
+func (f *FS) renewLease(path string, stop chan struct{}) {
+	f.leaseMu.Lock()
+	defer f.leaseMu.Unlock()
+	select {
+	case <-stop:
+		return
+	default:
+	}
+	f.storeLease(path)
+}
+
+// storeLease stores (or renews) our lease for `path`, a warning is logged if another host holds one
+func (f *FS) storeLease(path string) {
+	lease, err := f.LockLease(path)
+	if err != nil {
+		f.log.Error("failed to fetch the lock lease", "path", path, "err", err)
+		return
+	}
+	if lease != nil && lease.Host != root.Hostname {
+		f.log.Warn("file locked by another host", "path", path, "host", lease.Host,
+			"expires", time.Unix(lease.Expires, 0).Format(time.RFC3339))
+	}
+	if err := f.putLease(path, time.Now().Add(f.leaseTTL).Unix()); err != nil {
+		f.log.Error("failed to store the lock lease", "path", path, "err", err)
+	}
+}
+
+// releaseLease expires our lease for `path` in the background (if the leases are enabled)
+func (f *FS) releaseLease(path string) {
+	if f.leaseTTL == 0 {
+		return
+	}
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		f.leaseMu.Lock()
+		defer f.leaseMu.Unlock()
+		// Don't expire the lease of another host
+		lease, err := f.LockLease(path)
+		if err != nil {
+			f.log.Error("failed to fetch the lock lease", "path", path, "err", err)
+			return
+		}
+		if lease == nil || lease.Host != root.Hostname {
+			return
+		}
+		if err := f.putLease(path, 0); err != nil {
+			f.log.Error("failed to release the lock lease", "path", path, "err", err)
+		}
+	}()
+}
+
+func (f *FS) putLease(path string, expires int64) error {
+	js, err := json.Marshal(&LockLease{Host: root.Hostname, Expires: expires})
+	if err != nil {
+		return err
+	}
+	_, err = f.rkv.Put(fmt.Sprintf(lockLeaseKeyFmt, f.Name(), path), "", js, -1)
+	return err
+}
@@ -0,0 +1,220 @@
+package fstree
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tsileo/blobfs/pkg/blobstashtest"
+	"github.com/tsileo/blobfs/pkg/root"
+	"golang.org/x/net/context"
+)
+
+func TestLocks(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	file := createTestFile(t, f.Root(), "db.sqlite", "data")
+
+	// Read locks are shared
+	if err := file.Lock(&Lock{Owner: 1, Type: ReadLock, Start: 0, End: 99}); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := file.Lock(&Lock{Owner: 2, Type: ReadLock, Start: 50, End: 149}); err != nil {
+		t.Fatalf("shared lock failed: %v", err)
+	}
+	if err := file.Lock(&Lock{Owner: 2, Type: WriteLock, Start: 0, End: 9}); err != ErrLocked {
+		t.Errorf("write lock should conflict with a read lock, got %v", err)
+	}
+	// Non-overlapping ranges don't conflict
+	if err := file.Lock(&Lock{Owner: 2, Type: WriteLock, Start: 200, End: LockEOF}); err != nil {
+		t.Errorf("lock on another range failed: %v", err)
+	}
+	if conflict := file.QueryLock(&Lock{Owner: 3, Type: WriteLock, Start: 60, End: 60}); conflict == nil {
+		t.Errorf("QueryLock should return the conflicting lock")
+	}
+	if conflict := file.QueryLock(&Lock{Owner: 3, Type: ReadLock, Start: 150, End: 199}); conflict != nil {
+		t.Errorf("QueryLock should not return a conflict, got %+v", conflict)
+	}
+
+	// Unlocking the middle of a range splits it
+	file.Unlock(&Lock{Owner: 1, Start: 10, End: 19})
+	if err := file.Lock(&Lock{Owner: 3, Type: WriteLock, Start: 10, End: 19}); err != nil {
+		t.Errorf("lock on the unlocked range failed: %v", err)
+	}
+	if err := file.Lock(&Lock{Owner: 3, Type: WriteLock, Start: 0, End: 9}); err != ErrLocked {
+		t.Errorf("the rest of the range should still be locked, got %v", err)
+	}
+
+	// flock and POSIX locks don't interact
+	if err := file.Lock(&Lock{Owner: 4, Type: WriteLock, Start: 0, End: LockEOF, Flock: true}); err != nil {
+		t.Errorf("flock failed: %v", err)
+	}
+	if err := file.Lock(&Lock{Owner: 5, Type: ReadLock, Start: 0, End: LockEOF, Flock: true}); err != ErrLocked {
+		t.Errorf("flock should conflict with the other flock, got %v", err)
+	}
+
+	// Closing the file releases the locks of the owner
+	file.ReleaseLocks(1, false)
+	file.ReleaseLocks(2, false)
+	file.ReleaseLocks(3, false)
+	file.ReleaseLocks(4, true)
+	if locks := file.Locks(); len(locks) != 0 {
+		t.Errorf("no locks expected, got %+v", locks)
+	}
+}
+
+func TestLockWait(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	file := createTestFile(t, f.Root(), "mbox", "data")
+
+	if err := file.Lock(&Lock{Owner: 1, Type: WriteLock, Start: 0, End: LockEOF}); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	// Waiting can be interrupted
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := file.LockWait(ctx, &Lock{Owner: 2, Type: ReadLock, Start: 0, End: 0}); err != context.DeadlineExceeded {
+		t.Errorf("LockWait should time out, got %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- file.LockWait(context.Background(), &Lock{Owner: 2, Type: WriteLock, Start: 0, End: LockEOF})
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("LockWait should block, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	// Forgetting the node releases every lock
+	file.ReleaseAllLocks()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("LockWait failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("LockWait should return once the lock is released")
+	}
+	if locks := file.Locks(); len(locks) != 1 || locks[0].Owner != 2 {
+		t.Errorf("owner 2 should hold the lock, got %+v", locks)
+	}
+}
+
+func TestLockLeases(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+	defer func(hostname string) {
+		root.Hostname = hostname
+	}(root.Hostname)
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	fs1.EnableLockLeases(time.Minute)
+	file1 := createTestFile(t, fs1.Root(), "index.lock", "")
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	fs2.EnableLockLeases(time.Minute)
+	file2 := createTestFile(t, fs2.Root(), "index.lock", "")
+
+	root.Hostname = "host1"
+	if err := file1.Lock(&Lock{Owner: 1, Type: WriteLock, Start: 0, End: LockEOF}); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	fs1.Wait()
+	lease, err := fs2.LockLease("/index.lock")
+	if err != nil {
+		t.Fatalf("failed to fetch the lease: %v", err)
+	}
+	if lease == nil || lease.Host != "host1" {
+		t.Fatalf("host1 should hold the lease, got %+v", lease)
+	}
+
+	// The leases are advisory, another host can still lock the file locally (a warning is logged)
+	root.Hostname = "host2"
+	if err := file2.Lock(&Lock{Owner: 1, Type: WriteLock, Start: 0, End: LockEOF}); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	fs2.Wait()
+	file2.ReleaseLocks(1, false)
+	fs2.Wait()
+	if lease, _ := fs2.LockLease("/index.lock"); lease != nil {
+		t.Errorf("the lease should be released, got %+v", lease)
+	}
+}
+
+func TestReleaseAllLocksOpen(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	file := createTestFile(t, f.Root(), "shared.db", "data")
+
+	// Two handles on the same file (e.g. through two kernel nodes), one of them is forgotten
+	for i := 0; i < 2; i++ {
+		if err := file.Open(); err != nil {
+			t.Fatalf("open failed: %v", err)
+		}
+	}
+	if err := file.Lock(&Lock{Owner: 1, Type: WriteLock, Start: 0, End: LockEOF}); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if err := file.Release(); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	file.ReleaseAllLocks()
+	if locks := file.Locks(); len(locks) != 1 {
+		t.Errorf("the lock should be kept while the file is open, got %+v", locks)
+	}
+
+	if err := file.Release(); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	file.ReleaseAllLocks()
+	if locks := file.Locks(); len(locks) != 0 {
+		t.Errorf("no locks expected, got %+v", locks)
+	}
+}
+
+func TestLockLeaseRenewal(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	f.EnableLockLeases(2 * time.Second)
+	file := createTestFile(t, f.Root(), "index.lock", "")
+
+	if err := file.Lock(&Lock{Owner: 1, Type: WriteLock, Start: 0, End: LockEOF}); err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	f.Wait()
+	lease, err := f.LockLease("/index.lock")
+	if err != nil || lease == nil {
+		t.Fatalf("failed to fetch the lease: %v %v", lease, err)
+	}
+
+	// The lease is renewed every half TTL while the lock is held
+	time.Sleep(1500 * time.Millisecond)
+	renewed, err := f.LockLease("/index.lock")
+	if err != nil || renewed == nil {
+		t.Fatalf("failed to fetch the lease: %v %v", renewed, err)
+	}
+	if renewed.Expires <= lease.Expires {
+		t.Errorf("the lease should be renewed, expires %d, got %d", lease.Expires, renewed.Expires)
+	}
+
+	file.ReleaseLocks(1, false)
+	f.Wait()
+	if lease, _ := f.LockLease("/index.lock"); lease != nil {
+		t.Errorf("the lease should be released, got %+v", lease)
+	}
+}
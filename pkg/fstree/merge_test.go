@@ -0,0 +1,120 @@
+package fstree
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+)
+
+func diffPaths(nodes []*DiffNode) []string {
+	out := []string{}
+	for _, n := range nodes {
+		out = append(out, n.Path+":"+n.Hash)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func checkPaths(t *testing.T, name string, got, expected []string) {
+	if len(got) != len(expected) {
+		t.Errorf("%s: expected %v, got %v", name, expected, got)
+		return
+	}
+	for i := range got {
+		if got[i] != expected[i] {
+			t.Errorf("%s: expected %v, got %v", name, expected, got)
+			return
+		}
+	}
+}
+
+func TestCompareIndex(t *testing.T) {
+	f := &FS{}
+	local := map[string]string{
+		"/":          "root1",
+		"/same":      "s",
+		"/updated":   "u1",
+		"/local":     "l",
+		"/dir":       "d1",
+		"/dir/local": "dl",
+	}
+	remote := map[string]string{
+		"/":        "root2",
+		"/same":    "s",
+		"/updated": "u2",
+		"/remote":  "r",
+		"/dir":     "d2",
+	}
+	diff, err := f.compareIndex(local, remote)
+	if err != nil {
+		t.Fatalf("compareIndex failed: %v", err)
+	}
+	checkPaths(t, "added", diffPaths(diff.Added), []string{"/remote:r"})
+	checkPaths(t, "conflicted", diffPaths(diff.Conflicted), []string{"/dir:d2", "/updated:u2"})
+	checkPaths(t, "deleted candidates", diffPaths(diff.DeletedCandidates), []string{"/dir/local:dl", "/local:l"})
+
+	// The deepest candidates must come first
+	if diff.DeletedCandidates[0].Path != "/dir/local" {
+		t.Errorf("deleted candidates should be sorted by depth, got %v", diffPaths(diff.DeletedCandidates))
+	}
+}
+
+func testMeta(name, typ string, size int, refs ...interface{}) *meta.Meta {
+	m := meta.NewMeta()
+	m.Name = name
+	m.Type = typ
+	m.Size = size
+	m.Refs = append(m.Refs, refs...)
+	m.Hash, _ = m.Json()
+	return m
+}
+
+func TestDiffIndex(t *testing.T) {
+	a := testMeta("a", "file", 1, "ra")
+	b := testMeta("b", "file", 1, "rb")
+	b2 := testMeta("b", "file", 2, "rb2")
+	c := testMeta("c", "file", 1, "rc")
+	movedC := testMeta("moved", "file", 1, "rc")
+	dir := testMeta("dir", "dir", 0, a.Hash)
+	newDir := testMeta("newdir", "dir", 0, a.Hash)
+
+	oldIndex := map[string]*meta.Meta{
+		"/":      testMeta("", "dir", 0),
+		"/b":     b,
+		"/c":     c,
+		"/del":   testMeta("del", "file", 1, "rd"),
+		"/dir":   dir,
+		"/dir/a": a,
+	}
+	newIndex := map[string]*meta.Meta{
+		"/":         testMeta("", "dir", 0, "x"),
+		"/b":        b2,
+		"/moved":    movedC,
+		"/new":      testMeta("new", "file", 1, "rn"),
+		"/newdir":   newDir,
+		"/newdir/a": a,
+	}
+
+	changes := diffIndex(oldIndex, newIndex, nil)
+	got := []string{}
+	for _, c := range changes {
+		if c.Op == changeRenamed {
+			got = append(got, c.Op+" "+c.OldPath+" -> "+c.Path)
+		} else {
+			got = append(got, c.Op+" "+c.Path)
+		}
+	}
+	checkPaths(t, "changes", got, []string{
+		"M /b",
+		"D /del",
+		"R /c -> /moved",
+		"A /new",
+		"R /dir -> /newdir",
+	})
+
+	sr := NewStatusResp(changes)
+	if len(sr.Added) != 1 || len(sr.Modified) != 1 || len(sr.Deleted) != 1 || len(sr.Renamed) != 2 {
+		t.Errorf("bad status %+v", sr)
+	}
+}
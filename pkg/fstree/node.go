@@ -0,0 +1,1187 @@
+package fstree
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"github.com/tsileo/blobfs/pkg/ignore"
+	"github.com/tsileo/blobfs/pkg/root"
+
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+	"github.com/tsileo/blobstash/pkg/filetree/reader/filereader"
+	"gopkg.in/inconshreveable/log15.v2"
+)
+
+const maxInt = int(^uint(0) >> 1)
+
+// the Node interface is implemented by both Dir and File
+type Node interface {
+	Meta() *meta.Meta
+	SetMeta(*meta.Meta)
+	Save() error
+	IsDir() bool
+}
+
+// Dir is a directory node, the children are loaded lazily.
+type Dir struct {
+	fs       *FS
+	meta     *meta.Meta
+	parent   *Dir
+	Children map[string]Node
+	log      log15.Logger
+
+	immutable bool      // true for nodes belonging to a snapshot
+	usage     treeUsage // Usage of the dir as of its meta hash, cached by `FS.Usage` (protected by the usage lock)
+}
+
+func NewDir(rfs *FS, m *meta.Meta, parent *Dir) (*Dir, error) {
+	d := &Dir{
+		fs:     rfs,
+		meta:   m,
+		parent: parent,
+		log:    rfs.log.New("ref", m.Hash, "name", m.Name, "type", "dir"),
+	}
+	return d, nil
+}
+
+// Immutable returns true if the dir can't be modified (the FS is immutable or the dir belongs to a snapshot)
+func (d *Dir) Immutable() bool {
+	return d.immutable || d.fs.Immutable()
+}
+
+// IsRoot returns true if the dir is the root of the FS (the root of a snapshot is not)
+func (d *Dir) IsRoot() bool {
+	return d.parent == nil && !d.immutable
+}
+
+// FS returns the FS the dir belongs to
+func (d *Dir) FS() *FS {
+	return d.fs
+}
+
+// reload loads the children of the dir (the FS lock must be held for writing, unless the dir is not part of the
+// current tree, e.g. the root of a snapshot and its children are only seen by the caller)
+func (d *Dir) reload() error {
+	d.log.Info("Reload dir children")
+	blobs, err := d.fs.fetchChildren(d.meta)
+	if err != nil {
+		return err
+	}
+	return d.setChildren(blobs)
+}
+
+// load loads the children of the dir if needed, the metas are fetched without holding the FS lock (which must not be
+// held)
+func (d *Dir) load() error {
+	d.fs.mu.RLock()
+	m, loaded := d.meta, d.Children != nil
+	d.fs.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	d.log.Info("Load dir children")
+	blobs, err := d.fs.fetchChildren(m)
+	if err != nil {
+		return err
+	}
+
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	// The dir may have been loaded (or updated) in the meantime
+	if d.Children != nil || d.meta != m {
+		return nil
+	}
+	return d.setChildren(blobs)
+}
+
+// setChildren builds the children nodes from their metas blobs (the FS lock must be held for writing)
+func (d *Dir) setChildren(blobs [][]byte) error {
+	children := map[string]Node{}
+	for i, blob := range blobs {
+		ref := d.meta.Refs[i].(string)
+		m, err := meta.NewMetaFromBlob(ref, blob)
+		if err != nil {
+			return err
+		}
+		d.log.Debug("fetched meta", "meta", m)
+		if m.IsDir() {
+			ndir, err := NewDir(d.fs, m, d)
+			if err != nil {
+				d.log.Error("failed to build dir", "err", err)
+				return err
+			}
+			ndir.immutable = d.immutable
+			children[m.Name] = ndir
+		} else {
+			nfile, err := NewFile(d.fs, m, d)
+			if err != nil {
+				d.log.Error("failed to build file", "err", err)
+				return err
+			}
+			nfile.immutable = d.immutable
+			children[m.Name] = nfile
+		}
+	}
+	d.Children = children
+	return nil
+}
+
+// rlockLoaded acquires the FS lock for reading once the children of the dir are loaded
+func (d *Dir) rlockLoaded() error {
+	for {
+		d.fs.mu.RLock()
+		if d.Children != nil {
+			return nil
+		}
+		d.fs.mu.RUnlock()
+		if err := d.load(); err != nil {
+			return err
+		}
+	}
+}
+
+// lockLoaded acquires the FS lock for writing once the children of `dirs` are loaded, so the network fetches don't
+// block the other operations
+func (f *FS) lockLoaded(dirs ...*Dir) error {
+	for {
+		f.mu.Lock()
+		var cold *Dir
+		for _, d := range dirs {
+			if d.Children == nil {
+				cold = d
+				break
+			}
+		}
+		if cold == nil {
+			return nil
+		}
+		f.mu.Unlock()
+		if err := cold.load(); err != nil {
+			return err
+		}
+	}
+}
+
+// coldDirs appends the dirs of the tree whose children are not loaded to `cold`, and the `.blobfsignore` files to
+// `ignoreFiles` if it's not nil (the FS lock must be held)
+func coldDirs(d *Dir, cold *[]*Dir, ignoreFiles *[]string) {
+	if d.Children == nil {
+		*cold = append(*cold, d)
+		return
+	}
+	for name, node := range d.Children {
+		switch c := node.(type) {
+		case *Dir:
+			coldDirs(c, cold, ignoreFiles)
+		case *File:
+			if ignoreFiles != nil && name == ignore.FileName {
+				*ignoreFiles = append(*ignoreFiles, c.meta.Hash)
+			}
+		}
+	}
+}
+
+// lockTree acquires the FS lock (for writing if `write` is true) once the whole current tree is loaded, so the walks
+// (index, ignore patterns) don't fetch anything while holding it. The `.blobfsignore` files are fetched beforehand
+// too, the fetched blobs are cached in the local blobstore.
+func (f *FS) lockTree(write bool) error {
+	lock, unlock := f.mu.RLock, f.mu.RUnlock
+	if write {
+		lock, unlock = f.mu.Lock, f.mu.Unlock
+	}
+	fetched := false
+	for {
+		lock()
+		cold := []*Dir{}
+		var ignoreFiles *[]string
+		if !fetched {
+			ignoreFiles = &[]string{}
+		}
+		coldDirs(f.root, &cold, ignoreFiles)
+		if len(cold) == 0 && fetched {
+			return nil
+		}
+		unlock()
+
+		for _, d := range cold {
+			if err := d.load(); err != nil {
+				return err
+			}
+		}
+		if len(cold) == 0 {
+			for _, ref := range *ignoreFiles {
+				if _, err := f.fileContent(ref); err != nil {
+					return err
+				}
+			}
+			fetched = true
+		}
+	}
+}
+
+// coldParent returns the first dir along `path` (in the current tree) whose children are not loaded, nil if the node
+// at `path` can be looked up without fetching anything (the FS lock must be held)
+func (f *FS) coldParent(path string) *Dir {
+	d := f.root
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if d.Children == nil {
+			return d
+		}
+		child, ok := d.Children[name].(*Dir)
+		if !ok {
+			return nil
+		}
+		d = child
+	}
+	return nil
+}
+
+// lockPath acquires the FS lock (for writing if `write` is true) once the dirs along `path` are loaded
+func (f *FS) lockPath(path string, write bool) error {
+	lock, unlock := f.mu.RLock, f.mu.RUnlock
+	if write {
+		lock, unlock = f.mu.Lock, f.mu.Unlock
+	}
+	for {
+		lock()
+		cold := f.coldParent(path)
+		if cold == nil {
+			return nil
+		}
+		unlock()
+		if err := cold.load(); err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Dir) IsDir() bool { return true }
+
+func (d *Dir) Meta() *meta.Meta { return d.meta }
+
+func (d *Dir) SetMeta(m *meta.Meta) {
+	d.meta = m
+}
+
+// Lookup returns the child named `name`, `ErrNotFound` is returned if it does not exist
+func (d *Dir) Lookup(name string) (Node, error) {
+	if err := d.rlockLoaded(); err != nil {
+		return nil, err
+	}
+	defer d.fs.mu.RUnlock()
+	if c, ok := d.Children[name]; ok {
+		return c, nil
+	}
+	return nil, ErrNotFound
+}
+
+// ReadDir returns the children of the dir
+func (d *Dir) ReadDir() ([]Node, error) {
+	if err := d.rlockLoaded(); err != nil {
+		return nil, err
+	}
+	defer d.fs.mu.RUnlock()
+	nodes := []Node{}
+	for _, c := range d.Children {
+		nodes = append(nodes, c)
+	}
+	return nodes, nil
+}
+
+// Mkdir creates a new empty directory
+func (d *Dir) Mkdir(name string) (*Dir, error) {
+	if d.Immutable() {
+		return nil, ErrImmutable
+	}
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	if err := d.fs.lockLoaded(d); err != nil {
+		return nil, err
+	}
+	defer d.fs.mu.Unlock()
+
+	// Ensure the directory (or a file with the same name) does not already exist
+	if _, ok := d.Children[name]; ok {
+		return nil, ErrExists
+	}
+
+	// XXX(tsileo): can permissions be set when creating a dir? if so handle it
+
+	// Actually create the dir
+	newdir := &Dir{
+		fs:       d.fs,
+		parent:   d,
+		Children: map[string]Node{},
+		// Put only the name in the Meta since when saving it will set oll the needed attrs
+		meta: &meta.Meta{
+			Name: name,
+		},
+	}
+	newdir.log = d.fs.log.New("ref", "unknown", "name", name, "type", "dir")
+
+	// Save it
+	if err := newdir.Save(); err != nil {
+		return nil, err
+	}
+
+	// Make this new the dir the children of its parent
+	d.Children[newdir.meta.Name] = newdir
+	if err := d.Save(); err != nil {
+		return nil, err
+	}
+	newdir.log = newdir.log.New("ref", newdir.meta.Hash)
+
+	d.fs.Stats.Lock()
+	d.fs.Stats.updated = true
+	d.fs.Stats.DirsCreated++
+	d.fs.Stats.Unlock()
+
+	return newdir, nil
+}
+
+// Create creates a new empty file, the returned file is already open (`Release` must be called once done).
+func (d *Dir) Create(name string, mode os.FileMode) (*File, error) {
+	if d.Immutable() {
+		return nil, ErrImmutable
+	}
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+
+	if err := d.fs.lockLoaded(d); err != nil {
+		return nil, err
+	}
+	defer d.fs.mu.Unlock()
+
+	// The kernel only creates files that don't exist (an existing file is opened instead)
+	if _, ok := d.Children[name]; ok {
+		return nil, ErrExists
+	}
+
+	m := meta.NewMeta()
+	m.Type = "file"
+	m.Name = name
+	m.Mode = uint32(mode)
+	m.ModTime = time.Now().Format(time.RFC3339)
+
+	// If the parent directory is public, the new file should to
+	if d.meta.IsPublic() {
+		m.XAttrs = map[string]string{"public": "1"}
+	}
+
+	// Save the meta
+	mhash, mjs := m.Json()
+	m.Hash = mhash
+	mexists, err := d.fs.bs.Stat(mhash)
+	if err != nil {
+		return nil, err
+	}
+	if !mexists {
+		if err := d.fs.bs.Put(mhash, mjs); err != nil {
+			return nil, err
+		}
+	}
+
+	// Create the file node and set it as the children of the parent
+	f, err := NewFile(d.fs, m, d)
+	if err != nil {
+		return nil, err
+	}
+	d.Children[m.Name] = f
+	if err := d.Save(); err != nil {
+		return nil, err
+	}
+
+	// The new file isn't reachable until the FS lock is released, its own lock is not needed
+	f.state.openCount++
+	d.fs.addOpenFile(f)
+	f.log.Debug("new openCount", "count", f.state.openCount)
+
+	d.fs.Stats.Lock()
+	d.fs.Stats.updated = true
+	d.fs.Stats.FilesCreated++
+	d.fs.Stats.Unlock()
+
+	return f, nil
+}
+
+// Remove removes the file named `name`, `ErrIsDir` is returned if it's a directory (see `Rmdir`)
+func (d *Dir) Remove(name string) error {
+	return d.remove(name, false)
+}
+
+// Rmdir removes the directory named `name`, it must be empty
+func (d *Dir) Rmdir(name string) error {
+	return d.remove(name, true)
+}
+
+func (d *Dir) remove(name string, dir bool) error {
+	if d.Immutable() {
+		return ErrImmutable
+	}
+
+	if err := d.fs.lockLoaded(d); err != nil {
+		return err
+	}
+	defer d.fs.mu.Unlock()
+
+	node, ok := d.Children[name]
+	if !ok {
+		return ErrNotFound
+	}
+	switch {
+	case dir && !node.IsDir():
+		return ErrNotDir
+	case !dir && node.IsDir():
+		return ErrIsDir
+	case dir:
+		if err := node.(*Dir).checkEmpty(); err != nil {
+			return err
+		}
+	}
+
+	delete(d.Children, name)
+	d.fs.untrackPath(nodePath(d, name))
+	if err := d.Save(); err != nil {
+		d.log.Error("Failed to saved", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// checkEmpty returns `ErrNotEmpty` if the dir has children (the FS lock must be held), the children of a cold dir are
+// not fetched, its refs are counted instead
+func (d *Dir) checkEmpty() error {
+	if d.Children == nil {
+		if len(d.meta.Refs) > 0 {
+			return ErrNotEmpty
+		}
+		return nil
+	}
+	if len(d.Children) > 0 {
+		return ErrNotEmpty
+	}
+	return nil
+}
+
+// checkName returns `ErrInvalid` if `name` can't be used as a node name
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return ErrInvalid
+	}
+	return nil
+}
+
+// Rename moves the child `oldName` to `newDir` as `newName`. An existing destination is replaced like rename(2) does:
+// a directory can only replace an empty directory, and a file can't replace a directory.
+func (d *Dir) Rename(oldName string, newDir *Dir, newName string) error {
+	if d.Immutable() || newDir.Immutable() {
+		return ErrImmutable
+	}
+	if err := checkName(newName); err != nil {
+		return err
+	}
+
+	if err := d.fs.lockLoaded(d, newDir); err != nil {
+		return err
+	}
+	defer d.fs.mu.Unlock()
+
+	node, ok := d.Children[oldName]
+	if !ok {
+		return ErrNotFound
+	}
+	if d == newDir && oldName == newName {
+		return nil
+	}
+	if node.IsDir() {
+		// A directory can't be moved inside itself
+		for p := newDir; p != nil; p = p.parent {
+			if p == node {
+				return ErrInvalid
+			}
+		}
+	}
+	if target, ok := newDir.Children[newName]; ok {
+		switch {
+		case node.IsDir() && !target.IsDir():
+			return ErrNotDir
+		case !node.IsDir() && target.IsDir():
+			return ErrIsDir
+		case target.IsDir():
+			if err := target.(*Dir).checkEmpty(); err != nil {
+				return err
+			}
+		}
+	}
+
+	oldPath, newPath := nodePath(d, oldName), nodePath(newDir, newName)
+	m := node.Meta()
+	// FIXME(tsileo): Is the RenameMeta even needed? (it may be bad that it's saving the meta?)
+	if err := d.fs.uploader.RenameMeta(m, newName); err != nil {
+		m.Name = oldName
+		m.Hash, _ = m.Json()
+		return err
+	}
+	// Move the node (the destination, if any, is replaced)
+	delete(d.Children, oldName)
+	newDir.Children[newName] = node
+	switch n := node.(type) {
+	case *Dir:
+		n.parent = newDir
+	case *File:
+		n.parent = newDir
+	}
+	d.fs.trackRename(oldPath, newPath)
+
+	return saveDirs(d, newDir)
+}
+
+// saveDirs saves `a` and `b` with a single walk up to the root, so the mutation is stored as a single WIP root
+func saveDirs(a, b *Dir) error {
+	if a == b {
+		return a.Save()
+	}
+	ancestors := map[*Dir]bool{}
+	for p := a; p != nil; p = p.parent {
+		ancestors[p] = true
+	}
+	common := b
+	for common != nil && !ancestors[common] {
+		common = common.parent
+	}
+	if common == nil {
+		// Should not happen as both dirs belong to the same tree
+		if err := a.Save(); err != nil {
+			return err
+		}
+		return b.Save()
+	}
+	// Save both branches bottom-up, and then the common ancestor up to the root
+	for _, dir := range []*Dir{a, b} {
+		for p := dir; p != common; p = p.parent {
+			if err := p.saveMeta(); err != nil {
+				return err
+			}
+		}
+	}
+	return common.Save()
+}
+
+func makePublic(node Node, value string) error {
+	if value == "1" {
+		if node.Meta().XAttrs == nil {
+			node.Meta().XAttrs = map[string]string{}
+		}
+		node.Meta().XAttrs["public"] = value
+	} else {
+		delete(node.Meta().XAttrs, "public")
+	}
+	// TODO(tsileo): too much mutations??
+	if node.IsDir() {
+		for _, child := range node.(*Dir).Children {
+			if err := makePublic(child, value); err != nil {
+				return err
+			}
+		}
+	}
+	if err := node.Save(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SetXattr sets the extended attribute, setting the `public` attribute applies to the children too
+func (d *Dir) SetXattr(name string, value []byte) error {
+	if d.Immutable() {
+		return ErrImmutable
+	}
+
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+
+	// If the request is to make the dir public, make it recursively
+	if name == "public" {
+		return makePublic(d, string(value))
+	}
+
+	if d.meta.XAttrs == nil {
+		d.meta.XAttrs = map[string]string{}
+	}
+
+	d.meta.XAttrs[name] = string(value)
+
+	return d.Save()
+}
+
+// RemoveXattr removes the extended attribute, `ErrNoXattr` is returned if it's not set
+func (d *Dir) RemoveXattr(name string) error {
+	if d.Immutable() {
+		return ErrImmutable
+	}
+
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+
+	if d.meta.XAttrs == nil {
+		return ErrNoXattr
+	}
+
+	if _, ok := d.meta.XAttrs[name]; ok {
+		// Delete the attribute
+		delete(d.meta.XAttrs, name)
+		return d.Save()
+	}
+	return ErrNoXattr
+}
+
+// Save save all the node recursively bottom to top until the root node is reached
+// Assumes the caller has acquired the lock
+func (d *Dir) Save() error {
+	if d.Immutable() {
+		d.log.Warn("Trying to save an immutable node")
+		return nil
+	}
+	if err := d.saveMeta(); err != nil {
+		return err
+	}
+
+	if d.parent == nil {
+		// If no parent, this is the root so save the ref
+		return d.saveRoot()
+	}
+	// d.parent.mu.Lock()
+	// defer d.parent.mu.Unlock()
+	return d.parent.Save()
+}
+
+// saveMeta saves the meta of the dir without saving its parents
+func (d *Dir) saveMeta() error {
+	d.log.Debug("saving")
+
+	// Create a new Meta and populate it using the previous Meta data
+	m := meta.NewMeta()
+	m.Name = d.meta.Name
+	m.Type = "dir"
+	m.Mode = uint32(os.ModeDir | 0555)
+	m.XAttrs = d.meta.XAttrs
+	if d.meta.ModTime != "" {
+		m.ModTime = d.meta.ModTime
+	} else {
+		m.ModTime = time.Now().Format(time.RFC3339)
+	}
+
+	// The refs are sorted so the hash doesn't depend on the map order (it's compared with the pushed one)
+	refs := []string{}
+	for _, c := range d.Children {
+		switch node := c.(type) {
+		case *Dir:
+			refs = append(refs, node.meta.Hash)
+		case *File:
+			refs = append(refs, node.meta.Hash)
+		}
+	}
+	sort.Strings(refs)
+	for _, ref := range refs {
+		m.AddRef(ref)
+	}
+
+	// Recompute the hash and update the node's meta ref
+	mhash, mjs := m.Json()
+	m.Hash = mhash
+	d.meta = m
+
+	mexists, err := d.fs.bs.Stat(mhash)
+	if err != nil {
+		d.log.Error("stat failed", "err", err)
+		return err
+	}
+
+	if !mexists {
+		if err := d.fs.bs.Put(mhash, mjs); err != nil {
+			d.log.Error("put failed", "err", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// saveRoot stores the root as a new WIP mutation
+func (d *Dir) saveRoot() error {
+	root := root.New(d.meta.Hash, 0)
+	root.Base = d.fs.base
+	// The renames are stored along with the tree so they survive a restart
+	if len(d.fs.renames) > 0 {
+		root.Renames = map[string]string{}
+		for p, from := range d.fs.renames {
+			root.Renames[p] = from
+		}
+	}
+	js, err := json.Marshal(root)
+	if err != nil {
+		return err
+	}
+
+	// Save the mutation locally
+	kv, err := d.fs.lkv.Put(fmt.Sprintf(localRootKeyFmt, d.fs.Name()), "", js, -1)
+	if err != nil {
+		return err
+	}
+
+	root.Version = kv.Version
+	d.log.Debug("Creating a new VKV entry", "entry", kv)
+
+	// Update the local mount
+	d.fs.local = &Mount{
+		immutable: false,
+		root:      root,
+		node:      d,
+	}
+
+	d.log.Debug("Current root", "root", d.fs.root, "new", d)
+
+	// FIXME(tsileo): should the root be updated??
+	// (copying the root onto itself would race with the lock-free reads of its immutable fields like `fs`)
+	if d.fs.root != nil && d.fs.root != d {
+		*d.fs.root = *d
+	}
+	return nil
+}
+
+type fileState struct {
+	updated   bool
+	openCount int
+	dirty     dirtyRanges  // Ranges written since the last flush
+	chunks    []*fileChunk // Chunks of the in-memory content as of the last load/flush
+	locks     fileLocks    // Advisory locks (flock/fcntl)
+}
+
+// File is a file node, the content is loaded in memory while the file is open.
+type File struct {
+	fs       *FS
+	data     []byte // FIXME(tsileo): if data grows too much, use a temp file
+	meta     *meta.Meta
+	FakeFile *filereader.File
+	log      log15.Logger
+	parent   *Dir
+	state    *fileState
+	mu       sync.RWMutex // Protects data, FakeFile and state (see the package doc for the lock order)
+
+	immutable bool // true for nodes belonging to a snapshot
+}
+
+func NewFile(fs *FS, m *meta.Meta, parent *Dir) (*File, error) {
+	return &File{
+		parent: parent,
+		fs:     fs,
+		meta:   m,
+		log:    fs.log.New("ref", m.Hash, "name", m.Name, "type", "file"),
+		state:  &fileState{},
+	}, nil
+}
+
+// Immutable returns true if the file can't be modified (the FS is immutable or the file belongs to a snapshot)
+func (f *File) Immutable() bool {
+	return f.immutable || f.fs.Immutable()
+}
+
+// Snapshot returns true if the file belongs to a snapshot
+func (f *File) Snapshot() bool {
+	return f.immutable
+}
+
+// FS returns the FS the file belongs to
+func (f *File) FS() *FS {
+	return f.fs
+}
+
+func (f *File) IsDir() bool { return false }
+
+func (f *File) Meta() *meta.Meta { return f.meta }
+
+func (f *File) SetMeta(m *meta.Meta) {
+	f.meta = m
+}
+
+// XXX(tsileo): try to get rid of this
+type ClosingBuffer struct {
+	*bytes.Buffer
+}
+
+func (*ClosingBuffer) Close() error {
+	return nil
+}
+
+// Open opens the file, on the first open, the file content is loaded in memory (without holding the FS lock)
+func (f *File) Open() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.state.openCount++
+	f.fs.addOpenFile(f)
+	f.log.Debug("open count", "count", f.state.openCount)
+
+	// If it's the first file descriptor for this file, load the file content into a buffer so it can be written
+	// FIXME(tsileo): instead of loading all the file in RAM, create a temporary file at $BLOBFS_WD/$PATH_IN_THE_FS
+	// this way, if there's a power outage/unexpected exception, the WIP won't be loose (like is it right now)
+	if f.state.openCount == 1 {
+		f.state.chunks = nil
+		f.state.dirty = nil
+	}
+	if f.state.openCount == 1 && len(f.meta.Refs) > 0 {
+		f.log.Debug("Loading the file in memory")
+		f.FakeFile = filereader.NewFile(sharedBlobs{f.fs}, f.meta)
+		var err error
+		f.data, err = ioutil.ReadAll(f.FakeFile)
+		if err != nil {
+			f.log.Error("failed to read", "err", err)
+			return err
+		}
+		// Keep the chunks of the loaded content, so the unmodified ones are reused when saving it
+		f.state.chunks = fileChunks(f.meta)
+	}
+
+	return nil
+}
+
+// Write writes `data` at `offset` in the in-memory buffer, the file is saved on the last `Release`
+func (f *File) Write(data []byte, offset int64) (int, error) {
+	if f.Immutable() {
+		return 0, ErrImmutable
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Set the updated flag
+	f.state.updated = true
+	f.state.dirty = f.state.dirty.add(int(offset), int(offset)+len(data))
+
+	newLen := offset + int64(len(data))
+	if newLen > int64(maxInt) {
+		return 0, syscall.EFBIG
+	}
+
+	n := copy(f.data[offset:], data)
+	if n < len(data) {
+		f.data = append(f.data, data[n:]...)
+	}
+
+	return len(data), nil
+}
+
+// Read reads up to `size` bytes at `offset`, the file must be open
+func (f *File) Read(offset int64, size int) ([]byte, error) {
+	// The FakeFile loads the content on the first read
+	if f.Immutable() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+	} else {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+	}
+
+	if f.data == nil && f.FakeFile == nil {
+		f.log.Debug("Aborting, neither data or FakeFile is init")
+		return nil, nil
+	}
+
+	if offset >= int64(f.size()) {
+		f.log.Debug("Aborting, out of boundaries offset")
+		return nil, nil
+	}
+
+	if f.Immutable() {
+		f.log.Debug("Reading from FakeFile")
+		buf := make([]byte, size)
+		n, err := f.FakeFile.ReadAt(buf, offset)
+		if err == io.EOF {
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+
+	f.log.Debug("Reading from memory")
+	end := offset + int64(size)
+	if end > int64(len(f.data)) {
+		end = int64(len(f.data))
+	}
+	return f.data[offset:end], nil
+}
+
+// Flush saves the in-memory content if it has been updated (the blobs are written to the local blobstore and a new
+// WIP root is saved), the file stays open
+func (f *File) Flush() error {
+	if f.Immutable() {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.flush()
+}
+
+// Fsync is like `Flush`, but it only returns once the blobs and the WIP root are durably stored on disk
+func (f *File) Fsync() error {
+	if f.Immutable() {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if err := f.flush(); err != nil {
+		return err
+	}
+	return f.fs.syncLocal()
+}
+
+// Release closes the file, if it's the last file descriptor, the updated content is saved
+func (f *File) Release() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	defer func() {
+		f.state.openCount--
+		f.fs.removeOpenFile(f, f.state.openCount == 0)
+		f.log.Debug("new openCount", "count", f.state.openCount)
+		f.log.Debug("OP Release END")
+	}()
+
+	// If it's the last file descriptor for this file, then we need to save it
+	if f.state.openCount == 1 {
+		f.log.Debug("Last file descriptor for this node, cleaning up the FakeFile and data")
+		if err := f.flush(); err != nil {
+			return err
+		}
+		// This is the last file descriptor, we can clean everything
+		if f.FakeFile != nil {
+			f.FakeFile.Close()
+			f.FakeFile = nil
+		}
+		f.data = nil
+		f.state.chunks = nil
+	}
+	return nil
+}
+
+// dirty returns true if the in-memory content has been updated since the last flush (the file lock must be held)
+func (f *File) dirty() bool {
+	return !f.Immutable() && f.data != nil && len(f.data) > 0 && f.state.updated
+}
+
+// flush uploads the in-memory content if it has been updated, and saves the parent (the file lock must be held, the
+// content is uploaded before acquiring the FS lock)
+func (f *File) flush() error {
+	if !f.dirty() {
+		return nil
+	}
+	// XXX(tsileo): data will be saved once the tree will be synced
+	m2, reused, err := f.upload()
+	f.log.Debug("new meta", "meta", fmt.Sprintf("%+v", m2), "reused_chunks", reused)
+	if err != nil {
+		return err
+	}
+	if err := f.saveContent(m2); err != nil {
+		return err
+	}
+
+	f.log.Debug("Flushed", "data_len", len(f.data))
+	f.state.updated = false
+	f.state.dirty = nil
+	f.state.chunks = fileChunks(m2)
+	return nil
+}
+
+// upload splits the in-memory content using the content-defined chunker, saves the new chunks and returns the meta
+// of the new content (only the size and the refs are set) along with the number of reused chunks (the file lock must
+// be held).
+// Only the modified ranges are re-chunked: the chunks of the current meta that weren't written since the last flush
+// are reused as is (without hashing them again) as soon as a new chunk boundary matches their start.
+func (f *File) upload() (*meta.Meta, int, error) {
+	m := meta.NewMeta()
+	m.Type = "file"
+	m.Size = len(f.data)
+	m.ModTime = time.Now().Format(time.RFC3339)
+
+	old := f.state.chunks
+	var oldSize int
+	if len(old) > 0 {
+		oldSize = old[len(old)-1].end
+	}
+	// Writes never move the existing bytes, a chunk is still valid if it hasn't been written. The last chunk is only
+	// valid if the file didn't grow, as its end may have been set by the end of the data rather than the chunker.
+	reusable := func(c *fileChunk) bool {
+		return !f.state.dirty.overlaps(c.start, c.end) && (c.end < oldSize || len(f.data) == oldSize)
+	}
+
+	var offset, reused, i int
+	for offset < len(f.data) {
+		for i < len(old) && old[i].start < offset {
+			i++
+		}
+		if i < len(old) && old[i].start == offset && reusable(old[i]) {
+			offset = old[i].end
+			m.Refs = append(m.Refs, []interface{}{offset, old[i].hash})
+			reused++
+			continue
+		}
+
+		chunk := f.data[offset : offset+f.fs.chunker.Cut(f.data[offset:])]
+		offset += len(chunk)
+		hash := fmt.Sprintf("%x", blake2b.Sum256(chunk))
+		exists, err := f.fs.bs.Stat(hash)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !exists {
+			if err := f.fs.bs.Put(hash, chunk); err != nil {
+				return nil, 0, err
+			}
+		}
+		m.Refs = append(m.Refs, []interface{}{offset, hash})
+	}
+	return m, reused, nil
+}
+
+// saveContent completes the content meta `m` with the current name/mode/xattrs (they may have been updated while
+// uploading), saves it and replaces the file meta (the file lock must be held)
+func (f *File) saveContent(m *meta.Meta) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	m.Name = f.meta.Name
+	m.Mode = f.meta.Mode
+	if m.Mode == 0 {
+		m.Mode = 0644
+	}
+	m.XAttrs = f.meta.XAttrs
+
+	mhash, mjs := m.Json()
+	m.Hash = mhash
+	mexists, err := f.fs.bs.Stat(mhash)
+	if err != nil {
+		return err
+	}
+	if !mexists {
+		if err := f.fs.bs.Put(mhash, mjs); err != nil {
+			return err
+		}
+	}
+	f.meta = m
+	return f.parent.Save()
+}
+
+// SetXattr sets the extended attribute
+func (f *File) SetXattr(name string, value []byte) error {
+	if f.Immutable() {
+		return ErrImmutable
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.meta.XAttrs == nil {
+		f.meta.XAttrs = map[string]string{}
+	}
+	f.meta.XAttrs[name] = string(value)
+
+	// XXX(tsileo): check thath the parent get the updated hash?
+	return f.Save()
+}
+
+// RemoveXattr removes the extended attribute, `ErrNoXattr` is returned if it's not set
+func (f *File) RemoveXattr(name string) error {
+	if f.Immutable() {
+		return ErrImmutable
+	}
+
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.meta.XAttrs == nil {
+		return ErrNoXattr
+	}
+
+	if _, ok := f.meta.XAttrs[name]; ok {
+		// Delete the attribute
+		delete(f.meta.XAttrs, name)
+
+		// Save the meta
+		return f.Save()
+	}
+
+	return ErrNoXattr
+}
+
+// Save will save every node recursively bottom to top until the root is reached.
+// Assumes the FS lock is acquired.
+func (f *File) Save() error {
+	if f.Immutable() {
+		f.log.Warn("Trying to save an immutable node")
+		return nil
+	}
+
+	// Update the new `Meta`
+	f.log.Debug("OP Save (file)", "meta", f.meta)
+	// f.parent.fs.uploader.PutMeta(f.meta)
+
+	// Recompute the hash as the meta may have been updated in place (e.g. the xattrs)
+	mhash, mjs := f.meta.Json()
+	if mhash != f.meta.Hash {
+		f.meta.Hash = mhash
+		mexists, err := f.fs.bs.Stat(mhash)
+		if err != nil {
+			f.log.Error("stat failed", "err", err)
+			return err
+		}
+		if !mexists {
+			if err := f.fs.bs.Put(mhash, mjs); err != nil {
+				f.log.Error("put failed", "err", err)
+				return err
+			}
+		}
+	}
+
+	// And save the parent
+	return f.parent.Save()
+}
+
+// Size returns the size of the file, including the unsaved writes
+func (f *File) Size() int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.size()
+}
+
+// size is like `Size` (the file lock must be held)
+func (f *File) size() int {
+	if f.Immutable() || f.data == nil {
+		return f.meta.Size
+	} else {
+		// If the file is open, check the buffer length
+		return len(f.data)
+	}
+}
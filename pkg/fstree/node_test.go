@@ -0,0 +1,533 @@
+package fstree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/dchest/blake2b"
+	"github.com/tsileo/blobfs/pkg/blobstashtest"
+	"github.com/tsileo/blobfs/pkg/blobstore/blobstoretest"
+	"github.com/tsileo/blobstash/pkg/vkv"
+)
+
+func createTestFile(t *testing.T, d *Dir, name, content string) *File {
+	f, err := d.Create(name, 0644)
+	if err != nil {
+		t.Fatalf("failed to create %s: %v", name, err)
+	}
+	if _, err := f.Write([]byte(content), 0); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	if err := f.Release(); err != nil {
+		t.Fatalf("failed to release %s: %v", name, err)
+	}
+	return f
+}
+
+func readFile(t *testing.T, f *File) string {
+	if err := f.Open(); err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer f.Release()
+	data, err := f.Read(0, 1024)
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return string(data)
+}
+
+func TestDirOps(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	root := f.Root()
+
+	docs, err := root.Mkdir("docs")
+	if err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	if _, err := root.Mkdir("docs"); err != ErrExists {
+		t.Errorf("mkdir of an existing dir should return ErrExists, got %v", err)
+	}
+	if f.Stats.DirsCreated != 1 {
+		t.Errorf("1 dir created expected, got %d", f.Stats.DirsCreated)
+	}
+
+	createTestFile(t, docs, "hello.txt", "hello")
+	expectFile(t, f, "/docs/hello.txt", "hello")
+
+	// Overwrite the beginning of the file
+	node, err := docs.Lookup("hello.txt")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	file := node.(*File)
+	if err := file.Open(); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, err := file.Write([]byte("J"), 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := file.Release(); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if content := readFile(t, file); content != "Jello" {
+		t.Errorf("bad content, expected \"Jello\", got %q", content)
+	}
+
+	if err := docs.Rename("hello.txt", root, "moved.txt"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if _, err := docs.Lookup("hello.txt"); err != ErrNotFound {
+		t.Errorf("renamed file should not exist anymore, got %v", err)
+	}
+	expectFile(t, f, "/moved.txt", "Jello")
+	if err := docs.Rename("nope", root, "nope2"); err != ErrNotFound {
+		t.Errorf("renaming an unknown file should return ErrNotFound, got %v", err)
+	}
+
+	if err := root.Remove("moved.txt"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if _, ok := readTestFile(t, f, "/moved.txt"); ok {
+		t.Errorf("removed file should not exist anymore")
+	}
+
+	// Every mutation is saved as a WIP root
+	changes, err := f.Status()
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if len(changes) != 1 || changes[0].Path != "/docs" || changes[0].Op != changeAdded {
+		t.Errorf("only /docs should be added, got %+v", changes)
+	}
+}
+
+func TestXattrs(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	root := f.Root()
+
+	docs, err := root.Mkdir("docs")
+	if err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	file := createTestFile(t, docs, "a.txt", "a")
+
+	if err := file.SetXattr("user.tag", []byte("1")); err != nil {
+		t.Fatalf("setxattr failed: %v", err)
+	}
+	if file.Meta().XAttrs["user.tag"] != "1" {
+		t.Errorf("xattr not set")
+	}
+	if err := file.RemoveXattr("user.tag"); err != nil {
+		t.Fatalf("removexattr failed: %v", err)
+	}
+	if err := file.RemoveXattr("user.tag"); err != ErrNoXattr {
+		t.Errorf("removing an unset xattr should return ErrNoXattr, got %v", err)
+	}
+
+	// Making a dir public makes its children public too
+	if err := docs.SetXattr("public", []byte("1")); err != nil {
+		t.Fatalf("setxattr failed: %v", err)
+	}
+	public, err := f.PublicNodes()
+	if err != nil {
+		t.Fatalf("failed to list public nodes: %v", err)
+	}
+	if len(public) != 2 {
+		t.Errorf("2 public nodes expected, got %d", len(public))
+	}
+	// And new files are public
+	newFile, err := docs.Create("b.txt", 0644)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	defer newFile.Release()
+	if !newFile.Meta().IsPublic() {
+		t.Errorf("new file in a public dir should be public")
+	}
+}
+
+func TestSnapshotImmutable(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	createTestFile(t, f.Root(), "a.txt", "a")
+
+	snapshots, err := f.Snapshots()
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %v", err)
+	}
+	last := snapshots[len(snapshots)-1]
+	dir, err := f.SnapshotDir(last.Name)
+	if err != nil {
+		t.Fatalf("failed to load snapshot: %v", err)
+	}
+	if dir.IsRoot() {
+		t.Errorf("a snapshot dir is not the root")
+	}
+	if _, err := dir.Mkdir("nope"); err != ErrImmutable {
+		t.Errorf("mkdir in a snapshot should return ErrImmutable, got %v", err)
+	}
+	node, err := dir.Lookup("a.txt")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if _, err := node.(*File).Write([]byte("b"), 0); err != ErrImmutable {
+		t.Errorf("write in a snapshot should return ErrImmutable, got %v", err)
+	}
+	if _, err := f.SnapshotDir("nope"); err != ErrNotFound {
+		t.Errorf("unknown snapshot should return ErrNotFound, got %v", err)
+	}
+}
+
+func TestResolveRef(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	createTestFile(t, f.Root(), "a.txt", "a")
+	createTestFile(t, f.Root(), "b.txt", "b")
+
+	snapshots, err := f.Snapshots()
+	if err != nil {
+		t.Fatalf("failed to list snapshots: %v", err)
+	}
+	a, b := snapshots[len(snapshots)-2], snapshots[len(snapshots)-1]
+	if a.Root.Ref == b.Root.Ref {
+		t.Fatalf("the snapshots should have different roots")
+	}
+	var prefix string
+	for i := range a.Root.Ref {
+		if a.Root.Ref[i] != b.Root.Ref[i] {
+			prefix = a.Root.Ref[:i]
+			break
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ref := range []string{a.Root.Ref, a.Root.Ref[:10], a.Name} {
+		dir, err := f.resolveRef(ref)
+		if err != nil {
+			t.Fatalf("failed to resolve %q: %v", ref, err)
+		}
+		if dir.meta.Hash != a.Root.Ref {
+			t.Errorf("%q should resolve to %s, got %s", ref, a.Root.Ref, dir.meta.Hash)
+		}
+	}
+	if _, err := f.resolveRef(prefix); err != ErrAmbiguousRef {
+		t.Errorf("a prefix shared by two roots should return ErrAmbiguousRef, got %v", err)
+	}
+}
+
+func TestFlushAll(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	writeTestFile(t, f, "/.blobfsignore", "*.log\n")
+	writeTestFile(t, f, "/debug.log", "local only")
+
+	file, err := f.Root().Create("a.txt", 0644)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := file.Write([]byte("a"), 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if n := f.OpenFiles(); n != 1 {
+		t.Errorf("1 open file expected, got %d", n)
+	}
+
+	flushed, err := f.FlushAll()
+	if err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	if flushed != 1 {
+		t.Errorf("1 flushed file expected, got %d", flushed)
+	}
+	// The content is saved while the file is still open
+	expectFile(t, f, "/a.txt", "a")
+	if flushed, _ := f.FlushAll(); flushed != 0 {
+		t.Errorf("nothing should be flushed twice, got %d", flushed)
+	}
+
+	if err := file.Release(); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	if n := f.OpenFiles(); n != 0 {
+		t.Errorf("no open files expected, got %d", n)
+	}
+
+	summary, err := f.LocalSummary()
+	if err != nil {
+		t.Fatalf("failed to build the summary: %v", err)
+	}
+	if len(summary.Changes) != 2 {
+		t.Errorf("2 changes expected (/.blobfsignore and /a.txt), got %+v", summary.Changes)
+	}
+	if len(summary.Ignored) != 1 || summary.Ignored[0] != "/debug.log" {
+		t.Errorf("bad ignored nodes %+v", summary.Ignored)
+	}
+}
+
+func TestDirtyRanges(t *testing.T) {
+	var r dirtyRanges
+	r = r.add(10, 20)
+	r = r.add(30, 40)
+	r = r.add(0, 5)
+	r = r.add(18, 25)
+	r = r.add(25, 30) // Adjacent ranges are merged
+	r = r.add(50, 50) // Empty range
+	if !reflect.DeepEqual(r, dirtyRanges{{0, 5}, {10, 40}}) {
+		t.Errorf("bad ranges %v", r)
+	}
+	for _, tc := range []struct {
+		start, end int
+		expected   bool
+	}{
+		{5, 10, false},
+		{4, 10, true},
+		{39, 45, true},
+		{40, 45, false},
+		{12, 13, true},
+	} {
+		if r.overlaps(tc.start, tc.end) != tc.expected {
+			t.Errorf("overlaps(%d, %d) should be %v", tc.start, tc.end, tc.expected)
+		}
+	}
+}
+
+func TestIncrementalUpload(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	data := blobstoretest.RandomBlob(2 * 1024 * 1024).Data
+	file := createTestFile(t, f.Root(), "big.bin", string(data))
+
+	// The refs must be the same as if the whole content was chunked again
+	expectedRefs := func(data []byte) []string {
+		refs := []string{}
+		for _, chunk := range f.chunker.Split(data) {
+			refs = append(refs, fmt.Sprintf("%x", blake2b.Sum256(chunk)))
+		}
+		return refs
+	}
+	upload := func(offset int, patch []byte) ([]string, int) {
+		if err := file.Open(); err != nil {
+			t.Fatalf("failed to open: %v", err)
+		}
+		if _, err := file.Write(patch, int64(offset)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		file.mu.Lock()
+		m, reused, err := file.upload()
+		file.mu.Unlock()
+		if err != nil {
+			t.Fatalf("upload failed: %v", err)
+		}
+		if err := file.Release(); err != nil {
+			t.Fatalf("failed to release: %v", err)
+		}
+		refs := []string{}
+		for _, c := range fileChunks(m) {
+			refs = append(refs, c.hash)
+		}
+		return refs, reused
+	}
+
+	// Overwrite a few bytes in the middle
+	copy(data[len(data)/2:], "hello")
+	refs, reused := upload(len(data)/2, []byte("hello"))
+	if !reflect.DeepEqual(refs, expectedRefs(data)) {
+		t.Errorf("bad refs after overwrite")
+	}
+	if reused < len(refs)-2 {
+		t.Errorf("only the modified chunks should be re-hashed, %d/%d reused", reused, len(refs))
+	}
+	expectFile(t, f, "/big.bin", string(data))
+
+	// Append to the file
+	tail := blobstoretest.RandomBlob(1024).Data
+	refs, reused = upload(len(data), tail)
+	data = append(data, tail...)
+	if !reflect.DeepEqual(refs, expectedRefs(data)) {
+		t.Errorf("bad refs after append")
+	}
+	if reused < len(refs)-2 {
+		t.Errorf("only the last chunks should be re-hashed, %d/%d reused", reused, len(refs))
+	}
+	expectFile(t, f, "/big.bin", string(data))
+}
+
+// syncingBlobStore counts the calls to `Sync`
+type syncingBlobStore struct {
+	BlobStore
+	syncs int
+}
+
+func (bs *syncingBlobStore) Sync() error {
+	bs.syncs++
+	return nil
+}
+
+// putLogKvStore records the entries written to the local vkv store
+type putLogKvStore struct {
+	LocalKvStore
+	puts []*vkv.KeyValue
+}
+
+func (kvs *putLogKvStore) Put(key, ref string, data []byte, version int) (*vkv.KeyValue, error) {
+	kv, err := kvs.LocalKvStore.Put(key, ref, data, version)
+	if err != nil {
+		return nil, err
+	}
+	kvs.puts = append(kvs.puts, kv)
+	return kv, nil
+}
+
+func TestFsync(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	bs := &syncingBlobStore{BlobStore: f.bs}
+	f.bs = bs
+	lkv := &putLogKvStore{LocalKvStore: f.lkv}
+	f.lkv = lkv
+
+	file, err := f.Root().Create("db.sqlite", 0644)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if _, err := file.Write([]byte("first"), 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := file.Flush(); err != nil {
+		t.Fatalf("flush failed: %v", err)
+	}
+	expectFile(t, f, "/db.sqlite", "first")
+	if bs.syncs != 0 {
+		t.Errorf("flush should not sync the local stores")
+	}
+
+	if _, err := file.Write([]byte("second"), 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := file.Fsync(); err != nil {
+		t.Fatalf("fsync failed: %v", err)
+	}
+	if bs.syncs != 1 {
+		t.Errorf("fsync should sync the local stores, got %d syncs", bs.syncs)
+	}
+
+	// The process is killed before the file is released: the WIP root saved by fsync is loaded on restart. The local
+	// vkv store is not synced, a new store only holding the entries already put is enough.
+	tmp, err := ioutil.TempDir("", "blobfs_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+	lkv2, err := vkv.New(filepath.Join(tmp, "lkv"))
+	if err != nil {
+		t.Fatalf("failed to init local vkv: %v", err)
+	}
+	defer lkv2.Close()
+	for _, kv := range lkv.puts {
+		if _, err := lkv2.Put(kv.Key, kv.Hash, kv.Data, kv.Version); err != nil {
+			t.Fatalf("put failed: %v", err)
+		}
+	}
+	f2 := New(f.log, f.name, f.bs, lkv2, f.rkv, false)
+	if err := f2.Load(); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	expectFile(t, f2, "/db.sqlite", "second")
+}
+
+func TestUsage(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	writeTestFile(t, f, "/a.txt", "hello")
+	writeTestFile(t, f, "/dir/b.txt", "hello world")
+
+	// The unsaved writes of the open files count too
+	file, err := f.Root().Create("c.txt", 0644)
+	if err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	defer file.Release()
+	if _, err := file.Write([]byte("abc"), 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	size, nodes, err := f.Usage()
+	if err != nil {
+		t.Fatalf("usage failed: %v", err)
+	}
+	if size != 19 {
+		t.Errorf("19 bytes expected, got %d", size)
+	}
+	// The root, /dir and the 3 files
+	if nodes != 5 {
+		t.Errorf("5 nodes expected, got %d", nodes)
+	}
+}
+
+func TestUsageCache(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	writeTestFile(t, f, "/dir/a.txt", "hello")
+	writeTestFile(t, f, "/other/b.txt", "hello world")
+	if _, _, err := f.Usage(); err != nil {
+		t.Fatalf("usage failed: %v", err)
+	}
+
+	// The unchanged dirs are not walked again (their children are not even loaded)
+	dir, err := f.Root().Lookup("dir")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	f.mu.Lock()
+	dir.(*Dir).Children = nil
+	f.mu.Unlock()
+	bs := &blockingBlobStore{BlobStore: f.bs, blocked: make(chan struct{}, 1), unblock: make(chan struct{})}
+	f.bs = bs
+	defer close(bs.unblock)
+
+	writeTestFile(t, f, "/other/c.txt", "abc")
+	size, nodes, err := f.Usage()
+	if err != nil {
+		t.Fatalf("usage failed: %v", err)
+	}
+	if size != 19 || nodes != 6 {
+		t.Errorf("19 bytes and 6 nodes expected, got %d bytes and %d nodes", size, nodes)
+	}
+	if bs.gets != 0 {
+		t.Errorf("no fetches expected, got %d", bs.gets)
+	}
+}
@@ -0,0 +1,193 @@
+package fstree
+
+import (
+	"testing"
+
+	"github.com/tsileo/blobfs/pkg/blobstashtest"
+)
+
+// The errors below are mapped to the errno expected by the POSIX tools by the FUSE adapter (ErrNotFound -> ENOENT,
+// ErrExists -> EEXIST, ErrNotEmpty -> ENOTEMPTY, ErrNotDir -> ENOTDIR, ErrIsDir -> EISDIR, ErrInvalid -> EINVAL)
+
+func newPosixTestTree(t *testing.T) (*FS, *Dir, func()) {
+	s := blobstashtest.New()
+	f, cleanup := newTestFS(t, s, "test")
+	root := f.Root()
+
+	// /
+	//   file.txt
+	//   empty/
+	//   full/
+	//     child.txt
+	createTestFile(t, root, "file.txt", "file")
+	if _, err := root.Mkdir("empty"); err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	full, err := root.Mkdir("full")
+	if err != nil {
+		t.Fatalf("mkdir failed: %v", err)
+	}
+	createTestFile(t, full, "child.txt", "child")
+
+	return f, root, func() {
+		cleanup()
+		s.Close()
+	}
+}
+
+func lookupDir(t *testing.T, d *Dir, name string) *Dir {
+	node, err := d.Lookup(name)
+	if err != nil {
+		t.Fatalf("lookup %s failed: %v", name, err)
+	}
+	return node.(*Dir)
+}
+
+func TestRemoveErrors(t *testing.T) {
+	f, root, cleanup := newPosixTestTree(t)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		name     string
+		dir      bool
+		expected error
+	}{
+		{"nope", false, ErrNotFound},
+		{"nope", true, ErrNotFound},
+		{"empty", false, ErrIsDir},
+		{"file.txt", true, ErrNotDir},
+		{"full", true, ErrNotEmpty},
+	} {
+		var err error
+		if tc.dir {
+			err = root.Rmdir(tc.name)
+		} else {
+			err = root.Remove(tc.name)
+		}
+		if err != tc.expected {
+			t.Errorf("removing %s (dir=%v) should return %v, got %v", tc.name, tc.dir, tc.expected, err)
+		}
+	}
+	// Nothing was removed
+	expectFile(t, f, "/file.txt", "file")
+	expectFile(t, f, "/full/child.txt", "child")
+	if _, err := root.Lookup("empty"); err != nil {
+		t.Errorf("/empty should still exist, got %v", err)
+	}
+
+	if err := root.Rmdir("empty"); err != nil {
+		t.Fatalf("rmdir failed: %v", err)
+	}
+	if err := root.Remove("file.txt"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	for _, name := range []string{"empty", "file.txt"} {
+		if _, err := root.Lookup(name); err != ErrNotFound {
+			t.Errorf("%s should be removed, got %v", name, err)
+		}
+	}
+	// Once emptied, the dir can be removed
+	full := lookupDir(t, root, "full")
+	if err := full.Remove("child.txt"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	if err := root.Rmdir("full"); err != nil {
+		t.Errorf("rmdir of an emptied dir failed: %v", err)
+	}
+}
+
+func TestRenameErrors(t *testing.T) {
+	f, root, cleanup := newPosixTestTree(t)
+	defer cleanup()
+	full := lookupDir(t, root, "full")
+
+	for _, tc := range []struct {
+		oldName  string
+		newDir   *Dir
+		newName  string
+		expected error
+	}{
+		{"nope", root, "nope2", ErrNotFound},
+		{"file.txt", root, "empty", ErrIsDir},
+		{"empty", root, "file.txt", ErrNotDir},
+		{"empty", root, "full", ErrNotEmpty},
+		{"full", full, "sub", ErrInvalid},
+		{"file.txt", root, "", ErrInvalid},
+		{"file.txt", root, "a/b", ErrInvalid},
+		{"file.txt", root, "..", ErrInvalid},
+	} {
+		if err := root.Rename(tc.oldName, tc.newDir, tc.newName); err != tc.expected {
+			t.Errorf("renaming %s to %s should return %v, got %v", tc.oldName, tc.newName, tc.expected, err)
+		}
+	}
+	// Nothing was moved
+	expectFile(t, f, "/file.txt", "file")
+	expectFile(t, f, "/full/child.txt", "child")
+	if _, err := root.Lookup("empty"); err != nil {
+		t.Errorf("/empty should still exist, got %v", err)
+	}
+}
+
+func TestRenameReplace(t *testing.T) {
+	f, root, cleanup := newPosixTestTree(t)
+	defer cleanup()
+
+	// Renaming a node to itself is a no-op
+	if err := root.Rename("file.txt", root, "file.txt"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	expectFile(t, f, "/file.txt", "file")
+
+	// A file replaces an existing file
+	createTestFile(t, root, "other.txt", "other")
+	if err := root.Rename("other.txt", root, "file.txt"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	expectFile(t, f, "/file.txt", "other")
+	if _, err := root.Lookup("other.txt"); err != ErrNotFound {
+		t.Errorf("/other.txt should not exist anymore, got %v", err)
+	}
+
+	// A dir replaces an empty dir
+	if err := root.Rename("full", root, "empty"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	expectFile(t, f, "/empty/child.txt", "child")
+	if _, err := root.Lookup("full"); err != ErrNotFound {
+		t.Errorf("/full should not exist anymore, got %v", err)
+	}
+	nodes, err := root.ReadDir()
+	if err != nil {
+		t.Fatalf("readdir failed: %v", err)
+	}
+	if len(nodes) != 2 {
+		t.Errorf("2 nodes expected (/file.txt and /empty), got %d", len(nodes))
+	}
+}
+
+func TestMkdirErrors(t *testing.T) {
+	_, root, cleanup := newPosixTestTree(t)
+	defer cleanup()
+
+	for _, tc := range []struct {
+		name     string
+		expected error
+	}{
+		{"empty", ErrExists},
+		{"file.txt", ErrExists},
+		{"", ErrInvalid},
+		{".", ErrInvalid},
+		{"a/b", ErrInvalid},
+	} {
+		if _, err := root.Mkdir(tc.name); err != tc.expected {
+			t.Errorf("mkdir %q should return %v, got %v", tc.name, tc.expected, err)
+		}
+	}
+
+	// Creating a file doesn't replace an existing node either
+	for _, name := range []string{"empty", "file.txt"} {
+		if _, err := root.Create(name, 0644); err != ErrExists {
+			t.Errorf("create %s should return ErrExists, got %v", name, err)
+		}
+	}
+}
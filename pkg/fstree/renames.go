@@ -0,0 +1,66 @@
+package fstree
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// The renames are tracked so `Status` and `Diff` can report a renamed node as R even if it was modified (or is empty)
+// after being moved, matching the nodes by content only works for the unmodified ones.
+
+// nodePath returns the path of the node named `name` in `parent` from the root of the FS (the lock must be held)
+func nodePath(parent *Dir, name string) string {
+	parts := []string{name}
+	for d := parent; d != nil && d.parent != nil; d = d.parent {
+		parts = append([]string{d.meta.Name}, parts...)
+	}
+	return "/" + strings.Join(parts, "/")
+}
+
+// renamedFrom returns the path of the node at `p` in the last pushed tree (the lock must be held)
+func (f *FS) renamedFrom(p string) string {
+	if from, ok := f.renames[p]; ok {
+		return from
+	}
+	// The node may have been moved along with one of its parents
+	for dir := filepath.Dir(p); dir != "/"; dir = filepath.Dir(dir) {
+		if from, ok := f.renames[dir]; ok {
+			return from + strings.TrimPrefix(p, dir)
+		}
+	}
+	return p
+}
+
+// trackRename records that the node at `oldPath` was moved to `newPath`, replacing the node at `newPath` if any (the
+// lock must be held)
+func (f *FS) trackRename(oldPath, newPath string) {
+	from := f.renamedFrom(oldPath)
+	f.untrackPath(newPath)
+
+	// The renames of the children moved along with the node
+	moved := map[string]string{}
+	for p, childFrom := range f.renames {
+		if strings.HasPrefix(p, oldPath+"/") {
+			delete(f.renames, p)
+			moved[newPath+strings.TrimPrefix(p, oldPath)] = childFrom
+		}
+	}
+	for p, childFrom := range moved {
+		if p != childFrom {
+			f.renames[p] = childFrom
+		}
+	}
+	delete(f.renames, oldPath)
+	if from != newPath {
+		f.renames[newPath] = from
+	}
+}
+
+// untrackPath forgets the renames of the node at `p` and of its children, once removed (the lock must be held)
+func (f *FS) untrackPath(p string) {
+	for np := range f.renames {
+		if np == p || strings.HasPrefix(np, p+"/") {
+			delete(f.renames, np)
+		}
+	}
+}
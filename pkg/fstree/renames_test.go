@@ -0,0 +1,172 @@
+package fstree
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/tsileo/blobfs/pkg/blobstashtest"
+)
+
+func wipVersions(t *testing.T, f *FS) int {
+	versions, err := f.lkv.Versions(fmt.Sprintf(localRootKeyFmt, f.Name()), 0, -1, 0)
+	if err != nil {
+		t.Fatalf("failed to fetch the WIP versions: %v", err)
+	}
+	return len(versions.Versions)
+}
+
+func TestRenameAcrossDirs(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	writeTestFile(t, f, "/a/sub/x.txt", "x")
+	writeTestFile(t, f, "/b/y.txt", "y")
+
+	root := f.Root()
+	a := lookupDir(t, lookupDir(t, root, "a"), "sub")
+	b := lookupDir(t, root, "b")
+	// Neither dir is cached
+	a.Children = nil
+	b.Children = nil
+
+	before := wipVersions(t, f)
+	if err := a.Rename("x.txt", b, "y.txt"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if n := wipVersions(t, f) - before; n != 1 {
+		t.Errorf("the rename should be stored as a single WIP mutation, got %d", n)
+	}
+	expectFile(t, f, "/b/y.txt", "x")
+	if _, ok := readTestFile(t, f, "/a/sub/x.txt"); ok {
+		t.Errorf("/a/sub/x.txt should not exist anymore")
+	}
+
+	// The moved node is saved in its new parent
+	node, err := b.Lookup("y.txt")
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	file := node.(*File)
+	if p := file.Path(); p != "/b/y.txt" {
+		t.Errorf("bad path %q", p)
+	}
+	if err := file.Open(); err != nil {
+		t.Fatalf("open failed: %v", err)
+	}
+	if _, err := file.Write([]byte("z"), 0); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := file.Release(); err != nil {
+		t.Fatalf("release failed: %v", err)
+	}
+	expectFile(t, f, "/b/y.txt", "z")
+	if _, ok := readTestFile(t, f, "/a/sub/x.txt"); ok {
+		t.Errorf("/a/sub/x.txt should not be restored by saving the moved file")
+	}
+
+	// A dir can be moved too
+	if err := root.Rename("b", a, "b"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	expectFile(t, f, "/a/sub/b/y.txt", "z")
+	if p := file.Path(); p != "/a/sub/b/y.txt" {
+		t.Errorf("bad path %q", p)
+	}
+}
+
+func TestRenameTracking(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	f, cleanup := newTestFS(t, s, "test")
+	defer cleanup()
+	writeTestFile(t, f, "/empty.txt", "")
+	writeTestFile(t, f, "/doc.txt", "doc")
+	writeTestFile(t, f, "/dir/a.txt", "a")
+	writeTestFile(t, f, "/dir/b.txt", "b")
+	if err := f.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	root := f.Root()
+	// An empty file can't be matched by content
+	if err := root.Rename("empty.txt", root, "empty2.txt"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	// Renamed twice, then modified
+	if err := root.Rename("doc.txt", root, "tmp.txt"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if err := root.Rename("tmp.txt", root, "doc2.txt"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	writeTestFile(t, f, "/doc2.txt", "updated")
+	// A renamed dir with a modified child
+	if err := root.Rename("dir", root, "dir2"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	writeTestFile(t, f, "/dir2/a.txt", "updated")
+
+	expected := map[string]string{
+		"/doc2.txt":   "R /doc.txt",
+		"/empty2.txt": "R /empty.txt",
+		"/dir2":       "R /dir",
+		"/dir2/a.txt": "M ",
+	}
+	checkChanges := func() {
+		changes, err := f.Status()
+		if err != nil {
+			t.Fatalf("status failed: %v", err)
+		}
+		if len(changes) != len(expected) {
+			t.Errorf("%d changes expected, got %d", len(expected), len(changes))
+		}
+		for _, c := range changes {
+			if got := c.Op + " " + c.OldPath; expected[c.Path] != got {
+				t.Errorf("%s: expected %q, got %q", c.Path, expected[c.Path], got)
+			}
+		}
+	}
+	checkChanges()
+
+	// The renames survive a restart
+	f2 := New(f.log, f.Name(), f.bs, f.lkv, f.rkv, false)
+	if err := f2.Load(); err != nil {
+		t.Fatalf("failed to load root: %v", err)
+	}
+	f = f2
+	checkChanges()
+
+	// A renamed node that gets removed is reported as deleted
+	if err := f.Root().Remove("empty2.txt"); err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	delete(expected, "/empty2.txt")
+	expected["/empty.txt"] = "D "
+	checkChanges()
+
+	// Renaming a node back to its pushed path cancels the rename
+	if err := f.Root().Rename("dir2", f.Root(), "dir"); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	delete(expected, "/dir2")
+	delete(expected, "/dir2/a.txt")
+	expected["/dir/a.txt"] = "M "
+	checkChanges()
+
+	if err := f.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if len(f.renames) != 0 {
+		t.Errorf("the renames should be reset after a push, got %+v", f.renames)
+	}
+	changes, err := f.Status()
+	if err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("no changes expected after a push, got %+v", changes)
+	}
+}
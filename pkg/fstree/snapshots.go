@@ -0,0 +1,122 @@
+package fstree
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tsileo/blobfs/pkg/root"
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+	"github.com/tsileo/blobstash/pkg/vkv"
+)
+
+// Snapshot is a retained root mutation (either pushed or WIP)
+type Snapshot struct {
+	Name    string
+	Root    *root.Root
+	Data    []byte // Raw KV data, needed by `kvDataToDir`
+	Version int
+}
+
+// snapshotName returns the directory name for a snapshot, e.g. `2016-11-02T150405Z-a1b2c3d4e5`
+func snapshotName(r *root.Root) string {
+	ref := r.Ref
+	if len(ref) > 10 {
+		ref = ref[:10]
+	}
+	return fmt.Sprintf("%s-%s", time.Unix(0, int64(r.Version)).UTC().Format("2006-01-02T150405Z"), ref)
+}
+
+// Snapshots returns every retained root mutation, sorted from the oldest to the newest
+func (f *FS) Snapshots() ([]*Snapshot, error) {
+	return f.snapshots()
+}
+
+// SnapshotDir returns the (immutable) root dir of the snapshot named `name`, `ErrNotFound` is returned if there is
+// no such snapshot
+func (f *FS) SnapshotDir(name string) (*Dir, error) {
+	snapshots, err := f.snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range snapshots {
+		if s.Name != name {
+			continue
+		}
+		_, dir, err := f.kvDataToDir(s.Data, s.Version)
+		if err != nil {
+			return nil, err
+		}
+		dir.immutable = true
+		return dir, nil
+	}
+	return nil, ErrNotFound
+}
+
+// snapshots returns every retained root mutation, sorted from the oldest to the newest.
+// The mutations are fetched from the local vkv store (both pushed and WIP) and from the remote kvstore, the current
+// tree is not involved so the FS lock is not needed.
+func (f *FS) snapshots() ([]*Snapshot, error) {
+	index := map[string]*Snapshot{}
+	add := func(data []byte, version int) error {
+		r, err := root.NewFromJSON(data, version)
+		if err != nil {
+			return err
+		}
+		if r.Ref == "" {
+			return nil
+		}
+		s := &Snapshot{
+			Name:    snapshotName(r),
+			Root:    r,
+			Data:    data,
+			Version: version,
+		}
+		index[s.Name] = s
+		return nil
+	}
+
+	fsName := fmt.Sprintf(rootKeyFmt, f.Name())
+	localFsName := fmt.Sprintf(localRootKeyFmt, f.Name())
+	for _, key := range []string{fsName, localFsName} {
+		versions, err := f.lkv.Versions(key, 0, -1, 0)
+		switch err {
+		case nil:
+			for _, kv := range versions.Versions {
+				if err := add(kv.Data, kv.Version); err != nil {
+					return nil, err
+				}
+			}
+		case vkv.ErrNotFound:
+		default:
+			return nil, err
+		}
+	}
+
+	versions, err := f.rkv.Versions(fsName, 0, -1, 0)
+	switch err {
+	case nil:
+		for _, kv := range versions.Versions {
+			if err := add(kv.Data, kv.Version); err != nil {
+				return nil, err
+			}
+		}
+	case kvstore.ErrKeyNotFound:
+	default:
+		// The remote may not be reachable, only the local mutations will be available
+		f.log.Warn("failed to fetch remote mutations", "err", err)
+	}
+
+	out := []*Snapshot{}
+	for _, s := range index {
+		out = append(out, s)
+	}
+	sort.Sort(byVersion(out))
+	return out, nil
+}
+
+type byVersion []*Snapshot
+
+func (s byVersion) Len() int           { return len(s) }
+func (s byVersion) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byVersion) Less(i, j int) bool { return s[i].Version < s[j].Version }
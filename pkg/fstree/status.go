@@ -0,0 +1,373 @@
+package fstree
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tsileo/blobstash/pkg/filetree/filetreeutil/meta"
+	"github.com/tsileo/blobstash/pkg/vkv"
+)
+
+// Change markers
+const (
+	changeAdded    = "A"
+	changeModified = "M"
+	changeDeleted  = "D"
+	changeRenamed  = "R"
+)
+
+// Change represents a single difference between two trees
+type Change struct {
+	Op      string `json:"op"`
+	Path    string `json:"path"`
+	OldPath string `json:"old_path,omitempty"` // Only set for renames
+	Ref     string `json:"ref,omitempty"`
+	OldRef  string `json:"old_ref,omitempty"`
+	Size    int    `json:"size"`
+	OldSize int    `json:"old_size"`
+	IsDir   bool   `json:"is_dir"`
+	Diff    string `json:"diff,omitempty"` // Unified diff, only set by `FS.Diff` for text files
+}
+
+type Renamed struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type StatusResp struct {
+	Added    []string   `json:"added"`
+	Modified []string   `json:"modified"`
+	Deleted  []string   `json:"deleted"`
+	Renamed  []*Renamed `json:"renamed"`
+}
+
+// NewStatusResp groups the changes by type
+func NewStatusResp(changes []*Change) *StatusResp {
+	sr := &StatusResp{
+		Added:    []string{},
+		Modified: []string{},
+		Deleted:  []string{},
+		Renamed:  []*Renamed{},
+	}
+	for _, c := range changes {
+		switch c.Op {
+		case changeAdded:
+			sr.Added = append(sr.Added, c.Path)
+		case changeModified:
+			sr.Modified = append(sr.Modified, c.Path)
+		case changeDeleted:
+			sr.Deleted = append(sr.Deleted, c.Path)
+		case changeRenamed:
+			sr.Renamed = append(sr.Renamed, &Renamed{c.OldPath, c.Path})
+		}
+	}
+	return sr
+}
+
+// buildMetaIndex works like `buildLocalIndex` but keeps the whole meta (a map[path]*meta.Meta)
+func (f *FS) buildMetaIndex(n Node, p string) (map[string]*meta.Meta, error) {
+	index := map[string]*meta.Meta{}
+	index[filepath.Join(p, n.Meta().Name)] = n.Meta()
+	if n.IsDir() {
+		d := n.(*Dir)
+		if d.Children == nil {
+			if err := d.reload(); err != nil {
+				return nil, err
+			}
+		}
+		for _, child := range d.Children {
+			childIndex, err := f.buildMetaIndex(child, filepath.Join(p, n.Meta().Name))
+			if err != nil {
+				return nil, err
+			}
+			for cp, cm := range childIndex {
+				index[cp] = cm
+			}
+		}
+	}
+	return index, nil
+}
+
+// contentKey returns a key identifying the content of a node regardless of its name (the meta hash includes the
+// name), an empty key is returned for empty nodes as they can't be matched reliably.
+func contentKey(m *meta.Meta) string {
+	if len(m.Refs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d:%v", m.Type, m.Size, m.Refs)
+}
+
+// diffIndex computes the changes needed to go from `oldIndex` to `newIndex`, `renames` are the tracked renames (new
+// path -> old path, can be nil).
+// Directories are only reported when added/deleted/renamed, modifications are only reported for files.
+func diffIndex(oldIndex, newIndex map[string]*meta.Meta, renames map[string]string) []*Change {
+	added := map[string]*meta.Meta{}
+	deleted := map[string]*meta.Meta{}
+	changes := []*Change{}
+
+	for p, om := range oldIndex {
+		if p == "/" {
+			continue
+		}
+		nm, ok := newIndex[p]
+		switch {
+		case !ok:
+			deleted[p] = om
+		case om.IsDir() != nm.IsDir():
+			deleted[p] = om
+			added[p] = nm
+		case !nm.IsDir() && om.Hash != nm.Hash:
+			changes = append(changes, &Change{
+				Op:      changeModified,
+				Path:    p,
+				Ref:     nm.Hash,
+				OldRef:  om.Hash,
+				Size:    nm.Size,
+				OldSize: om.Size,
+			})
+		}
+	}
+	for p, nm := range newIndex {
+		if p == "/" {
+			continue
+		}
+		if _, ok := oldIndex[p]; !ok {
+			added[p] = nm
+		}
+	}
+
+	// The tracked renames first, they match the renamed nodes even if they were modified afterwards (or are empty), the
+	// shortest paths are processed first so the children of a renamed directory are matched along with it
+	renamedPaths := []string{}
+	for p := range renames {
+		renamedPaths = append(renamedPaths, p)
+	}
+	sort.Sort(byDepth(renamedPaths))
+	for _, newPath := range renamedPaths {
+		oldPath := renames[newPath]
+		om, okOld := deleted[oldPath]
+		nm, okNew := added[newPath]
+		if !okOld || !okNew || om.IsDir() != nm.IsDir() {
+			// Stale (e.g. the pushed tree was updated by a pull)
+			continue
+		}
+		delete(deleted, oldPath)
+		delete(added, newPath)
+		changes = append(changes, &Change{
+			Op:      changeRenamed,
+			Path:    newPath,
+			OldPath: oldPath,
+			Ref:     nm.Hash,
+			OldRef:  om.Hash,
+			Size:    nm.Size,
+			OldSize: om.Size,
+			IsDir:   nm.IsDir(),
+		})
+		if !om.IsDir() {
+			continue
+		}
+		// The children that moved along with the directory are only reported if they were modified
+		for p, cm := range deleted {
+			if !strings.HasPrefix(p, oldPath+"/") {
+				continue
+			}
+			np := newPath + strings.TrimPrefix(p, oldPath)
+			am, ok := added[np]
+			if !ok || am.IsDir() != cm.IsDir() {
+				continue
+			}
+			delete(deleted, p)
+			delete(added, np)
+			if !am.IsDir() && am.Hash != cm.Hash {
+				changes = append(changes, &Change{
+					Op:      changeModified,
+					Path:    np,
+					Ref:     am.Hash,
+					OldRef:  cm.Hash,
+					Size:    am.Size,
+					OldSize: cm.Size,
+				})
+			}
+		}
+	}
+
+	// Detect renames by matching deleted and added nodes with the same content, the shortest paths are processed
+	// first so a renamed directory "hides" the renames of its children
+	byContent := map[string][]string{}
+	for p, m := range added {
+		if k := contentKey(m); k != "" {
+			byContent[k] = append(byContent[k], p)
+		}
+	}
+	deletedPaths := []string{}
+	for p := range deleted {
+		deletedPaths = append(deletedPaths, p)
+	}
+	sort.Sort(byDepth(deletedPaths))
+	for _, oldPath := range deletedPaths {
+		om, ok := deleted[oldPath]
+		if !ok {
+			// Already handled as the child of a renamed directory
+			continue
+		}
+		candidates := byContent[contentKey(om)]
+		if contentKey(om) == "" || len(candidates) == 0 {
+			continue
+		}
+		newPath := candidates[0]
+		byContent[contentKey(om)] = candidates[1:]
+		nm := added[newPath]
+		delete(deleted, oldPath)
+		delete(added, newPath)
+		changes = append(changes, &Change{
+			Op:      changeRenamed,
+			Path:    newPath,
+			OldPath: oldPath,
+			Ref:     nm.Hash,
+			OldRef:  om.Hash,
+			Size:    nm.Size,
+			OldSize: om.Size,
+			IsDir:   nm.IsDir(),
+		})
+		if om.IsDir() {
+			// Drop the children that moved along with the directory
+			for p, cm := range deleted {
+				if !strings.HasPrefix(p, oldPath+"/") {
+					continue
+				}
+				np := newPath + strings.TrimPrefix(p, oldPath)
+				if am, ok := added[np]; ok && am.Hash == cm.Hash {
+					delete(deleted, p)
+					delete(added, np)
+				}
+			}
+		}
+	}
+
+	for p, m := range added {
+		changes = append(changes, &Change{Op: changeAdded, Path: p, Ref: m.Hash, Size: m.Size, IsDir: m.IsDir()})
+	}
+	for p, m := range deleted {
+		changes = append(changes, &Change{Op: changeDeleted, Path: p, OldRef: m.Hash, OldSize: m.Size, IsDir: m.IsDir()})
+	}
+	sort.Sort(byPath(changes))
+	return changes
+}
+
+type byPath []*Change
+
+func (s byPath) Len() int           { return len(s) }
+func (s byPath) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPath) Less(i, j int) bool { return s[i].Path < s[j].Path }
+
+type byDepth []string
+
+func (s byDepth) Len() int      { return len(s) }
+func (s byDepth) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byDepth) Less(i, j int) bool {
+	di, dj := strings.Count(s[i], "/"), strings.Count(s[j], "/")
+	if di == dj {
+		return s[i] < s[j]
+	}
+	return di < dj
+}
+
+// pushedDir returns the root dir of the last pushed mutation, nil if nothing has been pushed yet (it's not part of
+// the current tree, the FS lock is not needed)
+func (f *FS) pushedDir() (*Dir, error) {
+	kv, err := f.lkv.Get(fmt.Sprintf(rootKeyFmt, f.Name()), -1)
+	switch err {
+	case nil:
+	case vkv.ErrNotFound:
+		return nil, nil
+	default:
+		return nil, err
+	}
+	_, pushedDir, err := f.kvDataToDir(kv.Data, kv.Version)
+	if err != nil {
+		return nil, err
+	}
+	pushedDir.immutable = true
+	return pushedDir, nil
+}
+
+// dirIndex returns the index of the given dir, an empty index is returned for a nil dir
+func (f *FS) dirIndex(d *Dir) (map[string]*meta.Meta, error) {
+	if d == nil {
+		return map[string]*meta.Meta{}, nil
+	}
+	return f.buildMetaIndex(d, "/")
+}
+
+// pushedIndex returns the index of the last pushed root, it's built without holding the FS lock
+func (f *FS) pushedIndex() (map[string]*meta.Meta, error) {
+	pushedDir, err := f.pushedDir()
+	if err != nil {
+		return nil, err
+	}
+	return f.dirIndex(pushedDir)
+}
+
+// Status returns the changes between the last pushed root and the WIP root
+func (f *FS) Status() ([]*Change, error) {
+	pushedIndex, err := f.pushedIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.lockTree(false); err != nil {
+		return nil, err
+	}
+	defer f.mu.RUnlock()
+
+	return f.status(pushedIndex)
+}
+
+// status returns the changes between `pushedIndex` and the current tree (the FS lock must be held, see `lockTree`)
+func (f *FS) status(pushedIndex map[string]*meta.Meta) ([]*Change, error) {
+	wipIndex, err := f.dirIndex(f.root)
+	if err != nil {
+		return nil, err
+	}
+	// Ignored nodes are never pushed
+	matcher, err := f.ignoreMatcher(f.root)
+	if err != nil {
+		return nil, err
+	}
+	filterIndex(wipIndex, matcher)
+	return diffIndex(pushedIndex, wipIndex, f.renames), nil
+}
+
+// LocalSummary describes what only exists locally
+type LocalSummary struct {
+	Changes []*Change // Changes not pushed yet
+	Ignored []string  // Top-most nodes ignored via `.blobfsignore` files
+}
+
+// LocalSummary returns the changes not pushed yet and the ignored nodes
+func (f *FS) LocalSummary() (*LocalSummary, error) {
+	pushedIndex, err := f.pushedIndex()
+	if err != nil {
+		return nil, err
+	}
+	if err := f.lockTree(false); err != nil {
+		return nil, err
+	}
+	defer f.mu.RUnlock()
+
+	changes, err := f.status(pushedIndex)
+	if err != nil {
+		return nil, err
+	}
+	ignored, err := f.ignoredNodes(f.root)
+	if err != nil {
+		return nil, err
+	}
+	summary := &LocalSummary{Changes: changes, Ignored: []string{}}
+	for p := range ignored {
+		summary.Ignored = append(summary.Ignored, p)
+	}
+	sort.Strings(summary.Ignored)
+	return summary, nil
+}
@@ -0,0 +1,482 @@
+package fstree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	log15 "gopkg.in/inconshreveable/log15.v2"
+
+	"github.com/tsileo/blobfs/pkg/blobstashtest"
+	bstore "github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobfs/pkg/cache"
+	"github.com/tsileo/blobfs/pkg/encryption"
+	"github.com/tsileo/blobstash/pkg/client/kvstore"
+	"github.com/tsileo/blobstash/pkg/filetree/reader/filereader"
+	"github.com/tsileo/blobstash/pkg/vkv"
+	"golang.org/x/net/context"
+)
+
+// newTestFS returns a new FS named `name`, backed by the fake BlobStash server `s`.
+// Each FS gets its own local cache and local vkv store, like two different hosts sharing the same remote.
+func newTestFS(t *testing.T, s *blobstashtest.Server, name string) (*FS, func()) {
+	return newEncryptedTestFS(t, s, name, nil)
+}
+
+// newEncryptedTestFS returns a new test FS encrypting the remote blobs/roots with `key` (if not nil)
+func newEncryptedTestFS(t *testing.T, s *blobstashtest.Server, name string, key *encryption.Key) (*FS, func()) {
+	tmp, err := ioutil.TempDir("", "blobfs_test")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	logger := log15.New("name", name)
+	logger.SetHandler(log15.DiscardHandler())
+
+	opts := kvstore.DefaultOpts().SetHost(s.Host(), "")
+	var rbs bstore.BlobStore = bstore.NewRemote(opts)
+	var rkv KvStore = kvstore.New(opts)
+	if key != nil {
+		rbs = encryption.NewBlobStore(rbs, rkv, key)
+		rkv = encryption.NewKvStore(rkv, key)
+	}
+	bs := cache.NewTiered(logger, bstore.NewMemory(), rbs)
+	lkv, err := vkv.New(filepath.Join(tmp, "lkv"))
+	if err != nil {
+		t.Fatalf("failed to init local vkv: %v", err)
+	}
+
+	f := New(logger, name, bs, lkv, rkv, false)
+	if err := f.Load(); err != nil {
+		t.Fatalf("failed to load root: %v", err)
+	}
+	return f, func() {
+		lkv.Close()
+		os.RemoveAll(tmp)
+	}
+}
+
+func writeTestFile(t *testing.T, f *FS, path, content string) {
+	m, err := f.uploader.PutReader(filepath.Base(path), ioutil.NopCloser(strings.NewReader(content)))
+	if err != nil {
+		t.Fatalf("failed to upload %s: %v", path, err)
+	}
+	if err := f.restoreNode(path, m); err != nil {
+		t.Fatalf("failed to create %s: %v", path, err)
+	}
+}
+
+func readTestFile(t *testing.T, f *FS, path string) (string, bool) {
+	node, err := f.nodeAt(f.root, path)
+	if err != nil {
+		t.Fatalf("failed to lookup %s: %v", path, err)
+	}
+	if node == nil {
+		return "", false
+	}
+	data, err := ioutil.ReadAll(filereader.NewFile(f.bs, node.Meta()))
+	if err != nil {
+		t.Fatalf("failed to read %s: %v", path, err)
+	}
+	return string(data), true
+}
+
+func expectFile(t *testing.T, f *FS, path, expected string) {
+	data, ok := readTestFile(t, f, path)
+	if !ok {
+		t.Errorf("%s: %s should exist", f.name, path)
+		return
+	}
+	if data != expected {
+		t.Errorf("%s: bad content for %s, expected %q, got %q", f.name, path, expected, data)
+	}
+}
+
+func TestPushPull(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/hello.txt", "hello")
+	writeTestFile(t, fs1, "/docs/readme", "readme")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	// A new host should load the pushed tree
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	expectFile(t, fs2, "/hello.txt", "hello")
+	expectFile(t, fs2, "/docs/readme", "readme")
+
+	// Pulling without new remote mutations is a no-op
+	if err := fs2.Pull(); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	expectFile(t, fs2, "/hello.txt", "hello")
+
+	writeTestFile(t, fs1, "/hello.txt", "hello world")
+	writeTestFile(t, fs1, "/new.txt", "new")
+	if err := fs1.Push([]byte("second push")); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if err := fs2.Pull(); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	expectFile(t, fs2, "/hello.txt", "hello world")
+	expectFile(t, fs2, "/new.txt", "new")
+	expectFile(t, fs2, "/docs/readme", "readme")
+}
+
+func TestPushIgnored(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/.blobfsignore", "*.log\n")
+	writeTestFile(t, fs1, "/debug.log", "local only")
+	writeTestFile(t, fs1, "/hello.txt", "hello")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	expectFile(t, fs2, "/hello.txt", "hello")
+	if _, ok := readTestFile(t, fs2, "/debug.log"); ok {
+		t.Errorf("ignored file should not be pushed")
+	}
+}
+
+func TestPullIgnored(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/.blobfsignore", "*.log\n")
+	writeTestFile(t, fs1, "/hello.txt", "hello")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	wipVersions := func() int {
+		versions, err := fs2.lkv.Versions(fmt.Sprintf(localRootKeyFmt, fs2.Name()), 0, -1, 0)
+		if err != nil {
+			t.Fatalf("failed to list the WIP versions: %v", err)
+		}
+		return len(versions.Versions)
+	}
+
+	// Only an ignored node is updated locally (after the remote update, so the WIP root is the newest one)
+	writeTestFile(t, fs1, "/hello.txt", "hello world")
+	writeTestFile(t, fs2, "/local.log", "local only")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	before := wipVersions()
+	for i, content := range []string{"hello world", "hello again"} {
+		if i > 0 {
+			writeTestFile(t, fs1, "/hello.txt", content)
+			if err := fs1.Push(nil); err != nil {
+				t.Fatalf("push failed: %v", err)
+			}
+		}
+		// The pull is a fast-forward, the ignored nodes are not conflicts
+		if err := fs2.Pull(); err != nil {
+			t.Fatalf("pull #%d failed: %v", i+1, err)
+		}
+		expectFile(t, fs2, "/hello.txt", content)
+		expectFile(t, fs2, "/local.log", "local only")
+		if _, ok := readTestFile(t, fs2, "/hello.txt.conflicted"); ok {
+			t.Errorf("pull #%d should not create a conflicted file", i+1)
+		}
+	}
+	if after := wipVersions(); after != before {
+		t.Errorf("the pulls should not record WIP mutations, got %d new ones", after-before)
+	}
+
+	// After a restart, the pulled tree is loaded (and not the older WIP tree) along with the ignored nodes
+	fs2 = New(fs2.log, fs2.Name(), fs2.bs, fs2.lkv, fs2.rkv, false)
+	if err := fs2.Load(); err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	expectFile(t, fs2, "/hello.txt", "hello again")
+	expectFile(t, fs2, "/local.log", "local only")
+	if err := fs2.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	fs3, cleanup3 := newTestFS(t, s, "test")
+	defer cleanup3()
+	expectFile(t, fs3, "/hello.txt", "hello again")
+}
+
+func TestPullConflict(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/a.txt", "a")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	expectFile(t, fs2, "/a.txt", "a")
+
+	// Both hosts update the same file, only the first one pushes
+	writeTestFile(t, fs1, "/a.txt", "remote a")
+	writeTestFile(t, fs1, "/remote.txt", "remote")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	writeTestFile(t, fs2, "/a.txt", "local a")
+	writeTestFile(t, fs2, "/local.txt", "local")
+
+	if err := fs2.Pull(); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	expectFile(t, fs2, "/a.txt", "local a")
+	expectFile(t, fs2, "/a.txt.conflicted", "remote a")
+	expectFile(t, fs2, "/remote.txt", "remote")
+	expectFile(t, fs2, "/local.txt", "local")
+}
+
+func TestPushConflict(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/a.txt", "a")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+
+	writeTestFile(t, fs1, "/a.txt", "remote a")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	// fs2 must pull the new remote mutation before pushing
+	writeTestFile(t, fs2, "/b.txt", "b")
+	if err := fs2.Push(nil); err != ErrConflict {
+		t.Fatalf("push should return ErrConflict, got %v", err)
+	}
+	if err := fs2.Pull(); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	if err := fs2.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+}
+
+func TestPushStatsAndCancel(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/a.txt", "a")
+
+	// A canceled push must not update the remote root
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := fs1.PushContext(ctx, nil, &SyncStats{}); err != context.Canceled {
+		t.Fatalf("canceled push should return context.Canceled, got %v", err)
+	}
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	if _, ok := readTestFile(t, fs2, "/a.txt"); ok {
+		t.Errorf("a canceled push should not be visible remotely")
+	}
+
+	stats := &SyncStats{}
+	if err := fs1.PushContext(context.Background(), nil, stats); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if stats.BlobsTotal == 0 || stats.BlobsStated != stats.BlobsTotal {
+		t.Errorf("every blob should be stated, got %+v", stats)
+	}
+	if stats.BlobsUploaded+stats.BlobsSkipped != stats.BlobsTotal || stats.BytesUploaded == 0 {
+		t.Errorf("bad stats %+v", stats)
+	}
+}
+
+// failingBlobStore fails the blob fetches with `err` once the blobs are being uploaded (after the first remote stat)
+type failingBlobStore struct {
+	BlobStore
+	err       error
+	mu        sync.Mutex
+	uploading bool
+}
+
+func (bs *failingBlobStore) StatRemote(hash string) (bool, error) {
+	bs.mu.Lock()
+	bs.uploading = true
+	bs.mu.Unlock()
+	return bs.BlobStore.StatRemote(hash)
+}
+
+func (bs *failingBlobStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	if bs.uploading {
+		return nil, bs.err
+	}
+	return bs.BlobStore.Get(ctx, hash)
+}
+
+func TestPushFetchError(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	writeTestFile(t, fs1, "/a.txt", "a")
+
+	// A blob that can't be read from the cache must fail the push instead of being uploaded empty
+	errFetch := fmt.Errorf("fetch failed")
+	bs := fs1.bs
+	fs1.bs = &failingBlobStore{BlobStore: bs, err: errFetch}
+	if err := fs1.Push(nil); err != errFetch {
+		t.Fatalf("push should fail with %v, got %v", errFetch, err)
+	}
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	if _, ok := readTestFile(t, fs2, "/a.txt"); ok {
+		t.Errorf("a failed push should not be visible remotely")
+	}
+
+	fs1.bs = bs
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+}
+
+func TestPushDedup(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	fs1, cleanup1 := newTestFS(t, s, "test")
+	defer cleanup1()
+	// The data is generated from a fixed seed so the chunk boundaries are the same on every run
+	data := make([]byte, 2*1024*1024)
+	rand.New(rand.NewSource(42)).Read(data)
+	file := createTestFile(t, fs1.Root(), "big.bin", string(data))
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	// Insert a byte in the middle of the file, only the chunks around the edit should be uploaded
+	edited := append(append(append([]byte{}, data[:len(data)/2]...), 'x'), data[len(data)/2:]...)
+	if err := file.Open(); err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if _, err := file.Write(edited, 0); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := file.Release(); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	stats := &SyncStats{}
+	if err := fs1.PushContext(context.Background(), nil, stats); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	// The file and root metas are uploaded along with the new chunks: the edited one, and the next ones if the max
+	// size cuts were shifted by the edit (the file has ~16 chunks)
+	if chunks := stats.BlobsUploaded - 2; chunks < 1 || chunks > 3 {
+		t.Errorf("1 to 3 new chunks expected, got %d (%+v)", chunks, stats)
+	}
+
+	fs2, cleanup2 := newTestFS(t, s, "test")
+	defer cleanup2()
+	expectFile(t, fs2, "/big.bin", string(edited))
+}
+
+func TestPushPullEncrypted(t *testing.T) {
+	s := blobstashtest.New()
+	defer s.Close()
+
+	key, err := encryption.KeyFromPassphrase("secret", "test")
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	fs1, cleanup1 := newEncryptedTestFS(t, s, "test", key)
+	defer cleanup1()
+	writeTestFile(t, fs1, "/secret.txt", "secret content")
+	writeTestFile(t, fs1, "/shared/public.txt", "public content")
+	node, err := fs1.nodeAt(fs1.root, "/shared")
+	if err != nil || node == nil {
+		t.Fatalf("failed to lookup /shared: %v", err)
+	}
+	if err := node.(*Dir).SetXattr("public", []byte("1")); err != nil {
+		t.Fatalf("failed to make /shared public: %v", err)
+	}
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+
+	// BlobStash only sees encrypted data, except for the public nodes
+	secret, _ := fs1.nodeAt(fs1.root, "/secret.txt")
+	public, _ := fs1.nodeAt(fs1.root, "/shared/public.txt")
+	if ok, _ := s.Blobs.Stat(secret.Meta().Hash); ok {
+		t.Errorf("the private blobs should not be stored in plaintext")
+	}
+	if ok, _ := s.Blobs.Stat(public.Meta().Hash); !ok {
+		t.Errorf("the public blobs should be stored in plaintext")
+	}
+	if kv := s.Get("blobfs:root:test", -1); kv == nil || strings.Contains(string(kv.Data), "ref") {
+		t.Errorf("the remote root should be encrypted, got %+v", kv)
+	}
+
+	// Another host with the same key can load and pull the tree
+	fs2, cleanup2 := newEncryptedTestFS(t, s, "test", key)
+	defer cleanup2()
+	expectFile(t, fs2, "/secret.txt", "secret content")
+	expectFile(t, fs2, "/shared/public.txt", "public content")
+
+	writeTestFile(t, fs1, "/secret.txt", "updated")
+	if err := fs1.Push(nil); err != nil {
+		t.Fatalf("push failed: %v", err)
+	}
+	if err := fs2.Pull(); err != nil {
+		t.Fatalf("pull failed: %v", err)
+	}
+	expectFile(t, fs2, "/secret.txt", "updated")
+
+	// Without the key, the root can't be loaded
+	wrong, err := encryption.KeyFromPassphrase("wrong", "test")
+	if err != nil {
+		t.Fatalf("failed to derive key: %v", err)
+	}
+	tmp, _ := ioutil.TempDir("", "blobfs_test")
+	defer os.RemoveAll(tmp)
+	lkv, err := vkv.New(filepath.Join(tmp, "lkv"))
+	if err != nil {
+		t.Fatalf("failed to init local vkv: %v", err)
+	}
+	defer lkv.Close()
+	logger := log15.New()
+	logger.SetHandler(log15.DiscardHandler())
+	opts := kvstore.DefaultOpts().SetHost(s.Host(), "")
+	bs := cache.NewTiered(logger, bstore.NewMemory(), encryption.NewBlobStore(bstore.NewRemote(opts), kvstore.New(opts), wrong))
+	fs3 := New(logger, "test", bs, lkv, encryption.NewKvStore(kvstore.New(opts), wrong), false)
+	if err := fs3.Load(); err != encryption.ErrDecrypt {
+		t.Errorf("loading with the wrong key should return ErrDecrypt, got %v", err)
+	}
+}
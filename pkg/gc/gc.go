@@ -1,8 +1,15 @@
+// Package gc implements a mark and sweep garbage collector for blobs: the reachable keys are marked with `Keep`, and
+// the other ones are removed by `Collect`/`Sweep`.
+//
+// It's a library hook only: nothing in blobfs removes local blobs yet (the local tier holds blobs that may not have
+// been pushed). A caller removing blobs from a `blobstore.Local` should use `NewWithCompaction` with its `Compact`, so
+// the space used by the removed small blobs is reclaimed.
 package gc
 
 type GarbageCollector struct {
-	keep       map[string]struct{}
-	removeFunc func(string) error
+	keep        map[string]struct{}
+	removeFunc  func(string) error
+	compactFunc func() (int64, error)
 }
 
 func New(removeFunc func(string) error) *GarbageCollector {
@@ -12,6 +19,14 @@ func New(removeFunc func(string) error) *GarbageCollector {
 	}
 }
 
+// NewWithCompaction returns a GarbageCollector that calls `compactFunc` at the end of a sweep that removed keys (e.g.
+// to reclaim the space used by the removed blobs in the pack files)
+func NewWithCompaction(removeFunc func(string) error, compactFunc func() (int64, error)) *GarbageCollector {
+	gc := New(removeFunc)
+	gc.compactFunc = compactFunc
+	return gc
+}
+
 func (gc *GarbageCollector) Keep(key string) {
 	gc.keep[key] = struct{}{}
 }
@@ -26,3 +41,23 @@ func (gc *GarbageCollector) Collect(key string) error {
 	}
 	return nil
 }
+
+// Sweep collects every key returned by `iter` (e.g. a BlobStore `Iter`), then runs the compaction if any key was
+// removed. Returns the number of removed keys and reclaimed bytes.
+func (gc *GarbageCollector) Sweep(iter func(func(string) error) error) (int, int64, error) {
+	removed := 0
+	if err := iter(func(key string) error {
+		if _, ok := gc.keep[key]; ok {
+			return nil
+		}
+		removed++
+		return gc.removeFunc(key)
+	}); err != nil {
+		return removed, 0, err
+	}
+	if removed == 0 || gc.compactFunc == nil {
+		return removed, 0, nil
+	}
+	reclaimed, err := gc.compactFunc()
+	return removed, reclaimed, err
+}
@@ -0,0 +1,62 @@
+package gc
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/tsileo/blobfs/pkg/blobstore"
+	"github.com/tsileo/blobfs/pkg/blobstore/blobstoretest"
+)
+
+func TestSweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobfs")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	bs, err := blobstore.New(dir, "testgc")
+	if err != nil {
+		t.Fatalf("failed to init blobstore: %v", err)
+	}
+	defer bs.Close()
+
+	gc := NewWithCompaction(bs.Remove, bs.Compact)
+	blobs := []*blobstoretest.Blob{}
+	for i := 0; i < 20; i++ {
+		blob := blobstoretest.RandomBlob(512)
+		if err := bs.Put(blob.Hash, blob.Data); err != nil {
+			t.Fatalf("failed to put blob: %v", err)
+		}
+		blobs = append(blobs, blob)
+	}
+	for _, blob := range blobs[:5] {
+		gc.Keep(blob.Hash)
+	}
+
+	removed, reclaimed, err := gc.Sweep(bs.Iter)
+	if err != nil {
+		t.Fatalf("sweep failed: %v", err)
+	}
+	if removed != 15 {
+		t.Errorf("15 blobs should have been removed, got %d", removed)
+	}
+	if reclaimed == 0 {
+		t.Errorf("the sweep should have compacted the packs")
+	}
+	for i, blob := range blobs {
+		exists, err := bs.Stat(blob.Hash)
+		if err != nil {
+			t.Fatalf("failed to stat blob: %v", err)
+		}
+		if exists != (i < 5) {
+			t.Errorf("blob %d: exists=%v", i, exists)
+		}
+	}
+
+	// Nothing to remove, no compaction
+	if removed, reclaimed, err := gc.Sweep(bs.Iter); err != nil || removed != 0 || reclaimed != 0 {
+		t.Errorf("second sweep should be a no-op, got removed=%d reclaimed=%d err=%v", removed, reclaimed, err)
+	}
+}
@@ -0,0 +1,161 @@
+/*
+
+Package ignore implements gitignore-style matching for `.blobfsignore` files.
+
+Each ignore file applies to the directory containing it (and its children), the supported syntax is:
+
+ - blank lines and lines starting with `#` are skipped
+ - a leading `!` negates the pattern (re-include a path excluded by a previous pattern)
+ - a trailing `/` only matches directories
+ - a pattern without a `/` (except the trailing one) matches the name at any depth
+ - a pattern with a `/` is relative to the directory containing the ignore file
+ - `*`, `?` and `[...]` match within a path component, `**` matches any number of components
+
+Like git, a path can't be re-included if one of its parent directories is excluded.
+
+*/
+package ignore
+
+import (
+	"bufio"
+	"bytes"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FileName is the name of the ignore files
+const FileName = ".blobfsignore"
+
+type pattern struct {
+	base     string   // Directory containing the ignore file
+	segments []string // Pattern splitted by "/"
+	anchored bool     // Relative to base (if false, only the name is matched)
+	negate   bool
+	dirOnly  bool
+}
+
+// Matcher holds the patterns from all the ignore files of a tree
+type Matcher struct {
+	patterns []*pattern
+}
+
+// New returns an empty Matcher (that ignores nothing)
+func New() *Matcher {
+	return &Matcher{patterns: []*pattern{}}
+}
+
+// Add parses the content of the ignore file located in the `base` directory (e.g. "/" or "/src/app")
+func (m *Matcher) Add(base string, data []byte) {
+	base = path.Clean("/" + base)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		p := &pattern{base: base}
+		if strings.HasPrefix(line, "!") {
+			p.negate = true
+			line = line[1:]
+		} else if strings.HasPrefix(line, `\`) {
+			// Escaped leading "#" or "!"
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		if strings.Contains(line, "/") {
+			p.anchored = true
+			line = strings.TrimLeft(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.segments = strings.Split(line, "/")
+		m.patterns = append(m.patterns, p)
+	}
+}
+
+// Empty returns true if the Matcher has no patterns
+func (m *Matcher) Empty() bool {
+	return m == nil || len(m.patterns) == 0
+}
+
+// Match returns true if the given absolute path (e.g. "/src/app/node_modules") is ignored, either directly or
+// because one of its parent directories is ignored.
+func (m *Matcher) Match(p string, isDir bool) bool {
+	if m.Empty() {
+		return false
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return false
+	}
+	// Check the parents first, from the top-most one
+	parts := strings.Split(p[1:], "/")
+	for i := 1; i < len(parts); i++ {
+		if m.match("/"+strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return m.match(p, isDir)
+}
+
+// match returns true if the path is ignored by the patterns, the last matching pattern wins
+func (m *Matcher) match(p string, isDir bool) bool {
+	ignored := false
+	for _, pat := range m.patterns {
+		if pat.match(p, isDir) {
+			ignored = !pat.negate
+		}
+	}
+	return ignored
+}
+
+func (pat *pattern) match(p string, isDir bool) bool {
+	if pat.dirOnly && !isDir {
+		return false
+	}
+	var rel string
+	switch {
+	case pat.base == "/":
+		rel = p[1:]
+	case strings.HasPrefix(p, pat.base+"/"):
+		rel = p[len(pat.base)+1:]
+	default:
+		// The path is not under the directory containing the ignore file
+		return false
+	}
+	segments := strings.Split(rel, "/")
+	if !pat.anchored {
+		ok, _ := filepath.Match(pat.segments[0], segments[len(segments)-1])
+		return ok
+	}
+	return matchSegments(pat.segments, segments)
+}
+
+// matchSegments matches the path components against the pattern components, "**" matches zero or more components
+func matchSegments(pattern, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Try to match the rest of the pattern at every position
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], segments[0]); !ok {
+			return false
+		}
+		pattern = pattern[1:]
+		segments = segments[1:]
+	}
+	return len(segments) == 0
+}
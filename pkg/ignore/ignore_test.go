@@ -0,0 +1,60 @@
+package ignore
+
+import "testing"
+
+var rootIgnore = []byte(`
+# comment
+*.swp
+node_modules/
+/build
+docs/**/*.tmp
+*.log
+!keep.log
+\#notacomment
+`)
+
+var subIgnore = []byte(`
+dist
+!*.swp
+`)
+
+func TestMatcher(t *testing.T) {
+	m := New()
+	if m.Match("/anything", false) {
+		t.Errorf("empty matcher should not ignore anything")
+	}
+	m.Add("/", rootIgnore)
+	m.Add("/src/app", subIgnore)
+
+	for _, tdata := range []struct {
+		path     string
+		isDir    bool
+		expected bool
+	}{
+		{"/", true, false},
+		{"/README.md", false, false},
+		{"/.main.go.swp", false, true},
+		{"/src/.main.go.swp", false, true},
+		{"/node_modules", true, true},
+		{"/node_modules", false, false},
+		{"/src/app/node_modules", true, true},
+		{"/src/app/node_modules/lib/index.js", false, true},
+		{"/build", true, true},
+		{"/build/out.bin", false, true},
+		{"/src/build", true, false},
+		{"/docs/a.tmp", false, true},
+		{"/docs/a/b/c.tmp", false, true},
+		{"/a.tmp", false, false},
+		{"/debug.log", false, true},
+		{"/keep.log", false, false},
+		{"/#notacomment", false, true},
+		{"/src/app/dist", true, true},
+		{"/src/dist", true, false},
+		{"/src/app/.main.go.swp", false, false},
+		{"/src/other/.main.go.swp", false, true},
+	} {
+		if got := m.Match(tdata.path, tdata.isDir); got != tdata.expected {
+			t.Errorf("Match(%q, %v) should be %v, got %v", tdata.path, tdata.isDir, tdata.expected, got)
+		}
+	}
+}
@@ -7,13 +7,31 @@ import (
 
 const (
 	DirPerm = 0700
+
+	// VarDirEnv overrides the default var directory
+	VarDirEnv = "BLOBFS_VAR_DIR"
 )
 
+var varDir string
+
+// SetVarDir overrides the var directory (takes precedence over $BLOBFS_VAR_DIR)
+func SetVarDir(dir string) {
+	varDir = dir
+}
+
+// DefaultVarDir returns the var directory used when nothing else is set
+func DefaultVarDir() string {
+	return filepath.Join(os.Getenv("HOME"), "var", "blobfs")
+}
+
 func VarDir() string {
-	if dir := os.Getenv("BLOBFS_VAR_DIR"); dir != "" {
+	if varDir != "" {
+		return varDir
+	}
+	if dir := os.Getenv(VarDirEnv); dir != "" {
 		return dir
 	}
-	return filepath.Join(os.Getenv("HOME"), "var", "blobfs")
+	return DefaultVarDir()
 }
 
 func InitVarDir() error {
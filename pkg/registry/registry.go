@@ -0,0 +1,204 @@
+/*
+
+Package registry implements the per-user registry of the live BlobFS mounts.
+
+Each mount is registered as a JSON file (`<name>.json`) next to its API socket (`<name>.sock`), in
+`$XDG_RUNTIME_DIR/blobfs` (or `$TMPDIR/blobfs-<uid>` if `XDG_RUNTIME_DIR` is not set). Entries whose process is not
+running anymore are considered stale and are cleaned up when found.
+
+*/
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNotMounted     = errors.New("not mounted")
+	ErrAlreadyMounted = errors.New("already mounted")
+)
+
+// Mount is a registry entry
+type Mount struct {
+	Name       string    `json:"name"`
+	Mountpoint string    `json:"mountpoint"`
+	Socket     string    `json:"socket"`
+	Pid        int       `json:"pid"`
+	Started    time.Time `json:"started"`
+}
+
+// Alive returns true if the process serving the mount is still running
+func (m *Mount) Alive() bool {
+	if m.Pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(m.Pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Registry is a directory holding the mount entries
+type Registry struct {
+	dir string
+}
+
+// Dir returns the default registry directory for the current user
+func Dir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "blobfs")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("blobfs-%d", os.Getuid()))
+}
+
+// New returns the registry stored in `dir`, it will be created if needed
+func New(dir string) (*Registry, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Registry{dir}, nil
+}
+
+// Default returns the registry stored in `Dir()`
+func Default() (*Registry, error) {
+	return New(Dir())
+}
+
+// SocketPath returns the path of the API socket for the given FS name
+func (r *Registry) SocketPath(name string) string {
+	return filepath.Join(r.dir, name+".sock")
+}
+
+func (r *Registry) entryPath(name string) string {
+	return filepath.Join(r.dir, name+".json")
+}
+
+// Register adds the mount to the registry, `ErrAlreadyMounted` is returned if the FS is already mounted by a live
+// process. A stale entry (and its socket) is replaced.
+func (r *Registry) Register(m *Mount) error {
+	existing, err := r.Get(m.Name)
+	switch err {
+	case nil:
+		if existing.Pid != m.Pid {
+			return ErrAlreadyMounted
+		}
+	case ErrNotMounted:
+	default:
+		return err
+	}
+	js, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	// Write the entry atomically so the CLI never reads a partial entry
+	tmp := r.entryPath(m.Name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, js, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.entryPath(m.Name))
+}
+
+// Unregister removes the mount entry and its socket
+func (r *Registry) Unregister(name string) error {
+	if err := os.Remove(r.SocketPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(r.entryPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (r *Registry) load(path string) (*Mount, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mount{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Get returns the live mount for the FS name, `ErrNotMounted` is returned if there's none
+func (r *Registry) Get(name string) (*Mount, error) {
+	m, err := r.load(r.entryPath(name))
+	switch {
+	case err == nil:
+	case os.IsNotExist(err):
+		return nil, ErrNotMounted
+	default:
+		return nil, err
+	}
+	if !m.Alive() {
+		if err := r.Unregister(name); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotMounted
+	}
+	return m, nil
+}
+
+type byName []*Mount
+
+func (m byName) Len() int           { return len(m) }
+func (m byName) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
+func (m byName) Less(i, j int) bool { return m[i].Name < m[j].Name }
+
+// List returns the live mounts sorted by name
+func (r *Registry) List() ([]*Mount, error) {
+	files, err := ioutil.ReadDir(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	out := []*Mount{}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		m, err := r.Get(strings.TrimSuffix(fi.Name(), ".json"))
+		switch err {
+		case nil:
+			out = append(out, m)
+		case ErrNotMounted:
+		default:
+			return nil, err
+		}
+	}
+	sort.Sort(byName(out))
+	return out, nil
+}
+
+// Find returns the live mount containing `path`, walking up from `path` until a mountpoint is found
+func (r *Registry) Find(path string) (*Mount, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	mounts, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+	index := map[string]*Mount{}
+	for _, m := range mounts {
+		index[m.Mountpoint] = m
+	}
+	for {
+		if m, ok := index[path]; ok {
+			return m, nil
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return nil, ErrNotMounted
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blobfs_registry")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := New(dir)
+	if err != nil {
+		t.Fatalf("failed to init registry: %v", err)
+	}
+
+	docs := &Mount{Name: "docs", Mountpoint: "/home/user/docs", Socket: r.SocketPath("docs"), Pid: os.Getpid(), Started: time.Now()}
+	if err := r.Register(docs); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if err := r.Register(&Mount{Name: "docs", Mountpoint: "/tmp/docs", Pid: os.Getppid()}); err != ErrAlreadyMounted {
+		t.Errorf("registering a live mount twice should return ErrAlreadyMounted, got %v", err)
+	}
+
+	// A stale entry (the process is gone) is replaced
+	if err := r.Register(&Mount{Name: "stale", Mountpoint: "/home/user/stale", Pid: 1 << 30}); err != nil {
+		t.Fatalf("failed to register: %v", err)
+	}
+	if _, err := r.Get("stale"); err != ErrNotMounted {
+		t.Errorf("stale mount should return ErrNotMounted, got %v", err)
+	}
+	if _, err := os.Stat(r.entryPath("stale")); !os.IsNotExist(err) {
+		t.Errorf("stale entry should be removed")
+	}
+
+	m, err := r.Get("docs")
+	if err != nil {
+		t.Fatalf("failed to get mount: %v", err)
+	}
+	if m.Mountpoint != docs.Mountpoint || m.Socket != docs.Socket {
+		t.Errorf("bad mount %+v", m)
+	}
+
+	mounts, err := r.List()
+	if err != nil {
+		t.Fatalf("failed to list mounts: %v", err)
+	}
+	if len(mounts) != 1 || mounts[0].Name != "docs" {
+		t.Errorf("only docs should be listed, got %+v", mounts)
+	}
+
+	for _, p := range []string{"/home/user/docs", "/home/user/docs/a/b.txt"} {
+		m, err := r.Find(p)
+		if err != nil {
+			t.Errorf("failed to find mount for %s: %v", p, err)
+			continue
+		}
+		if m.Name != "docs" {
+			t.Errorf("bad mount for %s: %+v", p, m)
+		}
+	}
+	if _, err := r.Find("/home/user/docsx"); err != ErrNotMounted {
+		t.Errorf("path outside of the mount should return ErrNotMounted, got %v", err)
+	}
+
+	if err := r.Unregister("docs"); err != nil {
+		t.Fatalf("failed to unregister: %v", err)
+	}
+	if _, err := r.Get("docs"); err != ErrNotMounted {
+		t.Errorf("unregistered mount should return ErrNotMounted, got %v", err)
+	}
+}
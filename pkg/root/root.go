@@ -10,6 +10,12 @@ type Root struct {
 	Ref      string `json:"ref"`
 	Comment  string `json:"comment"`
 	Version  int    `json:"-"`
+
+	// Paths renamed since the last push (new path -> pushed path), only set on the local WIP roots
+	Renames map[string]string `json:"renames,omitempty"`
+
+	// Version of the pushed (or pulled) root the tree is based on, only set on the local WIP roots
+	Base int `json:"base,omitempty"`
 }
 
 func New(ref string, version int) *Root {